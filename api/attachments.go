@@ -0,0 +1,99 @@
+package api
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/adsouza/chat-backend/storage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// downloadChunkSize bounds how much of the content of an attachment is sent in each response.
+const downloadChunkSize = 64 << 10
+
+// AttachmentToProto describes an attachment as clients see it. The logic package also uses it to describe attachments
+// in the metadata of messages.
+func AttachmentToProto(attachment storage.Attachment) *Attachment {
+	a := &Attachment{
+		Id:          attachment.ID,
+		Filename:    attachment.Filename,
+		ContentType: attachment.ContentType,
+		Size:        uint64(attachment.Size),
+		Sha256:      attachment.SHA256,
+	}
+	if attachment.Width != 0 && attachment.Height != 0 {
+		a.Image = &Image{Width: attachment.Width, Height: attachment.Height}
+	}
+	return a
+}
+
+// uploadReader presents the chunks of an upload as a single stream of content.
+type uploadReader struct {
+	stream Chat_UploadAttachmentServer
+	chunk  []byte
+}
+
+func (r *uploadReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		req, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.chunk = req.Chunk
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (c *chatServer) UploadAttachment(stream Chat_UploadAttachmentServer) error {
+	caller, err := requireCaller(stream.Context())
+	if err != nil {
+		return err
+	}
+	first, err := stream.Recv()
+	if err == io.EOF {
+		return status.Errorf(codes.InvalidArgument, "an upload requires at least one request")
+	}
+	if err != nil {
+		return err
+	}
+	attachment, err := c.msgController.UploadAttachment(caller, first.Filename, first.ContentType, &uploadReader{stream: stream, chunk: first.Chunk})
+	if err != nil {
+		return statusError(err)
+	}
+	return stream.SendAndClose(&UploadAttachmentResponse{Attachment: AttachmentToProto(attachment)})
+}
+
+func (c *chatServer) DownloadAttachment(req *DownloadAttachmentRequest, stream Chat_DownloadAttachmentServer) error {
+	caller, err := requireCaller(stream.Context())
+	if err != nil {
+		return err
+	}
+	attachment, content, err := c.msgController.OpenAttachment(caller, req.AttachmentId)
+	if err != nil {
+		return statusError(err)
+	}
+	defer content.Close()
+	resp := &DownloadAttachmentResponse{Attachment: AttachmentToProto(attachment)}
+	buf := make([]byte, downloadChunkSize)
+	for {
+		n, err := io.ReadFull(content, buf)
+		// The description is sent even if there is no content.
+		if n > 0 || resp.Attachment != nil {
+			resp.Chunk = buf[:n]
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			resp = &DownloadAttachmentResponse{}
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil
+		default:
+			return statusError(fmt.Errorf("unable to read attachment: %v", err))
+		}
+	}
+}
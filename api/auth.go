@@ -0,0 +1,174 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type SessionValidator interface {
+	ValidateSession(token string) (string, error)
+}
+
+type callerKey struct{}
+
+// callerFromContext returns the username of the authenticated caller, if any.
+func callerFromContext(ctx context.Context) (string, bool) {
+	caller, ok := ctx.Value(callerKey{}).(string)
+	return caller, ok
+}
+
+// authenticate checks the bearer token in the incoming metadata (if present) & records the caller's identity in the
+// returned context. Requests without a token pass through anonymously, so handlers must decide whether they need one.
+func authenticate(ctx context.Context, validator SessionValidator) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return ctx, nil
+	}
+	token := strings.TrimPrefix(values[0], "Bearer ")
+	if token == values[0] {
+		return nil, status.Errorf(codes.Unauthenticated, "authorization metadata must contain a bearer token")
+	}
+	caller, err := validator.ValidateSession(token)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return context.WithValue(ctx, callerKey{}, caller), nil
+}
+
+// AuthInterceptor returns a unary server interceptor that resolves bearer tokens into caller identities.
+func AuthInterceptor(validator SessionValidator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, validator)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// AuthStreamInterceptor is the streaming counterpart of AuthInterceptor.
+func AuthStreamInterceptor(validator SessionValidator) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(stream.Context(), validator)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// requireCaller returns the authenticated caller or an Unauthenticated error.
+func requireCaller(ctx context.Context) (string, error) {
+	caller, ok := callerFromContext(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "a valid session token is required")
+	}
+	return caller, nil
+}
+
+// TrustedProxies holds the addresses of the proxies, such as the HTTP gateway, that may relay requests on behalf of
+// clients, which they report the addresses of in x-forwarded-for.
+type TrustedProxies []*net.IPNet
+
+// DefaultTrustedProxies only trusts loopback addresses, from which the HTTP gateway relays requests to the gRPC server.
+var DefaultTrustedProxies, _ = ParseTrustedProxies("127.0.0.0/8,::1")
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses & CIDR ranges.
+func ParseTrustedProxies(list string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q: %v", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (t TrustedProxies) trusts(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress returns the address of the client on whose behalf a request came from the specified peer, given the
+// x-forwarded-for values that it carries. Each proxy appends the address it received the request from, so the client
+// is the nearest hop that isn't a trusted proxy. Hops before that could have been made up by the client.
+func (t TrustedProxies) clientAddress(peer string, forwarded []string) string {
+	addr := peer
+	if !t.trusts(addr) {
+		return addr
+	}
+	var hops []string
+	for _, value := range forwarded {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		addr = hop
+		if !t.trusts(hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// clientIP returns the IP address of the client that made a request, or "" if it is unknown. Requests relayed by a
+// trusted proxy, such as the HTTP gateway, are attributed to the address in the x-forwarded-for metadata that it adds.
+func clientIP(ctx context.Context, proxies TrustedProxies) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		host = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	return proxies.clientAddress(host, md.Get("x-forwarded-for"))
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"math"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// requireMember returns the authenticated caller, provided they are a member of the specified conversation.
+func (c *chatServer) requireMember(ctx context.Context, conversation int64) (string, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return "", statusError(err)
+	}
+	members, err := c.msgController.ListMembers(conversation)
+	if err != nil {
+		return "", statusError(err)
+	}
+	for _, member := range members {
+		if member == caller {
+			return caller, nil
+		}
+	}
+	return "", status.Errorf(codes.PermissionDenied, "you are not a member of conversation %d", conversation)
+}
+
+func (c *chatServer) CreateConversation(ctx context.Context, req *CreateConversationRequest) (*CreateConversationResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &CreateConversationResponse{}, statusError(err)
+	}
+	id, err := c.msgController.CreateConversation(caller, req.Title, req.Members)
+	return &CreateConversationResponse{ConversationId: id}, statusError(err)
+}
+
+// AddMember lets any member of a group conversation add another user to it.
+func (c *chatServer) AddMember(ctx context.Context, req *AddMemberRequest) (*AddMemberResponse, error) {
+	if _, err := c.requireMember(ctx, req.ConversationId); err != nil {
+		return &AddMemberResponse{}, statusError(err)
+	}
+	return &AddMemberResponse{}, statusError(c.msgController.AddMember(req.ConversationId, req.Username))
+}
+
+// RemoveMember lets any member of a group conversation leave it, while only its owner may remove other members.
+func (c *chatServer) RemoveMember(ctx context.Context, req *RemoveMemberRequest) (*RemoveMemberResponse, error) {
+	caller, err := c.requireMember(ctx, req.ConversationId)
+	if err != nil {
+		return &RemoveMemberResponse{}, statusError(err)
+	}
+	return &RemoveMemberResponse{}, statusError(c.msgController.RemoveMember(caller, req.ConversationId, req.Username))
+}
+
+func (c *chatServer) ListMembers(ctx context.Context, req *ListMembersRequest) (*ListMembersResponse, error) {
+	if _, err := c.requireMember(ctx, req.ConversationId); err != nil {
+		return &ListMembersResponse{}, statusError(err)
+	}
+	members, err := c.msgController.ListMembers(req.ConversationId)
+	return &ListMembersResponse{Usernames: members}, statusError(err)
+}
+
+func (c *chatServer) ListConversations(ctx context.Context, req *ListConversationsRequest) (*ListConversationsResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &ListConversationsResponse{}, statusError(err)
+	}
+	before := req.ContinuationToken
+	if before == 0 {
+		before = math.MaxInt64
+	}
+	limit := req.Limit
+	if limit == 0 {
+		limit = math.MaxUint32
+	}
+	summaries, continuationToken, err := c.msgController.ListConversations(caller, limit, before)
+	if err != nil {
+		return &ListConversationsResponse{}, statusError(err)
+	}
+	resp := &ListConversationsResponse{ContinuationToken: continuationToken}
+	for _, summary := range summaries {
+		lastMessage, err := messageToProto(summary.LastMessage)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		resp.Conversations = append(resp.Conversations, &ConversationSummary{
+			ConversationId: summary.ID,
+			Title:          summary.Title,
+			Group:          summary.Group,
+			Peer:           summary.Peer,
+			LastMessage:    lastMessage,
+			UnreadCount:    summary.Unread,
+		})
+	}
+	return resp, nil
+}
+
+func (c *chatServer) MarkRead(ctx context.Context, req *MarkReadRequest) (*MarkReadResponse, error) {
+	caller, err := c.requireMember(ctx, req.ConversationId)
+	if err != nil {
+		return &MarkReadResponse{}, statusError(err)
+	}
+	return &MarkReadResponse{}, statusError(c.msgController.MarkRead(caller, req.ConversationId, req.UpToMessageId))
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/adsouza/chat-backend/storage"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// ErrorDomain identifies this service in the ErrorInfo details attached to its errors.
+const ErrorDomain = "chat-backend"
+
+var codesByKind = map[storage.Kind]codes.Code{
+	storage.KindInvalid:            codes.InvalidArgument,
+	storage.KindNotFound:           codes.NotFound,
+	storage.KindExists:             codes.AlreadyExists,
+	storage.KindUnauthenticated:    codes.Unauthenticated,
+	storage.KindPermissionDenied:   codes.PermissionDenied,
+	storage.KindFailedPrecondition: codes.FailedPrecondition,
+	storage.KindUnsupported:        codes.Unimplemented,
+	storage.KindExhausted:          codes.ResourceExhausted,
+}
+
+// statusError converts an error from a controller into a gRPC status error. Domain errors get the status code for their
+// kind, along with an ErrorInfo detail whose reason clients can branch on. Status errors pass through unchanged &
+// anything else is logged & reported as an internal error, without its message, which may hold details of the storage
+// layer that clients have no business seeing. Errors that say how long to wait before retrying, such as those for
+// throttled logins, also get a RetryInfo detail, & those that say which fields of the request are invalid get a
+// BadRequest detail.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var domainErr *storage.Error
+	if !errors.As(err, &domainErr) {
+		log.Printf("Internal error: %v.", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+	code, ok := codesByKind[domainErr.Kind]
+	if !ok {
+		code = codes.Unknown
+	}
+	details := []proto.Message{&errdetails.ErrorInfo{Reason: domainErr.Reason, Domain: ErrorDomain}}
+	var retryable interface{ RetryDelay() time.Duration }
+	if errors.As(err, &retryable) {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(retryable.RetryDelay())})
+	}
+	var invalid interface {
+		FieldViolations() []storage.FieldViolation
+	}
+	if errors.As(err, &invalid) {
+		badRequest := &errdetails.BadRequest{}
+		for _, v := range invalid.FieldViolations() {
+			badRequest.FieldViolations = append(badRequest.FieldViolations,
+				&errdetails.BadRequest_FieldViolation{Field: v.Field, Description: v.Description})
+		}
+		details = append(details, badRequest)
+	}
+	st, detailErr := status.New(code, err.Error()).WithDetails(details...)
+	if detailErr != nil {
+		return status.Error(code, err.Error())
+	}
+	return st.Err()
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	// GatewayPrefix is the path under which Gateway serves each RPC, by method name, along with its OpenAPI document.
+	GatewayPrefix = "/v1/"
+	openAPIPath   = GatewayPrefix + "openapi.json"
+	// maxRequestBytes bounds the size of the JSON body of a request.
+	maxRequestBytes = 1 << 20
+)
+
+var (
+	marshaler   = protojson.MarshalOptions{EmitUnpopulated: true}
+	unmarshaler = protojson.UnmarshalOptions{}
+)
+
+// Gateway exposes every Chat RPC over HTTP/JSON by relaying requests to a gRPC server, so that they go through the same
+// authentication & error mapping as native gRPC calls. Each RPC is a POST to GatewayPrefix followed by its name, whose
+// body & response are the JSON forms of its request & response messages. Server-streaming RPCs respond with
+// newline-delimited JSON objects, each of which has either a result or, if the stream fails, an error field. Errors are
+// google.rpc.Status objects, sent with the HTTP status corresponding to their code. A bearer token in the Authorization
+// header is passed on to the gRPC server, as is the client's address in x-forwarded-for.
+type Gateway struct {
+	conn    grpc.ClientConnInterface
+	service protoreflect.ServiceDescriptor
+	openAPI []byte
+	// proxies may relay requests to the gateway, whose X-Forwarded-For header then says which client they came from.
+	proxies TrustedProxies
+}
+
+// NewGateway returns a Gateway that relays requests over conn, which must be connected to a server of the Chat service.
+// Requests from the specified proxies are attributed to the clients named in their X-Forwarded-For header.
+func NewGateway(conn grpc.ClientConnInterface, proxies TrustedProxies) (*Gateway, error) {
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName("Chat")
+	if err != nil {
+		return nil, fmt.Errorf("unable to find descriptor of Chat service: %v", err)
+	}
+	service := desc.(protoreflect.ServiceDescriptor)
+	doc, err := OpenAPIDocument(service)
+	if err != nil {
+		return nil, err
+	}
+	return &Gateway{conn: conn, service: service, openAPI: doc, proxies: proxies}, nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == openAPIPath {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(g.openAPI)
+		return
+	}
+	var method protoreflect.MethodDescriptor
+	if strings.HasPrefix(r.URL.Path, GatewayPrefix) {
+		method = g.service.Methods().ByName(protoreflect.Name(strings.TrimPrefix(r.URL.Path, GatewayPrefix)))
+	}
+	if method == nil {
+		writeError(w, status.Errorf(codes.NotFound, "no such method: %v", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "RPCs must be invoked via POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if method.IsStreamingClient() {
+		writeError(w, status.Errorf(codes.Unimplemented, "client-streaming RPCs are not available over HTTP"))
+		return
+	}
+	in, err := newMessage(method.Input())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	if err != nil {
+		writeError(w, status.Errorf(codes.InvalidArgument, "unable to read request body: %v", err))
+		return
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := unmarshaler.Unmarshal(body, in); err != nil {
+			writeError(w, status.Errorf(codes.InvalidArgument, "unable to parse request body: %v", err))
+			return
+		}
+	}
+	ctx := r.Context()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client := g.proxies.clientAddress(host, r.Header.Values("X-Forwarded-For"))
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", client)
+	}
+	fullMethod := fmt.Sprintf("/%s/%s", g.service.FullName(), method.Name())
+	if method.IsStreamingServer() {
+		g.serveStream(ctx, w, fullMethod, method, in)
+		return
+	}
+	out, err := newMessage(method.Output())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := g.conn.Invoke(ctx, fullMethod, in, out); err != nil {
+		writeError(w, err)
+		return
+	}
+	data, err := marshaler.Marshal(out)
+	if err != nil {
+		writeError(w, status.Errorf(codes.Internal, "unable to encode response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// serveStream relays the messages of a server-streaming RPC until it ends or the client goes away.
+func (g *Gateway) serveStream(ctx context.Context, w http.ResponseWriter, fullMethod string, method protoreflect.MethodDescriptor, in proto.Message) {
+	stream, err := g.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, fullMethod)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := stream.SendMsg(in); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := stream.CloseSend(); err != nil {
+		writeError(w, err)
+		return
+	}
+	// Wait for the server to accept the stream, so that a failure to do so can be reported with a suitable HTTP status.
+	if _, err := stream.Header(); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+		out, err := newMessage(method.Output())
+		if err == nil {
+			err = stream.RecvMsg(out)
+		}
+		if err == io.EOF {
+			return
+		}
+		var line []byte
+		if err != nil {
+			// The HTTP status has already been sent, so the error can only be reported in the body.
+			data, merr := marshaler.Marshal(status.Convert(err).Proto())
+			if merr != nil {
+				return
+			}
+			line = append(append([]byte(`{"error":`), data...), "}\n"...)
+		} else {
+			data, merr := marshaler.Marshal(out)
+			if merr != nil {
+				return
+			}
+			line = append(append([]byte(`{"result":`), data...), "}\n"...)
+		}
+		if _, werr := w.Write(line); werr != nil || err != nil {
+			return
+		}
+	}
+}
+
+// newMessage returns an empty message of the type described by desc.
+func newMessage(desc protoreflect.MessageDescriptor) (proto.Message, error) {
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to find message type %v: %v", desc.FullName(), err)
+	}
+	return mt.New().Interface(), nil
+}
+
+// writeError sends the JSON form of the status of err, with the corresponding HTTP status.
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	data, merr := marshaler.Marshal(st.Proto())
+	if merr != nil {
+		http.Error(w, st.Message(), httpStatusFromCode(st.Code()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatusFromCode(st.Code()))
+	w.Write(data)
+}
+
+// httpStatusFromCode maps a gRPC status code onto the closest HTTP status, as described in google/rpc/code.proto.
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -2,60 +2,507 @@ package api
 
 import (
 	"fmt"
+	"io"
 	"math"
+	"strings"
+	"time"
 
+	"github.com/adsouza/chat-backend/entities"
 	"github.com/adsouza/chat-backend/storage"
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type UserController interface {
 	CreateUser(username string, passphrase string) error
+	// Login is throttled by clientIP as well as by username, unless clientIP is empty. The code is only required of
+	// users who have enrolled in TOTP.
+	Login(username, passphrase, code, clientIP string) (string, time.Time, error)
+	Logout(token string) error
+	RefreshSession(token string) (string, time.Time, error)
+	ChangePassphrase(username, oldPassphrase, newPassphrase string) (string, time.Time, error)
+	RenameUser(username, newUsername string) error
+	DeleteAccount(username, passphrase string) error
+	UnlockAccount(admin, username, clientIP string) error
+	EnrollTOTP(username, passphrase string) (string, []string, error)
+	ConfirmTOTP(username, code string) error
+	DisableTOTP(username, code string) error
 }
 
 type MessageController interface {
-	SendMessage(sender, recipient, message string) error
-	FetchMessagesBefore(user1, user2 string, limit uint32, before int64) ([]storage.Message, int64, error)
+	SendMessage(sender, recipient, message, idempotencyKey string, attachments ...int64) (storage.Message, error)
+	SendToConversation(sender string, conversation int64, message, idempotencyKey string, attachments ...int64) (storage.Message, error)
+	FetchMessagesBefore(viewer, peer string, limit uint32, before int64) ([]storage.Message, int64, error)
+	FetchConversationBefore(viewer string, conversation int64, limit uint32, before int64) ([]storage.Message, int64, error)
+	FetchMessagesAfter(viewer, peer string, limit uint32, after int64) ([]storage.Message, int64, error)
+	FetchConversationAfter(viewer string, conversation int64, limit uint32, after int64) ([]storage.Message, int64, error)
+	Subscribe(user string) (<-chan storage.Message, func())
+	FetchMessagesReceivedAfter(user string, limit uint32, after int64) ([]storage.Message, int64, error)
+	CreateConversation(creator, title string, members []string) (int64, error)
+	FindDirectConversation(viewer, peer string) (int64, error)
+	AddMember(conversation int64, username string) error
+	RemoveMember(remover string, conversation int64, username string) error
+	ListMembers(conversation int64) ([]string, error)
+	ListConversations(user string, limit uint32, before int64) ([]storage.ConversationSummary, int64, error)
+	MarkRead(user string, conversation, message int64) error
+	ReadPositions(conversation int64) ([]storage.ReadCursor, error)
+	FetchMessage(id int64) (storage.Message, error)
+	EditMessage(editor string, id int64, content string) (storage.Message, error)
+	FetchRevisions(id int64) ([]storage.Revision, error)
+	HideMessage(user string, id int64) error
+	DeleteMessage(author string, id int64) error
+	SearchMessages(user string, query storage.SearchQuery) ([]storage.SearchResult, error)
+	SubscribeEvents(user string) (<-chan storage.Event, func())
+	OnlineContacts(user string) ([]string, error)
+	SetTyping(user string, conversation int64) error
+	UploadAttachment(owner, filename, contentType string, content io.Reader) (storage.Attachment, error)
+	OpenAttachment(user string, id int64) (storage.Attachment, io.ReadCloser, error)
 }
 
+const (
+	// resumeBatchSize bounds how many missed messages are read from storage at a time when resuming a subscription.
+	resumeBatchSize = 100
+	// maxSyncBatch bounds how many messages a single FORWARD fetch may return.
+	maxSyncBatch = 500
+	// defaultSearchLimit & maxSearchLimit bound how many results a single search returns.
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
 type chatServer struct {
 	userController UserController
 	msgController  MessageController
+	// proxies may attribute the requests they relay to the clients they relay them for.
+	proxies TrustedProxies
 }
 
-func NewChatServer(userCtlr UserController, msgCtlr MessageController) *chatServer {
-	return &chatServer{userController: userCtlr, msgController: msgCtlr}
+func NewChatServer(userCtlr UserController, msgCtlr MessageController, proxies TrustedProxies) *chatServer {
+	return &chatServer{userController: userCtlr, msgController: msgCtlr, proxies: proxies}
 }
 
 func (c *chatServer) CreateUser(ctx context.Context, req *CreateUserRequest) (*CreateUserResponse, error) {
-	return &CreateUserResponse{}, c.userController.CreateUser(req.GetUsername(), req.GetPassphrase())
+	return &CreateUserResponse{}, statusError(c.userController.CreateUser(req.GetUsername(), req.GetPassphrase()))
+}
+
+func (c *chatServer) Login(ctx context.Context, req *LoginRequest) (*LoginResponse, error) {
+	token, expiry, err := c.userController.Login(req.GetUsername(), req.GetPassphrase(), req.GetTotpCode(), clientIP(ctx, c.proxies))
+	if err != nil {
+		return &LoginResponse{}, statusError(err)
+	}
+	return &LoginResponse{Token: token, Expiry: expiry.Unix()}, nil
+}
+
+func (c *chatServer) Logout(ctx context.Context, req *LogoutRequest) (*LogoutResponse, error) {
+	return &LogoutResponse{}, statusError(c.userController.Logout(req.GetToken()))
+}
+
+func (c *chatServer) RefreshSession(ctx context.Context, req *RefreshSessionRequest) (*RefreshSessionResponse, error) {
+	token, expiry, err := c.userController.RefreshSession(req.GetToken())
+	if err != nil {
+		return &RefreshSessionResponse{}, statusError(err)
+	}
+	return &RefreshSessionResponse{Token: token, Expiry: expiry.Unix()}, nil
+}
+
+func (c *chatServer) ChangePassphrase(ctx context.Context, req *ChangePassphraseRequest) (*ChangePassphraseResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &ChangePassphraseResponse{}, statusError(err)
+	}
+	token, expiry, err := c.userController.ChangePassphrase(caller, req.OldPassphrase, req.NewPassphrase)
+	if err != nil {
+		return &ChangePassphraseResponse{}, statusError(err)
+	}
+	return &ChangePassphraseResponse{Token: token, Expiry: expiry.Unix()}, nil
+}
+
+func (c *chatServer) RenameUser(ctx context.Context, req *RenameUserRequest) (*RenameUserResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &RenameUserResponse{}, statusError(err)
+	}
+	return &RenameUserResponse{}, statusError(c.userController.RenameUser(caller, req.NewUsername))
+}
+
+func (c *chatServer) DeleteAccount(ctx context.Context, req *DeleteAccountRequest) (*DeleteAccountResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &DeleteAccountResponse{}, statusError(err)
+	}
+	return &DeleteAccountResponse{}, statusError(c.userController.DeleteAccount(caller, req.Passphrase))
+}
+
+func (c *chatServer) UnlockAccount(ctx context.Context, req *UnlockAccountRequest) (*UnlockAccountResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &UnlockAccountResponse{}, statusError(err)
+	}
+	if req.Username == "" && req.ClientIp == "" {
+		return &UnlockAccountResponse{}, status.Errorf(codes.InvalidArgument, "a username or client IP is required")
+	}
+	return &UnlockAccountResponse{}, statusError(c.userController.UnlockAccount(caller, req.Username, req.ClientIp))
+}
+
+func (c *chatServer) EnrollTOTP(ctx context.Context, req *EnrollTOTPRequest) (*EnrollTOTPResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &EnrollTOTPResponse{}, statusError(err)
+	}
+	uri, recoveryCodes, err := c.userController.EnrollTOTP(caller, req.Passphrase)
+	if err != nil {
+		return &EnrollTOTPResponse{}, statusError(err)
+	}
+	return &EnrollTOTPResponse{Uri: uri, RecoveryCodes: recoveryCodes}, nil
+}
+
+func (c *chatServer) ConfirmTOTP(ctx context.Context, req *ConfirmTOTPRequest) (*ConfirmTOTPResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &ConfirmTOTPResponse{}, statusError(err)
+	}
+	return &ConfirmTOTPResponse{}, statusError(c.userController.ConfirmTOTP(caller, req.Code))
+}
+
+func (c *chatServer) DisableTOTP(ctx context.Context, req *DisableTOTPRequest) (*DisableTOTPResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &DisableTOTPResponse{}, statusError(err)
+	}
+	return &DisableTOTPResponse{}, statusError(c.userController.DisableTOTP(caller, req.Code))
 }
 
 func (c *chatServer) SendMessage(ctx context.Context, req *SendMessageRequest) (*SendMessageResponse, error) {
-	return &SendMessageResponse{}, c.msgController.SendMessage(req.Sender, req.Recipient, req.Content)
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &SendMessageResponse{}, statusError(err)
+	}
+	if req.Sender != "" && req.Sender != caller {
+		return &SendMessageResponse{}, status.Errorf(codes.PermissionDenied, "cannot send messages on behalf of another user")
+	}
+	if req.ConversationId != 0 {
+		if req.Recipient != "" {
+			return &SendMessageResponse{}, status.Errorf(codes.InvalidArgument, "only one of recipient & conversation ID may be set")
+		}
+		if _, err := c.requireMember(ctx, req.ConversationId); err != nil {
+			return &SendMessageResponse{}, statusError(err)
+		}
+		msg, err := c.msgController.SendToConversation(caller, req.ConversationId, req.Content, req.IdempotencyKey, req.AttachmentIds...)
+		if err != nil {
+			return &SendMessageResponse{}, statusError(err)
+		}
+		return sendMessageResponse(msg)
+	}
+	if req.Recipient == "" {
+		return &SendMessageResponse{}, status.Errorf(codes.InvalidArgument, "either a recipient or a conversation ID is required")
+	}
+	msg, err := c.msgController.SendMessage(caller, req.Recipient, req.Content, req.IdempotencyKey, req.AttachmentIds...)
+	if err != nil {
+		return &SendMessageResponse{}, statusError(err)
+	}
+	return sendMessageResponse(msg)
+}
+
+func sendMessageResponse(msg storage.Message) (*SendMessageResponse, error) {
+	m, err := messageToProto(msg)
+	if err != nil {
+		return &SendMessageResponse{}, statusError(err)
+	}
+	return &SendMessageResponse{MessageId: m.Id, ConversationId: m.ConversationId, Timestamp: m.Timestamp, Metadata: m.Metadata}, nil
 }
 
 func (c *chatServer) FetchMessages(ctx context.Context, req *FetchMessagesRequest) (*FetchMessagesResponse, error) {
-	if req.User1 == "" || req.User2 == "" {
-		return &FetchMessagesResponse{}, fmt.Errorf("both the User1 & User2 fields are required")
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &FetchMessagesResponse{}, statusError(err)
 	}
-	before := req.ContinuationToken
-	if before == 0 {
-		before = math.MaxInt64
+	var peer string
+	if req.ConversationId != 0 {
+		if _, err := c.requireMember(ctx, req.ConversationId); err != nil {
+			return &FetchMessagesResponse{}, statusError(err)
+		}
+	} else {
+		if req.User1 == "" || req.User2 == "" {
+			return &FetchMessagesResponse{}, status.Errorf(codes.InvalidArgument, "either a conversation ID or both the User1 & User2 fields are required")
+		}
+		switch caller {
+		case req.User1:
+			peer = req.User2
+		case req.User2:
+			peer = req.User1
+		default:
+			return &FetchMessagesResponse{}, status.Errorf(codes.PermissionDenied, "cannot fetch a conversation you are not part of")
+		}
 	}
-	limit := req.Limit
-	if limit == 0 {
-		limit = math.MaxUint32
+	var messages []storage.Message
+	resp := &FetchMessagesResponse{}
+	switch req.Direction {
+	case FetchMessagesRequest_FORWARD:
+		limit := req.Limit
+		if limit == 0 || limit > maxSyncBatch {
+			limit = maxSyncBatch
+		}
+		if req.ConversationId != 0 {
+			messages, resp.SyncToken, err = c.msgController.FetchConversationAfter(caller, req.ConversationId, limit, req.SyncToken)
+		} else {
+			messages, resp.SyncToken, err = c.msgController.FetchMessagesAfter(caller, peer, limit, req.SyncToken)
+		}
+	default:
+		before := req.ContinuationToken
+		if before == 0 {
+			before = math.MaxInt64
+		}
+		limit := req.Limit
+		if limit == 0 {
+			limit = math.MaxUint32
+		}
+		if req.ConversationId != 0 {
+			messages, resp.ContinuationToken, err = c.msgController.FetchConversationBefore(caller, req.ConversationId, limit, before)
+		} else {
+			messages, resp.ContinuationToken, err = c.msgController.FetchMessagesBefore(caller, peer, limit, before)
+		}
+	}
+	if err != nil {
+		return &FetchMessagesResponse{}, statusError(err)
 	}
-	messages, continuationToken, err := c.msgController.FetchMessagesBefore(req.User1, req.User2, limit, before)
-	resp := &FetchMessagesResponse{ContinuationToken: continuationToken}
 	for _, msg := range messages {
+		m, err := messageToProto(msg)
+		if err != nil {
+			return nil, statusError(err)
+		}
+		resp.Messages = append(resp.Messages, m)
+	}
+	switch {
+	case len(messages) > 0:
+		resp.ConversationId = messages[0].Conversation
+	case req.ConversationId != 0:
+		resp.ConversationId = req.ConversationId
+	default:
+		// An empty page of a 1:1 conversation, which the users may not have started yet.
+		if resp.ConversationId, err = c.msgController.FindDirectConversation(caller, peer); err != nil {
+			return nil, statusError(err)
+		}
+		if resp.ConversationId == 0 {
+			return resp, nil
+		}
+	}
+	cursors, err := c.msgController.ReadPositions(resp.ConversationId)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	for _, cursor := range cursors {
+		resp.ReadPositions = append(resp.ReadPositions, &ReadPosition{Username: cursor.Username, MessageId: cursor.Message})
+	}
+	return resp, nil
+}
+
+func messageToProto(msg storage.Message) (*Message, error) {
+	metadata := &Metadata{}
+	if err := proto.Unmarshal(msg.Metadata, metadata); err != nil {
+		return nil, fmt.Errorf("failure unmarshalling message metadata: %v", err)
+	}
+	m := &Message{
+		Id:             msg.ID,
+		ConversationId: msg.Conversation,
+		Timestamp:      msg.Timestamp.Unix(),
+		Author:         msg.Author,
+		Content:        msg.Content,
+		Metadata:       metadata,
+		RevisionCount:  msg.Revisions,
+		Deleted:        msg.Deleted,
+	}
+	if !msg.EditedAt.IsZero() {
+		m.EditedAt = msg.EditedAt.Unix()
+	}
+	for _, e := range entities.Extract(msg.Content) {
+		m.Entities = append(m.Entities, &Entity{
+			Kind:  Entity_Kind(e.Kind),
+			Start: uint32(e.Start),
+			End:   uint32(e.End),
+			Value: e.Value,
+		})
+	}
+	return m, nil
+}
+
+func (c *chatServer) EditMessage(ctx context.Context, req *EditMessageRequest) (*EditMessageResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &EditMessageResponse{}, statusError(err)
+	}
+	original, err := c.msgController.FetchMessage(req.MessageId)
+	if err != nil {
+		return &EditMessageResponse{}, statusError(err)
+	}
+	if original.Author != caller {
+		return &EditMessageResponse{}, status.Errorf(codes.PermissionDenied, "only the author of a message may edit it")
+	}
+	msg, err := c.msgController.EditMessage(caller, req.MessageId, req.Content)
+	if err != nil {
+		return &EditMessageResponse{}, statusError(err)
+	}
+	m, err := messageToProto(msg)
+	if err != nil {
+		return &EditMessageResponse{}, statusError(err)
+	}
+	return &EditMessageResponse{Message: m}, nil
+}
+
+func (c *chatServer) FetchMessageRevisions(ctx context.Context, req *FetchMessageRevisionsRequest) (*FetchMessageRevisionsResponse, error) {
+	msg, err := c.msgController.FetchMessage(req.MessageId)
+	if err != nil {
+		return &FetchMessageRevisionsResponse{}, statusError(err)
+	}
+	if _, err := c.requireMember(ctx, msg.Conversation); err != nil {
+		return &FetchMessageRevisionsResponse{}, statusError(err)
+	}
+	revisions, err := c.msgController.FetchRevisions(req.MessageId)
+	if err != nil {
+		return &FetchMessageRevisionsResponse{}, statusError(err)
+	}
+	resp := &FetchMessageRevisionsResponse{}
+	for _, revision := range revisions {
 		metadata := &Metadata{}
-		if err := proto.Unmarshal(msg.Metadata, metadata); err != nil {
-			return nil, fmt.Errorf("failure unmarshalling message metadata: %v", err)
+		if err := proto.Unmarshal(revision.Metadata, metadata); err != nil {
+			return &FetchMessageRevisionsResponse{}, fmt.Errorf("failure unmarshalling revision metadata: %v", err)
+		}
+		resp.Revisions = append(resp.Revisions, &Revision{
+			Revision:  revision.Number,
+			Timestamp: revision.Timestamp.Unix(),
+			Content:   revision.Content,
+			Metadata:  metadata,
+		})
+	}
+	return resp, nil
+}
+
+func (c *chatServer) SubscribeMessages(req *SubscribeMessagesRequest, stream Chat_SubscribeMessagesServer) error {
+	caller, err := requireCaller(stream.Context())
+	if err != nil {
+		return err
+	}
+	// Subscribe before replaying missed messages so that nothing sent in the meantime is lost.
+	messages, cancel := c.msgController.Subscribe(caller)
+	defer cancel()
+	// Let the client know that the subscription is live, since the first message may be a long time coming.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	last := req.ResumeAfter
+	send := func(msg storage.Message) error {
+		m, err := messageToProto(msg)
+		if err != nil {
+			return err
 		}
-		resp.Messages = append(resp.Messages,
-			&Message{Timestamp: msg.Timestamp.Unix(), Author: msg.Author, Content: msg.Content, Metadata: metadata})
+		last = msg.ID
+		return stream.Send(m)
+	}
+	if err := c.replayMissed(caller, last, send); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case msg, ok := <-messages:
+			if !ok {
+				return status.Errorf(codes.Unavailable, "subscriber fell too far behind; resubscribe from message %d", last)
+			}
+			if msg.ID <= last {
+				// Already delivered while replaying missed messages.
+				continue
+			}
+			if err := send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replayMissed passes each message that user received after the one with the specified ID to send, oldest first.
+func (c *chatServer) replayMissed(user string, after int64, send func(storage.Message) error) error {
+	for after > 0 {
+		missed, _, err := c.msgController.FetchMessagesReceivedAfter(user, resumeBatchSize, after)
+		if err != nil {
+			return statusError(err)
+		}
+		for _, msg := range missed {
+			if err := send(msg); err != nil {
+				return err
+			}
+			after = msg.ID
+		}
+		if len(missed) < resumeBatchSize {
+			break
+		}
+	}
+	return nil
+}
+
+func (c *chatServer) DeleteMessage(ctx context.Context, req *DeleteMessageRequest) (*DeleteMessageResponse, error) {
+	msg, err := c.msgController.FetchMessage(req.MessageId)
+	if err != nil {
+		return &DeleteMessageResponse{}, statusError(err)
+	}
+	caller, err := c.requireMember(ctx, msg.Conversation)
+	if err != nil {
+		return &DeleteMessageResponse{}, statusError(err)
+	}
+	switch req.Scope {
+	case DeleteMessageRequest_FOR_EVERYONE:
+		if msg.Author != caller {
+			return &DeleteMessageResponse{}, status.Errorf(codes.PermissionDenied, "only the author of a message may delete it for everyone")
+		}
+		return &DeleteMessageResponse{}, statusError(c.msgController.DeleteMessage(caller, req.MessageId))
+	default:
+		return &DeleteMessageResponse{}, statusError(c.msgController.HideMessage(caller, req.MessageId))
+	}
+}
+
+func (c *chatServer) SearchMessages(ctx context.Context, req *SearchMessagesRequest) (*SearchMessagesResponse, error) {
+	caller, err := requireCaller(ctx)
+	if err != nil {
+		return &SearchMessagesResponse{}, statusError(err)
+	}
+	if len(strings.Fields(req.Query)) == 0 {
+		return &SearchMessagesResponse{}, status.Errorf(codes.InvalidArgument, "a search query is required")
+	}
+	limit := req.Limit
+	switch {
+	case limit == 0:
+		limit = defaultSearchLimit
+	case limit > maxSearchLimit:
+		limit = maxSearchLimit
+	}
+	query := storage.SearchQuery{
+		Text:   req.Query,
+		Peer:   req.Peer,
+		Author: req.Author,
+		Limit:  limit,
+		Offset: req.ContinuationToken,
+	}
+	if req.After != 0 {
+		query.After = time.Unix(req.After, 0)
+	}
+	if req.Before != 0 {
+		query.Before = time.Unix(req.Before, 0)
+	}
+	results, err := c.msgController.SearchMessages(caller, query)
+	if err != nil {
+		return &SearchMessagesResponse{}, statusError(err)
+	}
+	resp := &SearchMessagesResponse{}
+	for _, result := range results {
+		m, err := messageToProto(result.Message)
+		if err != nil {
+			return &SearchMessagesResponse{}, statusError(err)
+		}
+		resp.Results = append(resp.Results, &SearchResult{Message: m, Snippet: result.Snippet})
+	}
+	if len(results) == int(limit) {
+		resp.ContinuationToken = query.Offset + int64(limit)
 	}
-	return resp, err
+	return resp, nil
 }
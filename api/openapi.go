@@ -0,0 +1,146 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// jsonObject is a node of an OpenAPI document.
+type jsonObject map[string]interface{}
+
+// statusSchema describes the JSON form of google.rpc.Status, in which every error is reported.
+var statusSchema = jsonObject{
+	"type": "object",
+	"properties": jsonObject{
+		"code":    jsonObject{"type": "integer", "format": "int32"},
+		"message": jsonObject{"type": "string"},
+		"details": jsonObject{
+			"type": "array",
+			"items": jsonObject{
+				"type":                 "object",
+				"properties":           jsonObject{"@type": jsonObject{"type": "string"}},
+				"additionalProperties": true,
+			},
+		},
+	},
+}
+
+// OpenAPIDocument describes the HTTP/JSON form of every method of a service, as served by Gateway, in OpenAPI 3 format.
+func OpenAPIDocument(service protoreflect.ServiceDescriptor) ([]byte, error) {
+	schemas := jsonObject{"google.rpc.Status": statusSchema}
+	paths := jsonObject{}
+	methods := service.Methods()
+	for i := 0; i < methods.Len(); i++ {
+		method := methods.Get(i)
+		if method.IsStreamingClient() {
+			continue
+		}
+		contentType, description := "application/json", "The response message."
+		response := schemaRef(schemas, method.Output())
+		if method.IsStreamingServer() {
+			contentType, description = "application/x-ndjson", "A stream of objects, one per line, each containing a result or an error."
+			response = jsonObject{
+				"type": "object",
+				"properties": jsonObject{
+					"result": response,
+					"error":  jsonObject{"$ref": "#/components/schemas/google.rpc.Status"},
+				},
+			}
+		}
+		paths[GatewayPrefix+string(method.Name())] = jsonObject{"post": jsonObject{
+			"operationId": string(method.Name()),
+			"requestBody": jsonObject{
+				"required": true,
+				"content":  jsonObject{"application/json": jsonObject{"schema": schemaRef(schemas, method.Input())}},
+			},
+			"responses": jsonObject{
+				"200": jsonObject{
+					"description": description,
+					"content":     jsonObject{contentType: jsonObject{"schema": response}},
+				},
+				"default": jsonObject{
+					"description": "An error, sent with the HTTP status corresponding to its code.",
+					"content": jsonObject{"application/json": jsonObject{
+						"schema": jsonObject{"$ref": "#/components/schemas/google.rpc.Status"},
+					}},
+				},
+			},
+		}}
+	}
+	doc := jsonObject{
+		"openapi": "3.0.3",
+		"info":    jsonObject{"title": string(service.FullName()), "version": "v1"},
+		"paths":   paths,
+		"components": jsonObject{
+			"schemas":         schemas,
+			"securitySchemes": jsonObject{"session": jsonObject{"type": "http", "scheme": "bearer"}},
+		},
+		// Some methods can be called anonymously, so the session token is optional.
+		"security": []jsonObject{{"session": []string{}}, {}},
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode OpenAPI document: %v", err)
+	}
+	return data, nil
+}
+
+// schemaRef adds a schema for the JSON form of a message (& any that it refers to) & returns a reference to it.
+func schemaRef(schemas jsonObject, message protoreflect.MessageDescriptor) jsonObject {
+	name := string(message.FullName())
+	ref := jsonObject{"$ref": "#/components/schemas/" + name}
+	if _, ok := schemas[name]; ok {
+		return ref
+	}
+	properties := jsonObject{}
+	schemas[name] = jsonObject{"type": "object", "properties": properties}
+	fields := message.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		switch {
+		case field.IsMap():
+			properties[field.JSONName()] = jsonObject{"type": "object", "additionalProperties": valueSchema(schemas, field.MapValue())}
+		case field.IsList():
+			properties[field.JSONName()] = jsonObject{"type": "array", "items": valueSchema(schemas, field)}
+		default:
+			properties[field.JSONName()] = valueSchema(schemas, field)
+		}
+	}
+	return ref
+}
+
+// valueSchema describes the JSON form of a single value of a field, following the proto3 JSON mapping.
+func valueSchema(schemas jsonObject, field protoreflect.FieldDescriptor) jsonObject {
+	switch field.Kind() {
+	case protoreflect.BoolKind:
+		return jsonObject{"type": "boolean"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return jsonObject{"type": "integer", "format": "int32"}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return jsonObject{"type": "integer", "format": "int64", "minimum": 0}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		// 64 bit integers are encoded as strings, since JSON numbers can't represent all of them exactly.
+		return jsonObject{"type": "string", "format": "int64"}
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return jsonObject{"type": "string", "format": "uint64"}
+	case protoreflect.FloatKind:
+		return jsonObject{"type": "number", "format": "float"}
+	case protoreflect.DoubleKind:
+		return jsonObject{"type": "number", "format": "double"}
+	case protoreflect.BytesKind:
+		return jsonObject{"type": "string", "format": "byte"}
+	case protoreflect.EnumKind:
+		var names []string
+		values := field.Enum().Values()
+		for i := 0; i < values.Len(); i++ {
+			names = append(names, string(values.Get(i).Name()))
+		}
+		return jsonObject{"type": "string", "enum": names}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return schemaRef(schemas, field.Message())
+	default:
+		return jsonObject{"type": "string"}
+	}
+}
@@ -0,0 +1,311 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/adsouza/chat-backend/storage"
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// WebSocketPath is where the handler returned by NewWebSocketHandler is meant to be served.
+	WebSocketPath = GatewayPrefix + "websocket"
+	// authTimeout bounds how long a client may take to send its Authenticate frame after connecting.
+	authTimeout = 10 * time.Second
+	// The server pings each client every pingInterval & drops it if nothing, not even a pong, arrives within pongTimeout.
+	pingInterval = 30 * time.Second
+	pongTimeout  = 2 * pingInterval
+	// writeTimeout bounds how long a client may take to accept a single frame.
+	writeTimeout = 10 * time.Second
+	// replyBuffer bounds how many responses to a client's frames may await delivery before the server stops reading
+	// further frames from it.
+	replyBuffer = 16
+)
+
+type webSocketHandler struct {
+	chat      *chatServer
+	validator SessionValidator
+	upgrader  websocket.Upgrader
+	// origins holds the lowercased origins, besides the server's own, of the pages that may open WebSockets.
+	origins map[string]bool
+}
+
+// NewWebSocketHandler returns a handler that lets browsers chat over a WebSocket, as described alongside ClientFrame
+// in api.proto. Frames are exchanged in the same JSON form as Gateway uses, & are subject to the same checks as the
+// equivalent RPCs. Should a client fall too far behind the messages & events pushed to it, its connection is closed
+// with code 1013 (try again later), after which it may reconnect & resume from the last message it received. Once its
+// session ends, e.g. by logging out, its connection is closed with code 1008 (policy violation).
+//
+// Browsers may only open WebSockets from pages served by the same host as the handler or from one of origins, each
+// of which is a scheme & host, e.g. https://chat.example.com.
+func NewWebSocketHandler(chat *chatServer, validator SessionValidator, origins ...string) http.Handler {
+	h := &webSocketHandler{chat: chat, validator: validator, origins: make(map[string]bool)}
+	for _, origin := range origins {
+		h.origins[strings.ToLower(origin)] = true
+	}
+	h.upgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096, CheckOrigin: h.checkOrigin}
+	return h
+}
+
+// checkOrigin accepts requests from pages served by the same host as the handler or from one of the allowed origins,
+// along with requests that have no Origin header, as they don't come from browsers.
+func (h *webSocketHandler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || h.origins[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// checkSession returns an error unless token still identifies a session of caller. Logging out, changing passphrase &
+// deleting the account all end sessions, whereas renaming the account ends those of the old username as far as a
+// WebSocket is concerned, since its subscriptions are for that username.
+func (h *webSocketHandler) checkSession(token, caller string) error {
+	username, err := h.validator.ValidateSession(token)
+	if err != nil {
+		return err
+	}
+	if username != caller {
+		return status.Errorf(codes.Unauthenticated, "the account was renamed to %v, so the client must reconnect", username)
+	}
+	return nil
+}
+
+func (h *webSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded with a suitable HTTP error.
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxRequestBytes)
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	frame, err := readFrame(conn)
+	if err != nil && status.Code(err) != codes.InvalidArgument {
+		return
+	}
+	if err == nil {
+		if auth := frame.GetAuthenticate(); auth == nil {
+			err = status.Errorf(codes.Unauthenticated, "the first frame must authenticate the client")
+		} else if caller, verr := h.validator.ValidateSession(auth.Token); verr != nil {
+			err = verr
+		} else {
+			h.serve(r.Context(), conn, auth.Token, caller, frame.Id, auth.ResumeAfter)
+			return
+		}
+	}
+	if writeFrame(conn, errorFrame(frame.GetId(), err)) == nil {
+		closeConn(conn, websocket.ClosePolicyViolation, "authentication failed")
+	}
+}
+
+// serve pushes messages & events to an authenticated client, along with responses to the frames it sends, until
+// either side goes away or the client's session ends. The session is checked before handling each frame & whenever
+// the client is pinged.
+func (h *webSocketHandler) serve(ctx context.Context, conn *websocket.Conn, token, caller, id string, resumeAfter int64) {
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, callerKey{}, caller))
+	defer cancel()
+	// Subscribe before replaying missed messages so that nothing sent in the meantime is lost.
+	messages, unsubscribe := h.chat.msgController.Subscribe(caller)
+	defer unsubscribe()
+	events, unsubscribeEvents := h.chat.msgController.SubscribeEvents(caller)
+	defer unsubscribeEvents()
+	if err := writeFrame(conn, &ServerFrame{Id: id, Body: &ServerFrame_Authenticated{Authenticated: caller}}); err != nil {
+		return
+	}
+	last := resumeAfter
+	send := func(msg storage.Message) error {
+		m, err := messageToProto(msg)
+		if err != nil {
+			return err
+		}
+		last = msg.ID
+		return writeFrame(conn, &ServerFrame{Body: &ServerFrame_Message{Message: m}})
+	}
+	if err := h.chat.replayMissed(caller, last, send); err != nil {
+		if writeFrame(conn, errorFrame("", err)) == nil {
+			closeConn(conn, websocket.CloseInternalServerErr, "unable to replay missed messages")
+		}
+		return
+	}
+	// Presence is best effort, so a failure to look it up shouldn't stop the client from chatting.
+	online, _ := h.chat.msgController.OnlineContacts(caller)
+	for _, contact := range online {
+		if err := writeFrame(conn, eventFrame(storage.Event{Kind: storage.EventOnline, Username: contact})); err != nil {
+			return
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+	replies := make(chan *ServerFrame, replyBuffer)
+	// ended receives the response to the frame that the reader found the session to have ended before handling.
+	ended := make(chan *ServerFrame, 1)
+	done := make(chan struct{})
+	go h.read(ctx, conn, token, caller, replies, ended, done)
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+	// This is the only goroutine that writes to the connection, apart from control frames, which may be sent
+	// concurrently.
+	for {
+		var err error
+		select {
+		case <-done:
+			select {
+			case reply := <-ended:
+				endSession(conn, reply)
+			default:
+			}
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				closeConn(conn, websocket.CloseTryAgainLater, "fell too far behind")
+				return
+			}
+			if msg.ID <= last {
+				// Already delivered while replaying missed messages.
+				continue
+			}
+			err = send(msg)
+		case event, ok := <-events:
+			if !ok {
+				closeConn(conn, websocket.CloseTryAgainLater, "fell too far behind")
+				return
+			}
+			err = writeFrame(conn, eventFrame(event))
+		case reply := <-replies:
+			err = writeFrame(conn, reply)
+		case <-ping.C:
+			if serr := h.checkSession(token, caller); serr != nil {
+				endSession(conn, errorFrame("", serr))
+				return
+			}
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// read handles the frames sent by an authenticated client until the connection fails, passing any responses to
+// replies. Should the client's session have ended, it passes the response to the frame it was about to handle to
+// ended instead & stops. It closes done when it returns.
+func (h *webSocketHandler) read(ctx context.Context, conn *websocket.Conn, token, caller string, replies, ended chan<- *ServerFrame, done chan<- struct{}) {
+	defer close(done)
+	for {
+		frame, err := readFrame(conn)
+		var reply *ServerFrame
+		switch {
+		case err == nil:
+			if serr := h.checkSession(token, caller); serr != nil {
+				ended <- errorFrame(frame.Id, serr)
+				return
+			}
+			reply = h.handle(ctx, caller, frame)
+		case status.Code(err) == codes.InvalidArgument:
+			// The connection is still usable, but the client has sent something other than a ClientFrame.
+			reply = errorFrame("", err)
+		default:
+			return
+		}
+		if reply == nil {
+			continue
+		}
+		select {
+		case replies <- reply:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handle carries out the request in a frame sent by an authenticated client & returns the response, if any.
+func (h *webSocketHandler) handle(ctx context.Context, caller string, frame *ClientFrame) *ServerFrame {
+	switch body := frame.Body.(type) {
+	case *ClientFrame_SendMessage:
+		resp, err := h.chat.SendMessage(ctx, body.SendMessage)
+		if err != nil {
+			return errorFrame(frame.Id, err)
+		}
+		return &ServerFrame{Id: frame.Id, Body: &ServerFrame_MessageSent{MessageSent: resp}}
+	case *ClientFrame_Typing:
+		// Typing notifications are best effort, so only failures are acknowledged.
+		if err := h.chat.msgController.SetTyping(caller, body.Typing.GetConversationId()); err != nil {
+			return errorFrame(frame.Id, err)
+		}
+		return nil
+	case *ClientFrame_Authenticate:
+		return errorFrame(frame.Id, status.Errorf(codes.FailedPrecondition, "the client is already authenticated"))
+	default:
+		return errorFrame(frame.Id, status.Errorf(codes.InvalidArgument, "frame has no recognized body"))
+	}
+}
+
+// readFrame returns the next frame from the client. Frames that can't be parsed are reported as InvalidArgument
+// errors, whereas any other error means that the connection has failed.
+func readFrame(conn *websocket.Conn) (*ClientFrame, error) {
+	kind, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if kind != websocket.TextMessage {
+		return nil, status.Errorf(codes.InvalidArgument, "frames must be sent as text messages")
+	}
+	frame := &ClientFrame{}
+	if err := unmarshaler.Unmarshal(data, proto.MessageV2(frame)); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unable to parse frame: %v", err)
+	}
+	return frame, nil
+}
+
+func writeFrame(conn *websocket.Conn, frame *ServerFrame) error {
+	data, err := marshaler.Marshal(proto.MessageV2(frame))
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// endSession tells the client why its session ended & closes the connection.
+func endSession(conn *websocket.Conn, reply *ServerFrame) {
+	if writeFrame(conn, reply) == nil {
+		closeConn(conn, websocket.ClosePolicyViolation, "session has ended")
+	}
+}
+
+// closeConn starts the closing handshake, after which the connection should be closed without waiting for the client.
+func closeConn(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeTimeout))
+}
+
+// errorFrame reports err in the same terms as the equivalent gRPC error.
+func errorFrame(id string, err error) *ServerFrame {
+	st := status.Convert(statusError(err))
+	frameErr := &FrameError{Code: int32(st.Code()), Message: st.Message()}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			frameErr.Reason = info.Reason
+		}
+	}
+	return &ServerFrame{Id: id, Body: &ServerFrame_Error{Error: frameErr}}
+}
+
+func eventFrame(event storage.Event) *ServerFrame {
+	if event.Kind == storage.EventTyping {
+		return &ServerFrame{Body: &ServerFrame_Typing{Typing: &Typing{ConversationId: event.Conversation, Username: event.Username}}}
+	}
+	return &ServerFrame{Body: &ServerFrame_Presence{Presence: &Presence{Username: event.Username, Online: event.Kind == storage.EventOnline}}}
+}
@@ -1 +1,2 @@
 rm api/api.pb.go chat.db
+rm -rf attachments
@@ -0,0 +1,273 @@
+// Package entities finds the parts of the text of a message that clients may want to render specially, such as links
+// & mentions of other users.
+package entities
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Kind classifies entities. Its values match those of Entity.Kind in api.proto.
+type Kind int
+
+const (
+	URL Kind = iota + 1
+	Mention
+	Hashtag
+	Email
+	Emoji
+)
+
+// Entity is a span of text, given as byte offsets into it, along with its normalized value: a URL with its scheme, or
+// a username or hashtag without its leading symbol. The value of an email address or emoji is the text itself.
+type Entity struct {
+	Kind       Kind
+	Start, End int
+	Value      string
+}
+
+var (
+	urlPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+	// Emails are matched before mentions, since the domain of an address would otherwise look like one.
+	emailPattern   = regexp.MustCompile(`[\p{L}\p{N}._%+-]+@[\p{L}\p{N}-]+(?:\.[\p{L}\p{N}-]+)*\.\p{L}{2,}`)
+	mentionPattern = regexp.MustCompile(`@[\p{L}\p{N}_.-]+`)
+	hashtagPattern = regexp.MustCompile(`#[\p{L}\p{M}\p{N}_]+`)
+)
+
+// Extract returns the entities in text, in order & without overlaps.
+func Extract(text string) []Entity {
+	var found []Entity
+	// claim adds an entity unless it overlaps one that was found earlier, which takes precedence.
+	claim := func(e Entity) {
+		for _, other := range found {
+			if e.Start < other.End && other.Start < e.End {
+				return
+			}
+		}
+		found = append(found, e)
+	}
+	for _, span := range urlPattern.FindAllStringIndex(text, -1) {
+		start, end := span[0], trimURL(text, span[0], span[1])
+		value := text[start:end]
+		if strings.HasPrefix(strings.ToLower(value), "www.") {
+			value = "http://" + value
+		}
+		claim(Entity{Kind: URL, Start: start, End: end, Value: value})
+	}
+	for _, span := range emailPattern.FindAllStringIndex(text, -1) {
+		if startsWord(text, span[0]) {
+			claim(Entity{Kind: Email, Start: span[0], End: span[1], Value: text[span[0]:span[1]]})
+		}
+	}
+	for _, span := range mentionPattern.FindAllStringIndex(text, -1) {
+		end := span[0] + len(strings.TrimRight(text[span[0]:span[1]], ".-"))
+		if startsWord(text, span[0]) && end > span[0]+1 {
+			claim(Entity{Kind: Mention, Start: span[0], End: end, Value: text[span[0]+1 : end]})
+		}
+	}
+	for _, span := range hashtagPattern.FindAllStringIndex(text, -1) {
+		tag := text[span[0]+1 : span[1]]
+		// Tags that are only numbers, like "#1", are more likely to be ordinals.
+		if startsWord(text, span[0]) && strings.IndexFunc(tag, unicode.IsLetter) >= 0 {
+			claim(Entity{Kind: Hashtag, Start: span[0], End: span[1], Value: tag})
+		}
+	}
+	for _, span := range emojiSpans(text) {
+		claim(Entity{Kind: Emoji, Start: span[0], End: span[1], Value: text[span[0]:span[1]]})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Start < found[j].Start })
+	return found
+}
+
+// URLs returns the values of the URL entities in text.
+func URLs(text string) []string {
+	var urls []string
+	for _, e := range Extract(text) {
+		if e.Kind == URL {
+			urls = append(urls, e.Value)
+		}
+	}
+	return urls
+}
+
+// startsWord reports whether the symbol at offset i begins a word rather than continuing one, as the @ of an email
+// address or the # of a URL fragment would.
+func startsWord(text string, i int) bool {
+	if i == 0 {
+		return true
+	}
+	prev, _ := utf8.DecodeLastRuneInString(text[:i])
+	return !unicode.IsLetter(prev) && !unicode.IsNumber(prev) && !strings.ContainsRune("_@#&/.", prev)
+}
+
+// trimURL returns where a URL matched between start & end really ends, excluding trailing punctuation that is more
+// likely to belong to the surrounding sentence, such as a full stop or a closing bracket without an opening one.
+func trimURL(text string, start, end int) int {
+	for end > start {
+		last := text[end-1]
+		switch {
+		case strings.IndexByte(".,;:!?'*", last) >= 0:
+			end--
+		case last == ')' && strings.Count(text[start:end], "(") < strings.Count(text[start:end], ")"):
+			end--
+		default:
+			return end
+		}
+	}
+	return end
+}
+
+const (
+	zeroWidthJoiner   = '\u200d'
+	variationSelector = '\ufe0f'
+	combiningKeycap   = '\u20e3'
+)
+
+// emojiPresentation holds the code points that are displayed as emoji by default.
+var emojiPresentation = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x231a, 0x231b, 1},
+		{0x23e9, 0x23ec, 1},
+		{0x23f0, 0x23f3, 3},
+		{0x25fd, 0x25fe, 1},
+		{0x2614, 0x2615, 1},
+		{0x2648, 0x2653, 1},
+		{0x267f, 0x2693, 20},
+		{0x26a1, 0x26a1, 1},
+		{0x26aa, 0x26ab, 1},
+		{0x26bd, 0x26be, 1},
+		{0x26c4, 0x26c5, 1},
+		{0x26ce, 0x26d4, 6},
+		{0x26ea, 0x26ea, 1},
+		{0x26f2, 0x26f3, 1},
+		{0x26f5, 0x26fa, 5},
+		{0x26fd, 0x26fd, 1},
+		{0x2705, 0x2705, 1},
+		{0x270a, 0x270b, 1},
+		{0x2728, 0x2728, 1},
+		{0x274c, 0x274e, 2},
+		{0x2753, 0x2755, 1},
+		{0x2757, 0x2757, 1},
+		{0x2795, 0x2797, 1},
+		{0x27b0, 0x27bf, 15},
+		{0x2b1b, 0x2b1c, 1},
+		{0x2b50, 0x2b55, 5},
+	},
+	R32: []unicode.Range32{
+		{0x1f004, 0x1f0cf, 0xcb},
+		{0x1f18e, 0x1f18e, 1},
+		{0x1f191, 0x1f19a, 1},
+		{0x1f201, 0x1f251, 1},
+		{0x1f300, 0x1f64f, 1},
+		{0x1f680, 0x1f6ff, 1},
+		{0x1f7e0, 0x1f7ff, 1},
+		{0x1f900, 0x1faff, 1},
+	},
+}
+
+// textPresentation holds the code points that are only displayed as emoji when followed by a variation selector.
+var textPresentation = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00a9, 0x00ae, 5},
+		{0x203c, 0x2049, 13},
+		{0x2122, 0x2139, 23},
+		{0x2194, 0x21aa, 1},
+		{0x2300, 0x23ff, 1},
+		{0x24c2, 0x24c2, 1},
+		{0x25aa, 0x25fe, 1},
+		{0x2600, 0x27bf, 1},
+		{0x2934, 0x2935, 1},
+		{0x2b05, 0x2b55, 1},
+		{0x3030, 0x303d, 13},
+		{0x3297, 0x3299, 2},
+	},
+	R32: []unicode.Range32{
+		{0x1f170, 0x1f17f, 1},
+	},
+	LatinOffset: 1,
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+func isSkinTone(r rune) bool {
+	return r >= 0x1f3fb && r <= 0x1f3ff
+}
+
+func isTag(r rune) bool {
+	return r >= 0xe0020 && r <= 0xe007f
+}
+
+// isEmoji reports whether an emoji starts at index i.
+func isEmoji(runes []rune, i int) bool {
+	r := runes[i]
+	if isSkinTone(r) {
+		return false
+	}
+	return unicode.Is(emojiPresentation, r) ||
+		unicode.Is(textPresentation, r) && i+1 < len(runes) && runes[i+1] == variationSelector
+}
+
+// emojiSpans returns the byte offsets of each emoji in text. Sequences joined by zero width joiners, & those with
+// modifiers such as skin tones, as well as flags & keycaps, each count as one emoji.
+func emojiSpans(text string) [][2]int {
+	var spans [][2]int
+	var runes []rune
+	// offsets holds the byte offset of each rune, followed by the length of the text.
+	var offsets []int
+	for offset, r := range text {
+		runes = append(runes, r)
+		offsets = append(offsets, offset)
+	}
+	offsets = append(offsets, len(text))
+	for i := 0; i < len(runes); {
+		start := i
+		switch r := runes[i]; {
+		case isRegionalIndicator(r):
+			i++
+			if i < len(runes) && isRegionalIndicator(runes[i]) {
+				i++
+			}
+		case strings.ContainsRune("0123456789#*", r) && keycapEnd(runes, i) > i:
+			i = keycapEnd(runes, i)
+		case isEmoji(runes, i):
+			i = emojiSequenceEnd(runes, i)
+		default:
+			i++
+			continue
+		}
+		spans = append(spans, [2]int{offsets[start], offsets[i]})
+	}
+	return spans
+}
+
+// keycapEnd returns the index after the keycap sequence that starts at index i, or i if there isn't one.
+func keycapEnd(runes []rune, i int) int {
+	j := i + 1
+	if j < len(runes) && runes[j] == variationSelector {
+		j++
+	}
+	if j < len(runes) && runes[j] == combiningKeycap {
+		return j + 1
+	}
+	return i
+}
+
+// emojiSequenceEnd returns the index after the emoji that starts at index i, including its modifiers & anything joined
+// to it.
+func emojiSequenceEnd(runes []rune, i int) int {
+	for i++; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == variationSelector || isSkinTone(r) || isTag(r):
+		case r == zeroWidthJoiner && i+1 < len(runes) && isEmoji(runes, i+1):
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
@@ -0,0 +1,64 @@
+package entities_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/adsouza/chat-backend/entities"
+)
+
+func TestExtract(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want []entities.Entity
+	}{
+		{"How's it going?", nil},
+		{"Plain text with a # and an @ & #1 in it.", nil},
+		{"See https://example.com/a_(b)?c=d#e.", []entities.Entity{
+			{Kind: entities.URL, Start: 4, End: 35, Value: "https://example.com/a_(b)?c=d#e"},
+		}},
+		{"(www.example.com)", []entities.Entity{
+			{Kind: entities.URL, Start: 1, End: 16, Value: "http://www.example.com"},
+		}},
+		{"Ask @testuser2 or mail bob.smith+chat@example.co.uk, #GoLang!", []entities.Entity{
+			{Kind: entities.Mention, Start: 4, End: 14, Value: "testuser2"},
+			{Kind: entities.Email, Start: 23, End: 51, Value: "bob.smith+chat@example.co.uk"},
+			{Kind: entities.Hashtag, Start: 53, End: 60, Value: "GoLang"},
+		}},
+		{"Thanks @testuser1.", []entities.Entity{
+			{Kind: entities.Mention, Start: 7, End: 17, Value: "testuser1"},
+		}},
+		{"http://example.com/@user/#tag", []entities.Entity{
+			{Kind: entities.URL, Start: 0, End: 29, Value: "http://example.com/@user/#tag"},
+		}},
+		{"#café au lait", []entities.Entity{
+			{Kind: entities.Hashtag, Start: 0, End: 6, Value: "café"},
+		}},
+		{"Hi 👋🏽! 👨‍👩‍👧 🇳🇿 1️⃣ ❤️ ♥ ☕", []entities.Entity{
+			{Kind: entities.Emoji, Start: 3, End: 11, Value: "👋🏽"},
+			{Kind: entities.Emoji, Start: 13, End: 31, Value: "👨‍👩‍👧"},
+			{Kind: entities.Emoji, Start: 32, End: 40, Value: "🇳🇿"},
+			{Kind: entities.Emoji, Start: 41, End: 48, Value: "1️⃣"},
+			{Kind: entities.Emoji, Start: 49, End: 55, Value: "❤️"},
+			{Kind: entities.Emoji, Start: 60, End: 63, Value: "☕"},
+		}},
+	} {
+		got := entities.Extract(tc.text)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Entities in %q mismatch: got %+v, want %+v.", tc.text, got, tc.want)
+		}
+		for _, e := range got {
+			if e.Kind == entities.Emoji && tc.text[e.Start:e.End] != e.Value {
+				t.Errorf("Offsets of %q in %q are wrong: got %q.", e.Value, tc.text, tc.text[e.Start:e.End])
+			}
+		}
+	}
+}
+
+func TestURLs(t *testing.T) {
+	got := entities.URLs("Try www.example.com, or https://example.org/ @someone")
+	want := []string{"http://www.example.com", "https://example.org/"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("URLs mismatch: got %v, want %v.", got, want)
+	}
+}
@@ -1,42 +1,108 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/adsouza/chat-backend/api"
 	"github.com/adsouza/chat-backend/logic"
 	"github.com/adsouza/chat-backend/storage"
+	"github.com/gorilla/websocket"
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
+// errorReason returns the reason given by the ErrorInfo detail of a status error, if any.
+func errorReason(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+// retryDelay returns how long the RetryInfo detail of a status error says to wait, if it has one.
+func retryDelay(err error) time.Duration {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration()
+		}
+	}
+	return 0
+}
+
+// fieldViolations summarizes the BadRequest detail of a status error, if any.
+func fieldViolations(err error) string {
+	var violations []string
+	for _, detail := range status.Convert(err).Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range badRequest.FieldViolations {
+				violations = append(violations, v.Field+" "+v.Description)
+			}
+		}
+	}
+	return strings.Join(violations, "; ")
+}
+
+// withToken returns a context that presents the specified session token to the server.
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
 func main() {
-	db, err := sql.Open("sqlite3", "")
+	db, err := sql.Open("sqlite3", storage.SQLiteDSN(""))
 	if err != nil {
 		log.Fatalf("Could not open connection to DB: %v.", err)
 	}
 	defer db.Close()
-	if _, err := db.Exec(storage.PragmaCmd); err != nil {
-		log.Printf("Unable to enable foreign key constraints in DB: %v.", err)
-	}
-	if _, err := db.Exec(storage.UserTableInitCmd); err != nil {
-		log.Fatalf("Unable to create new users table in test DB: %v.", err)
-	}
-	if _, err := db.Exec(storage.ConversationTableInitCmd); err != nil {
-		log.Fatalf("Unable to create new conversations table in test DB: %v.", err)
+	// Each connection to an unnamed DB gets its own private copy, so only use one.
+	db.SetMaxOpenConns(1)
+	if err := storage.CreateTables(db); err != nil {
+		log.Fatalf("Unable to create tables in test DB: %v.", err)
 	}
 
 	lis, err := net.Listen("tcp", ":12345")
 	if err != nil {
 		log.Fatalf("Could not bind to port: %v.", err)
 	}
-	grpcServer := grpc.NewServer()
-	userCtlr := logic.NewUserController(storage.NewSQLDB(db))
-	msgCtlr := logic.NewMessageController(storage.NewSQLDB(db))
-	api.RegisterChatServer(grpcServer, api.NewChatServer(userCtlr, msgCtlr))
+	blobDir, err := os.MkdirTemp("", "attachments")
+	if err != nil {
+		log.Fatalf("Could not create directory for attachments: %v.", err)
+	}
+	defer os.RemoveAll(blobDir)
+	blobs, err := storage.NewFileBlobStore(blobDir)
+	if err != nil {
+		log.Fatalf("Could not create blob store: %v.", err)
+	}
+	userCtlr := logic.NewUserController(storage.NewSQLDB(db), logic.WithAccountBlobs(blobs), logic.WithAdmins("testuser1"))
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(api.AuthInterceptor(userCtlr)),
+		grpc.StreamInterceptor(api.AuthStreamInterceptor(userCtlr)))
+	msgCtlr := logic.NewMessageController(storage.NewSQLDB(db), logic.WithBlobStore(blobs))
+	chat := api.NewChatServer(userCtlr, msgCtlr, api.DefaultTrustedProxies)
+	api.RegisterChatServer(grpcServer, chat)
 	go grpcServer.Serve(lis)
 
 	conn, err := grpc.Dial(":12345", grpc.WithInsecure())
@@ -54,26 +120,115 @@ func main() {
 	if err != nil {
 		log.Fatalf("Could not create 2nd user account: %v.", err)
 	}
+	_, err = client.CreateUser(context.Background(), &api.CreateUserRequest{Username: "testuser3", Passphrase: "0123456789abcdef"})
+	if err != nil {
+		log.Fatalf("Could not create 3rd user account: %v.", err)
+	}
+	_, err = client.CreateUser(context.Background(), &api.CreateUserRequest{Username: "testuser3", Passphrase: "0123456789abcdef"})
+	if status.Code(err) != codes.AlreadyExists || errorReason(err) != "USER_EXISTS" {
+		log.Fatalf("Duplicate user account was not rejected as such: %v.", err)
+	}
+	_, err = client.CreateUser(context.Background(), &api.CreateUserRequest{Username: "testuser4", Passphrase: "0123456789"})
+	if status.Code(err) != codes.InvalidArgument || errorReason(err) != "WEAK_PASSPHRASE" {
+		log.Fatalf("Weak passphrase was not rejected as such: %v.", err)
+	}
+	_, err = client.CreateUser(context.Background(), &api.CreateUserRequest{Username: "TestUser3", Passphrase: "0123456789abcdef"})
+	if status.Code(err) != codes.AlreadyExists || errorReason(err) != "USER_EXISTS" {
+		log.Printf("Username differing from another only in case was not rejected as such: %v.", err)
+	}
+	_, err = client.CreateUser(context.Background(), &api.CreateUserRequest{Username: "Admin", Passphrase: "my admin passphrase"})
+	if got, want := fieldViolations(err), "username is reserved; passphrase must not contain the username"; got != want {
+		log.Printf("Field violations mismatch: got %q, want %q.", got, want)
+	}
+	session, err := client.Login(context.Background(), &api.LoginRequest{Username: "testuser1", Passphrase: "0123456789abcdef"})
+	if err != nil {
+		log.Fatalf("Could not log in: %v.", err)
+	}
+	_, err = client.Login(context.Background(), &api.LoginRequest{Username: "testuser1", Passphrase: "0123456789abcdeF"})
+	if status.Code(err) != codes.Unauthenticated || errorReason(err) != "INVALID_CREDENTIALS" {
+		log.Fatalf("Login using wrong passphrase was not rejected as such: %v.", err)
+	}
+	refreshed, err := client.RefreshSession(context.Background(), &api.RefreshSessionRequest{Token: session.Token})
+	if err != nil {
+		log.Fatalf("Could not refresh session: %v.", err)
+	}
+	if _, err := client.RefreshSession(context.Background(), &api.RefreshSessionRequest{Token: session.Token}); err == nil {
+		log.Fatalf("Managed to refresh a session token that was already replaced!")
+	}
+	if _, err := client.Logout(context.Background(), &api.LogoutRequest{Token: refreshed.Token}); err != nil {
+		log.Fatalf("Could not log out: %v.", err)
+	}
+	session1, err := client.Login(context.Background(), &api.LoginRequest{Username: "testuser1", Passphrase: "0123456789abcdef"})
+	if err != nil {
+		log.Fatalf("Could not log in: %v.", err)
+	}
+	session2, err := client.Login(context.Background(), &api.LoginRequest{Username: "testuser2", Passphrase: "0123456789abcdef"})
+	if err != nil {
+		log.Fatalf("Could not log in as 2nd user: %v.", err)
+	}
+	session3, err := client.Login(context.Background(), &api.LoginRequest{Username: "testuser3", Passphrase: "0123456789abcdef"})
+	if err != nil {
+		log.Fatalf("Could not log in as 3rd user: %v.", err)
+	}
+	ctx1, ctx2 := withToken(session1.Token), withToken(session2.Token)
 	_, err = client.SendMessage(context.Background(),
+		&api.SendMessageRequest{Sender: "testuser1", Recipient: "testuser2", Content: "Anyone there?"})
+	if status.Code(err) != codes.Unauthenticated {
+		log.Fatalf("Unauthenticated message send was not rejected: %v.", err)
+	}
+	_, err = client.SendMessage(withToken(refreshed.Token),
+		&api.SendMessageRequest{Sender: "testuser1", Recipient: "testuser2", Content: "Anyone there?"})
+	if status.Code(err) != codes.Unauthenticated {
+		log.Fatalf("Message send using a logged out session was not rejected: %v.", err)
+	}
+	_, err = client.SendMessage(ctx2,
+		&api.SendMessageRequest{Sender: "testuser1", Recipient: "testuser2", Content: "I am testuser1, honest."})
+	if status.Code(err) != codes.PermissionDenied {
+		log.Fatalf("Message sent on behalf of another user was not rejected: %v.", err)
+	}
+	_, err = client.SendMessage(ctx1,
+		&api.SendMessageRequest{Sender: "testuser1", Recipient: "nobody", Content: "Anyone there?"})
+	if status.Code(err) != codes.NotFound || errorReason(err) != "RECIPIENT_UNKNOWN" {
+		log.Fatalf("Message to a nonexistent user was not rejected as such: %v.", err)
+	}
+	_, err = client.SendMessage(ctx1,
 		&api.SendMessageRequest{Sender: "testuser1", Recipient: "testuser2", Content: "How's it going?"})
 	if err != nil {
 		log.Fatalf("Could not send a message: %v.", err)
 	}
-	_, err = client.SendMessage(context.Background(),
+	_, err = client.SendMessage(ctx2,
 		&api.SendMessageRequest{Sender: "testuser2", Recipient: "testuser1", Content: "Can't complain. You?"})
 	if err != nil {
 		log.Fatalf("Could not send 2nd message: %v.", err)
 	}
-	_, err = client.SendMessage(context.Background(), &api.SendMessageRequest{
-		Sender:    "testuser1",
-		Recipient: "testuser2",
-		Content:   "https://www.youtube.com/watch?v=9bZkp7q19f0",
-	})
+	video := &api.SendMessageRequest{
+		Sender:         "testuser1",
+		Recipient:      "testuser2",
+		Content:        "https://www.youtube.com/watch?v=9bZkp7q19f0",
+		IdempotencyKey: "video-1",
+	}
+	sent, err := client.SendMessage(ctx1, video)
 	if err != nil {
 		log.Fatalf("Could not send 3rd message: %v.", err)
 	}
+	if got, want := sent.Metadata.GetVideo().GetSource(), api.Video_YOUTUBE; got != want {
+		log.Printf("Sent message metadata mismatch for video source: got %v, want %v.", got, want)
+	}
+	// Retrying the send must not store a duplicate.
+	resent, err := client.SendMessage(ctx1, video)
+	if err != nil {
+		log.Fatalf("Could not retry sending 3rd message: %v.", err)
+	}
+	if got, want := resent.MessageId, sent.MessageId; got != want {
+		log.Printf("Retried message ID mismatch: got %v, want %v.", got, want)
+	}
+	// Make sure outsiders cannot read the conversation.
+	_, err = client.FetchMessages(withToken(session3.Token), &api.FetchMessagesRequest{User1: "testuser1", User2: "testuser2"})
+	if status.Code(err) != codes.PermissionDenied {
+		log.Fatalf("Fetching someone else's conversation was not rejected: %v.", err)
+	}
 	// Fetch the most recent 2 messages in the conversation.
-	conversation, err := client.FetchMessages(context.Background(),
+	conversation, err := client.FetchMessages(ctx1,
 		&api.FetchMessagesRequest{User1: "testuser1", User2: "testuser2", Limit: 2})
 	if err != nil {
 		log.Fatalf("Could not fetch messages: %v.", err)
@@ -90,11 +245,17 @@ func main() {
 	if got, want := conversation.Messages[0].Metadata.GetVideo().Source, api.Video_YOUTUBE; got != want {
 		log.Printf("Message metadata mismatch for video source: got %v, want %v.", got, want)
 	}
+	if entities := conversation.Messages[0].Entities; len(entities) != 1 || entities[0].Kind != api.Entity_URL {
+		log.Printf("Message entities mismatch: got %v, want 1 URL.", entities)
+	}
 	if got, want := conversation.Messages[1].Content, "Can't complain. You?"; got != want {
 		log.Printf("Message content mismatch: got %v, want %v.", got, want)
 	}
+	if conversation.Messages[1].Metadata.GetMedia() != nil {
+		log.Printf("Message without a link has media metadata: got %v.", conversation.Messages[1].Metadata)
+	}
 	// Now fetch the rest of the conversation.
-	conversation, err = client.FetchMessages(context.Background(),
+	conversation, err = client.FetchMessages(ctx2,
 		&api.FetchMessagesRequest{User1: "testuser1", User2: "testuser2", ContinuationToken: conversation.ContinuationToken})
 	if err != nil {
 		log.Fatalf("Could not fetch messages: %v.", err)
@@ -108,4 +269,606 @@ func main() {
 	if got, want := conversation.Messages[0].Content, "How's it going?"; got != want {
 		log.Printf("Message content mismatch: got %v, want %v.", got, want)
 	}
+	// Subscribe as the recipient, resuming after the first message so that the ones sent since are replayed.
+	subCtx, cancel := context.WithCancel(ctx2)
+	defer cancel()
+	stream, err := client.SubscribeMessages(subCtx, &api.SubscribeMessagesRequest{ResumeAfter: conversation.Messages[0].Id})
+	if err != nil {
+		log.Fatalf("Could not subscribe to messages: %v.", err)
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		log.Fatalf("Could not receive missed message: %v.", err)
+	}
+	if got, want := msg.Content, "https://www.youtube.com/watch?v=9bZkp7q19f0"; got != want {
+		log.Printf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	_, err = client.SendMessage(ctx1,
+		&api.SendMessageRequest{Sender: "testuser1", Recipient: "testuser2", Content: "Still there?"})
+	if err != nil {
+		log.Fatalf("Could not send 4th message: %v.", err)
+	}
+	msg, err = stream.Recv()
+	if err != nil {
+		log.Fatalf("Could not receive new message: %v.", err)
+	}
+	if got, want := msg.Content, "Still there?"; got != want {
+		log.Printf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	// Start a group conversation & bring the 3rd user in later.
+	group, err := client.CreateConversation(ctx1, &api.CreateConversationRequest{Title: "Testers", Members: []string{"testuser2"}})
+	if err != nil {
+		log.Fatalf("Could not create a group conversation: %v.", err)
+	}
+	ctx3 := withToken(session3.Token)
+	_, err = client.SendMessage(ctx3, &api.SendMessageRequest{ConversationId: group.ConversationId, Content: "Can I join?"})
+	if status.Code(err) != codes.PermissionDenied {
+		log.Fatalf("Message sent to a group by a non-member was not rejected: %v.", err)
+	}
+	if _, err := client.AddMember(ctx2, &api.AddMemberRequest{ConversationId: group.ConversationId, Username: "testuser3"}); err != nil {
+		log.Fatalf("Could not add a member to the group conversation: %v.", err)
+	}
+	_, err = client.SendMessage(ctx3, &api.SendMessageRequest{ConversationId: group.ConversationId, Content: "Thanks!"})
+	if err != nil {
+		log.Fatalf("Could not send a message to the group conversation: %v.", err)
+	}
+	msg, err = stream.Recv()
+	if err != nil {
+		log.Fatalf("Could not receive new group message: %v.", err)
+	}
+	if got, want := msg.ConversationId, group.ConversationId; got != want {
+		log.Printf("Message conversation mismatch: got %v, want %v.", got, want)
+	}
+	members, err := client.ListMembers(ctx1, &api.ListMembersRequest{ConversationId: group.ConversationId})
+	if err != nil {
+		log.Fatalf("Could not list members of the group conversation: %v.", err)
+	}
+	if got, want := len(members.Usernames), 3; got != want {
+		log.Printf("Group conversation has wrong number of members: got %v, want %v.", got, want)
+	}
+	conversation, err = client.FetchMessages(ctx1, &api.FetchMessagesRequest{ConversationId: group.ConversationId})
+	if err != nil {
+		log.Fatalf("Could not fetch group messages: %v.", err)
+	}
+	if got, want := len(conversation.Messages), 1; got != want {
+		log.Fatalf("Group conversation has wrong number of messages: got %v, want %v.", got, want)
+	}
+	if got, want := conversation.Messages[0].Author, "testuser3"; got != want {
+		log.Printf("Message author mismatch: got %v, want %v.", got, want)
+	}
+	inbox, err := client.ListConversations(ctx2, &api.ListConversationsRequest{})
+	if err != nil {
+		log.Fatalf("Could not list conversations: %v.", err)
+	}
+	if got, want := len(inbox.Conversations), 2; got != want {
+		log.Fatalf("Inbox has wrong number of conversations: got %v, want %v.", got, want)
+	}
+	if got, want := inbox.Conversations[0].ConversationId, group.ConversationId; got != want {
+		log.Printf("Most recently active conversation mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := inbox.Conversations[1].Peer, "testuser1"; got != want {
+		log.Printf("Conversation peer mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := inbox.Conversations[1].UnreadCount, uint32(2); got != want {
+		log.Printf("Unread count mismatch: got %v, want %v.", got, want)
+	}
+	latest := inbox.Conversations[1].LastMessage
+	_, err = client.MarkRead(ctx2, &api.MarkReadRequest{ConversationId: latest.ConversationId, UpToMessageId: latest.Id})
+	if err != nil {
+		log.Fatalf("Could not mark conversation as read: %v.", err)
+	}
+	_, err = client.MarkRead(ctx3, &api.MarkReadRequest{ConversationId: latest.ConversationId, UpToMessageId: latest.Id})
+	if status.Code(err) != codes.PermissionDenied {
+		log.Fatalf("Marking someone else's conversation as read was not rejected: %v.", err)
+	}
+	conversation, err = client.FetchMessages(ctx1, &api.FetchMessagesRequest{User1: "testuser1", User2: "testuser2", Limit: 1})
+	if err != nil {
+		log.Fatalf("Could not fetch messages: %v.", err)
+	}
+	if got, want := len(conversation.ReadPositions), 2; got != want {
+		log.Fatalf("Wrong number of read positions: got %v, want %v.", got, want)
+	}
+	if got, want := conversation.ReadPositions[1].MessageId, latest.Id; got != want {
+		log.Printf("Read position mismatch: got %v, want %v.", got, want)
+	}
+	// Sync the whole 1:1 conversation forwards in batches of 2.
+	var synced []*api.Message
+	for syncToken := int64(0); ; {
+		batch, err := client.FetchMessages(ctx2, &api.FetchMessagesRequest{
+			User1: "testuser2", User2: "testuser1", Direction: api.FetchMessagesRequest_FORWARD, SyncToken: syncToken, Limit: 2,
+		})
+		if err != nil {
+			log.Fatalf("Could not sync messages: %v.", err)
+		}
+		synced = append(synced, batch.Messages...)
+		if len(batch.Messages) < 2 {
+			break
+		}
+		syncToken = batch.SyncToken
+	}
+	if got, want := len(synced), 4; got != want {
+		log.Fatalf("Wrong number of messages synced: got %v, want %v.", got, want)
+	}
+	if got, want := synced[0].Content, "How's it going?"; got != want {
+		log.Printf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	// Correct the first message & check that its history is kept.
+	_, err = client.EditMessage(ctx2, &api.EditMessageRequest{MessageId: synced[0].Id, Content: "Hijacked!"})
+	if status.Code(err) != codes.PermissionDenied {
+		log.Fatalf("Editing someone else's message was not rejected: %v.", err)
+	}
+	edited, err := client.EditMessage(ctx1, &api.EditMessageRequest{MessageId: synced[0].Id, Content: "How's it going, pal?"})
+	if err != nil {
+		log.Fatalf("Could not edit a message: %v.", err)
+	}
+	if got, want := edited.Message.RevisionCount, uint32(1); got != want {
+		log.Printf("Revision count mismatch: got %v, want %v.", got, want)
+	}
+	if edited.Message.EditedAt == 0 {
+		log.Printf("Edited message has no edit timestamp.")
+	}
+	_, err = client.FetchMessageRevisions(withToken(session3.Token), &api.FetchMessageRevisionsRequest{MessageId: synced[0].Id})
+	if status.Code(err) != codes.PermissionDenied {
+		log.Fatalf("Fetching revisions of someone else's message was not rejected: %v.", err)
+	}
+	history, err := client.FetchMessageRevisions(ctx2, &api.FetchMessageRevisionsRequest{MessageId: synced[0].Id})
+	if err != nil {
+		log.Fatalf("Could not fetch message revisions: %v.", err)
+	}
+	if got, want := len(history.Revisions), 2; got != want {
+		log.Fatalf("Wrong number of revisions: got %v, want %v.", got, want)
+	}
+	if got, want := history.Revisions[0].Content, "How's it going?"; got != want {
+		log.Printf("Revision content mismatch: got %v, want %v.", got, want)
+	}
+	// Delete the video for everyone, and the 2nd message for its author only.
+	_, err = client.DeleteMessage(ctx2, &api.DeleteMessageRequest{MessageId: synced[2].Id, Scope: api.DeleteMessageRequest_FOR_EVERYONE})
+	if status.Code(err) != codes.PermissionDenied {
+		log.Fatalf("Deleting someone else's message for everyone was not rejected: %v.", err)
+	}
+	_, err = client.DeleteMessage(withToken(session3.Token), &api.DeleteMessageRequest{MessageId: synced[1].Id})
+	if status.Code(err) != codes.PermissionDenied {
+		log.Fatalf("Deleting a message from someone else's conversation was not rejected: %v.", err)
+	}
+	_, err = client.DeleteMessage(ctx1, &api.DeleteMessageRequest{MessageId: synced[2].Id, Scope: api.DeleteMessageRequest_FOR_EVERYONE})
+	if err != nil {
+		log.Fatalf("Could not delete a message for everyone: %v.", err)
+	}
+	_, err = client.DeleteMessage(ctx2, &api.DeleteMessageRequest{MessageId: synced[1].Id})
+	if err != nil {
+		log.Fatalf("Could not delete a message for oneself: %v.", err)
+	}
+	for _, viewer := range []struct {
+		ctx  context.Context
+		want int
+	}{{ctx1, 4}, {ctx2, 3}} {
+		conversation, err = client.FetchMessages(viewer.ctx, &api.FetchMessagesRequest{User1: "testuser1", User2: "testuser2"})
+		if err != nil {
+			log.Fatalf("Could not fetch messages: %v.", err)
+		}
+		if got, want := len(conversation.Messages), viewer.want; got != want {
+			log.Fatalf("Conversation has wrong number of messages: got %v, want %v.", got, want)
+		}
+		if tombstone := conversation.Messages[1]; !tombstone.Deleted || tombstone.Content != "" {
+			log.Printf("Tombstone mismatch: got %v.", tombstone)
+		}
+	}
+	// Search for the edited message, which only its conversation's members can see.
+	found, err := client.SearchMessages(ctx2, &api.SearchMessagesRequest{Query: "pal"})
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		log.Printf("Skipping search, which requires building with -tags sqlite_fts5.")
+	case err != nil:
+		log.Fatalf("Could not search messages: %v.", err)
+	default:
+		if got, want := len(found.Results), 1; got != want {
+			log.Fatalf("Wrong number of search results: got %v, want %v.", got, want)
+		}
+		if got, want := found.Results[0].Message.Id, synced[0].Id; got != want {
+			log.Printf("Search result mismatch: got message %v, want %v.", got, want)
+		}
+		found, err = client.SearchMessages(withToken(session3.Token), &api.SearchMessagesRequest{Query: "pal"})
+		if err != nil {
+			log.Fatalf("Could not search messages: %v.", err)
+		}
+		if got, want := len(found.Results), 0; got != want {
+			log.Printf("Search results from someone else's conversation: got %v, want %v.", got, want)
+		}
+	}
+	// Send a photo, uploading it in 2 chunks.
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 4, 3))); err != nil {
+		log.Fatalf("Could not encode photo: %v.", err)
+	}
+	upload, err := client.UploadAttachment(ctx1)
+	if err != nil {
+		log.Fatalf("Could not start uploading attachment: %v.", err)
+	}
+	half := photo.Len() / 2
+	for _, req := range []*api.UploadAttachmentRequest{
+		{Filename: "photo.png", Chunk: photo.Bytes()[:half]},
+		{Chunk: photo.Bytes()[half:]},
+	} {
+		if err := upload.Send(req); err != nil {
+			log.Fatalf("Could not upload attachment: %v.", err)
+		}
+	}
+	uploaded, err := upload.CloseAndRecv()
+	if err != nil {
+		log.Fatalf("Could not upload attachment: %v.", err)
+	}
+	attachment := uploaded.Attachment
+	if got, want := attachment.ContentType, "image/png"; got != want {
+		log.Printf("Attachment content type mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := attachment.Size, uint64(photo.Len()); got != want {
+		log.Printf("Attachment size mismatch: got %v, want %v.", got, want)
+	}
+	if digest := sha256.Sum256(photo.Bytes()); attachment.Sha256 != hex.EncodeToString(digest[:]) {
+		log.Printf("Attachment digest mismatch: got %v, want %x.", attachment.Sha256, digest)
+	}
+	if attachment.Image.GetWidth() != 4 || attachment.Image.GetHeight() != 3 {
+		log.Printf("Attachment dimensions mismatch: got %v, want 4x3.", attachment.Image)
+	}
+	withPhoto := &api.SendMessageRequest{Recipient: "testuser2", Content: "Look!", AttachmentIds: []int64{attachment.Id}}
+	sent, err = client.SendMessage(ctx1, withPhoto)
+	if err != nil {
+		log.Fatalf("Could not send a message with an attachment: %v.", err)
+	}
+	if attachments := sent.Metadata.GetAttachments(); len(attachments) != 1 || attachments[0].Id != attachment.Id {
+		log.Printf("Sent message attachments mismatch: got %v, want attachment %v.", attachments, attachment.Id)
+	}
+	_, err = client.SendMessage(ctx1, withPhoto)
+	if status.Code(err) != codes.FailedPrecondition || errorReason(err) != "ATTACHMENT_UNAVAILABLE" {
+		log.Fatalf("Sending an attachment twice was not rejected as such: %v.", err)
+	}
+	// Only members of the conversation may download it.
+	if _, err := downloadAttachment(client, ctx3, attachment.Id); status.Code(err) != codes.PermissionDenied {
+		log.Fatalf("Downloading an attachment from someone else's conversation was not rejected: %v.", err)
+	}
+	downloaded, err := downloadAttachment(client, ctx2, attachment.Id)
+	if err != nil {
+		log.Fatalf("Could not download attachment: %v.", err)
+	}
+	if !bytes.Equal(downloaded, photo.Bytes()) {
+		log.Printf("Downloaded attachment mismatch: got %d bytes, want %d.", len(downloaded), photo.Len())
+	}
+	// Repeat some of the above over HTTP/JSON.
+	gateway, err := api.NewGateway(conn, api.DefaultTrustedProxies)
+	if err != nil {
+		log.Fatalf("Could not create gateway: %v.", err)
+	}
+	httpServer := httptest.NewServer(gateway)
+	defer httpServer.Close()
+	resp, err := http.Get(httpServer.URL + api.GatewayPrefix + "openapi.json")
+	if err != nil {
+		log.Fatalf("Could not fetch OpenAPI document: %v.", err)
+	}
+	var doc struct {
+		Paths map[string]interface{}
+	}
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	resp.Body.Close()
+	if err != nil {
+		log.Fatalf("Could not parse OpenAPI document: %v.", err)
+	}
+	if _, ok := doc.Paths[api.GatewayPrefix+"SendMessage"]; !ok {
+		log.Printf("OpenAPI document is missing SendMessage: got paths %v.", doc.Paths)
+	}
+	code, body := postJSON(httpServer.URL+api.GatewayPrefix+"CreateUser", "", `{"username": "testuser1", "passphrase": "0123456789abcdef"}`)
+	if code != http.StatusConflict || !strings.Contains(body, "USER_EXISTS") {
+		log.Fatalf("Duplicate user account was not rejected over HTTP: got %v %v.", code, body)
+	}
+	code, body = postJSON(httpServer.URL+api.GatewayPrefix+"Login", "", `{"username": "testuser3", "passphrase": "0123456789abcdef"}`)
+	var login struct{ Token string }
+	if err := json.Unmarshal([]byte(body), &login); code != http.StatusOK || err != nil {
+		log.Fatalf("Could not log in over HTTP: got %v %v.", code, body)
+	}
+	code, body = postJSON(httpServer.URL+api.GatewayPrefix+"SendMessage", "",
+		`{"sender": "testuser3", "recipient": "testuser1", "content": "Anyone there?"}`)
+	if code != http.StatusUnauthorized {
+		log.Fatalf("Unauthenticated message send over HTTP was not rejected: got %v %v.", code, body)
+	}
+	code, body = postJSON(httpServer.URL+api.GatewayPrefix+"SendMessage", login.Token,
+		`{"sender": "testuser3", "recipient": "testuser1", "content": "Hello over HTTP!"}`)
+	var sentOverHTTP struct{ MessageId string }
+	if err := json.Unmarshal([]byte(body), &sentOverHTTP); code != http.StatusOK || err != nil {
+		log.Fatalf("Could not send a message over HTTP: got %v %v.", code, body)
+	}
+	id, err := strconv.ParseInt(sentOverHTTP.MessageId, 10, 64)
+	if err != nil {
+		log.Fatalf("Could not parse message ID sent over HTTP: %v.", err)
+	}
+	// Replay it to its recipient via a streaming RPC.
+	req, err := http.NewRequest(http.MethodPost, httpServer.URL+api.GatewayPrefix+"SubscribeMessages",
+		strings.NewReader(fmt.Sprintf(`{"resumeAfter": "%d"}`, id-1)))
+	if err != nil {
+		log.Fatalf("Could not create HTTP request: %v.", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+session1.Token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Could not subscribe to messages over HTTP: %v.", err)
+	}
+	var line struct {
+		Result struct{ Id, Content string }
+	}
+	err = json.NewDecoder(resp.Body).Decode(&line)
+	resp.Body.Close()
+	if err != nil {
+		log.Fatalf("Could not read streamed message over HTTP: %v.", err)
+	}
+	if got, want := line.Result.Id, sentOverHTTP.MessageId; got != want {
+		log.Printf("Streamed message ID mismatch: got %v, want %v.", got, want)
+	}
+	// Chat over WebSockets, as a browser would.
+	wsServer := httptest.NewServer(api.NewWebSocketHandler(chat, userCtlr))
+	defer wsServer.Close()
+	wsURL := "ws" + strings.TrimPrefix(wsServer.URL, "http")
+	bogus, frame := dialWebSocket(wsURL, "bogus")
+	if frame.Error == nil || frame.Error.Code != int(codes.Unauthenticated) {
+		log.Fatalf("WebSocket with a bogus token was not rejected: got %+v.", frame)
+	}
+	if _, _, err := bogus.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		log.Printf("WebSocket closure mismatch: got %v, want policy violation.", err)
+	}
+	bogus.Close()
+	ws1, frame := dialWebSocket(wsURL, session1.Token)
+	defer ws1.Close()
+	if got, want := frame.Authenticated, "testuser1"; got != want {
+		log.Fatalf("Could not authenticate WebSocket: got %+v, want %v.", frame, want)
+	}
+	ws3, frame := dialWebSocket(wsURL, session3.Token)
+	if got, want := frame.Authenticated, "testuser3"; got != want {
+		log.Fatalf("Could not authenticate WebSocket: got %+v, want %v.", frame, want)
+	}
+	if frame = readWebSocketFrame(ws3); frame.Presence == nil || frame.Presence.Username != "testuser1" || !frame.Presence.Online {
+		log.Printf("Presence of contact mismatch: got %+v, want testuser1 online.", frame)
+	}
+	if frame = readWebSocketFrame(ws1); frame.Presence == nil || frame.Presence.Username != "testuser3" || !frame.Presence.Online {
+		log.Printf("Presence announcement mismatch: got %+v, want testuser3 online.", frame)
+	}
+	writeWebSocketFrame(ws3, `{"id": "1", "sendMessage": {"recipient": "testuser1", "content": "Hello over WebSocket!"}}`)
+	frame = readWebSocketFrame(ws3)
+	if frame.Id != "1" || frame.MessageSent == nil {
+		log.Fatalf("Could not send a message over WebSocket: got %+v.", frame)
+	}
+	sentOverWebSocket := frame.MessageSent
+	if frame = readWebSocketFrame(ws1); frame.Message == nil || frame.Message.Id != sentOverWebSocket.MessageId {
+		log.Printf("Pushed message mismatch: got %+v, want message %v.", frame, sentOverWebSocket.MessageId)
+	}
+	writeWebSocketFrame(ws3, fmt.Sprintf(`{"id": "2", "typing": {"conversationId": "%s"}}`, sentOverWebSocket.ConversationId))
+	if frame = readWebSocketFrame(ws1); frame.Typing == nil || frame.Typing.Username != "testuser3" {
+		log.Printf("Typing notification mismatch: got %+v, want testuser3 typing.", frame)
+	}
+	ws3.Close()
+	if frame = readWebSocketFrame(ws1); frame.Presence == nil || frame.Presence.Username != "testuser3" || frame.Presence.Online {
+		log.Printf("Presence announcement mismatch: got %+v, want testuser3 offline.", frame)
+	}
+	// A WebSocket stops working once its session ends.
+	temporary, err := client.Login(context.Background(), &api.LoginRequest{Username: "testuser3", Passphrase: "0123456789abcdef"})
+	if err != nil {
+		log.Fatalf("Could not log in as 3rd user: %v.", err)
+	}
+	ws3, _ = dialWebSocket(wsURL, temporary.Token)
+	// Skip the presence of testuser1.
+	readWebSocketFrame(ws3)
+	if _, err := client.Logout(context.Background(), &api.LogoutRequest{Token: temporary.Token}); err != nil {
+		log.Fatalf("Could not log out: %v.", err)
+	}
+	writeWebSocketFrame(ws3, `{"id": "3", "sendMessage": {"recipient": "testuser1", "content": "Am I still here?"}}`)
+	if frame = readWebSocketFrame(ws3); frame.Id != "3" || frame.Error == nil || frame.Error.Code != int(codes.Unauthenticated) {
+		log.Printf("Message sent over WebSocket after logging out was not rejected: got %+v.", frame)
+	}
+	if _, _, err := ws3.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		log.Printf("WebSocket closure mismatch: got %v, want policy violation.", err)
+	}
+	ws3.Close()
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://elsewhere.example"}}); err == nil {
+		log.Printf("WebSocket opened from another origin was not refused.")
+	}
+
+	// Manage an account from creation to deletion.
+	_, err = client.CreateUser(context.Background(), &api.CreateUserRequest{Username: "testuser4", Passphrase: "0123456789abcdef"})
+	if err != nil {
+		log.Fatalf("Could not create 4th user account: %v.", err)
+	}
+	session4, err := client.Login(context.Background(), &api.LoginRequest{Username: "testuser4", Passphrase: "0123456789abcdef"})
+	if err != nil {
+		log.Fatalf("Could not log in as 4th user: %v.", err)
+	}
+	_, err = client.ChangePassphrase(withToken(session4.Token), &api.ChangePassphraseRequest{OldPassphrase: "0123456789abcdeF", NewPassphrase: "fedcba9876543210"})
+	if status.Code(err) != codes.Unauthenticated || errorReason(err) != "INVALID_CREDENTIALS" {
+		log.Printf("Passphrase change with the wrong old passphrase was not rejected as such: %v.", err)
+	}
+	changed, err := client.ChangePassphrase(withToken(session4.Token), &api.ChangePassphraseRequest{OldPassphrase: "0123456789abcdef", NewPassphrase: "fedcba9876543210"})
+	if err != nil {
+		log.Fatalf("Could not change passphrase: %v.", err)
+	}
+	if _, err := client.ListConversations(withToken(session4.Token), &api.ListConversationsRequest{}); status.Code(err) != codes.Unauthenticated {
+		log.Printf("Session from before the passphrase change was not revoked: %v.", err)
+	}
+	ctx4 := withToken(changed.Token)
+	if _, err := client.RenameUser(ctx4, &api.RenameUserRequest{NewUsername: "testuser1"}); status.Code(err) != codes.AlreadyExists {
+		log.Printf("Rename to a taken username was not rejected as such: %v.", err)
+	}
+	if _, err := client.RenameUser(ctx4, &api.RenameUserRequest{NewUsername: "renamed4"}); err != nil {
+		log.Fatalf("Could not rename user: %v.", err)
+	}
+	sent, err = client.SendMessage(ctx4, &api.SendMessageRequest{Recipient: "testuser1", Content: "Guess who?"})
+	if err != nil {
+		log.Fatalf("Could not send message as renamed user: %v.", err)
+	}
+	fetched, err := client.FetchMessages(ctx1, &api.FetchMessagesRequest{ConversationId: sent.ConversationId, Limit: 1})
+	if err != nil {
+		log.Fatalf("Could not fetch message from renamed user: %v.", err)
+	}
+	if len(fetched.Messages) != 1 || fetched.Messages[0].Author != "renamed4" {
+		log.Printf("Author of message mismatch: got %v, want renamed4.", fetched.Messages)
+	}
+	if _, err := client.DeleteAccount(ctx4, &api.DeleteAccountRequest{Passphrase: "0123456789abcdef"}); status.Code(err) != codes.Unauthenticated {
+		log.Printf("Account deletion with the wrong passphrase was not rejected as such: %v.", err)
+	}
+	if _, err := client.DeleteAccount(ctx4, &api.DeleteAccountRequest{Passphrase: "fedcba9876543210"}); err != nil {
+		log.Fatalf("Could not delete account: %v.", err)
+	}
+	if _, err := client.FetchMessages(ctx1, &api.FetchMessagesRequest{ConversationId: sent.ConversationId}); status.Code(err) != codes.NotFound {
+		log.Printf("1:1 conversation with deleted user was not deleted: %v.", err)
+	}
+	if _, err := client.Login(context.Background(), &api.LoginRequest{Username: "renamed4", Passphrase: "fedcba9876543210"}); status.Code(err) != codes.Unauthenticated {
+		log.Printf("Login to deleted account was not rejected: %v.", err)
+	}
+
+	// Lock out a user by guessing at their passphrase, then have an administrator unlock them.
+	if _, err := client.CreateUser(context.Background(), &api.CreateUserRequest{Username: "testuser5", Passphrase: "0123456789abcdef"}); err != nil {
+		log.Fatalf("Could not create 5th user account: %v.", err)
+	}
+	for i := 0; i < 4; i++ {
+		_, err = client.Login(context.Background(), &api.LoginRequest{Username: "testuser5", Passphrase: fmt.Sprintf("guess%d", i)})
+		if status.Code(err) != codes.Unauthenticated {
+			log.Fatalf("Login using wrong passphrase was not rejected: %v.", err)
+		}
+	}
+	_, err = client.Login(context.Background(), &api.LoginRequest{Username: "testuser5", Passphrase: "0123456789abcdef"})
+	if status.Code(err) != codes.ResourceExhausted || errorReason(err) != "TOO_MANY_ATTEMPTS" {
+		log.Printf("Login after too many failures was not throttled: %v.", err)
+	}
+	if delay := retryDelay(err); delay <= 0 || delay > time.Second {
+		log.Printf("Retry delay mismatch: got %v, want up to 1s.", delay)
+	}
+	if _, err := client.UnlockAccount(ctx2, &api.UnlockAccountRequest{Username: "testuser5"}); status.Code(err) != codes.PermissionDenied {
+		log.Printf("Unlock by a user who isn't an administrator was not rejected: %v.", err)
+	}
+	if _, err := client.UnlockAccount(ctx1, &api.UnlockAccountRequest{Username: "testuser5"}); err != nil {
+		log.Fatalf("Could not unlock account: %v.", err)
+	}
+	if _, err := client.Login(context.Background(), &api.LoginRequest{Username: "testuser5", Passphrase: "0123456789abcdef"}); err != nil {
+		log.Printf("Login after unlocking mismatch: got %v, want success.", err)
+	}
+
+	// Enable two-factor authentication, log in with it & then disable it.
+	if _, err := client.CreateUser(context.Background(), &api.CreateUserRequest{Username: "testuser6", Passphrase: "0123456789abcdef"}); err != nil {
+		log.Fatalf("Could not create 6th user account: %v.", err)
+	}
+	session6, err := client.Login(context.Background(), &api.LoginRequest{Username: "testuser6", Passphrase: "0123456789abcdef"})
+	if err != nil {
+		log.Fatalf("Could not log in as 6th user: %v.", err)
+	}
+	ctx6 := withToken(session6.Token)
+	if _, err := client.EnrollTOTP(ctx6, &api.EnrollTOTPRequest{Passphrase: "0123456789abcde!"}); errorReason(err) != "INVALID_CREDENTIALS" {
+		log.Printf("Enrollment with the wrong passphrase was not rejected: %v.", err)
+	}
+	enrolled, err := client.EnrollTOTP(ctx6, &api.EnrollTOTPRequest{Passphrase: "0123456789abcdef"})
+	if err != nil {
+		log.Fatalf("Could not enroll in two-factor authentication: %v.", err)
+	}
+	otpauth, err := url.Parse(enrolled.Uri)
+	if err != nil || otpauth.Scheme != "otpauth" || len(enrolled.RecoveryCodes) == 0 {
+		log.Fatalf("Enrollment mismatch: got %v with %d recovery codes.", enrolled.Uri, len(enrolled.RecoveryCodes))
+	}
+	totpCode, err := logic.TOTPCode(otpauth.Query().Get("secret"), time.Now())
+	if err != nil {
+		log.Fatalf("Could not generate TOTP code: %v.", err)
+	}
+	if _, err := client.ConfirmTOTP(ctx6, &api.ConfirmTOTPRequest{Code: totpCode}); err != nil {
+		log.Fatalf("Could not confirm two-factor authentication: %v.", err)
+	}
+	_, err = client.Login(context.Background(), &api.LoginRequest{Username: "testuser6", Passphrase: "0123456789abcdef"})
+	if status.Code(err) != codes.Unauthenticated || errorReason(err) != "TOTP_REQUIRED" {
+		log.Printf("Login without a TOTP code was not rejected as such: %v.", err)
+	}
+	_, err = client.Login(context.Background(), &api.LoginRequest{Username: "testuser6", Passphrase: "0123456789abcdef", TotpCode: totpCode})
+	if status.Code(err) != codes.Unauthenticated || errorReason(err) != "INVALID_TOTP_CODE" {
+		log.Printf("Login with a TOTP code that was already used was not rejected as such: %v.", err)
+	}
+	if _, err := client.Login(context.Background(), &api.LoginRequest{Username: "testuser6", Passphrase: "0123456789abcdef", TotpCode: enrolled.RecoveryCodes[0]}); err != nil {
+		log.Fatalf("Could not log in with a recovery code: %v.", err)
+	}
+	if _, err := client.DisableTOTP(ctx6, &api.DisableTOTPRequest{Code: enrolled.RecoveryCodes[1]}); err != nil {
+		log.Fatalf("Could not disable two-factor authentication: %v.", err)
+	}
+	if _, err := client.Login(context.Background(), &api.LoginRequest{Username: "testuser6", Passphrase: "0123456789abcdef"}); err != nil {
+		log.Printf("Login after disabling two-factor authentication mismatch: got %v, want success.", err)
+	}
+}
+
+// downloadAttachment returns the content of an attachment.
+func downloadAttachment(client api.ChatClient, ctx context.Context, id int64) ([]byte, error) {
+	stream, err := client.DownloadAttachment(ctx, &api.DownloadAttachmentRequest{AttachmentId: id})
+	if err != nil {
+		return nil, err
+	}
+	var content []byte
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return content, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, resp.Chunk...)
+	}
+}
+
+// webSocketFrame is the JSON form of a ServerFrame, limited to the fields that are checked above.
+type webSocketFrame struct {
+	Id, Authenticated string
+	MessageSent       *struct{ MessageId, ConversationId string }
+	Message           *struct{ Id, Content string }
+	Typing            *struct{ ConversationId, Username string }
+	Presence          *struct {
+		Username string
+		Online   bool
+	}
+	Error *struct {
+		Code            int
+		Message, Reason string
+	}
+}
+
+// dialWebSocket opens a WebSocket, authenticates it with the specified session token & returns the server's response.
+func dialWebSocket(url, token string) (*websocket.Conn, webSocketFrame) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		log.Fatalf("Could not open WebSocket: %v.", err)
+	}
+	writeWebSocketFrame(conn, fmt.Sprintf(`{"authenticate": {"token": %q}}`, token))
+	return conn, readWebSocketFrame(conn)
+}
+
+func writeWebSocketFrame(conn *websocket.Conn, frame string) {
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		log.Fatalf("Could not send WebSocket frame: %v.", err)
+	}
+}
+
+func readWebSocketFrame(conn *websocket.Conn) webSocketFrame {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame webSocketFrame
+	if err := conn.ReadJSON(&frame); err != nil {
+		log.Fatalf("Could not read WebSocket frame: %v.", err)
+	}
+	return frame
+}
+
+// postJSON invokes an RPC via the HTTP/JSON gateway, returning the HTTP status & response body.
+func postJSON(url, token, body string) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		log.Fatalf("Could not create HTTP request: %v.", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Could not send HTTP request: %v.", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatalf("Could not read HTTP response: %v.", err)
+	}
+	return resp.StatusCode, string(data)
 }
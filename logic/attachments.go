@@ -0,0 +1,197 @@
+package logic
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/adsouza/chat-backend/api"
+	"github.com/adsouza/chat-backend/storage"
+)
+
+// AttachmentStore is implemented by stores that can keep track of attachments. Not every store can, so the message
+// controller checks for it at runtime.
+type AttachmentStore interface {
+	AddAttachment(attachment storage.Attachment) (storage.Attachment, error)
+	FetchAttachment(id int64) (storage.Attachment, error)
+}
+
+// MaxAttachmentBytes bounds the size of the content of an attachment.
+const MaxAttachmentBytes = 25 << 20
+
+// WithBlobStore enables attachments, keeping their content in the specified store.
+func WithBlobStore(blobs storage.BlobStore) MessageOption {
+	return func(c *msgController) {
+		c.blobs = blobs
+	}
+}
+
+// attachmentStore returns the store of attachments, or ErrAttachmentsUnavailable if they aren't enabled.
+func (c *msgController) attachmentStore() (AttachmentStore, error) {
+	store, ok := c.db.(AttachmentStore)
+	if !ok || c.blobs == nil {
+		return nil, ErrAttachmentsUnavailable
+	}
+	return store, nil
+}
+
+// sizeLimiter counts the bytes read through it & fails once there are too many of them.
+type sizeLimiter struct {
+	r io.Reader
+	n int64
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > MaxAttachmentBytes {
+		return n, fmt.Errorf("%w: limit is %d bytes", ErrAttachmentTooLarge, MaxAttachmentBytes)
+	}
+	return n, err
+}
+
+// UploadAttachment stores content as an attachment that its owner can then send in a message. The content type is
+// detected from the content unless specified, & the dimensions of images are recorded.
+func (c *msgController) UploadAttachment(owner, filename, contentType string, content io.Reader) (storage.Attachment, error) {
+	store, err := c.attachmentStore()
+	if err != nil {
+		return storage.Attachment{}, err
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return storage.Attachment{}, fmt.Errorf("unable to generate blob key: %v", err)
+	}
+	attachment := storage.Attachment{Owner: owner, BlobKey: hex.EncodeToString(key), ContentType: contentType}
+	// Only keep the last element of any path that the client sent, whatever its separators.
+	switch attachment.Filename = path.Base(strings.ReplaceAll(filename, "\\", "/")); attachment.Filename {
+	case ".", "..", "/":
+		attachment.Filename = "upload"
+	}
+	buffered := bufio.NewReader(content)
+	// DetectContentType considers at most the first 512 bytes. Any failure to read them will recur below.
+	head, _ := buffered.Peek(512)
+	detected := http.DetectContentType(head)
+	if attachment.ContentType == "" {
+		attachment.ContentType = detected
+	}
+	limiter := &sizeLimiter{r: buffered}
+	digest := sha256.New()
+	if err := c.blobs.Put(attachment.BlobKey, io.TeeReader(limiter, digest)); err != nil {
+		c.blobs.Delete(attachment.BlobKey)
+		return storage.Attachment{}, err
+	}
+	attachment.Size, attachment.SHA256 = limiter.n, hex.EncodeToString(digest.Sum(nil))
+	if strings.HasPrefix(detected, "image/") {
+		attachment.Width, attachment.Height = c.imageSize(attachment.BlobKey)
+	}
+	added, err := store.AddAttachment(attachment)
+	if err != nil {
+		c.blobs.Delete(attachment.BlobKey)
+		return storage.Attachment{}, err
+	}
+	return added, nil
+}
+
+// imageSize returns the dimensions of the image stored under key, or zeros if it can't be decoded.
+func (c *msgController) imageSize(key string) (uint32, uint32) {
+	r, err := c.blobs.Get(key)
+	if err != nil {
+		return 0, 0
+	}
+	defer r.Close()
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return 0, 0
+	}
+	return uint32(config.Width), uint32(config.Height)
+}
+
+// OpenAttachment returns an attachment along with its content, which the caller must close. Until it is sent, only
+// its owner may open it, after which only members of the conversation it was sent to may do so.
+func (c *msgController) OpenAttachment(user string, id int64) (storage.Attachment, io.ReadCloser, error) {
+	store, err := c.attachmentStore()
+	if err != nil {
+		return storage.Attachment{}, nil, err
+	}
+	attachment, err := store.FetchAttachment(id)
+	if err != nil {
+		return storage.Attachment{}, nil, err
+	}
+	switch {
+	case attachment.Message != 0:
+		msg, err := c.db.FetchMessage(attachment.Message)
+		if err != nil {
+			return storage.Attachment{}, nil, err
+		}
+		if msg.Deleted {
+			return storage.Attachment{}, nil, fmt.Errorf("%w: attachment %d was sent in message %d", ErrMessageDeleted, id, msg.ID)
+		}
+		info, err := c.db.FetchConversation(msg.Conversation)
+		if err != nil {
+			return storage.Attachment{}, nil, err
+		}
+		if !contains(info.Members, user) {
+			return storage.Attachment{}, nil, fmt.Errorf("%w: %v is not a member of conversation %d", ErrNotMember, user, msg.Conversation)
+		}
+	case attachment.Owner != user:
+		// Don't reveal that other users' unsent attachments exist.
+		return storage.Attachment{}, nil, fmt.Errorf("%w: %d", storage.ErrAttachmentNotFound, id)
+	}
+	content, err := c.blobs.Get(attachment.BlobKey)
+	if err != nil {
+		return storage.Attachment{}, nil, err
+	}
+	return attachment, content, nil
+}
+
+// describeAttachments returns the metadata of the attachments that sender is about to send, each of which must be
+// theirs. Nor may they have been sent already, unless in the message that sender stored with the same idempotency key,
+// since a retry of that message returns the original instead of sending them again.
+func (c *msgController) describeAttachments(sender string, ids []int64, idempotencyKey string) ([]*api.Attachment, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	store, err := c.attachmentStore()
+	if err != nil {
+		return nil, err
+	}
+	var described []*api.Attachment
+	seen := make(map[int64]bool)
+	// original is the message sent with the same idempotency key, which is only looked up if need be.
+	var original *storage.Message
+	for _, id := range ids {
+		if seen[id] {
+			return nil, fmt.Errorf("%w: %d is listed more than once", storage.ErrAttachmentUnavailable, id)
+		}
+		seen[id] = true
+		attachment, err := store.FetchAttachment(id)
+		if err != nil {
+			return nil, err
+		}
+		if attachment.Owner != sender {
+			return nil, fmt.Errorf("%w: %d", storage.ErrAttachmentNotFound, id)
+		}
+		if attachment.Message != 0 {
+			if original == nil && idempotencyKey != "" {
+				msg, err := c.db.FetchMessageByIdempotencyKey(sender, idempotencyKey)
+				if err != nil && !errors.Is(err, storage.ErrMessageNotFound) {
+					return nil, err
+				}
+				original = &msg
+			}
+			if original == nil || original.ID != attachment.Message {
+				return nil, fmt.Errorf("%w: %d was already sent", storage.ErrAttachmentUnavailable, id)
+			}
+		}
+		described = append(described, api.AttachmentToProto(attachment))
+	}
+	return described, nil
+}
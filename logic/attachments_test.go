@@ -0,0 +1,215 @@
+package logic_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/adsouza/chat-backend/api"
+	"github.com/adsouza/chat-backend/logic"
+	"github.com/adsouza/chat-backend/storage"
+	"github.com/golang/protobuf/proto"
+)
+
+type mockAttachmentStore struct {
+	attachments []storage.Attachment
+}
+
+func (m *mockAttachmentStore) AddAttachment(attachment storage.Attachment) (storage.Attachment, error) {
+	attachment.ID = int64(len(m.attachments) + 1)
+	m.attachments = append(m.attachments, attachment)
+	return attachment, nil
+}
+
+func (m *mockAttachmentStore) FetchAttachment(id int64) (storage.Attachment, error) {
+	if id < 1 || id > int64(len(m.attachments)) {
+		return storage.Attachment{}, storage.ErrAttachmentNotFound
+	}
+	return m.attachments[id-1], nil
+}
+
+// attachable checks that each of the attachments belongs to owner & hasn't been sent yet.
+func (m *mockAttachmentStore) attachable(owner string, ids []int64) error {
+	for _, id := range ids {
+		if a, err := m.FetchAttachment(id); err != nil || a.Owner != owner || a.Message != 0 {
+			return storage.ErrAttachmentUnavailable
+		}
+	}
+	return nil
+}
+
+func (m *mockAttachmentStore) attach(message int64, ids []int64) {
+	for _, id := range ids {
+		m.attachments[id-1].Message = message
+	}
+}
+
+func TestAttachments(t *testing.T) {
+	blobs, err := storage.NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to create blob store: %v.", err)
+	}
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb, logic.WithBlobStore(blobs))
+	var photo bytes.Buffer
+	if err := png.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatalf("Unable to encode test image: %v.", err)
+	}
+	uploaded, err := msgCtlr.UploadAttachment("testuser1", `C:\Users\me\..\photo.png`, "", bytes.NewReader(photo.Bytes()))
+	if err != nil {
+		t.Fatalf("Unable to upload attachment: %v.", err)
+	}
+	digest := sha256.Sum256(photo.Bytes())
+	want := storage.Attachment{
+		ID:          uploaded.ID,
+		Owner:       "testuser1",
+		BlobKey:     uploaded.BlobKey,
+		Filename:    "photo.png",
+		ContentType: "image/png",
+		Size:        int64(photo.Len()),
+		SHA256:      hex.EncodeToString(digest[:]),
+		Width:       3,
+		Height:      2,
+	}
+	if uploaded != want {
+		t.Errorf("Uploaded attachment mismatch:\ngot  %+v\nwant %+v", uploaded, want)
+	}
+	notes, err := msgCtlr.UploadAttachment("testuser2", "notes.txt", "text/markdown", strings.NewReader("# Notes"))
+	if err != nil {
+		t.Fatalf("Unable to upload attachment: %v.", err)
+	}
+	if notes.ContentType != "text/markdown" || notes.Width != 0 || notes.Height != 0 {
+		t.Errorf("Uploaded attachment mismatch: got %+v, want specified content type & no dimensions.", notes)
+	}
+	if _, _, err := msgCtlr.OpenAttachment("testuser2", uploaded.ID); !errors.Is(err, storage.ErrAttachmentNotFound) {
+		t.Errorf("Opening someone else's unsent attachment: got error %v, want %v.", err, storage.ErrAttachmentNotFound)
+	}
+	conversation, err := msgCtlr.CreateConversation("testuser1", "Photos", []string{"testuser2"})
+	if err != nil {
+		t.Fatalf("Unable to create conversation: %v.", err)
+	}
+	if _, err := msgCtlr.SendToConversation("testuser1", conversation, "Mine!", "", notes.ID); !errors.Is(err, storage.ErrAttachmentNotFound) {
+		t.Errorf("Sending someone else's attachment: got error %v, want %v.", err, storage.ErrAttachmentNotFound)
+	}
+	msg, err := msgCtlr.SendToConversation("testuser1", conversation, "Look!", "", uploaded.ID)
+	if err != nil {
+		t.Fatalf("Unable to send message with attachment: %v.", err)
+	}
+	wantMetadata := &api.Metadata{Attachments: []*api.Attachment{{
+		Id:          uploaded.ID,
+		Filename:    "photo.png",
+		ContentType: "image/png",
+		Size:        uint64(photo.Len()),
+		Sha256:      hex.EncodeToString(digest[:]),
+		Image:       &api.Image{Width: 3, Height: 2},
+	}}}
+	checkMetadata := func(msg storage.Message) {
+		t.Helper()
+		got := &api.Metadata{}
+		if err := proto.Unmarshal(msg.Metadata, got); err != nil {
+			t.Fatalf("Unable to parse metadata: %v.", err)
+		}
+		if !proto.Equal(got, wantMetadata) {
+			t.Errorf("Metadata mismatch: got %v, want %v.", got, wantMetadata)
+		}
+	}
+	checkMetadata(msg)
+	if _, err := msgCtlr.SendToConversation("testuser1", conversation, "Again!", "", uploaded.ID); !errors.Is(err, storage.ErrAttachmentUnavailable) {
+		t.Errorf("Sending an attachment twice: got error %v, want %v.", err, storage.ErrAttachmentUnavailable)
+	}
+	keyed, err := msgCtlr.UploadAttachment("testuser1", "keyed.txt", "", strings.NewReader("Keyed"))
+	if err != nil {
+		t.Fatalf("Unable to upload attachment: %v.", err)
+	}
+	sent, err := msgCtlr.SendMessage("testuser1", "testuser2", "Here", "key1", keyed.ID)
+	if err != nil {
+		t.Fatalf("Unable to send message with attachment: %v.", err)
+	}
+	if retried, err := msgCtlr.SendMessage("testuser1", "testuser2", "Here", "key1", keyed.ID); err != nil || retried.ID != sent.ID {
+		t.Errorf("Retrying a message with an attachment: got %+v (%v), want message %d.", retried, err, sent.ID)
+	}
+	if _, err := msgCtlr.SendMessage("testuser1", "testuser2", "Here again", "key2", keyed.ID); !errors.Is(err, storage.ErrAttachmentUnavailable) {
+		t.Errorf("Sending an attachment twice with different idempotency keys: got error %v, want %v.", err, storage.ErrAttachmentUnavailable)
+	}
+	for _, user := range []string{"testuser1", "testuser2"} {
+		_, content, err := msgCtlr.OpenAttachment(user, uploaded.ID)
+		if err != nil {
+			t.Fatalf("Unable to open attachment as %v: %v.", user, err)
+		}
+		data, err := io.ReadAll(content)
+		content.Close()
+		if err != nil {
+			t.Fatalf("Unable to read attachment: %v.", err)
+		}
+		if !bytes.Equal(data, photo.Bytes()) {
+			t.Errorf("Attachment content mismatch: got %d bytes, want %d.", len(data), photo.Len())
+		}
+	}
+	if _, _, err := msgCtlr.OpenAttachment("testuser3", uploaded.ID); !errors.Is(err, logic.ErrNotMember) {
+		t.Errorf("Opening an attachment from someone else's conversation: got error %v, want %v.", err, logic.ErrNotMember)
+	}
+	edited, err := msgCtlr.EditMessage("testuser1", msg.ID, "Look at this!")
+	if err != nil {
+		t.Fatalf("Unable to edit message: %v.", err)
+	}
+	checkMetadata(edited)
+	if err := msgCtlr.DeleteMessage("testuser1", msg.ID); err != nil {
+		t.Fatalf("Unable to delete message: %v.", err)
+	}
+	if _, _, err := msgCtlr.OpenAttachment("testuser2", uploaded.ID); !errors.Is(err, logic.ErrMessageDeleted) {
+		t.Errorf("Opening an attachment of a deleted message: got error %v, want %v.", err, logic.ErrMessageDeleted)
+	}
+}
+
+func TestAttachmentTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	blobs, err := storage.NewFileBlobStore(dir)
+	if err != nil {
+		t.Fatalf("Unable to create blob store: %v.", err)
+	}
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb, logic.WithBlobStore(blobs))
+	content := io.LimitReader(zeros{}, logic.MaxAttachmentBytes+1)
+	if _, err := msgCtlr.UploadAttachment("testuser1", "huge.bin", "", content); !errors.Is(err, logic.ErrAttachmentTooLarge) {
+		t.Errorf("Uploading an oversized attachment: got error %v, want %v.", err, logic.ErrAttachmentTooLarge)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("Oversized attachment left blobs behind: %v, %v.", entries, err)
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestAttachmentsUnavailable(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	if _, err := msgCtlr.UploadAttachment("testuser1", "notes.txt", "", strings.NewReader("Notes")); !errors.Is(err, logic.ErrAttachmentsUnavailable) {
+		t.Errorf("Uploading without a blob store: got error %v, want %v.", err, logic.ErrAttachmentsUnavailable)
+	}
+	if _, err := msgCtlr.SendMessage("testuser1", "testuser2", "Look!", "", 1); !errors.Is(err, logic.ErrAttachmentsUnavailable) {
+		t.Errorf("Sending an attachment without a blob store: got error %v, want %v.", err, logic.ErrAttachmentsUnavailable)
+	}
+}
@@ -0,0 +1,88 @@
+package logic
+
+import (
+	"fmt"
+
+	"github.com/adsouza/chat-backend/storage"
+)
+
+type ConversationStore interface {
+	CreateConversation(title string, members []string) (int64, error)
+	FetchConversation(id int64) (storage.Conversation, error)
+	AddMember(conversation int64, username string) error
+	RemoveMember(conversation int64, username string) error
+	ReadContacts(user string) ([]string, error)
+	FindDirectConversation(user1, user2 string) (int64, error)
+}
+
+// CreateConversation starts a group conversation between the creator & the specified members.
+func (c *msgController) CreateConversation(creator, title string, members []string) (int64, error) {
+	participants := []string{creator}
+	seen := map[string]bool{creator: true}
+	for _, member := range members {
+		if member == "" {
+			return 0, ErrEmptyUsername
+		}
+		if !seen[member] {
+			seen[member] = true
+			participants = append(participants, member)
+		}
+	}
+	return c.db.CreateConversation(title, participants)
+}
+
+// FindDirectConversation returns the ID of the 1:1 conversation between viewer & peer, or 0 if they have yet to start one.
+func (c *msgController) FindDirectConversation(viewer, peer string) (int64, error) {
+	return c.db.FindDirectConversation(viewer, peer)
+}
+
+// AddMember adds a user to a group conversation. Any member may do so, which the caller must check.
+func (c *msgController) AddMember(conversation int64, username string) error {
+	info, err := c.db.FetchConversation(conversation)
+	if err != nil {
+		return err
+	}
+	if !info.Group {
+		return ErrDirectConversation
+	}
+	return c.db.AddMember(conversation, username)
+}
+
+// RemoveMember removes a member from a group conversation on behalf of remover, which only its owner may do, except
+// for members leaving it themselves.
+func (c *msgController) RemoveMember(remover string, conversation int64, username string) error {
+	info, err := c.db.FetchConversation(conversation)
+	if err != nil {
+		return err
+	}
+	if !info.Group {
+		return ErrDirectConversation
+	}
+	if remover != username && remover != info.Owner {
+		return fmt.Errorf("%w: %v does not own conversation %d", ErrNotOwner, remover, conversation)
+	}
+	return c.db.RemoveMember(conversation, username)
+}
+
+func (c *msgController) ListMembers(conversation int64) ([]string, error) {
+	info, err := c.db.FetchConversation(conversation)
+	if err != nil {
+		return nil, err
+	}
+	return info.Members, nil
+}
+
+// ListConversations returns a page of the user's inbox, most recently active conversations first.
+func (c *msgController) ListConversations(user string, limit uint32, before int64) ([]storage.ConversationSummary, int64, error) {
+	return c.db.ReadConversationSummaries(user, limit, before)
+}
+
+// MarkRead records that the user has read every message in the conversation up to & including the specified one.
+func (c *msgController) MarkRead(user string, conversation, message int64) error {
+	return c.db.UpdateReadCursor(conversation, user, message)
+}
+
+// ReadPositions returns the ID of the newest message each member of the conversation has read.
+func (c *msgController) ReadPositions(conversation int64) ([]storage.ReadCursor, error) {
+	return c.db.ReadCursors(conversation)
+}
@@ -0,0 +1,30 @@
+package logic
+
+import "github.com/adsouza/chat-backend/storage"
+
+// These errors are of the same type as those in the storage package, so the API can map both onto status codes alike.
+var (
+	ErrWeakPassphrase     = storage.NewError(storage.KindInvalid, "WEAK_PASSPHRASE", "passphrase does not meet the policy")
+	ErrInvalidCredentials = storage.NewError(storage.KindUnauthenticated, "INVALID_CREDENTIALS", "incorrect username or passphrase")
+	ErrSessionExpired     = storage.NewError(storage.KindUnauthenticated, "SESSION_EXPIRED", "session token has expired")
+	ErrEmptyUsername      = storage.NewError(storage.KindInvalid, "EMPTY_USERNAME", "usernames must not be empty")
+	ErrInvalidUsername    = storage.NewError(storage.KindInvalid, "INVALID_USERNAME", "username does not meet the policy")
+	ErrNotMember          = storage.NewError(storage.KindPermissionDenied, "NOT_MEMBER", "user is not a member of the conversation")
+	ErrNotAuthor          = storage.NewError(storage.KindPermissionDenied, "NOT_AUTHOR", "user is not the author of the message")
+	ErrNotOwner           = storage.NewError(storage.KindPermissionDenied, "NOT_OWNER", "user does not own the conversation")
+	ErrMessageDeleted     = storage.NewError(storage.KindFailedPrecondition, "MESSAGE_DELETED", "message has been deleted")
+	ErrDirectConversation = storage.NewError(storage.KindFailedPrecondition, "DIRECT_CONVERSATION",
+		"members cannot be added to or removed from a 1:1 conversation")
+	ErrAttachmentsUnavailable = storage.NewError(storage.KindUnsupported, "ATTACHMENTS_UNAVAILABLE", "attachments are not enabled")
+	ErrAttachmentTooLarge     = storage.NewError(storage.KindInvalid, "ATTACHMENT_TOO_LARGE", "attachment is too large")
+	ErrTooManyAttempts        = storage.NewError(storage.KindExhausted, "TOO_MANY_ATTEMPTS", "too many failed logins")
+	ErrNotAdmin               = storage.NewError(storage.KindPermissionDenied, "NOT_ADMIN", "user is not an administrator")
+	ErrTOTPRequired           = storage.NewError(storage.KindUnauthenticated, "TOTP_REQUIRED", "a one-time code is required")
+	ErrInvalidTOTPCode        = storage.NewError(storage.KindUnauthenticated, "INVALID_TOTP_CODE", "incorrect one-time code")
+	ErrTOTPEnrolled           = storage.NewError(storage.KindFailedPrecondition, "TOTP_ENROLLED",
+		"two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled = storage.NewError(storage.KindFailedPrecondition, "TOTP_NOT_ENROLLED",
+		"two-factor authentication is not enabled")
+	ErrAdminAccount = storage.NewError(storage.KindFailedPrecondition, "ADMIN_ACCOUNT",
+		"administrators cannot be renamed or deleted")
+)
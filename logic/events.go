@@ -0,0 +1,84 @@
+package logic
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/adsouza/chat-backend/storage"
+)
+
+// SubscribeEvents returns a channel on which events concerning the user's contacts are delivered, along with a func to
+// cancel the subscription. The user is considered online for as long as they have any event subscriptions, which their
+// contacts are notified of. As with Subscribe, the channel is closed if the subscriber falls too far behind.
+func (c *msgController) SubscribeEvents(user string) (<-chan storage.Event, func()) {
+	events, cancel := c.events.subscribe(user)
+	c.presenceMu.Lock()
+	c.presence[user]++
+	first := c.presence[user] == 1
+	c.presenceMu.Unlock()
+	if first {
+		c.announce(storage.Event{Kind: storage.EventOnline, Username: user})
+	}
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			cancel()
+			c.presenceMu.Lock()
+			c.presence[user]--
+			last := c.presence[user] == 0
+			if last {
+				delete(c.presence, user)
+			}
+			c.presenceMu.Unlock()
+			if last {
+				c.announce(storage.Event{Kind: storage.EventOffline, Username: user})
+			}
+		})
+	}
+}
+
+// announce delivers a change in the presence of a user to all of their contacts.
+func (c *msgController) announce(event storage.Event) {
+	contacts, err := c.db.ReadContacts(event.Username)
+	if err != nil {
+		// Presence is best effort, so there's no one to report this to.
+		return
+	}
+	for _, contact := range contacts {
+		c.events.publish(contact, event)
+	}
+}
+
+// OnlineContacts returns those of the user's contacts who are currently online.
+func (c *msgController) OnlineContacts(user string) ([]string, error) {
+	contacts, err := c.db.ReadContacts(user)
+	if err != nil {
+		return nil, err
+	}
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	var online []string
+	for _, contact := range contacts {
+		if c.presence[contact] > 0 {
+			online = append(online, contact)
+		}
+	}
+	return online, nil
+}
+
+// SetTyping notifies the other members of a conversation that the user is composing a message in it.
+func (c *msgController) SetTyping(user string, conversation int64) error {
+	info, err := c.db.FetchConversation(conversation)
+	if err != nil {
+		return err
+	}
+	if !contains(info.Members, user) {
+		return fmt.Errorf("%w: %v is not a member of conversation %d", ErrNotMember, user, conversation)
+	}
+	for _, member := range info.Members {
+		if member != user {
+			c.events.publish(member, storage.Event{Kind: storage.EventTyping, Username: user, Conversation: conversation})
+		}
+	}
+	return nil
+}
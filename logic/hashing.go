@@ -0,0 +1,138 @@
+package logic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hasher generates hashes of passphrases in one format. Every supported format is self-describing, recording its
+// parameters within the hash, so that hashes generated under an earlier policy can still be verified.
+type Hasher interface {
+	Hash(passphrase string) ([]byte, error)
+	// Outdated reports whether a hash was generated in another format or with other parameters than this hasher uses.
+	Outdated(hash []byte) bool
+}
+
+// DefaultHasher is used unless the user controller is configured with another.
+var DefaultHasher Hasher = BcryptHasher{Cost: bcrypt.DefaultCost}
+
+// BcryptHasher generates bcrypt hashes in the modular crypt format, e.g. $2a$10$...
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(passphrase string) ([]byte, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(passphrase), h.Cost)
+	if err != nil {
+		return nil, fmt.Errorf("unable to hash passphrase: %v", err)
+	}
+	return hash, nil
+}
+
+// MaxPassphraseBytes is the length beyond which bcrypt refuses to hash a passphrase, rather than ignore the rest of it.
+func (h BcryptHasher) MaxPassphraseBytes() int {
+	return 72
+}
+
+func (h BcryptHasher) Outdated(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
+
+// Argon2idHasher generates argon2id hashes in the PHC string format, e.g. $argon2id$v=19$m=65536,t=3,p=4$salt$key.
+type Argon2idHasher struct {
+	// Time is the number of passes over the memory & Memory its size in KiB.
+	Time, Memory uint32
+	Threads      uint8
+}
+
+// DefaultArgon2idHasher uses the parameters that RFC 9106 recommends for memory-constrained environments.
+var DefaultArgon2idHasher = Argon2idHasher{Time: 3, Memory: 64 << 10, Threads: 4}
+
+const (
+	argon2idPrefix  = "$argon2id$"
+	argon2idSaltLen = 16
+	argon2idKeyLen  = 32
+)
+
+// argon2idHash is the decoded form of an argon2id hash.
+type argon2idHash struct {
+	version   int
+	params    Argon2idHasher
+	salt, key []byte
+}
+
+func (h Argon2idHasher) Hash(passphrase string) ([]byte, error) {
+	salt := make([]byte, argon2idSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("unable to generate salt: %v", err)
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, h.Time, h.Memory, h.Threads, argon2idKeyLen)
+	return []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+func (h Argon2idHasher) Outdated(hash []byte) bool {
+	decoded, err := parseArgon2id(hash)
+	return err != nil || decoded.version != argon2.Version || decoded.params != h || len(decoded.key) != argon2idKeyLen
+}
+
+func parseArgon2id(hash []byte) (argon2idHash, error) {
+	var decoded argon2idHash
+	fields := strings.Split(strings.TrimPrefix(string(hash), argon2idPrefix), "$")
+	if !bytes.HasPrefix(hash, []byte(argon2idPrefix)) || len(fields) != 4 {
+		return argon2idHash{}, fmt.Errorf("malformed argon2id hash")
+	}
+	if _, err := fmt.Sscanf(fields[0], "v=%d", &decoded.version); err != nil {
+		return argon2idHash{}, fmt.Errorf("malformed argon2id version: %v", err)
+	}
+	p := &decoded.params
+	if _, err := fmt.Sscanf(fields[1], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return argon2idHash{}, fmt.Errorf("malformed argon2id parameters: %v", err)
+	}
+	if p.Time == 0 || p.Threads == 0 {
+		return argon2idHash{}, fmt.Errorf("invalid argon2id parameters %v", fields[1])
+	}
+	var err error
+	if decoded.salt, err = base64.RawStdEncoding.DecodeString(fields[2]); err != nil {
+		return argon2idHash{}, fmt.Errorf("malformed argon2id salt: %v", err)
+	}
+	if decoded.key, err = base64.RawStdEncoding.DecodeString(fields[3]); err != nil || len(decoded.key) == 0 {
+		return argon2idHash{}, fmt.Errorf("malformed argon2id key")
+	}
+	return decoded, nil
+}
+
+// verifyPassphrase checks a passphrase against a hash in any supported format, returning ErrInvalidCredentials if it
+// doesn't match.
+func verifyPassphrase(hash []byte, passphrase string) error {
+	if !bytes.HasPrefix(hash, []byte(argon2idPrefix)) {
+		// Anything else must be bcrypt, which was the only format before others were supported.
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(passphrase)); err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrInvalidCredentials
+		} else if err != nil {
+			return fmt.Errorf("unable to verify passphrase: %v", err)
+		}
+		return nil
+	}
+	decoded, err := parseArgon2id(hash)
+	if err != nil {
+		return fmt.Errorf("unable to verify passphrase: %v", err)
+	}
+	if decoded.version != argon2.Version {
+		return fmt.Errorf("unable to verify passphrase: unsupported argon2id version %d", decoded.version)
+	}
+	p := decoded.params
+	key := argon2.IDKey([]byte(passphrase), decoded.salt, p.Time, p.Memory, p.Threads, uint32(len(decoded.key)))
+	if subtle.ConstantTimeCompare(key, decoded.key) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
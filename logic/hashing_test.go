@@ -0,0 +1,82 @@
+package logic_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/adsouza/chat-backend/logic"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fastArgon2id keeps the tests quick, unlike the parameters that should be used in production.
+var fastArgon2id = logic.Argon2idHasher{Time: 1, Memory: 64, Threads: 1}
+
+func TestArgon2id(t *testing.T) {
+	store := &mockUserStore{hashes: make(map[string][]byte)}
+	userCtlr := logic.NewUserController(store, logic.WithHasher(fastArgon2id))
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	hash := string(store.hashes["testuser1"])
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Hash is not in the argon2id format: got %v.", hash)
+	}
+	if err := userCtlr.Authenticate("testuser1", "123456789abcdefg"); err != nil {
+		t.Errorf("Unable to authenticate user with argon2id hash: %v.", err)
+	}
+	if err := userCtlr.Authenticate("testuser1", "123456789abcdef!"); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Errorf("Authenticating with wrong passphrase: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+	}
+	if fastArgon2id.Outdated([]byte(hash)) {
+		t.Errorf("Hash generated with the same parameters is considered outdated: %v.", hash)
+	}
+	for _, hasher := range []logic.Hasher{logic.DefaultArgon2idHasher, logic.BcryptHasher{Cost: bcrypt.MinCost}} {
+		if !hasher.Outdated([]byte(hash)) {
+			t.Errorf("Hash is not considered outdated by %+v: %v.", hasher, hash)
+		}
+	}
+	store.hashes["testuser1"] = []byte("$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5")
+	if err := userCtlr.Authenticate("testuser1", "123456789abcdefg"); err == nil || errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Errorf("Authenticating against a malformed hash: got error %v, want a failure to verify.", err)
+	}
+}
+
+func TestHashUpgrade(t *testing.T) {
+	store := &mockUserStore{hashes: make(map[string][]byte)}
+	if err := logic.NewUserController(store, logic.WithHasher(logic.BcryptHasher{Cost: bcrypt.MinCost})).CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	original := string(store.hashes["testuser1"])
+	for _, tc := range []struct {
+		hasher logic.Hasher
+		prefix string
+	}{
+		{logic.BcryptHasher{Cost: bcrypt.MinCost + 1}, "$2a$05$"},
+		{fastArgon2id, "$argon2id$"},
+		{logic.BcryptHasher{Cost: bcrypt.MinCost}, "$2a$04$"},
+	} {
+		userCtlr := logic.NewUserController(store, logic.WithHasher(tc.hasher))
+		if err := userCtlr.Authenticate("testuser1", "123456789abcdefg"); err != nil {
+			t.Fatalf("Unable to authenticate user before upgrade to %+v: %v.", tc.hasher, err)
+		}
+		if _, _, err := userCtlr.Login("testuser1", "123456789abcdef!", "", ""); !errors.Is(err, logic.ErrInvalidCredentials) {
+			t.Errorf("Logging in with wrong passphrase: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+		}
+		if hash := string(store.hashes["testuser1"]); !tc.hasher.Outdated([]byte(hash)) {
+			t.Errorf("Hash was upgraded to %+v by a failed login: %v.", tc.hasher, hash)
+		}
+		if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", ""); err != nil {
+			t.Fatalf("Unable to log in: %v.", err)
+		}
+		if hash := string(store.hashes["testuser1"]); !strings.HasPrefix(hash, tc.prefix) || tc.hasher.Outdated([]byte(hash)) {
+			t.Errorf("Hash was not upgraded to %+v: got %v.", tc.hasher, hash)
+		}
+		if err := userCtlr.Authenticate("testuser1", "123456789abcdefg"); err != nil {
+			t.Errorf("Unable to authenticate user after upgrade to %+v: %v.", tc.hasher, err)
+		}
+	}
+	if got := string(store.hashes["testuser1"]); got == original {
+		t.Errorf("Hash is unchanged after a round trip through other formats: %v.", got)
+	}
+}
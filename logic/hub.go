@@ -0,0 +1,63 @@
+package logic
+
+import (
+	"sync"
+)
+
+// SubscriberBuffer is how many undelivered messages a subscriber may accumulate before it is considered too slow to
+// keep up & gets dropped.
+const SubscriberBuffer = 64
+
+// hub fans out newly stored messages, or events, to every open subscription of their recipient.
+type hub[T any] struct {
+	mu   sync.Mutex
+	subs map[string]map[chan T]struct{}
+}
+
+func newHub[T any]() *hub[T] {
+	return &hub[T]{subs: make(map[string]map[chan T]struct{})}
+}
+
+// subscribe registers a new subscription for the specified user. The returned channel is closed once the returned
+// cancellation func is called, or if the subscriber falls more than SubscriberBuffer messages behind.
+func (h *hub[T]) subscribe(user string) (<-chan T, func()) {
+	ch := make(chan T, SubscriberBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[user] == nil {
+		h.subs[user] = make(map[chan T]struct{})
+	}
+	h.subs[user][ch] = struct{}{}
+	return ch, func() { h.unsubscribe(user, ch) }
+}
+
+func (h *hub[T]) unsubscribe(user string, ch chan T) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(user, ch)
+}
+
+// remove must be called with the lock held. It is a no-op if the subscription was already removed.
+func (h *hub[T]) remove(user string, ch chan T) {
+	if _, ok := h.subs[user][ch]; !ok {
+		return
+	}
+	delete(h.subs[user], ch)
+	if len(h.subs[user]) == 0 {
+		delete(h.subs, user)
+	}
+	close(ch)
+}
+
+// publish delivers msg to all of the user's subscriptions without blocking, dropping any that are full.
+func (h *hub[T]) publish(user string, msg T) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[user] {
+		select {
+		case ch <- msg:
+		default:
+			h.remove(user, ch)
+		}
+	}
+}
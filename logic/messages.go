@@ -3,60 +3,316 @@ package logic
 import (
 	"fmt"
 	"net/url"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/adsouza/chat-backend/api"
+	"github.com/adsouza/chat-backend/entities"
 	"github.com/adsouza/chat-backend/storage"
 	"github.com/golang/protobuf/proto"
 )
 
-const (
-	Vevo = "www.vevo.com/watch"
-)
+// previewWait bounds how long sending or editing a message waits for a preview of the link in it. A slower preview is
+// left out, though it is still cached once it arrives, so that an edit of the message can include it.
+const previewWait = time.Second
 
 type MsgStore interface {
-	AddMessage(sender, recipient, content string, metadata []byte) error
-	ReadMessagesBefore(user1, user2 string, limit uint32, before int64) ([]storage.Message, int64, error)
+	AddMessage(sender, recipient, content string, metadata []byte, idempotencyKey string, attachments ...int64) (storage.Message, bool, error)
+	AddConversationMessage(conversation int64, sender, content string, metadata []byte, idempotencyKey string, attachments ...int64) (storage.Message, bool, error)
+	FetchMessageByIdempotencyKey(sender, idempotencyKey string) (storage.Message, error)
+	ReadMessagesBefore(viewer, peer string, limit uint32, before int64) ([]storage.Message, int64, error)
+	ReadConversationBefore(viewer string, conversation int64, limit uint32, before int64) ([]storage.Message, int64, error)
+	ReadMessagesAfter(viewer, peer string, limit uint32, after int64) ([]storage.Message, int64, error)
+	ReadConversationAfter(viewer string, conversation int64, limit uint32, after int64) ([]storage.Message, int64, error)
+	ReadMessagesReceivedAfter(recipient string, limit uint32, after int64) ([]storage.Message, int64, error)
+	ReadConversationSummaries(user string, limit uint32, before int64) ([]storage.ConversationSummary, int64, error)
+	UpdateReadCursor(conversation int64, username string, message int64) error
+	ReadCursors(conversation int64) ([]storage.ReadCursor, error)
+	FetchMessage(id int64) (storage.Message, error)
+	EditMessage(id int64, content string, metadata []byte) (storage.Message, error)
+	ReadRevisions(id int64) ([]storage.Revision, error)
+	HideMessage(id int64, username string) error
+	DeleteMessage(id int64) error
+}
+
+// SearchStore is implemented by stores that can search the content of messages. Not every store can, so the message
+// controller checks for it at runtime.
+type SearchStore interface {
+	SearchMessages(viewer string, query storage.SearchQuery) ([]storage.SearchResult, error)
 }
 
 type Db interface {
 	UserStore
 	MsgStore
+	ConversationStore
 }
 
 type msgController struct {
-	db Db
+	db     Db
+	hub    *hub[storage.Message]
+	events *hub[storage.Event]
+	// presence counts the event subscriptions of each user who has any.
+	presenceMu sync.Mutex
+	presence   map[string]int
+	providers  *ProviderRegistry
+	// unfurler is nil unless links are to be previewed.
+	unfurler *Unfurler
+	// blobs is nil unless attachments are enabled.
+	blobs storage.BlobStore
+}
+
+// MessageOption enables an optional feature of the message controller.
+type MessageOption func(*msgController)
+
+// WithUnfurler makes the message controller fetch links sent in messages, so as to include previews of them in the
+// metadata of those messages.
+func WithUnfurler(unfurler *Unfurler) MessageOption {
+	return func(c *msgController) {
+		c.unfurler = unfurler
+	}
+}
+
+// WithProviders replaces the DefaultProviders of media that the message controller recognizes in links.
+func WithProviders(providers *ProviderRegistry) MessageOption {
+	return func(c *msgController) {
+		c.providers = providers
+	}
 }
 
-func NewMessageController(db Db) *msgController {
-	return &msgController{db: db}
+func NewMessageController(db Db, opts ...MessageOption) *msgController {
+	c := &msgController{
+		db:        db,
+		hub:       newHub[storage.Message](),
+		events:    newHub[storage.Event](),
+		presence:  make(map[string]int),
+		providers: NewProviderRegistry(DefaultProviders()...),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
-func metadataFromURL(url *url.URL) *api.Metadata {
-	if strings.HasPrefix(url.Path, "/watch") {
-		switch url.Host {
-		case "www.youtube.com":
-			return &api.Metadata{Media: &api.Metadata_Video{Video: &api.Video{Source: api.Video_YOUTUBE}}}
-		case "www.vevo.com":
-			return &api.Metadata{Media: &api.Metadata_Video{Video: &api.Video{Source: api.Video_VEVO}}}
-		default:
+// unfurl fills in the metadata guessed from a link with whatever its preview reveals.
+func (c *msgController) unfurl(link *url.URL, metadata *api.Metadata) *api.Metadata {
+	if c.unfurler == nil || (link.Scheme != "http" && link.Scheme != "https") || link.Host == "" {
+		return metadata
+	}
+	type result struct {
+		preview Preview
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		preview, err := c.unfurler.Unfurl(link.String())
+		done <- result{preview, err}
+	}()
+	var preview Preview
+	select {
+	case r := <-done:
+		if r.err != nil {
+			// Previews are a nicety, so the guess will have to do.
+			return metadata
 		}
+		preview = r.preview
+	case <-time.After(previewWait):
+		return metadata
 	}
-	// Assume we have an image.
-	return &api.Metadata{Media: &api.Metadata_Image{Image: &api.Image{}}}
+	switch {
+	case metadata.GetVideo() != nil:
+		metadata.GetVideo().LengthInSeconds = uint32(preview.Duration / time.Second)
+	case preview.Image:
+		return &api.Metadata{Media: &api.Metadata_Image{Image: &api.Image{Width: preview.Width, Height: preview.Height}}}
+	case preview.Title != "" || preview.Description != "" || preview.ThumbnailURL != "":
+		return &api.Metadata{Media: &api.Metadata_LinkPreview{LinkPreview: &api.LinkPreview{
+			Url:             preview.URL,
+			Title:           preview.Title,
+			Description:     preview.Description,
+			SiteName:        preview.SiteName,
+			ThumbnailUrl:    preview.ThumbnailURL,
+			ThumbnailWidth:  preview.ThumbnailWidth,
+			ThumbnailHeight: preview.ThumbnailHeight,
+		}}}
+	}
+	return metadata
 }
 
-func (c *msgController) SendMessage(sender, recipient, message string) error {
-	var data []byte
-	if url, err := url.Parse(message); err == nil {
-		data, err = proto.Marshal(metadataFromURL(url))
-		if err != nil {
-			return fmt.Errorf("could not marshal metadata proto into blob: %v", err)
+// metadataFromContent returns the serialized metadata to store alongside a message, which describes the first link in
+// it along with any attachments. Messages with neither have none.
+func (c *msgController) metadataFromContent(message string, attachments []*api.Attachment) ([]byte, error) {
+	metadata := &api.Metadata{}
+	if links := entities.URLs(message); len(links) > 0 {
+		if url, err := url.Parse(links[0]); err == nil {
+			metadata = c.unfurl(url, c.providers.Metadata(url))
 		}
 	}
-	return c.db.AddMessage(sender, recipient, message, data)
+	metadata.Attachments = attachments
+	if proto.Size(metadata) == 0 {
+		return nil, nil
+	}
+	data, err := proto.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal metadata proto into blob: %v", err)
+	}
+	return data, nil
+}
+
+// SendMessage stores a message in the 1:1 conversation between sender & recipient, along with any attachments that the
+// sender uploaded, & delivers it to the recipient, returning it as stored. A retry with the same non-empty idempotency
+// key returns the original message instead.
+func (c *msgController) SendMessage(sender, recipient, message, idempotencyKey string, attachments ...int64) (storage.Message, error) {
+	described, err := c.describeAttachments(sender, attachments, idempotencyKey)
+	if err != nil {
+		return storage.Message{}, err
+	}
+	data, err := c.metadataFromContent(message, described)
+	if err != nil {
+		return storage.Message{}, err
+	}
+	msg, created, err := c.db.AddMessage(sender, recipient, message, data, idempotencyKey, attachments...)
+	if err != nil {
+		return storage.Message{}, err
+	}
+	if created {
+		c.hub.publish(recipient, msg)
+	}
+	return msg, nil
+}
+
+// SendToConversation stores a message in the specified conversation & delivers it to every other member. See
+// SendMessage.
+func (c *msgController) SendToConversation(sender string, conversation int64, message, idempotencyKey string, attachments ...int64) (storage.Message, error) {
+	info, err := c.db.FetchConversation(conversation)
+	if err != nil {
+		return storage.Message{}, err
+	}
+	if !contains(info.Members, sender) {
+		return storage.Message{}, fmt.Errorf("%w: %v is not a member of conversation %d", ErrNotMember, sender, conversation)
+	}
+	described, err := c.describeAttachments(sender, attachments, idempotencyKey)
+	if err != nil {
+		return storage.Message{}, err
+	}
+	data, err := c.metadataFromContent(message, described)
+	if err != nil {
+		return storage.Message{}, err
+	}
+	msg, created, err := c.db.AddConversationMessage(conversation, sender, message, data, idempotencyKey, attachments...)
+	if err != nil {
+		return storage.Message{}, err
+	}
+	if created {
+		for _, member := range info.Members {
+			if member != sender {
+				c.hub.publish(member, msg)
+			}
+		}
+	}
+	return msg, nil
+}
+
+func (c *msgController) FetchMessage(id int64) (storage.Message, error) {
+	return c.db.FetchMessage(id)
+}
+
+// EditMessage replaces the content of a message, which only its author may do. Its attachments are kept.
+func (c *msgController) EditMessage(editor string, id int64, content string) (storage.Message, error) {
+	msg, err := c.db.FetchMessage(id)
+	if err != nil {
+		return storage.Message{}, err
+	}
+	if msg.Author != editor {
+		return storage.Message{}, fmt.Errorf("%w: %v is not the author of message %d", ErrNotAuthor, editor, id)
+	}
+	if msg.Deleted {
+		return storage.Message{}, fmt.Errorf("%w: %d", ErrMessageDeleted, id)
+	}
+	previous := &api.Metadata{}
+	if err := proto.Unmarshal(msg.Metadata, previous); err != nil {
+		return storage.Message{}, fmt.Errorf("could not unmarshal metadata of message %d: %v", id, err)
+	}
+	data, err := c.metadataFromContent(content, previous.Attachments)
+	if err != nil {
+		return storage.Message{}, err
+	}
+	return c.db.EditMessage(id, content, data)
+}
+
+func (c *msgController) FetchRevisions(id int64) ([]storage.Revision, error) {
+	return c.db.ReadRevisions(id)
+}
+
+// HideMessage deletes a message from the point of view of the specified member of its conversation only.
+func (c *msgController) HideMessage(user string, id int64) error {
+	msg, err := c.db.FetchMessage(id)
+	if err != nil {
+		return err
+	}
+	info, err := c.db.FetchConversation(msg.Conversation)
+	if err != nil {
+		return err
+	}
+	if !contains(info.Members, user) {
+		return fmt.Errorf("%w: %v is not a member of conversation %d", ErrNotMember, user, msg.Conversation)
+	}
+	return c.db.HideMessage(id, user)
+}
+
+// DeleteMessage replaces a message with a tombstone for everyone, which only its author may do.
+func (c *msgController) DeleteMessage(author string, id int64) error {
+	msg, err := c.db.FetchMessage(id)
+	if err != nil {
+		return err
+	}
+	if msg.Author != author {
+		return fmt.Errorf("%w: %v is not the author of message %d", ErrNotAuthor, author, id)
+	}
+	return c.db.DeleteMessage(id)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchMessagesBefore pages backwards through the 1:1 conversation between viewer & peer, as seen by viewer.
+func (c *msgController) FetchMessagesBefore(viewer, peer string, limit uint32, before int64) ([]storage.Message, int64, error) {
+	return c.db.ReadMessagesBefore(viewer, peer, limit, before)
+}
+
+func (c *msgController) FetchConversationBefore(viewer string, conversation int64, limit uint32, before int64) ([]storage.Message, int64, error) {
+	return c.db.ReadConversationBefore(viewer, conversation, limit, before)
+}
+
+func (c *msgController) FetchMessagesAfter(viewer, peer string, limit uint32, after int64) ([]storage.Message, int64, error) {
+	return c.db.ReadMessagesAfter(viewer, peer, limit, after)
+}
+
+func (c *msgController) FetchConversationAfter(viewer string, conversation int64, limit uint32, after int64) ([]storage.Message, int64, error) {
+	return c.db.ReadConversationAfter(viewer, conversation, limit, after)
+}
+
+// SearchMessages returns the messages in user's conversations that best match the query, or
+// storage.ErrSearchUnavailable if the store doesn't support search.
+func (c *msgController) SearchMessages(user string, query storage.SearchQuery) ([]storage.SearchResult, error) {
+	searcher, ok := c.db.(SearchStore)
+	if !ok {
+		return nil, storage.ErrSearchUnavailable
+	}
+	return searcher.SearchMessages(user, query)
+}
+
+// Subscribe returns a channel on which messages sent to the specified user are delivered as soon as they are stored,
+// along with a func to cancel the subscription. The channel is closed if the subscriber falls too far behind, in which
+// case it should resubscribe & use FetchMessagesReceivedAfter to catch up.
+func (c *msgController) Subscribe(user string) (<-chan storage.Message, func()) {
+	return c.hub.subscribe(user)
 }
 
-func (c *msgController) FetchMessagesBefore(user1, user2 string, limit uint32, before int64) ([]storage.Message, int64, error) {
-	return c.db.ReadMessagesBefore(user1, user2, limit, before)
+func (c *msgController) FetchMessagesReceivedAfter(user string, limit uint32, after int64) ([]storage.Message, int64, error) {
+	return c.db.ReadMessagesReceivedAfter(user, limit, after)
 }
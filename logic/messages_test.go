@@ -1,12 +1,19 @@
 package logic_test
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"net/url"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/adsouza/chat-backend/api"
 	"github.com/adsouza/chat-backend/logic"
 	"github.com/adsouza/chat-backend/storage"
+	"github.com/golang/protobuf/proto"
 )
 
 func conversationIdFromParticipants(user1, user2 string) string {
@@ -18,17 +25,40 @@ func conversationIdFromParticipants(user1, user2 string) string {
 
 type mockMsgStore struct {
 	conversations map[string][]storage.Message
+	groups        map[int64]*storage.Conversation
+	groupMessages map[int64][]storage.Message
+	hidden        map[int64][]string
+	keys          map[string]storage.Message
+	lastID        int64
 }
 
-func (m *mockMsgStore) AddMessage(sender, recipient, content string, metadata []byte) error {
+func (m *mockMsgStore) AddMessage(sender, recipient, content string, metadata []byte, idempotencyKey string, attachments ...int64) (storage.Message, bool, error) {
+	if msg, ok := m.keys[sender+":"+idempotencyKey]; ok && idempotencyKey != "" {
+		return msg, false, nil
+	}
 	// Add the new message to the beginning.
+	m.lastID++
+	msg := storage.Message{ID: m.lastID, Author: sender, Content: content, Metadata: metadata}
 	conversationId := conversationIdFromParticipants(sender, recipient)
-	m.conversations[conversationId] = append([]storage.Message{{Author: sender, Content: content}}, m.conversations[conversationId]...)
-	return nil
+	m.conversations[conversationId] = append([]storage.Message{msg}, m.conversations[conversationId]...)
+	if idempotencyKey != "" {
+		if m.keys == nil {
+			m.keys = make(map[string]storage.Message)
+		}
+		m.keys[sender+":"+idempotencyKey] = msg
+	}
+	return msg, true, nil
 }
 
-func (m *mockMsgStore) ReadMessagesBefore(user1, user2 string, limit uint32, before int64) ([]storage.Message, int64, error) {
-	conversationId := conversationIdFromParticipants(user1, user2)
+func (m *mockMsgStore) FetchMessageByIdempotencyKey(sender, idempotencyKey string) (storage.Message, error) {
+	if msg, ok := m.keys[sender+":"+idempotencyKey]; ok {
+		return msg, nil
+	}
+	return storage.Message{}, storage.ErrMessageNotFound
+}
+
+func (m *mockMsgStore) ReadMessagesBefore(viewer, peer string, limit uint32, before int64) ([]storage.Message, int64, error) {
+	conversationId := conversationIdFromParticipants(viewer, peer)
 	conversation, ok := m.conversations[conversationId]
 	if !ok {
 		return nil, math.MaxInt64, fmt.Errorf("no row with key %v exists", conversationId)
@@ -36,9 +66,208 @@ func (m *mockMsgStore) ReadMessagesBefore(user1, user2 string, limit uint32, bef
 	return conversation, math.MaxInt64, nil
 }
 
+func (m *mockMsgStore) AddConversationMessage(conversation int64, sender, content string, metadata []byte, idempotencyKey string, attachments ...int64) (storage.Message, bool, error) {
+	m.lastID++
+	msg := storage.Message{ID: m.lastID, Conversation: conversation, Author: sender, Content: content, Metadata: metadata}
+	m.groupMessages[conversation] = append([]storage.Message{msg}, m.groupMessages[conversation]...)
+	return msg, true, nil
+}
+
+func (m *mockMsgStore) ReadConversationBefore(viewer string, conversation int64, limit uint32, before int64) ([]storage.Message, int64, error) {
+	return m.groupMessages[conversation], math.MaxInt64, nil
+}
+
+func (m *mockMsgStore) CreateConversation(title string, members []string) (int64, error) {
+	if m.groups == nil {
+		m.groups = make(map[int64]*storage.Conversation)
+		m.groupMessages = make(map[int64][]storage.Message)
+	}
+	id := int64(len(m.groups) + 1)
+	m.groups[id] = &storage.Conversation{ID: id, Title: title, Group: true, Owner: members[0], Members: members}
+	return id, nil
+}
+
+func (m *mockMsgStore) FetchConversation(id int64) (storage.Conversation, error) {
+	conversation, ok := m.groups[id]
+	if !ok {
+		return storage.Conversation{}, storage.ErrConversationNotFound
+	}
+	return *conversation, nil
+}
+
+func (m *mockMsgStore) AddMember(conversation int64, username string) error {
+	m.groups[conversation].Members = append(m.groups[conversation].Members, username)
+	return nil
+}
+
+func (m *mockMsgStore) RemoveMember(conversation int64, username string) error {
+	members := m.groups[conversation].Members
+	for i, member := range members {
+		if member == username {
+			m.groups[conversation].Members = append(members[:i:i], members[i+1:]...)
+			return nil
+		}
+	}
+	return storage.ErrMemberNotFound
+}
+
+func (m *mockMsgStore) ReadContacts(user string) ([]string, error) {
+	seen := make(map[string]bool)
+	var contacts []string
+	add := func(members []string) {
+		if !contains(members, user) {
+			return
+		}
+		for _, member := range members {
+			if member != user && !seen[member] {
+				seen[member] = true
+				contacts = append(contacts, member)
+			}
+		}
+	}
+	for id := range m.conversations {
+		add(strings.Split(id, ":"))
+	}
+	for _, group := range m.groups {
+		add(group.Members)
+	}
+	return contacts, nil
+}
+
+func (m *mockMsgStore) FindDirectConversation(user1, user2 string) (int64, error) {
+	return 0, fmt.Errorf("not implemented by mock")
+}
+
+func contains(members []string, user string) bool {
+	for _, member := range members {
+		if member == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mockMsgStore) ReadMessagesAfter(viewer, peer string, limit uint32, after int64) ([]storage.Message, int64, error) {
+	conversationId := conversationIdFromParticipants(viewer, peer)
+	var messages []storage.Message
+	// Stored newest first, so walk backwards.
+	for i := len(m.conversations[conversationId]) - 1; i >= 0 && uint32(len(messages)) < limit; i-- {
+		if msg := m.conversations[conversationId][i]; msg.ID > after {
+			messages = append(messages, msg)
+			after = msg.ID
+		}
+	}
+	return messages, after, nil
+}
+
+func (m *mockMsgStore) ReadConversationAfter(viewer string, conversation int64, limit uint32, after int64) ([]storage.Message, int64, error) {
+	return nil, after, fmt.Errorf("not implemented by mock")
+}
+
+func (m *mockMsgStore) ReadMessagesReceivedAfter(recipient string, limit uint32, after int64) ([]storage.Message, int64, error) {
+	return nil, after, fmt.Errorf("not implemented by mock")
+}
+
+func (m *mockMsgStore) ReadConversationSummaries(user string, limit uint32, before int64) ([]storage.ConversationSummary, int64, error) {
+	return nil, before, fmt.Errorf("not implemented by mock")
+}
+
+func (m *mockMsgStore) UpdateReadCursor(conversation int64, username string, message int64) error {
+	return fmt.Errorf("not implemented by mock")
+}
+
+func (m *mockMsgStore) ReadCursors(conversation int64) ([]storage.ReadCursor, error) {
+	return nil, fmt.Errorf("not implemented by mock")
+}
+
+// findMessage returns a pointer to the stored message with the specified ID, or nil if there is none.
+func (m *mockMsgStore) findMessage(id int64) *storage.Message {
+	for _, messages := range m.conversations {
+		for i := range messages {
+			if messages[i].ID == id {
+				return &messages[i]
+			}
+		}
+	}
+	for _, messages := range m.groupMessages {
+		for i := range messages {
+			if messages[i].ID == id {
+				return &messages[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (m *mockMsgStore) FetchMessage(id int64) (storage.Message, error) {
+	if msg := m.findMessage(id); msg != nil {
+		return *msg, nil
+	}
+	return storage.Message{}, storage.ErrMessageNotFound
+}
+
+func (m *mockMsgStore) EditMessage(id int64, content string, metadata []byte) (storage.Message, error) {
+	msg := m.findMessage(id)
+	if msg == nil {
+		return storage.Message{}, storage.ErrMessageNotFound
+	}
+	msg.Content, msg.Metadata, msg.EditedAt = content, metadata, time.Now()
+	msg.Revisions++
+	return *msg, nil
+}
+
+func (m *mockMsgStore) ReadRevisions(id int64) ([]storage.Revision, error) {
+	return nil, fmt.Errorf("not implemented by mock")
+}
+
+func (m *mockMsgStore) HideMessage(id int64, username string) error {
+	if m.hidden == nil {
+		m.hidden = make(map[int64][]string)
+	}
+	m.hidden[id] = append(m.hidden[id], username)
+	return nil
+}
+
+func (m *mockMsgStore) DeleteMessage(id int64) error {
+	msg := m.findMessage(id)
+	if msg == nil {
+		return storage.ErrMessageNotFound
+	}
+	msg.Content, msg.Metadata, msg.Deleted = "", nil, true
+	return nil
+}
+
 type mockDb struct {
 	mockUserStore
 	mockMsgStore
+	mockAttachmentStore
+}
+
+// AddMessage attaches the attachments to the message, or stores neither if it can't, as the real store does.
+func (m *mockDb) AddMessage(sender, recipient, content string, metadata []byte, idempotencyKey string, attachments ...int64) (storage.Message, bool, error) {
+	if _, ok := m.keys[sender+":"+idempotencyKey]; ok && idempotencyKey != "" {
+		return m.mockMsgStore.AddMessage(sender, recipient, content, metadata, idempotencyKey)
+	}
+	if err := m.attachable(sender, attachments); err != nil {
+		return storage.Message{}, false, err
+	}
+	msg, created, err := m.mockMsgStore.AddMessage(sender, recipient, content, metadata, idempotencyKey)
+	if err == nil {
+		m.attach(msg.ID, attachments)
+	}
+	return msg, created, err
+}
+
+// AddConversationMessage attaches the attachments to the message, or stores neither if it can't. See AddMessage.
+func (m *mockDb) AddConversationMessage(conversation int64, sender, content string, metadata []byte, idempotencyKey string, attachments ...int64) (storage.Message, bool, error) {
+	if err := m.attachable(sender, attachments); err != nil {
+		return storage.Message{}, false, err
+	}
+	msg, created, err := m.mockMsgStore.AddConversationMessage(conversation, sender, content, metadata, idempotencyKey)
+	if err == nil {
+		m.attach(msg.ID, attachments)
+	}
+	return msg, created, err
 }
 
 func TestHappyPath(t *testing.T) {
@@ -54,10 +283,10 @@ func TestHappyPath(t *testing.T) {
 		t.Fatalf("2nd user account was not permitted but should be.")
 	}
 	msgCtlr := logic.NewMessageController(mockDb)
-	if err := msgCtlr.SendMessage("testuser1", "testuser2", "Bonjour!"); err != nil {
+	if _, err := msgCtlr.SendMessage("testuser1", "testuser2", "Bonjour!", ""); err != nil {
 		t.Fatalf("Sending a message failed: %v.", err)
 	}
-	if err := msgCtlr.SendMessage("testuser2", "testuser1", "A revoir."); err != nil {
+	if _, err := msgCtlr.SendMessage("testuser2", "testuser1", "A revoir.", ""); err != nil {
 		t.Fatalf("Sending a 2nd message failed: %v.", err)
 	}
 	conversation, _, err := msgCtlr.FetchMessagesBefore("testuser1", "testuser2", math.MaxUint32, math.MaxInt64)
@@ -108,7 +337,522 @@ func TestVideoURL(t *testing.T) {
 		t.Fatalf("2nd user account was not permitted but should be.")
 	}
 	msgCtlr := logic.NewMessageController(mockDb)
-	if err := msgCtlr.SendMessage("testuser1", "testuser2", "https://www.youtube.com/watch?v=9bZkp7q19f0"); err != nil {
-		t.Fatalf("Sending a YouTube URL failed: %v.", err)
+	video := func(source api.Video_Source, id string, start uint32, playlist string) *api.Metadata {
+		return &api.Metadata{Media: &api.Metadata_Video{
+			Video: &api.Video{Source: source, Id: id, StartSeconds: start, PlaylistId: playlist},
+		}}
+	}
+	for _, tc := range []struct {
+		link string
+		want *api.Metadata
+	}{
+		{"https://www.youtube.com/watch?v=9bZkp7q19f0", video(api.Video_YOUTUBE, "9bZkp7q19f0", 0, "")},
+		{"https://youtu.be/9bZkp7q19f0?t=1m30s", video(api.Video_YOUTUBE, "9bZkp7q19f0", 90, "")},
+		{"https://m.youtube.com/watch?v=9bZkp7q19f0&list=PL123&t=42", video(api.Video_YOUTUBE, "9bZkp7q19f0", 42, "PL123")},
+		{"https://www.youtube.com/shorts/abc-DEF_123", video(api.Video_YOUTUBE, "abc-DEF_123", 0, "")},
+		{"https://www.youtube.com/playlist?list=PL123", video(api.Video_YOUTUBE, "", 0, "PL123")},
+		{"https://www.vevo.com/watch/psy/gangnam-style/USUV71201149", video(api.Video_VEVO, "USUV71201149", 0, "")},
+		{"https://vimeo.com/76979871#t=1:05", video(api.Video_VIMEO, "76979871", 65, "")},
+		{"https://player.vimeo.com/video/76979871", video(api.Video_VIMEO, "76979871", 0, "")},
+		{"https://www.twitch.tv/videos/1234567?t=1h2m3s", video(api.Video_TWITCH, "v1234567", 3723, "")},
+		{"https://www.twitch.tv/somechannel", video(api.Video_TWITCH, "somechannel", 0, "")},
+		{"https://soundcloud.com/artist/some-track#t=0:30", video(api.Video_SOUNDCLOUD, "artist/some-track", 30, "")},
+		{"https://soundcloud.com/artist/sets/some-album", video(api.Video_SOUNDCLOUD, "", 0, "artist/sets/some-album")},
+		{"https://open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC", video(api.Video_SPOTIFY, "track:4uLU6hMCjMI75M1A2tKUQC", 0, "")},
+		{"https://open.spotify.com/intl-fr/album/1DFixLWuPkv3KT3TnV35m3", video(api.Video_SPOTIFY, "", 0, "album:1DFixLWuPkv3KT3TnV35m3")},
+		{"https://example.com/clips/holiday.MP4", video(api.Video_FILE, "", 0, "")},
+		{"https://example.com/photos/beach.jpeg?size=large", &api.Metadata{Media: &api.Metadata_Image{Image: &api.Image{}}}},
+		{"https://example.com/about", &api.Metadata{}},
+		{"https://www.youtube.com/about", &api.Metadata{}},
+	} {
+		msg, err := msgCtlr.SendMessage("testuser1", "testuser2", tc.link, "")
+		if err != nil {
+			t.Fatalf("Sending %v failed: %v.", tc.link, err)
+		}
+		got := &api.Metadata{}
+		if err := proto.Unmarshal(msg.Metadata, got); err != nil {
+			t.Fatalf("Unable to parse metadata: %v.", err)
+		}
+		if !proto.Equal(got, tc.want) {
+			t.Errorf("Metadata of %v mismatch: got %v, want %v.", tc.link, got, tc.want)
+		}
+	}
+}
+
+func TestCustomProvider(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	providers := logic.NewProviderRegistry()
+	providers.Register(logic.Provider{
+		Name:     "Example",
+		Source:   api.Video_UNKNOWN,
+		Matchers: []logic.Matcher{{Host: "videos.example.com", Path: regexp.MustCompile(`^/v/`)}},
+		Extract:  func(link *url.URL) logic.Media { return logic.Media{ID: strings.TrimPrefix(link.Path, "/v/")} },
+	})
+	msgCtlr := logic.NewMessageController(mockDb, logic.WithProviders(providers))
+	msg, err := msgCtlr.SendMessage("testuser1", "testuser2", "Look: https://videos.example.com/v/xyz", "")
+	if err != nil {
+		t.Fatalf("Sending a link failed: %v.", err)
+	}
+	got := &api.Metadata{}
+	if err := proto.Unmarshal(msg.Metadata, got); err != nil {
+		t.Fatalf("Unable to parse metadata: %v.", err)
+	}
+	if id := got.GetVideo().GetId(); id != "xyz" {
+		t.Errorf("Video ID mismatch: got %q, want %q.", id, "xyz")
+	}
+	// The default providers were replaced, so YouTube is no longer recognized.
+	msg, err = msgCtlr.SendMessage("testuser1", "testuser2", "https://www.youtube.com/watch?v=9bZkp7q19f0", "")
+	if err != nil {
+		t.Fatalf("Sending a link failed: %v.", err)
+	}
+	if len(msg.Metadata) != 0 {
+		t.Errorf("Link to an unregistered provider has metadata: %v.", msg.Metadata)
+	}
+}
+
+func TestMetadataOnlyForLinks(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	for content, wantMetadata := range map[string]bool{
+		"How's it going?":         false,
+		"Ping @testuser2 #urgent": false,
+		"Watch this: https://www.youtube.com/watch?v=9bZkp7q19f0 !": true,
+	} {
+		msg, err := msgCtlr.SendMessage("testuser1", "testuser2", content, "")
+		if err != nil {
+			t.Fatalf("Sending a message failed: %v.", err)
+		}
+		if got := len(msg.Metadata) > 0; got != wantMetadata {
+			t.Errorf("Metadata presence for %q mismatch: got %v, want %v.", content, got, wantMetadata)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	messages, cancel := msgCtlr.Subscribe("testuser2")
+	otherMessages, otherCancel := msgCtlr.Subscribe("testuser2")
+	defer otherCancel()
+	if _, err := msgCtlr.SendMessage("testuser1", "testuser2", "Bonjour!", ""); err != nil {
+		t.Fatalf("Sending a message failed: %v.", err)
+	}
+	if _, err := msgCtlr.SendMessage("testuser2", "testuser1", "A revoir.", ""); err != nil {
+		t.Fatalf("Sending a 2nd message failed: %v.", err)
+	}
+	for _, ch := range []<-chan storage.Message{messages, otherMessages} {
+		select {
+		case msg := <-ch:
+			if got, want := msg.Content, "Bonjour!"; got != want {
+				t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message was not delivered to subscriber.")
+		}
+	}
+	cancel()
+	if _, ok := <-messages; ok {
+		t.Errorf("Subscriber received a message it should not have.")
+	}
+	// Cancelling twice must be harmless.
+	cancel()
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	messages, cancel := msgCtlr.Subscribe("testuser2")
+	defer cancel()
+	for i := 0; i <= logic.SubscriberBuffer; i++ {
+		if _, err := msgCtlr.SendMessage("testuser1", "testuser2", "Are you there?", ""); err != nil {
+			t.Fatalf("Sending a message failed: %v.", err)
+		}
+	}
+	received := 0
+	for range messages {
+		received++
+	}
+	if got, want := received, logic.SubscriberBuffer; got != want {
+		t.Errorf("Slow subscriber received wrong number of messages before being dropped: got %v, want %v.", got, want)
+	}
+}
+
+func TestGroupConversation(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	conversation, err := msgCtlr.CreateConversation("testuser1", "Test group", []string{"testuser2", "testuser1", "testuser3"})
+	if err != nil {
+		t.Fatalf("Unable to create a group conversation: %v.", err)
+	}
+	members, err := msgCtlr.ListMembers(conversation)
+	if err != nil {
+		t.Fatalf("Unable to list members of group conversation: %v.", err)
+	}
+	if got, want := len(members), 3; got != want {
+		t.Fatalf("Group conversation has wrong number of members: got %v, want %v.", got, want)
+	}
+	messages2, cancel2 := msgCtlr.Subscribe("testuser2")
+	defer cancel2()
+	messages3, cancel3 := msgCtlr.Subscribe("testuser3")
+	defer cancel3()
+	messages1, cancel1 := msgCtlr.Subscribe("testuser1")
+	defer cancel1()
+	if _, err := msgCtlr.SendToConversation("testuser1", conversation, "Hello everyone!", ""); err != nil {
+		t.Fatalf("Sending a message to a group conversation failed: %v.", err)
+	}
+	for _, ch := range []<-chan storage.Message{messages2, messages3} {
+		select {
+		case msg := <-ch:
+			if got, want := msg.Conversation, conversation; got != want {
+				t.Errorf("Message conversation mismatch: got %v, want %v.", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message was not delivered to group member.")
+		}
+	}
+	select {
+	case <-messages1:
+		t.Errorf("Message was delivered back to its sender.")
+	default:
+	}
+	if _, err := msgCtlr.SendToConversation("testuser4", conversation, "Let me in!", ""); err == nil {
+		t.Errorf("Non-member was able to send a message to a group conversation!")
+	}
+	if err := msgCtlr.RemoveMember("testuser2", conversation, "testuser3"); !errors.Is(err, logic.ErrNotOwner) {
+		t.Errorf("Removing another member without owning the group: got error %v, want %v.", err, logic.ErrNotOwner)
+	}
+	if err := msgCtlr.RemoveMember("testuser1", conversation, "testuser3"); err != nil {
+		t.Fatalf("Unable to remove member from group conversation: %v.", err)
+	}
+	if _, err := msgCtlr.SendToConversation("testuser3", conversation, "Wait, come back!", ""); err == nil {
+		t.Errorf("Removed member was able to send a message to a group conversation!")
+	}
+	if err := msgCtlr.AddMember(conversation, "testuser4"); err != nil {
+		t.Fatalf("Unable to add member to group conversation: %v.", err)
+	}
+	if _, err := msgCtlr.SendToConversation("testuser4", conversation, "Thanks for having me.", ""); err != nil {
+		t.Errorf("Added member was unable to send a message to a group conversation: %v.", err)
+	}
+	if err := msgCtlr.RemoveMember("testuser4", conversation, "testuser4"); err != nil {
+		t.Errorf("Unable to leave group conversation: %v.", err)
+	}
+	messages, _, err := msgCtlr.FetchConversationBefore("testuser1", conversation, math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to fetch group conversation: %v.", err)
+	}
+	if got, want := len(messages), 2; got != want {
+		t.Fatalf("Group conversation has wrong number of messages: got %v, want %v.", got, want)
+	}
+}
+
+func TestDirectConversationMembership(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	conversation, err := msgCtlr.CreateConversation("testuser1", "", []string{"testuser2"})
+	if err != nil {
+		t.Fatalf("Unable to create a conversation: %v.", err)
+	}
+	mockDb.groups[conversation].Group = false
+	if err := msgCtlr.AddMember(conversation, "testuser3"); err == nil {
+		t.Errorf("Able to add a member to a 1:1 conversation!")
+	}
+	if err := msgCtlr.RemoveMember("testuser1", conversation, "testuser2"); err == nil {
+		t.Errorf("Able to remove a member from a 1:1 conversation!")
+	}
+}
+
+func TestFetchMessagesAfter(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	for _, content := range []string{"One", "Two", "Three"} {
+		if _, err := msgCtlr.SendMessage("testuser1", "testuser2", content, ""); err != nil {
+			t.Fatalf("Sending a message failed: %v.", err)
+		}
+	}
+	messages, syncToken, err := msgCtlr.FetchMessagesAfter("testuser2", "testuser1", 2, 0)
+	if err != nil {
+		t.Fatalf("Unable to sync a conversation: %v.", err)
+	}
+	if got, want := len(messages), 2; got != want {
+		t.Fatalf("Wrong number of messages synced: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "One"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	messages, _, err = msgCtlr.FetchMessagesAfter("testuser2", "testuser1", 2, syncToken)
+	if err != nil {
+		t.Fatalf("Unable to sync a conversation: %v.", err)
+	}
+	if got, want := len(messages), 1; got != want {
+		t.Fatalf("Wrong number of messages synced: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Three"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+}
+
+func TestEditMessage(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	if _, err := msgCtlr.SendMessage("testuser1", "testuser2", "Bonjuor!", ""); err != nil {
+		t.Fatalf("Sending a message failed: %v.", err)
+	}
+	if _, err := msgCtlr.EditMessage("testuser2", 1, "Bonjour!"); err == nil {
+		t.Errorf("Recipient was able to edit a message they did not author!")
+	}
+	msg, err := msgCtlr.EditMessage("testuser1", 1, "Bonjour!")
+	if err != nil {
+		t.Fatalf("Unable to edit a message: %v.", err)
+	}
+	if got, want := msg.Content, "Bonjour!"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := msg.Revisions, uint32(1); got != want {
+		t.Errorf("Revision count mismatch: got %v, want %v.", got, want)
+	}
+	if msg.EditedAt.IsZero() {
+		t.Errorf("Edited message has no edit timestamp.")
+	}
+	if _, err := msgCtlr.EditMessage("testuser1", 2, "Nothing to see here."); err == nil {
+		t.Errorf("Able to edit a nonexistent message!")
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	if _, err := msgCtlr.SendMessage("testuser1", "testuser2", "Oops, wrong chat.", ""); err != nil {
+		t.Fatalf("Sending a message failed: %v.", err)
+	}
+	if err := msgCtlr.DeleteMessage("testuser2", 1); !errors.Is(err, logic.ErrNotAuthor) {
+		t.Errorf("Recipient deleting a message for everyone: got error %v, want %v.", err, logic.ErrNotAuthor)
+	}
+	if err := msgCtlr.DeleteMessage("testuser1", 1); err != nil {
+		t.Fatalf("Unable to delete a message for everyone: %v.", err)
+	}
+	if _, err := msgCtlr.EditMessage("testuser1", 1, "Resurrected!"); !errors.Is(err, logic.ErrMessageDeleted) {
+		t.Errorf("Editing a deleted message: got error %v, want %v.", err, logic.ErrMessageDeleted)
+	}
+	messages, _, err := msgCtlr.FetchMessagesBefore("testuser2", "testuser1", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to fetch a conversation: %v.", err)
+	}
+	if got, want := len(messages), 1; got != want {
+		t.Fatalf("Conversation has wrong number of messages: got %v, want %v.", got, want)
+	}
+	if !messages[0].Deleted || messages[0].Content != "" {
+		t.Errorf("Deleted message was not replaced by a tombstone: %+v.", messages[0])
+	}
+}
+
+func TestHideMessage(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	conversation, err := msgCtlr.CreateConversation("testuser1", "Test group", []string{"testuser2"})
+	if err != nil {
+		t.Fatalf("Unable to create a group conversation: %v.", err)
+	}
+	if _, err := msgCtlr.SendToConversation("testuser1", conversation, "Hello everyone!", ""); err != nil {
+		t.Fatalf("Sending a message to a group conversation failed: %v.", err)
+	}
+	messages, _, err := msgCtlr.FetchConversationBefore("testuser2", conversation, math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to fetch group conversation: %v.", err)
+	}
+	id := messages[0].ID
+	if err := msgCtlr.HideMessage("testuser3", id); !errors.Is(err, logic.ErrNotMember) {
+		t.Errorf("Non-member deleting a message for themselves: got error %v, want %v.", err, logic.ErrNotMember)
+	}
+	if err := msgCtlr.HideMessage("testuser2", id); err != nil {
+		t.Fatalf("Unable to delete a message for oneself: %v.", err)
+	}
+	if got, want := len(mockDb.hidden[id]), 1; got != want {
+		t.Errorf("Message hidden from wrong number of users: got %v, want %v.", got, want)
+	}
+}
+
+func TestIdempotentSend(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	messages, cancel := msgCtlr.Subscribe("testuser2")
+	defer cancel()
+	first, err := msgCtlr.SendMessage("testuser1", "testuser2", "https://www.youtube.com/watch?v=9bZkp7q19f0", "key1")
+	if err != nil {
+		t.Fatalf("Sending a message failed: %v.", err)
+	}
+	if len(first.Metadata) == 0 {
+		t.Errorf("Sent message has no metadata.")
+	}
+	retried, err := msgCtlr.SendMessage("testuser1", "testuser2", "https://www.youtube.com/watch?v=9bZkp7q19f0", "key1")
+	if err != nil {
+		t.Fatalf("Retrying a message failed: %v.", err)
+	}
+	if got, want := retried.ID, first.ID; got != want {
+		t.Errorf("Message ID mismatch: got %v, want %v.", got, want)
+	}
+	select {
+	case <-messages:
+	case <-time.After(time.Second):
+		t.Fatalf("Message was not delivered to subscriber.")
+	}
+	select {
+	case msg := <-messages:
+		t.Errorf("Retried message was delivered again: %+v.", msg)
+	default:
+	}
+}
+
+// searchableDb adds search to the mock DB, matching every message whose content is exactly the query text.
+type searchableDb struct {
+	mockDb
+	viewers []string
+}
+
+func (m *searchableDb) SearchMessages(viewer string, query storage.SearchQuery) ([]storage.SearchResult, error) {
+	m.viewers = append(m.viewers, viewer)
+	var results []storage.SearchResult
+	for _, msgs := range m.conversations {
+		for _, msg := range msgs {
+			if msg.Content == query.Text {
+				results = append(results, storage.SearchResult{Message: msg, Snippet: msg.Content})
+			}
+		}
+	}
+	return results, nil
+}
+
+func TestSearchMessages(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	if _, err := logic.NewMessageController(mockDb).SearchMessages("testuser1", storage.SearchQuery{Text: "hi"}); !errors.Is(err, storage.ErrSearchUnavailable) {
+		t.Errorf("Searching a store without search support: got error %v, want %v.", err, storage.ErrSearchUnavailable)
+	}
+	searchable := &searchableDb{mockDb: *mockDb}
+	msgCtlr := logic.NewMessageController(searchable)
+	if _, err := msgCtlr.SendMessage("testuser1", "testuser2", "hi", ""); err != nil {
+		t.Fatalf("Sending a message failed: %v.", err)
+	}
+	results, err := msgCtlr.SearchMessages("testuser2", storage.SearchQuery{Text: "hi"})
+	if err != nil {
+		t.Fatalf("Searching messages failed: %v.", err)
+	}
+	if got, want := len(results), 1; got != want {
+		t.Fatalf("Wrong number of search results: got %v, want %v.", got, want)
+	}
+	if got, want := results[0].Author, "testuser1"; got != want {
+		t.Errorf("Search result author mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := searchable.viewers, []string{"testuser2"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("Search was not performed as the searching user: got %v, want %v.", got, want)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	conversation, err := msgCtlr.CreateConversation("testuser1", "Test group", []string{"testuser2"})
+	if err != nil {
+		t.Fatalf("Unable to create a group conversation: %v.", err)
+	}
+	events, cancel := msgCtlr.SubscribeEvents("testuser2")
+	defer cancel()
+	if err := msgCtlr.SetTyping("testuser3", conversation); !errors.Is(err, logic.ErrNotMember) {
+		t.Errorf("Non-member typing in a conversation: got %v, want %v.", err, logic.ErrNotMember)
+	}
+	if err := msgCtlr.SetTyping("testuser1", conversation); err != nil {
+		t.Fatalf("Unable to notify members of typing: %v.", err)
+	}
+	select {
+	case event := <-events:
+		want := storage.Event{Kind: storage.EventTyping, Username: "testuser1", Conversation: conversation}
+		if event != want {
+			t.Errorf("Typing event mismatch: got %+v, want %+v.", event, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Typing event was not delivered to conversation member.")
+	}
+}
+
+func TestPresence(t *testing.T) {
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb)
+	if _, err := msgCtlr.SendMessage("testuser1", "testuser2", "Anyone home?", ""); err != nil {
+		t.Fatalf("Sending a message failed: %v.", err)
+	}
+	events, cancel := msgCtlr.SubscribeEvents("testuser1")
+	defer cancel()
+	if online, err := msgCtlr.OnlineContacts("testuser1"); err != nil || len(online) != 0 {
+		t.Errorf("Online contacts mismatch: got %v (%v), want none.", online, err)
+	}
+	_, cancel2 := msgCtlr.SubscribeEvents("testuser2")
+	_, otherCancel2 := msgCtlr.SubscribeEvents("testuser2")
+	if online, err := msgCtlr.OnlineContacts("testuser1"); err != nil || fmt.Sprint(online) != "[testuser2]" {
+		t.Errorf("Online contacts mismatch: got %v (%v), want [testuser2].", online, err)
+	}
+	// The user remains online until their last subscription is cancelled.
+	cancel2()
+	cancel2()
+	otherCancel2()
+	for _, want := range []storage.Event{
+		{Kind: storage.EventOnline, Username: "testuser2"},
+		{Kind: storage.EventOffline, Username: "testuser2"},
+	} {
+		select {
+		case event := <-events:
+			if event != want {
+				t.Errorf("Presence event mismatch: got %+v, want %+v.", event, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Presence event was not delivered to contact.")
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected presence event: %+v.", event)
+	default:
+	}
+	if online, err := msgCtlr.OnlineContacts("testuser1"); err != nil || len(online) != 0 {
+		t.Errorf("Online contacts mismatch: got %v (%v), want none.", online, err)
 	}
 }
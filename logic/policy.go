@@ -0,0 +1,224 @@
+package logic
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/adsouza/chat-backend/storage"
+)
+
+// CredentialPolicy determines which usernames may be registered & which passphrases may be chosen.
+type CredentialPolicy struct {
+	Username   UsernamePolicy
+	Passphrase PassphrasePolicy
+}
+
+// UsernamePolicy constrains usernames. Whatever it allows, two usernames that only differ in case or in the Unicode
+// form of their characters can't both be registered.
+type UsernamePolicy struct {
+	// Lengths are counted in characters, i.e. runes, rather than bytes. MaxLength is unlimited if zero.
+	MinLength, MaxLength int
+	// Allowed reports whether a character may appear in a username. Any character may if it is nil.
+	Allowed func(r rune) bool
+	// Reserved usernames can't be registered, in any case or form.
+	Reserved []string
+}
+
+// PassphrasePolicy constrains passphrases.
+type PassphrasePolicy struct {
+	// Lengths are counted in characters, i.e. runes, rather than bytes. MaxLength is unlimited if zero.
+	MinLength, MaxLength int
+	// Blocklist, if set, holds passphrases that are too common or have been exposed in breaches.
+	Blocklist *PassphraseList
+	// AllowUsername permits passphrases that contain the username, in any case or form.
+	AllowUsername bool
+}
+
+// DefaultReservedUsernames are names that users could otherwise register to pass themselves off as the operators.
+var DefaultReservedUsernames = []string{
+	"admin", "administrator", "root", "system", "support", "help", "security", "moderator", "postmaster", "abuse",
+}
+
+// DefaultCredentialPolicy is used unless the user controller is configured with another.
+var DefaultCredentialPolicy = CredentialPolicy{
+	Username:   UsernamePolicy{MinLength: 3, MaxLength: 32, Allowed: ASCIIUsernameChars, Reserved: DefaultReservedUsernames},
+	Passphrase: PassphrasePolicy{MinLength: 16, MaxLength: 1024},
+}
+
+// ASCIIUsernameChars allows ASCII letters & digits, '.', '_' & '-', which rules out look-alikes from other scripts.
+func ASCIIUsernameChars(r rune) bool {
+	return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-", r))
+}
+
+// UnicodeUsernameChars allows letters, combining marks & digits from any script, along with '.', '_' & '-'.
+func UnicodeUsernameChars(r rune) bool {
+	return unicode.In(r, unicode.Letter, unicode.Mark, unicode.Nd) || strings.ContainsRune("._-", r)
+}
+
+// WithCredentialPolicy sets the rules that usernames & passphrases must follow.
+func WithCredentialPolicy(policy CredentialPolicy) UserOption {
+	return func(c *userController) {
+		c.policy = policy
+	}
+}
+
+// PassphraseList is a set of passphrases that mustn't be used. Entries match regardless of case.
+type PassphraseList struct {
+	plain map[string]bool
+	// sha1 holds upper-case hex SHA-1 hashes of passphrases, as in the Pwned Passwords dataset.
+	sha1 map[string]bool
+}
+
+// LoadPassphraseList reads a list of passphrases from a file with one per line. Lines may instead hold the hex SHA-1
+// hash of a passphrase, optionally followed by a colon & a count of the breaches it appeared in, which is the format
+// of the Pwned Passwords dataset. Hashes match the exact passphrase only.
+func LoadPassphraseList(path string) (*PassphraseList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open passphrase list: %v", err)
+	}
+	defer f.Close()
+	list := &PassphraseList{plain: make(map[string]bool), sha1: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); len(hash) == 2*sha1.Size && isHex(hash) {
+			list.sha1[strings.ToUpper(hash)] = true
+			continue
+		}
+		list.plain[strings.ToLower(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read passphrase list: %v", err)
+	}
+	return list, nil
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// Contains reports whether a passphrase is on the list.
+func (l *PassphraseList) Contains(passphrase string) bool {
+	if l.plain[strings.ToLower(passphrase)] {
+		return true
+	}
+	sum := sha1.Sum([]byte(passphrase))
+	return l.sha1[strings.ToUpper(hex.EncodeToString(sum[:]))]
+}
+
+// Len returns the number of entries on the list.
+func (l *PassphraseList) Len() int {
+	return len(l.plain) + len(l.sha1)
+}
+
+// PolicyError reports every way in which a request breaks the credential policy. It wraps ErrEmptyUsername or
+// ErrInvalidUsername if the username is at fault & ErrWeakPassphrase if the passphrase is.
+type PolicyError struct {
+	Violations []storage.FieldViolation
+	errs       []error
+}
+
+func (e *PolicyError) Error() string {
+	descriptions := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		descriptions[i] = v.Field + " " + v.Description
+	}
+	return strings.Join(descriptions, "; ")
+}
+
+func (e *PolicyError) Unwrap() []error {
+	return e.errs
+}
+
+// FieldViolations lets the API tell clients which fields to correct.
+func (e *PolicyError) FieldViolations() []storage.FieldViolation {
+	return e.Violations
+}
+
+// add records the violations of one field, if any, along with the error that they amount to.
+func (e *PolicyError) add(err error, violations []storage.FieldViolation) {
+	if len(violations) > 0 {
+		e.Violations = append(e.Violations, violations...)
+		e.errs = append(e.errs, err)
+	}
+}
+
+// orNil returns nil rather than an error without any violations.
+func (e *PolicyError) orNil() error {
+	if len(e.errs) == 0 {
+		return nil
+	}
+	return e
+}
+
+func violation(field, format string, args ...interface{}) storage.FieldViolation {
+	return storage.FieldViolation{Field: field, Description: fmt.Sprintf(format, args...)}
+}
+
+// check records the ways in which a username, given in the specified field of a request, breaks the policy.
+func (p UsernamePolicy) check(e *PolicyError, field, username string) {
+	if username == "" {
+		e.add(ErrEmptyUsername, []storage.FieldViolation{violation(field, "must not be empty")})
+		return
+	}
+	var violations []storage.FieldViolation
+	if n := utf8.RuneCountInString(username); p.MaxLength > 0 && (n < p.MinLength || n > p.MaxLength) {
+		violations = append(violations, violation(field, "must be between %d & %d characters long", p.MinLength, p.MaxLength))
+	} else if n < p.MinLength {
+		violations = append(violations, violation(field, "must be at least %d characters long", p.MinLength))
+	}
+	if !utf8.ValidString(username) {
+		violations = append(violations, violation(field, "must be valid UTF-8"))
+	} else if i := strings.IndexFunc(username, func(r rune) bool { return p.Allowed != nil && !p.Allowed(r) }); i >= 0 {
+		r, _ := utf8.DecodeRuneInString(username[i:])
+		violations = append(violations, violation(field, "must not contain %q", r))
+	}
+	canonical := storage.CanonicalUsername(username)
+	for _, reserved := range p.Reserved {
+		if canonical == storage.CanonicalUsername(reserved) {
+			violations = append(violations, violation(field, "is reserved"))
+			break
+		}
+	}
+	e.add(ErrInvalidUsername, violations)
+}
+
+// check records the ways in which a passphrase, given in the specified field of a request, breaks the policy.
+func (p PassphrasePolicy) check(e *PolicyError, field, passphrase, username string) {
+	var violations []storage.FieldViolation
+	if n := utf8.RuneCountInString(passphrase); n < p.MinLength {
+		violations = append(violations, violation(field, "must be at least %d characters long", p.MinLength))
+	} else if p.MaxLength > 0 && n > p.MaxLength {
+		violations = append(violations, violation(field, "must be at most %d characters long", p.MaxLength))
+	}
+	if p.Blocklist != nil && p.Blocklist.Contains(passphrase) {
+		violations = append(violations, violation(field, "is too common or has appeared in a data breach"))
+	}
+	if canonical := storage.CanonicalUsername(username); !p.AllowUsername && canonical != "" &&
+		strings.Contains(storage.CanonicalUsername(passphrase), canonical) {
+		violations = append(violations, violation(field, "must not contain the username"))
+	}
+	e.add(ErrWeakPassphrase, violations)
+}
+
+// checkPassphrase records the ways in which a passphrase, given in the specified field of a request, breaks the policy
+// or is too long for the hasher to accept.
+func (c *userController) checkPassphrase(e *PolicyError, field, passphrase, username string) {
+	c.policy.Passphrase.check(e, field, passphrase, username)
+	if limited, ok := c.hasher.(interface{ MaxPassphraseBytes() int }); ok && len(passphrase) > limited.MaxPassphraseBytes() {
+		e.add(ErrWeakPassphrase, []storage.FieldViolation{
+			violation(field, "must be at most %d bytes long when encoded as UTF-8", limited.MaxPassphraseBytes()),
+		})
+	}
+}
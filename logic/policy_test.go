@@ -0,0 +1,177 @@
+package logic_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/adsouza/chat-backend/logic"
+	"github.com/adsouza/chat-backend/storage"
+)
+
+// violations returns the field violations of an error, formatted as the field followed by the description.
+func violations(err error) []string {
+	var policyErr *logic.PolicyError
+	if !errors.As(err, &policyErr) {
+		return nil
+	}
+	var formatted []string
+	for _, v := range policyErr.FieldViolations() {
+		formatted = append(formatted, v.Field+" "+v.Description)
+	}
+	return formatted
+}
+
+func TestUsernamePolicy(t *testing.T) {
+	unicodePolicy := logic.DefaultCredentialPolicy
+	unicodePolicy.Username.Allowed = logic.UnicodeUsernameChars
+	for _, tc := range []struct {
+		username string
+		policy   logic.CredentialPolicy
+		want     []string
+	}{
+		{"bob.smith_1-x", logic.DefaultCredentialPolicy, nil},
+		{"bo", logic.DefaultCredentialPolicy, []string{"username must be between 3 & 32 characters long"}},
+		{"bob smith", logic.DefaultCredentialPolicy, []string{`username must not contain ' '`}},
+		{"josé", logic.DefaultCredentialPolicy, []string{`username must not contain 'é'`}},
+		{"josé", unicodePolicy, nil},
+		{"ｔｅｓｔ", unicodePolicy, nil},
+		{"ROOT", logic.DefaultCredentialPolicy, []string{"username is reserved"}},
+		{"ｒｏｏｔ", unicodePolicy, []string{"username is reserved"}},
+		{"ab\u00a0", logic.DefaultCredentialPolicy, []string{`username must not contain '\u00a0'`}},
+	} {
+		userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)}, logic.WithCredentialPolicy(tc.policy))
+		err := userCtlr.CreateUser(tc.username, "123456789abcdefg")
+		if got := violations(err); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Violations for username %q: got %q, want %q.", tc.username, got, tc.want)
+		}
+		if tc.want != nil && !errors.Is(err, logic.ErrInvalidUsername) {
+			t.Errorf("Invalid username %q: got error %v, want %v.", tc.username, err, logic.ErrInvalidUsername)
+		}
+	}
+}
+
+func TestCustomUsernamePolicy(t *testing.T) {
+	// Neither a maximum length nor a set of allowed characters, which would otherwise rule out every username.
+	userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)},
+		logic.WithCredentialPolicy(logic.CredentialPolicy{Username: logic.UsernamePolicy{MinLength: 2}}))
+	for _, username := range []string{"bob smith", strings.Repeat("x", 100)} {
+		if err := userCtlr.CreateUser(username, "123456789abcdefg"); err != nil {
+			t.Errorf("Unable to create user %q without limits on length & characters: %v.", username, err)
+		}
+	}
+	if err := userCtlr.RenameUser("bob smith", "bob jones"); err != nil {
+		t.Errorf("Unable to rename user without limits on length & characters: %v.", err)
+	}
+	want := []string{"new_username must be at least 2 characters long"}
+	if got := violations(userCtlr.RenameUser("bob jones", "b")); !reflect.DeepEqual(got, want) {
+		t.Errorf("Violations for username that is too short: got %q, want %q.", got, want)
+	}
+}
+
+func TestCanonicalUsernames(t *testing.T) {
+	policy := logic.DefaultCredentialPolicy
+	policy.Username.Allowed = logic.UnicodeUsernameChars
+	userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)}, logic.WithCredentialPolicy(policy))
+	if err := userCtlr.CreateUser("TestUser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	// The same name in another case & in full-width characters.
+	for _, username := range []string{"testuser1", "ＴＥＳＴＵＳＥＲ１"} {
+		if err := userCtlr.CreateUser(username, "123456789abcdefg"); !errors.Is(err, storage.ErrUserExists) {
+			t.Errorf("Username %q equivalent to an existing one: got error %v, want %v.", username, err, storage.ErrUserExists)
+		}
+	}
+	if err := userCtlr.CreateUser("José", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	if err := userCtlr.CreateUser("jose\u0301", "123456789abcdefg"); !errors.Is(err, storage.ErrUserExists) {
+		t.Errorf("Username with decomposed accent: got error %v, want %v.", err, storage.ErrUserExists)
+	}
+	if err := userCtlr.RenameUser("TestUser1", "testuser1"); err != nil {
+		t.Errorf("Unable to change the case of a username: %v.", err)
+	}
+	if err := userCtlr.RenameUser("testuser1", "JOSÉ"); !errors.Is(err, storage.ErrUserExists) {
+		t.Errorf("Rename to a username equivalent to another: got error %v, want %v.", err, storage.ErrUserExists)
+	}
+}
+
+func TestPassphrasePolicy(t *testing.T) {
+	dir := t.TempDir()
+	breached := sha1.Sum([]byte("Tr0ub4dor&3xyzzy!"))
+	list := "password1234567890\nCorrectHorseBatteryStaple\n" + hex.EncodeToString(breached[:]) + ":42\n"
+	if err := os.WriteFile(filepath.Join(dir, "blocklist.txt"), []byte(list), 0600); err != nil {
+		t.Fatalf("Unable to write blocklist: %v.", err)
+	}
+	blocklist, err := logic.LoadPassphraseList(filepath.Join(dir, "blocklist.txt"))
+	if err != nil {
+		t.Fatalf("Unable to load blocklist: %v.", err)
+	}
+	policy := logic.DefaultCredentialPolicy
+	policy.Passphrase.Blocklist = blocklist
+	policy.Passphrase.MaxLength = 20
+	for _, tc := range []struct {
+		passphrase string
+		want       []string
+	}{
+		{"123456789abcdefg", nil},
+		// 16 characters, but twice as many bytes.
+		{"éééééééééééééééé", nil},
+		{"ééééééééééééééé", []string{"passphrase must be at least 16 characters long"}},
+		{"123456789abcdefghijkl", []string{"passphrase must be at most 20 characters long"}},
+		{"correcthorsebatterystaple", []string{
+			"passphrase must be at most 20 characters long", "passphrase is too common or has appeared in a data breach",
+		}},
+		{"PASSWORD1234567890", []string{"passphrase is too common or has appeared in a data breach"}},
+		{"Tr0ub4dor&3xyzzy!", []string{"passphrase is too common or has appeared in a data breach"}},
+		{"my TestUser1 secret", []string{"passphrase must not contain the username"}},
+	} {
+		userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)}, logic.WithCredentialPolicy(policy))
+		err := userCtlr.CreateUser("testuser1", tc.passphrase)
+		if got := violations(err); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Violations for passphrase %q: got %q, want %q.", tc.passphrase, got, tc.want)
+		}
+		if tc.want != nil && !errors.Is(err, logic.ErrWeakPassphrase) {
+			t.Errorf("Weak passphrase %q: got error %v, want %v.", tc.passphrase, err, logic.ErrWeakPassphrase)
+		}
+	}
+}
+
+func TestPassphraseTooLongToHash(t *testing.T) {
+	passphrase := strings.Repeat("correct horse ", 7) + "ba"
+	userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)})
+	err := userCtlr.CreateUser("testuser1", passphrase)
+	want := []string{"passphrase must be at most 72 bytes long when encoded as UTF-8"}
+	if got := violations(err); !reflect.DeepEqual(got, want) {
+		t.Errorf("Violations for %d character passphrase with bcrypt: got %q, want %q.", len(passphrase), got, want)
+	}
+	if !errors.Is(err, logic.ErrWeakPassphrase) {
+		t.Errorf("Passphrase too long for bcrypt: got error %v, want %v.", err, logic.ErrWeakPassphrase)
+	}
+	// argon2id has no such limit.
+	userCtlr = logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)},
+		logic.WithHasher(logic.Argon2idHasher{Time: 1, Memory: 64, Threads: 1}))
+	if err := userCtlr.CreateUser("testuser1", passphrase); err != nil {
+		t.Errorf("Unable to create user with %d character passphrase with argon2id: %v.", len(passphrase), err)
+	}
+}
+
+func TestPolicyReportsEveryField(t *testing.T) {
+	userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)})
+	err := userCtlr.CreateUser("x", "short")
+	if !errors.Is(err, logic.ErrInvalidUsername) || !errors.Is(err, logic.ErrWeakPassphrase) {
+		t.Errorf("Invalid username & passphrase: got error %v, want both %v & %v.", err, logic.ErrInvalidUsername, logic.ErrWeakPassphrase)
+	}
+	want := []string{"username must be between 3 & 32 characters long", "passphrase must be at least 16 characters long"}
+	if got := violations(err); !reflect.DeepEqual(got, want) {
+		t.Errorf("Violations mismatch: got %q, want %q.", got, want)
+	}
+	if _, _, err := userCtlr.ChangePassphrase("x", "short", "y"); errors.Is(err, logic.ErrWeakPassphrase) {
+		t.Errorf("New passphrase was checked before the old one: got error %v.", err)
+	}
+}
@@ -0,0 +1,260 @@
+package logic
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adsouza/chat-backend/api"
+)
+
+// Media identifies what a link to a provider refers to. Fields are left empty if the link doesn't say.
+type Media struct {
+	ID string
+	// Start is how far into the media playback should begin.
+	Start    time.Duration
+	Playlist string
+}
+
+// Matcher matches links by host & path.
+type Matcher struct {
+	// Host must equal the hostname of the link, ignoring case & any "www." prefix. If empty, any host matches.
+	Host string
+	// Path, if set, must match the path of the link.
+	Path *regexp.Regexp
+}
+
+func (m Matcher) matches(link *url.URL) bool {
+	if m.Host != "" && !strings.EqualFold(m.Host, strings.TrimPrefix(strings.ToLower(link.Hostname()), "www.")) {
+		return false
+	}
+	return m.Path == nil || m.Path.MatchString(link.Path)
+}
+
+// Provider describes a source of media that links in messages may refer to.
+type Provider struct {
+	Name string
+	// Source is reported in the Video metadata of links to this provider.
+	Source api.Video_Source
+	// Image means that the provider's links are to images, which have Image metadata instead of Video.
+	Image bool
+	// A link is to this provider if any of these match it.
+	Matchers []Matcher
+	// Extract identifies the media that a matching link refers to. If nil, nothing is extracted.
+	Extract func(link *url.URL) Media
+}
+
+// ProviderRegistry recognizes links to media from any of the providers registered with it, in order of registration.
+// It is safe for concurrent use.
+type ProviderRegistry struct {
+	mu        sync.RWMutex
+	providers []Provider
+}
+
+func NewProviderRegistry(providers ...Provider) *ProviderRegistry {
+	return &ProviderRegistry{providers: providers}
+}
+
+// Register adds a provider, which is only consulted for links that none of those registered earlier match.
+func (r *ProviderRegistry) Register(provider Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers = append(r.providers, provider)
+}
+
+// Lookup returns the first provider that matches the link.
+func (r *ProviderRegistry) Lookup(link *url.URL) (Provider, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, provider := range r.providers {
+		for _, matcher := range provider.Matchers {
+			if matcher.matches(link) {
+				return provider, true
+			}
+		}
+	}
+	return Provider{}, false
+}
+
+// Metadata describes the media that a link refers to, which is nothing if no provider matches it.
+func (r *ProviderRegistry) Metadata(link *url.URL) *api.Metadata {
+	provider, ok := r.Lookup(link)
+	if !ok {
+		return &api.Metadata{}
+	}
+	if provider.Image {
+		return &api.Metadata{Media: &api.Metadata_Image{Image: &api.Image{}}}
+	}
+	var media Media
+	if provider.Extract != nil {
+		media = provider.Extract(link)
+	}
+	return &api.Metadata{Media: &api.Metadata_Video{Video: &api.Video{
+		Source:       provider.Source,
+		Id:           media.ID,
+		StartSeconds: uint32(media.Start / time.Second),
+		PlaylistId:   media.Playlist,
+	}}}
+}
+
+// DefaultProviders returns the providers that the message controller recognizes unless told otherwise.
+func DefaultProviders() []Provider {
+	return []Provider{
+		{
+			Name:   "YouTube",
+			Source: api.Video_YOUTUBE,
+			Matchers: []Matcher{
+				{Host: "youtube.com", Path: regexp.MustCompile(`^/(watch|playlist|embed/|shorts/|live/|v/)`)},
+				{Host: "m.youtube.com", Path: regexp.MustCompile(`^/(watch|playlist|shorts/|live/)`)},
+				{Host: "music.youtube.com", Path: regexp.MustCompile(`^/(watch|playlist)`)},
+				{Host: "youtube-nocookie.com", Path: regexp.MustCompile(`^/embed/`)},
+				{Host: "youtu.be", Path: regexp.MustCompile(`^/[\w-]+$`)},
+			},
+			Extract: extractYouTube,
+		},
+		{
+			Name:     "Vevo",
+			Source:   api.Video_VEVO,
+			Matchers: []Matcher{{Host: "vevo.com", Path: regexp.MustCompile(`^/watch/`)}},
+			Extract:  func(link *url.URL) Media { return Media{ID: path.Base(link.Path)} },
+		},
+		{
+			Name:   "Vimeo",
+			Source: api.Video_VIMEO,
+			Matchers: []Matcher{
+				{Host: "vimeo.com", Path: regexp.MustCompile(`^/(\d+|channels/[\w-]+/\d+|showcase/\d+)/?$`)},
+				{Host: "player.vimeo.com", Path: regexp.MustCompile(`^/video/\d+`)},
+			},
+			Extract: extractVimeo,
+		},
+		{
+			Name:   "Twitch",
+			Source: api.Video_TWITCH,
+			Matchers: []Matcher{
+				{Host: "twitch.tv", Path: regexp.MustCompile(`^/(videos/\d+|\w+/clip/[\w-]+|\w+)/?$`)},
+				{Host: "m.twitch.tv", Path: regexp.MustCompile(`^/(videos/\d+|\w+/clip/[\w-]+|\w+)/?$`)},
+				{Host: "clips.twitch.tv", Path: regexp.MustCompile(`^/[\w-]+/?$`)},
+			},
+			Extract: extractTwitch,
+		},
+		{
+			Name:   "SoundCloud",
+			Source: api.Video_SOUNDCLOUD,
+			Matchers: []Matcher{
+				{Host: "soundcloud.com", Path: regexp.MustCompile(`^/[\w-]+/[\w-]+`)},
+				{Host: "m.soundcloud.com", Path: regexp.MustCompile(`^/[\w-]+/[\w-]+`)},
+			},
+			Extract: extractSoundCloud,
+		},
+		{
+			Name:   "Spotify",
+			Source: api.Video_SPOTIFY,
+			Matchers: []Matcher{
+				{Host: "open.spotify.com", Path: regexp.MustCompile(`^/(intl-[\w-]+/)?(track|episode|album|playlist|show)/\w+`)},
+			},
+			Extract: extractSpotify,
+		},
+		{
+			Name:     "Video file",
+			Source:   api.Video_FILE,
+			Matchers: []Matcher{{Path: regexp.MustCompile(`(?i)\.(mp4|m4v|webm|mov|ogv|mp3|m4a|ogg|oga|wav|flac)$`)}},
+		},
+		{
+			Name:     "Image file",
+			Image:    true,
+			Matchers: []Matcher{{Path: regexp.MustCompile(`(?i)\.(png|jpe?g|gif|webp|avif|bmp|svg)$`)}},
+		},
+	}
+}
+
+func extractYouTube(link *url.URL) Media {
+	query := link.Query()
+	media := Media{ID: query.Get("v"), Playlist: query.Get("list")}
+	if segments := strings.Split(strings.Trim(link.Path, "/"), "/"); media.ID == "" {
+		switch {
+		case strings.EqualFold(link.Hostname(), "youtu.be"):
+			media.ID = segments[0]
+		case len(segments) == 2:
+			// e.g. /embed/ID, /shorts/ID or /live/ID.
+			media.ID = segments[1]
+		}
+	}
+	media.Start = parseStart(firstNonEmpty(query.Get("t"), query.Get("start")))
+	return media
+}
+
+func extractVimeo(link *url.URL) Media {
+	media := Media{ID: path.Base(strings.TrimSuffix(link.Path, "/"))}
+	if strings.HasPrefix(link.Path, "/showcase/") {
+		media = Media{Playlist: media.ID}
+	}
+	media.Start = parseStart(strings.TrimPrefix(link.Fragment, "t="))
+	return media
+}
+
+func extractTwitch(link *url.URL) Media {
+	segments := strings.Split(strings.Trim(link.Path, "/"), "/")
+	media := Media{ID: segments[len(segments)-1], Start: parseStart(link.Query().Get("t"))}
+	if segments[0] == "videos" {
+		// Twitch distinguishes past broadcasts from channels, whose names may be numeric, by this prefix.
+		media.ID = "v" + media.ID
+	}
+	return media
+}
+
+func extractSoundCloud(link *url.URL) Media {
+	segments := strings.Split(strings.Trim(link.Path, "/"), "/")
+	media := Media{Start: parseStart(strings.TrimPrefix(link.Fragment, "t="))}
+	if len(segments) >= 3 && segments[1] == "sets" {
+		media.Playlist = strings.Join(segments[:3], "/")
+	} else {
+		media.ID = strings.Join(segments[:2], "/")
+	}
+	return media
+}
+
+func extractSpotify(link *url.URL) Media {
+	segments := strings.Split(strings.Trim(link.Path, "/"), "/")
+	if strings.HasPrefix(segments[0], "intl-") {
+		segments = segments[1:]
+	}
+	kind, id := segments[0], segments[1]
+	switch kind {
+	case "album", "playlist", "show":
+		return Media{Playlist: kind + ":" + id}
+	default:
+		return Media{ID: kind + ":" + id}
+	}
+}
+
+var startPattern = regexp.MustCompile(`^(?:(\d+)h)?(?:(\d+)m)?(?:(\d+)s?)?$`)
+
+// parseStart parses a start time given as seconds, as in "90" or "90s", with units, as in "1h2m3s", or with colons,
+// as in "1:02:03". It returns zero if s is none of those.
+func parseStart(s string) time.Duration {
+	if strings.Contains(s, ":") {
+		var d time.Duration
+		for _, part := range strings.Split(s, ":") {
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0
+			}
+			d = d*60 + time.Duration(n)
+		}
+		return d * time.Second
+	}
+	match := startPattern.FindStringSubmatch(strings.ToLower(s))
+	if match == nil {
+		return 0
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		n, _ := strconv.Atoi(match[i+1])
+		d += time.Duration(n) * unit
+	}
+	return d
+}
@@ -0,0 +1,158 @@
+package logic
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/adsouza/chat-backend/storage"
+)
+
+// ThrottlePolicy determines how failed logins for the same username, or from the same IP address, hold up further
+// attempts. Failures are forgotten after a successful login for the username, or after LockoutDuration without any.
+type ThrottlePolicy struct {
+	// FreeAttempts failures in a row are allowed before further attempts are delayed.
+	FreeAttempts uint32
+	// The delay after each failure beyond the free ones doubles, starting from BaseDelay, up to MaxDelay.
+	BaseDelay, MaxDelay time.Duration
+	// Once LockoutThreshold failures happen in a row, attempts are refused for LockoutDuration.
+	LockoutThreshold uint32
+	LockoutDuration  time.Duration
+}
+
+var (
+	DefaultUsernameThrottle = ThrottlePolicy{
+		FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute, LockoutThreshold: 10, LockoutDuration: 15 * time.Minute,
+	}
+	// DefaultClientIPThrottle is more lenient, since many users may share an address.
+	DefaultClientIPThrottle = ThrottlePolicy{
+		FreeAttempts: 10, BaseDelay: time.Second, MaxDelay: time.Minute, LockoutThreshold: 100, LockoutDuration: 15 * time.Minute,
+	}
+)
+
+// The scopes within which failed logins are recorded.
+const (
+	usernameScope = "username"
+	clientIPScope = "ip"
+)
+
+// retryAt returns when the next attempt may be made after the specified failures, which is zero if it needn't wait.
+func (p ThrottlePolicy) retryAt(failures storage.LoginFailures) time.Time {
+	switch {
+	case failures.Count >= p.LockoutThreshold:
+		return failures.Last.Add(p.LockoutDuration)
+	case failures.Count > p.FreeAttempts:
+		delay := p.BaseDelay
+		for i := p.FreeAttempts + 1; i < failures.Count && delay < p.MaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+		return failures.Last.Add(delay)
+	default:
+		return time.Time{}
+	}
+}
+
+// throttledError reports that logins are being refused until a certain time. Its RetryDelay method lets the API tell
+// clients how long to wait.
+type throttledError struct {
+	until time.Time
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("%v: try again in %v", ErrTooManyAttempts, e.RetryDelay())
+}
+
+func (e *throttledError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+// RetryDelay rounds up to whole seconds, so that a client which waits that long finds the wait over.
+func (e *throttledError) RetryDelay() time.Duration {
+	return (time.Until(e.until) + time.Second - 1).Truncate(time.Second)
+}
+
+// throttledSubject is something for which failed logins are tracked.
+type throttledSubject struct {
+	scope, subject string
+	policy         ThrottlePolicy
+}
+
+// throttledSubjects returns what failed logins are tracked for, omitting the client's address if it is unknown.
+func (c *userController) throttledSubjects(username, clientIP string) []throttledSubject {
+	subjects := []throttledSubject{{usernameScope, username, c.usernameThrottle}}
+	if clientIP != "" {
+		subjects = append(subjects, throttledSubject{clientIPScope, clientIP, c.clientIPThrottle})
+	}
+	return subjects
+}
+
+// reserveAttempt counts a login attempt as failed before it is checked, so that attempts made in parallel can't all
+// slip past the throttle while none of their failures have been recorded yet. It returns a throttledError without
+// recording anything if the attempt must wait because of earlier failures, & one after recording it if attempts in
+// parallel used up the allowance in the meantime. If the attempt succeeds, the caller releases it via releaseAttempt.
+func (c *userController) reserveAttempt(username, clientIP string) error {
+	now := time.Now()
+	subjects := c.throttledSubjects(username, clientIP)
+	seen := make([]storage.LoginFailures, len(subjects))
+	var until time.Time
+	for i, s := range subjects {
+		failures, err := c.db.FetchLoginFailures(s.scope, s.subject, now.Add(-s.policy.LockoutDuration))
+		if err != nil {
+			return err
+		}
+		seen[i] = failures
+		if at := s.policy.retryAt(failures); at.After(now) && at.After(until) {
+			until = at
+		}
+	}
+	if !until.IsZero() {
+		return &throttledError{until: until}
+	}
+	for i, s := range subjects {
+		failures, err := c.db.RecordLoginFailure(s.scope, s.subject, now, now.Add(-s.policy.LockoutDuration))
+		if err != nil {
+			return err
+		}
+		// Any failures preceding this one that weren't seen above were just recorded by attempts in parallel.
+		preceding := storage.LoginFailures{Count: failures.Count - 1, Last: seen[i].Last}
+		if preceding.Count != seen[i].Count {
+			preceding.Last = now
+		}
+		if at := s.policy.retryAt(preceding); at.After(now) && at.After(until) {
+			until = at
+		}
+	}
+	if !until.IsZero() {
+		return &throttledError{until: until}
+	}
+	return nil
+}
+
+// releaseAttempt takes back the failure that reserveAttempt recorded for an attempt that turned out not to fail.
+func (c *userController) releaseAttempt(username, clientIP string) error {
+	for _, s := range c.throttledSubjects(username, clientIP) {
+		if err := c.db.ForgetLoginFailure(s.scope, s.subject); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnlockAccount lets an administrator forget the failed logins for a username, a client's address or both, lifting
+// any lockout.
+func (c *userController) UnlockAccount(admin, username, clientIP string) error {
+	if !c.admins[admin] {
+		return fmt.Errorf("%w: %v", ErrNotAdmin, admin)
+	}
+	if username != "" {
+		if err := c.db.ClearLoginFailures(usernameScope, username); err != nil {
+			return err
+		}
+	}
+	if clientIP != "" {
+		return c.db.ClearLoginFailures(clientIPScope, clientIP)
+	}
+	return nil
+}
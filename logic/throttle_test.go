@@ -0,0 +1,193 @@
+package logic_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/adsouza/chat-backend/logic"
+	"github.com/adsouza/chat-backend/storage"
+)
+
+// strictThrottle uses delays long enough that no test could outlast them, so that they are skipped by rewinding the
+// time of the last failure instead.
+var strictThrottle = logic.ThrottlePolicy{
+	FreeAttempts: 2, BaseDelay: time.Hour, MaxDelay: time.Hour, LockoutThreshold: 4, LockoutDuration: 2 * time.Hour,
+}
+
+// retryDelay returns how long a throttled login was told to wait.
+func retryDelay(err error) time.Duration {
+	var throttled interface{ RetryDelay() time.Duration }
+	if !errors.As(err, &throttled) {
+		return 0
+	}
+	return throttled.RetryDelay()
+}
+
+// rewind moves the last failed login for a subject into the past.
+func (m *mockUserStore) rewind(key string, d time.Duration) {
+	failures := m.failures[key]
+	failures.Last = failures.Last.Add(-d)
+	m.failures[key] = failures
+}
+
+func TestUsernameThrottle(t *testing.T) {
+	store := &mockUserStore{hashes: make(map[string][]byte)}
+	userCtlr := logic.NewUserController(store, logic.WithLoginThrottles(strictThrottle, logic.DefaultClientIPThrottle),
+		logic.WithAdmins("admin"))
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := userCtlr.Login("testuser1", "123456789abcdef!", "", ""); !errors.Is(err, logic.ErrInvalidCredentials) {
+			t.Fatalf("Wrong passphrase #%d: got error %v, want %v.", i+1, err, logic.ErrInvalidCredentials)
+		}
+	}
+	_, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "")
+	if !errors.Is(err, logic.ErrTooManyAttempts) {
+		t.Fatalf("Login after too many failures: got error %v, want %v.", err, logic.ErrTooManyAttempts)
+	}
+	if got := retryDelay(err); got != time.Hour {
+		t.Errorf("Retry delay after too many failures: got %v, want %v.", got, time.Hour)
+	}
+	store.rewind("username/testuser1", time.Hour)
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdef!", "", ""); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Fatalf("Wrong passphrase once the delay was over: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+	}
+	store.rewind("username/testuser1", time.Hour)
+	_, _, err = userCtlr.Login("testuser1", "123456789abcdefg", "", "")
+	if !errors.Is(err, logic.ErrTooManyAttempts) {
+		t.Fatalf("Login while locked out: got error %v, want %v.", err, logic.ErrTooManyAttempts)
+	}
+	if got := retryDelay(err); got != time.Hour {
+		t.Errorf("Retry delay while locked out: got %v, want %v.", got, time.Hour)
+	}
+	store.rewind("username/testuser1", time.Hour)
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", ""); err != nil {
+		t.Fatalf("Unable to log in once the lockout was over: %v.", err)
+	}
+	if _, ok := store.failures["username/testuser1"]; ok {
+		t.Errorf("Failed logins were not forgotten after a successful login.")
+	}
+}
+
+// staleStore behaves as if every attempt looked up the failed logins before any of the others recorded a failure, as
+// happens when they are made in parallel.
+type staleStore struct {
+	*mockUserStore
+}
+
+func (s staleStore) FetchLoginFailures(scope, subject string, since time.Time) (storage.LoginFailures, error) {
+	return storage.LoginFailures{}, nil
+}
+
+func TestParallelAttempts(t *testing.T) {
+	store := &mockUserStore{hashes: make(map[string][]byte)}
+	userCtlr := logic.NewUserController(staleStore{store}, logic.WithLoginThrottles(strictThrottle, logic.DefaultClientIPThrottle))
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := userCtlr.Login("testuser1", "123456789abcdef!", "", "192.0.2.1"); !errors.Is(err, logic.ErrInvalidCredentials) {
+			t.Fatalf("Wrong passphrase #%d: got error %v, want %v.", i+1, err, logic.ErrInvalidCredentials)
+		}
+	}
+	_, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "192.0.2.1")
+	if !errors.Is(err, logic.ErrTooManyAttempts) {
+		t.Fatalf("Attempt beyond the free ones made in parallel: got error %v, want %v.", err, logic.ErrTooManyAttempts)
+	}
+	if got := retryDelay(err); got != time.Hour {
+		t.Errorf("Retry delay after attempts made in parallel: got %v, want %v.", got, time.Hour)
+	}
+	if got, want := store.failures["username/testuser1"].Count, uint32(4); got != want {
+		t.Errorf("Failed login count mismatch: got %v, want %v.", got, want)
+	}
+}
+
+func TestSuccessfulLoginsFromSharedAddress(t *testing.T) {
+	store := &mockUserStore{hashes: make(map[string][]byte)}
+	userCtlr := logic.NewUserController(store, logic.WithLoginThrottles(logic.DefaultUsernameThrottle, strictThrottle))
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	if _, _, err := userCtlr.Login("testuser2", "123456789abcdefg", "", "192.0.2.1"); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Fatalf("Unknown user: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+	}
+	for i := 0; i < 5; i++ {
+		if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "192.0.2.1"); err != nil {
+			t.Fatalf("Unable to log in #%d: %v.", i+1, err)
+		}
+	}
+	if got, want := store.failures["ip/192.0.2.1"].Count, uint32(1); got != want {
+		t.Errorf("Failed login count for the address mismatch: got %v, want %v.", got, want)
+	}
+}
+
+func TestClientIPThrottle(t *testing.T) {
+	store := &mockUserStore{hashes: make(map[string][]byte)}
+	userCtlr := logic.NewUserController(store, logic.WithLoginThrottles(logic.DefaultUsernameThrottle, strictThrottle))
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	for _, username := range []string{"testuser2", "testuser3", "testuser4"} {
+		if _, _, err := userCtlr.Login(username, "123456789abcdefg", "", "192.0.2.1"); !errors.Is(err, logic.ErrInvalidCredentials) {
+			t.Fatalf("Unknown user %v: got error %v, want %v.", username, err, logic.ErrInvalidCredentials)
+		}
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "192.0.2.1"); !errors.Is(err, logic.ErrTooManyAttempts) {
+		t.Errorf("Login from locked out address: got error %v, want %v.", err, logic.ErrTooManyAttempts)
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "192.0.2.2"); err != nil {
+		t.Errorf("Unable to log in from another address: %v.", err)
+	}
+	if _, ok := store.failures["ip/192.0.2.1"]; !ok {
+		t.Errorf("Failed logins from an address were forgotten after a successful login from another.")
+	}
+}
+
+func TestUnlockAccount(t *testing.T) {
+	store := &mockUserStore{hashes: make(map[string][]byte)}
+	userCtlr := logic.NewUserController(store, logic.WithLoginThrottles(strictThrottle, strictThrottle),
+		logic.WithAdmins("admin"))
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, _, err := userCtlr.Login("testuser1", "123456789abcdef!", "", "192.0.2.1"); !errors.Is(err, logic.ErrInvalidCredentials) {
+			t.Fatalf("Wrong passphrase #%d: got error %v, want %v.", i+1, err, logic.ErrInvalidCredentials)
+		}
+		store.rewind("username/testuser1", time.Hour)
+		store.rewind("ip/192.0.2.1", time.Hour)
+	}
+	if err := userCtlr.UnlockAccount("testuser1", "testuser1", "192.0.2.1"); !errors.Is(err, logic.ErrNotAdmin) {
+		t.Errorf("Unlock by non-admin: got error %v, want %v.", err, logic.ErrNotAdmin)
+	}
+	if err := userCtlr.UnlockAccount("admin", "testuser1", ""); err != nil {
+		t.Fatalf("Unable to unlock username: %v.", err)
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "192.0.2.1"); !errors.Is(err, logic.ErrTooManyAttempts) {
+		t.Errorf("Login from address that is still locked out: got error %v, want %v.", err, logic.ErrTooManyAttempts)
+	}
+	if err := userCtlr.UnlockAccount("admin", "", "192.0.2.1"); err != nil {
+		t.Fatalf("Unable to unlock address: %v.", err)
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "192.0.2.1"); err != nil {
+		t.Errorf("Unable to log in after unlocking: %v.", err)
+	}
+}
+
+func TestAdminAccountsKeepTheirNames(t *testing.T) {
+	userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)}, logic.WithAdmins("admin1"))
+	if err := userCtlr.CreateUser("admin1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	if err := userCtlr.RenameUser("admin1", "someone"); !errors.Is(err, logic.ErrAdminAccount) {
+		t.Errorf("Renaming an admin: got error %v, want %v.", err, logic.ErrAdminAccount)
+	}
+	if err := userCtlr.DeleteAccount("admin1", "123456789abcdefg"); !errors.Is(err, logic.ErrAdminAccount) {
+		t.Errorf("Deleting an admin: got error %v, want %v.", err, logic.ErrAdminAccount)
+	}
+	if err := userCtlr.Authenticate("admin1", "123456789abcdefg"); err != nil {
+		t.Errorf("Unable to authenticate as admin after refusing to rename & delete them: %v.", err)
+	}
+}
@@ -0,0 +1,240 @@
+package logic
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adsouza/chat-backend/storage"
+)
+
+// DefaultTOTPIssuer names this service in authenticator apps unless the user controller is configured with another.
+const DefaultTOTPIssuer = "chat-backend"
+
+// Codes follow RFC 6238 with the parameters that every authenticator app supports: HMAC-SHA1, 6 digits & 30 seconds.
+const (
+	totpPeriod    = 30 * time.Second
+	totpDigits    = 6
+	totpSecretLen = 20
+	// totpSkew is how many time steps either side of the current one are accepted, for clocks that disagree.
+	totpSkew = 1
+	// Each recovery code holds 80 random bits, which is too many to guess, so a fast hash suffices to store them.
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// WithTOTPIssuer sets the name under which authenticator apps list this service.
+func WithTOTPIssuer(issuer string) UserOption {
+	return func(c *userController) {
+		c.totpIssuer = issuer
+	}
+}
+
+// TOTPCode returns the code that an authenticator app shows at the specified time for a base32 encoded secret.
+func TOTPCode(secret string, at time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("malformed TOTP secret: %v", err)
+	}
+	return totpCode(key, at.Unix()/int64(totpPeriod/time.Second)), nil
+}
+
+// totpCode implements the HOTP algorithm of RFC 4226 for the specified counter, which TOTP derives from the time.
+func totpCode(key []byte, step int64) string {
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// matchTOTP returns the time step for which a code is valid, if it is valid for any step within the skew tolerance.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// recoveryCodeHash normalizes a recovery code, which users may type in either case & with or without separators, &
+// hashes it.
+func recoveryCodeHash(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes generates a set of recovery codes, formatted for legibility, along with their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, hashes := make([]string, recoveryCodeCount), make([]string, recoveryCodeCount)
+	buf := make([]byte, recoveryCodeBytes)
+	for i := range codes {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, fmt.Errorf("unable to generate recovery code: %v", err)
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(buf))
+		codes[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashes[i] = recoveryCodeHash(code)
+	}
+	return codes, hashes, nil
+}
+
+// EnrollTOTP generates a new TOTP secret for a user, returning an otpauth:// URI with which to add it to an
+// authenticator app & a set of recovery codes, each of which may be used once instead of a code from the app. The
+// secret takes effect once confirmed via ConfirmTOTP, until which it may be replaced by enrolling again. The user's
+// passphrase is required too, so that a stolen session token can't be used to lock them out of their account.
+func (c *userController) EnrollTOTP(username, passphrase string) (string, []string, error) {
+	if err := c.Authenticate(username, passphrase); err != nil {
+		return "", nil, err
+	}
+	if enrollment, err := c.db.FetchTOTP(username); err == nil && enrollment.Confirmed {
+		return "", nil, ErrTOTPEnrolled
+	} else if err != nil && !errors.Is(err, storage.ErrTOTPNotFound) {
+		return "", nil, err
+	}
+	key := make([]byte, totpSecretLen)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, fmt.Errorf("unable to generate TOTP secret: %v", err)
+	}
+	secret := totpEncoding.EncodeToString(key)
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := c.db.SetTOTP(username, secret, hashes); err != nil {
+		return "", nil, err
+	}
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + c.totpIssuer + ":" + username,
+		RawQuery: url.Values{
+			"secret":    {secret},
+			"issuer":    {c.totpIssuer},
+			"algorithm": {"SHA1"},
+			"digits":    {strconv.Itoa(totpDigits)},
+			"period":    {strconv.Itoa(int(totpPeriod / time.Second))},
+		}.Encode(),
+	}
+	return uri.String(), codes, nil
+}
+
+// ConfirmTOTP makes a user's TOTP secret take effect, provided the code comes from an authenticator app that has it.
+// Wrong codes are throttled as for DisableTOTP.
+func (c *userController) ConfirmTOTP(username, code string) error {
+	enrollment, err := c.db.FetchTOTP(username)
+	if errors.Is(err, storage.ErrTOTPNotFound) {
+		return ErrTOTPNotEnrolled
+	} else if err != nil {
+		return err
+	}
+	if enrollment.Confirmed {
+		return ErrTOTPEnrolled
+	}
+	if err := c.reserveAttempt(username, ""); err != nil {
+		return err
+	}
+	if err := c.useTOTPCode(username, enrollment, code); err != nil {
+		return err
+	}
+	if err := c.releaseAttempt(username, ""); err != nil {
+		return err
+	}
+	return c.db.ConfirmTOTP(username)
+}
+
+// DisableTOTP removes a user's TOTP secret & recovery codes, provided the code is valid, whether from their
+// authenticator app or one of their recovery codes. A secret that hasn't been confirmed is removed regardless.
+func (c *userController) DisableTOTP(username, code string) error {
+	enrollment, err := c.db.FetchTOTP(username)
+	if errors.Is(err, storage.ErrTOTPNotFound) {
+		return ErrTOTPNotEnrolled
+	} else if err != nil {
+		return err
+	}
+	if enrollment.Confirmed {
+		if err := c.reserveAttempt(username, ""); err != nil {
+			return err
+		}
+		if err := c.checkSecondFactor(username, enrollment, code); err != nil {
+			return err
+		}
+		if err := c.releaseAttempt(username, ""); err != nil {
+			return err
+		}
+	}
+	return c.db.DeleteTOTP(username)
+}
+
+// secondFactor checks the code that accompanies a login, which is only required of users who have a confirmed TOTP
+// secret.
+func (c *userController) secondFactor(username, code string) error {
+	enrollment, err := c.db.FetchTOTP(username)
+	if errors.Is(err, storage.ErrTOTPNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !enrollment.Confirmed {
+		return nil
+	}
+	if code == "" {
+		return ErrTOTPRequired
+	}
+	return c.checkSecondFactor(username, enrollment, code)
+}
+
+// checkSecondFactor accepts either a code from the user's authenticator app or one of their recovery codes, which is
+// used up. The caller must have reserved the attempt via reserveAttempt, so that wrong codes count towards the
+// throttling of the username & the client's address, as wrong passphrases do.
+func (c *userController) checkSecondFactor(username string, enrollment storage.TOTPEnrollment, code string) error {
+	if len(code) == totpDigits && strings.Trim(code, "0123456789") == "" {
+		return c.useTOTPCode(username, enrollment, code)
+	}
+	used, err := c.db.UseRecoveryCode(username, recoveryCodeHash(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidTOTPCode
+	}
+	return nil
+}
+
+// useTOTPCode checks a code from an authenticator app, which is rejected if it or a later one was already used.
+func (c *userController) useTOTPCode(username string, enrollment storage.TOTPEnrollment, code string) error {
+	step, ok := matchTOTP(enrollment.Secret, code, time.Now())
+	if !ok {
+		return ErrInvalidTOTPCode
+	}
+	used, err := c.db.UseTOTPStep(username, step)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return fmt.Errorf("%w: code was already used", ErrInvalidTOTPCode)
+	}
+	return nil
+}
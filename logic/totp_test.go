@@ -0,0 +1,125 @@
+package logic_test
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adsouza/chat-backend/logic"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA1 test vectors from RFC 6238, truncated to 6 digits.
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for _, tc := range []struct {
+		at   int64
+		want string
+	}{{59, "287082"}, {1111111109, "081804"}, {1234567890, "005924"}, {2000000000, "279037"}} {
+		if got, err := logic.TOTPCode(secret, time.Unix(tc.at, 0)); err != nil || got != tc.want {
+			t.Errorf("TOTP code at %d: got %v, %v, want %v.", tc.at, got, err, tc.want)
+		}
+	}
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	store := &mockUserStore{hashes: make(map[string][]byte)}
+	userCtlr := logic.NewUserController(store, logic.WithTOTPIssuer("Example Chat"))
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	if err := userCtlr.ConfirmTOTP("testuser1", "123456"); !errors.Is(err, logic.ErrTOTPNotEnrolled) {
+		t.Errorf("Confirmation without enrolling: got error %v, want %v.", err, logic.ErrTOTPNotEnrolled)
+	}
+	if _, _, err := userCtlr.EnrollTOTP("testuser1", "123456789abcdef!"); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Errorf("Enrolling with wrong passphrase: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+	}
+	uri, recoveryCodes, err := userCtlr.EnrollTOTP("testuser1", "123456789abcdefg")
+	if err != nil {
+		t.Fatalf("Unable to enroll: %v.", err)
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("Unable to parse otpauth URI %v: %v.", uri, err)
+	}
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" || parsed.Path != "/Example Chat:testuser1" || parsed.Query().Get("issuer") != "Example Chat" {
+		t.Errorf("otpauth URI mismatch: got %v.", uri)
+	}
+	secret := parsed.Query().Get("secret")
+	if got, want := len(recoveryCodes), 10; got != want {
+		t.Errorf("Recovery code count mismatch: got %v, want %v.", got, want)
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", ""); err != nil {
+		t.Errorf("Unable to log in without a code before confirming enrollment: %v.", err)
+	}
+	if err := userCtlr.ConfirmTOTP("testuser1", "abcdef"); !errors.Is(err, logic.ErrInvalidTOTPCode) {
+		t.Errorf("Confirmation with malformed code: got error %v, want %v.", err, logic.ErrInvalidTOTPCode)
+	}
+	code, err := logic.TOTPCode(secret, time.Now())
+	if err != nil {
+		t.Fatalf("Unable to generate code: %v.", err)
+	}
+	if err := userCtlr.ConfirmTOTP("testuser1", code); err != nil {
+		t.Fatalf("Unable to confirm enrollment: %v.", err)
+	}
+	if _, _, err := userCtlr.EnrollTOTP("testuser1", "123456789abcdefg"); !errors.Is(err, logic.ErrTOTPEnrolled) {
+		t.Errorf("Enrolling again: got error %v, want %v.", err, logic.ErrTOTPEnrolled)
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdef!", "", ""); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Errorf("Login with wrong passphrase: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", ""); !errors.Is(err, logic.ErrTOTPRequired) {
+		t.Errorf("Login without a code: got error %v, want %v.", err, logic.ErrTOTPRequired)
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", code, ""); !errors.Is(err, logic.ErrInvalidTOTPCode) {
+		t.Errorf("Login with a code that was already used: got error %v, want %v.", err, logic.ErrInvalidTOTPCode)
+	}
+	// The next code is accepted early in case the client's clock is ahead, but codes further ahead are not.
+	next, _ := logic.TOTPCode(secret, time.Now().Add(30*time.Second))
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", next, ""); err != nil {
+		t.Errorf("Unable to log in with the next code: %v.", err)
+	}
+	future, _ := logic.TOTPCode(secret, time.Now().Add(90*time.Second))
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", future, ""); !errors.Is(err, logic.ErrInvalidTOTPCode) {
+		t.Errorf("Login with a code from too far ahead: got error %v, want %v.", err, logic.ErrInvalidTOTPCode)
+	}
+	recoveryCode := strings.ToUpper(strings.ReplaceAll(recoveryCodes[0], "-", ""))
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", recoveryCode, ""); err != nil {
+		t.Errorf("Unable to log in with a recovery code: %v.", err)
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", recoveryCodes[0], ""); !errors.Is(err, logic.ErrInvalidTOTPCode) {
+		t.Errorf("Login with a recovery code that was already used: got error %v, want %v.", err, logic.ErrInvalidTOTPCode)
+	}
+	if err := userCtlr.DisableTOTP("testuser1", "wrong-code"); !errors.Is(err, logic.ErrInvalidTOTPCode) {
+		t.Errorf("Disabling with wrong code: got error %v, want %v.", err, logic.ErrInvalidTOTPCode)
+	}
+	if err := userCtlr.DisableTOTP("testuser1", recoveryCodes[1]); err != nil {
+		t.Fatalf("Unable to disable two-factor authentication: %v.", err)
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", ""); err != nil {
+		t.Errorf("Unable to log in without a code after disabling two-factor authentication: %v.", err)
+	}
+	if err := userCtlr.DisableTOTP("testuser1", recoveryCodes[2]); !errors.Is(err, logic.ErrTOTPNotEnrolled) {
+		t.Errorf("Disabling again: got error %v, want %v.", err, logic.ErrTOTPNotEnrolled)
+	}
+}
+
+func TestTOTPConfirmationThrottle(t *testing.T) {
+	store := &mockUserStore{hashes: make(map[string][]byte)}
+	userCtlr := logic.NewUserController(store, logic.WithLoginThrottles(strictThrottle, logic.DefaultClientIPThrottle))
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to create user: %v.", err)
+	}
+	if _, _, err := userCtlr.EnrollTOTP("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to enroll: %v.", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := userCtlr.ConfirmTOTP("testuser1", "abcdef"); !errors.Is(err, logic.ErrInvalidTOTPCode) {
+			t.Fatalf("Wrong code #%d: got error %v, want %v.", i+1, err, logic.ErrInvalidTOTPCode)
+		}
+	}
+	if err := userCtlr.ConfirmTOTP("testuser1", "abcdef"); !errors.Is(err, logic.ErrTooManyAttempts) {
+		t.Errorf("Confirmation after too many wrong codes: got error %v, want %v.", err, logic.ErrTooManyAttempts)
+	}
+}
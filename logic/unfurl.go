@@ -0,0 +1,405 @@
+package logic
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+const (
+	// UnfurlTimeout bounds how long unfurling a link may take, including fetching any oEmbed data it refers to.
+	UnfurlTimeout = 5 * time.Second
+	// maxPageBytes bounds how much of a page is scanned for tags, which normally appear near its start.
+	maxPageBytes = 1 << 20
+	// maxOEmbedBytes bounds the size of an oEmbed response.
+	maxOEmbedBytes = 64 << 10
+	// unfurlCacheSize bounds how many links have their previews cached, evicting the least recently used first.
+	unfurlCacheSize = 1024
+	unfurlCacheTTL  = time.Hour
+	// unfurlFailureTTL is shorter than unfurlCacheTTL so that a page that was briefly unavailable soon gets a preview.
+	unfurlFailureTTL = time.Minute
+	userAgent        = "chat-backend link previewer"
+)
+
+// Preview describes what a link points to. Fields are left empty if they couldn't be determined.
+type Preview struct {
+	// URL is the canonical URL of the page, after following any redirects.
+	URL, Title, Description, SiteName string
+	ThumbnailURL                      string
+	ThumbnailWidth, ThumbnailHeight   uint32
+	// Image is set if the link points directly at an image, in which case Width & Height are its dimensions.
+	Image         bool
+	Width, Height uint32
+	// Duration is the length of the video or audio at the link.
+	Duration time.Duration
+}
+
+// Unfurler fetches links & extracts previews of them from OpenGraph, Twitter Card & oEmbed tags. It is safe for
+// concurrent use.
+type Unfurler struct {
+	client *http.Client
+	mu     sync.Mutex
+	// cache is ordered from most to least recently used & indexed by URL.
+	cache *list.List
+	index map[string]*list.Element
+}
+
+type cacheEntry struct {
+	link    string
+	preview Preview
+	err     error
+	expiry  time.Time
+}
+
+// NewUnfurler returns an Unfurler that fetches links using client. If client is nil, a client is used that times out
+// after UnfurlTimeout & refuses to connect to any address that isn't globally routable, so that links in messages can't
+// be used to probe the network that the server runs on.
+func NewUnfurler(client *http.Client) *Unfurler {
+	if client == nil {
+		dialer := &net.Dialer{Timeout: UnfurlTimeout, Control: refuseNonPublic}
+		client = &http.Client{
+			Timeout: UnfurlTimeout,
+			Transport: &http.Transport{
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   UnfurlTimeout,
+				ResponseHeaderTimeout: UnfurlTimeout,
+				MaxIdleConns:          16,
+				IdleConnTimeout:       time.Minute,
+			},
+		}
+	}
+	return &Unfurler{client: client, cache: list.New(), index: make(map[string]*list.Element)}
+}
+
+// nonPublicPrefixes lists the special-purpose ranges of the IANA IPv4 & IPv6 registries that aren't globally reachable,
+// or that embed an IPv4 address which might not be.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "This network"
+	netip.MustParsePrefix("10.0.0.0/8"),      // Private
+	netip.MustParsePrefix("100.64.0.0/10"),   // Shared address space (carrier-grade NAT)
+	netip.MustParsePrefix("127.0.0.0/8"),     // Loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // Link-local
+	netip.MustParsePrefix("172.16.0.0/12"),   // Private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // Documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // Private
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // Documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // Documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // Multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved, including the limited broadcast address
+	netip.MustParsePrefix("::/96"),           // Unspecified, loopback & IPv4-compatible
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // Local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // Discard-only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, including Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // Documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fc00::/7"),        // Unique local
+	netip.MustParsePrefix("fe80::/10"),       // Link-local
+	netip.MustParsePrefix("fec0::/10"),       // Site-local
+	netip.MustParsePrefix("ff00::/8"),        // Multicast
+}
+
+// refuseNonPublic is a net.Dialer control func that only permits connections to globally routable addresses. IPv4
+// addresses written in IPv6 form are checked as IPv4 addresses.
+func refuseNonPublic(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap().WithZone("")
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("refusing to connect to non-public address %v", ip)
+		}
+	}
+	return nil
+}
+
+// Unfurl returns a preview of the page or image at link. Both previews & failures to obtain them are cached, the latter
+// for less time.
+func (u *Unfurler) Unfurl(link string) (Preview, error) {
+	u.mu.Lock()
+	if elem, ok := u.index[link]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if time.Now().Before(entry.expiry) {
+			u.cache.MoveToFront(elem)
+			u.mu.Unlock()
+			return entry.preview, entry.err
+		}
+		u.cache.Remove(elem)
+		delete(u.index, link)
+	}
+	u.mu.Unlock()
+	// Concurrent requests for the same link may each fetch it, which is harmless.
+	preview, err := u.fetch(link)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.index[link]; !ok {
+		ttl := unfurlCacheTTL
+		if err != nil {
+			ttl = unfurlFailureTTL
+		}
+		entry := &cacheEntry{link: link, preview: preview, err: err, expiry: time.Now().Add(ttl)}
+		u.index[link] = u.cache.PushFront(entry)
+		if u.cache.Len() > unfurlCacheSize {
+			oldest := u.cache.Back()
+			u.cache.Remove(oldest)
+			delete(u.index, oldest.Value.(*cacheEntry).link)
+		}
+	}
+	return preview, err
+}
+
+func (u *Unfurler) fetch(link string) (Preview, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), UnfurlTimeout)
+	defer cancel()
+	resp, err := u.get(ctx, link, "text/html,application/xhtml+xml,image/*;q=0.9,*/*;q=0.8")
+	if err != nil {
+		return Preview{}, err
+	}
+	defer resp.Body.Close()
+	page := resp.Request.URL
+	preview := Preview{URL: page.String()}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	body := io.LimitReader(resp.Body, maxPageBytes)
+	if strings.HasPrefix(mediaType, "image/") {
+		preview.Image = true
+		// The dimensions are in the header, so there's no need to decode the whole image.
+		if config, _, err := image.DecodeConfig(body); err == nil {
+			preview.Width, preview.Height = uint32(config.Width), uint32(config.Height)
+		}
+		return preview, nil
+	}
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return preview, nil
+	}
+
+	tags := scanHead(body)
+	preview.Title = tags.first("og:title", "twitter:title")
+	preview.Description = tags.first("og:description", "twitter:description", "description")
+	preview.SiteName = tags.first("og:site_name")
+	preview.ThumbnailURL = resolve(page,
+		tags.first("og:image:secure_url", "og:image", "og:image:url", "twitter:image", "twitter:image:src"))
+	preview.ThumbnailWidth = parseDimension(tags.first("og:image:width"))
+	preview.ThumbnailHeight = parseDimension(tags.first("og:image:height"))
+	if canonical := resolve(page, tags.first("og:url")); canonical != "" {
+		preview.URL = canonical
+	}
+	if seconds := tags.first("og:video:duration", "video:duration", "music:duration"); seconds != "" {
+		if n, err := strconv.ParseUint(seconds, 10, 32); err == nil {
+			preview.Duration = time.Duration(n) * time.Second
+		}
+	} else {
+		// Schema.org microdata, as used by YouTube, gives an ISO 8601 duration.
+		preview.Duration = parseISODuration(tags.first("duration"))
+	}
+	if endpoint := resolve(page, tags.oEmbed); endpoint != "" && (preview.Title == "" || preview.ThumbnailURL == "") {
+		// oEmbed data is only used to fill in gaps, so a failure to fetch it doesn't spoil the preview.
+		if data, err := u.fetchOEmbed(ctx, endpoint); err == nil {
+			data.fillIn(&preview, page)
+		}
+	}
+	if preview.Title == "" {
+		preview.Title = tags.title
+	}
+	return preview, nil
+}
+
+func (u *Unfurler) get(ctx context.Context, link, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unable to fetch %v: %v", link, resp.Status)
+	}
+	return resp, nil
+}
+
+// oEmbed holds the fields of interest of an oEmbed response. Some providers send numbers as strings, which
+// json.Number tolerates.
+type oEmbed struct {
+	Title           string      `json:"title"`
+	AuthorName      string      `json:"author_name"`
+	ProviderName    string      `json:"provider_name"`
+	ThumbnailURL    string      `json:"thumbnail_url"`
+	ThumbnailWidth  json.Number `json:"thumbnail_width"`
+	ThumbnailHeight json.Number `json:"thumbnail_height"`
+	Duration        json.Number `json:"duration"`
+}
+
+func (u *Unfurler) fetchOEmbed(ctx context.Context, endpoint string) (oEmbed, error) {
+	resp, err := u.get(ctx, endpoint, "application/json")
+	if err != nil {
+		return oEmbed{}, err
+	}
+	defer resp.Body.Close()
+	var data oEmbed
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOEmbedBytes)).Decode(&data); err != nil {
+		return oEmbed{}, fmt.Errorf("unable to parse oEmbed response: %v", err)
+	}
+	return data, nil
+}
+
+// fillIn sets whichever fields of the preview are still empty.
+func (o oEmbed) fillIn(preview *Preview, page *url.URL) {
+	if preview.Title == "" {
+		preview.Title = o.Title
+	}
+	if preview.SiteName == "" {
+		preview.SiteName = o.ProviderName
+	}
+	if preview.Description == "" && o.AuthorName != "" {
+		preview.Description = "By " + o.AuthorName
+	}
+	if preview.ThumbnailURL == "" {
+		preview.ThumbnailURL = resolve(page, o.ThumbnailURL)
+		preview.ThumbnailWidth = parseDimension(o.ThumbnailWidth.String())
+		preview.ThumbnailHeight = parseDimension(o.ThumbnailHeight.String())
+	}
+	if preview.Duration == 0 {
+		if seconds, err := o.Duration.Float64(); err == nil && seconds > 0 {
+			preview.Duration = time.Duration(seconds) * time.Second
+		}
+	}
+}
+
+// headTags holds the tags of interest in the head of a page.
+type headTags struct {
+	// meta maps the property, name or itemprop of each meta tag to its content. Only the first of each is kept.
+	meta   map[string]string
+	title  string
+	oEmbed string
+}
+
+func (t headTags) first(keys ...string) string {
+	for _, key := range keys {
+		if value := t.meta[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// scanHead collects tags from the page until the start of its body.
+func scanHead(r io.Reader) headTags {
+	tags := headTags{meta: make(map[string]string)}
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return tags
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "body":
+				return tags
+			case "title":
+				if tags.title == "" && z.Next() == html.TextToken {
+					tags.title = strings.TrimSpace(string(z.Text()))
+				}
+			case "meta":
+				attrs := readAttrs(z, hasAttr)
+				key := strings.ToLower(firstNonEmpty(attrs["property"], attrs["name"], attrs["itemprop"]))
+				if _, ok := tags.meta[key]; key != "" && !ok {
+					tags.meta[key] = strings.TrimSpace(attrs["content"])
+				}
+			case "link":
+				attrs := readAttrs(z, hasAttr)
+				if tags.oEmbed == "" && strings.EqualFold(attrs["type"], "application/json+oembed") &&
+					strings.Contains(strings.ToLower(attrs["rel"]), "alternate") {
+					tags.oEmbed = attrs["href"]
+				}
+			}
+		}
+	}
+}
+
+func readAttrs(z *html.Tokenizer, more bool) map[string]string {
+	attrs := make(map[string]string)
+	for more {
+		var key, value []byte
+		key, value, more = z.TagAttr()
+		attrs[strings.ToLower(string(key))] = string(value)
+	}
+	return attrs
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// resolve returns the absolute form of a URL found on a page, or nothing if it isn't an HTTP(S) URL.
+func resolve(page *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	parsed, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	abs := page.ResolveReference(parsed)
+	if abs.Scheme != "http" && abs.Scheme != "https" {
+		return ""
+	}
+	return abs.String()
+}
+
+func parseDimension(s string) uint32 {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(n)
+}
+
+var isoDuration = regexp.MustCompile(`^P(?:(\d+)D)?T?(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?$`)
+
+// parseISODuration parses the subset of ISO 8601 durations used for media, e.g. PT1H2M3S. It returns zero if s isn't
+// one.
+func parseISODuration(s string) time.Duration {
+	match := isoDuration.FindStringSubmatch(s)
+	if match == nil {
+		return 0
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		n, _ := strconv.Atoi(match[i+1])
+		d += time.Duration(n) * unit
+	}
+	return d
+}
@@ -0,0 +1,220 @@
+package logic_test
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adsouza/chat-backend/api"
+	"github.com/adsouza/chat-backend/logic"
+	"github.com/adsouza/chat-backend/storage"
+	"github.com/golang/protobuf/proto"
+)
+
+const testPage = `<!DOCTYPE html>
+<html><head>
+<title>Fallback title</title>
+<meta property="og:title" content="A day at the beach">
+<meta name="twitter:title" content="Ignored title">
+<meta name="description" content="Sun, sea &amp; sand.">
+<meta property="og:site_name" content="Holiday Snaps">
+<link rel="alternate" type="application/json+oembed" href="/oembed?url=beach">
+</head><body>
+<meta property="og:description" content="Ignored since it is in the body.">
+</body></html>`
+
+const testVideoPage = `<html><head>
+<meta property="og:title" content="Gangnam Style">
+<meta itemprop="duration" content="PT4M13S">
+</head></html>`
+
+// newTestSite serves a few pages to be unfurled & returns a client that sends every request to it, whatever the host.
+func newTestSite(t *testing.T) (*http.Client, *int32) {
+	var hits int32
+	var png3x2 bytes.Buffer
+	if err := png.Encode(&png3x2, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatalf("Unable to encode test image: %v.", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/beach", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, testPage)
+	})
+	mux.HandleFunc("/oembed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"title": "Ignored title", "thumbnail_url": "/thumb.png", "thumbnail_width": "480", "thumbnail_height": 360}`)
+	})
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png3x2.Bytes())
+	})
+	mux.HandleFunc("/watch", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, testVideoPage)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("Unable to parse URL of test server: %v.", err)
+	}
+	return &http.Client{Transport: redirectTransport{target}}, &hits
+}
+
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	redirected := req.Clone(req.Context())
+	redirected.URL.Scheme, redirected.URL.Host = t.target.Scheme, t.target.Host
+	resp, err := http.DefaultTransport.RoundTrip(redirected)
+	if err == nil {
+		// Make it look as if the response came from the original host.
+		resp.Request = req
+	}
+	return resp, err
+}
+
+func TestUnfurl(t *testing.T) {
+	client, hits := newTestSite(t)
+	unfurler := logic.NewUnfurler(client)
+	for i := 0; i < 2; i++ {
+		preview, err := unfurler.Unfurl("https://photos.example.com/beach")
+		if err != nil {
+			t.Fatalf("Unable to unfurl link: %v.", err)
+		}
+		want := logic.Preview{
+			URL:             "https://photos.example.com/beach",
+			Title:           "A day at the beach",
+			Description:     "Sun, sea & sand.",
+			SiteName:        "Holiday Snaps",
+			ThumbnailURL:    "https://photos.example.com/thumb.png",
+			ThumbnailWidth:  480,
+			ThumbnailHeight: 360,
+		}
+		if preview != want {
+			t.Errorf("Preview mismatch: got %+v, want %+v.", preview, want)
+		}
+	}
+	if got, want := atomic.LoadInt32(hits), int32(1); got != want {
+		t.Errorf("Cached preview was fetched again: got %v fetches, want %v.", got, want)
+	}
+	if _, err := unfurler.Unfurl("https://photos.example.com/missing"); err == nil {
+		t.Errorf("Unfurling a missing page succeeded.")
+	}
+}
+
+func TestUnfurlRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Default client connected to a loopback address.")
+	}))
+	defer server.Close()
+	unfurler := logic.NewUnfurler(nil)
+	if _, err := unfurler.Unfurl(server.URL); err == nil {
+		t.Errorf("Unfurling a loopback address succeeded.")
+	}
+	// The same server, with its address in IPv4-mapped IPv6 form.
+	mapped := strings.Replace(server.URL, "127.0.0.1", "[::ffff:127.0.0.1]", 1)
+	if _, err := unfurler.Unfurl(mapped); err == nil {
+		t.Errorf("Unfurling %v succeeded.", mapped)
+	}
+	for _, host := range []string{
+		"0.0.0.0", "10.1.2.3", "100.64.0.1", "100.127.255.254", "169.254.169.254", "172.31.0.1", "192.0.0.8",
+		"192.0.2.1", "192.168.1.1", "198.18.0.1", "198.19.255.255", "203.0.113.9", "224.0.0.251", "255.255.255.255",
+		"[::]", "[::1]", "[::ffff:10.0.0.1]", "[::ffff:100.64.0.1]", "[64:ff9b::a9fe:a9fe]", "[64:ff9b:1::a00:1]",
+		"[2001::1]", "[2002:c0a8:101::1]", "[fd00::1]", "[fe80::1]", "[ff02::1]",
+	} {
+		_, err := unfurler.Unfurl("http://" + host + "/")
+		if err == nil || !strings.Contains(err.Error(), "non-public address") {
+			t.Errorf("Unfurling %v: got %v, want a refusal to connect to a non-public address.", host, err)
+		}
+	}
+}
+
+func TestLinkMetadata(t *testing.T) {
+	client, _ := newTestSite(t)
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb, logic.WithUnfurler(logic.NewUnfurler(client)))
+	for _, tc := range []struct {
+		link string
+		want *api.Metadata
+	}{
+		{"https://photos.example.com/beach", &api.Metadata{Media: &api.Metadata_LinkPreview{LinkPreview: &api.LinkPreview{
+			Url:             "https://photos.example.com/beach",
+			Title:           "A day at the beach",
+			Description:     "Sun, sea & sand.",
+			SiteName:        "Holiday Snaps",
+			ThumbnailUrl:    "https://photos.example.com/thumb.png",
+			ThumbnailWidth:  480,
+			ThumbnailHeight: 360,
+		}}}},
+		{"https://photos.example.com/image.png", &api.Metadata{Media: &api.Metadata_Image{Image: &api.Image{Width: 3, Height: 2}}}},
+		{"https://www.youtube.com/watch?v=9bZkp7q19f0", &api.Metadata{Media: &api.Metadata_Video{
+			Video: &api.Video{Source: api.Video_YOUTUBE, LengthInSeconds: 253, Id: "9bZkp7q19f0"},
+		}}},
+	} {
+		msg, err := msgCtlr.SendMessage("testuser1", "testuser2", tc.link, "")
+		if err != nil {
+			t.Fatalf("Sending a link failed: %v.", err)
+		}
+		got := &api.Metadata{}
+		if err := proto.Unmarshal(msg.Metadata, got); err != nil {
+			t.Fatalf("Unable to parse metadata: %v.", err)
+		}
+		if !proto.Equal(got, tc.want) {
+			t.Errorf("Metadata of %v mismatch: got %v, want %v.", tc.link, got, tc.want)
+		}
+	}
+}
+
+func TestUnfurlTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	client := server.Client()
+	client.Timeout = 50 * time.Millisecond
+	if _, err := logic.NewUnfurler(client).Unfurl(server.URL); err == nil {
+		t.Errorf("Unfurling a page that never arrives succeeded.")
+	}
+}
+
+func TestSlowLinkDoesNotDelaySending(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	mockDb := &mockDb{
+		mockUserStore: mockUserStore{hashes: make(map[string][]byte)},
+		mockMsgStore:  mockMsgStore{conversations: make(map[string][]storage.Message)},
+	}
+	msgCtlr := logic.NewMessageController(mockDb, logic.WithUnfurler(logic.NewUnfurler(server.Client())))
+	start := time.Now()
+	msg, err := msgCtlr.SendMessage("testuser1", "testuser2", server.URL+"/slow", "")
+	if err != nil {
+		t.Fatalf("Sending a slow link failed: %v.", err)
+	}
+	if elapsed := time.Since(start); elapsed >= logic.UnfurlTimeout {
+		t.Errorf("Sending a slow link took %v, want less than %v.", elapsed, logic.UnfurlTimeout)
+	}
+	if msg.Metadata != nil {
+		t.Errorf("Metadata of a slow link: got %v, want none.", msg.Metadata)
+	}
+}
@@ -1,47 +1,303 @@
 package logic
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/adsouza/chat-backend/storage"
 )
 
+// SessionTTL is how long a session token remains valid after being issued or refreshed.
+const SessionTTL = 24 * time.Hour
+
 type UserStore interface {
-	AddUser(username string, hash []byte) error
+	AddUser(username, canonical string, hash []byte) error
 	FetchHash(username string) ([]byte, error)
+	AddSession(token, username string, expiry time.Time) error
+	FetchSession(token string) (string, time.Time, error)
+	DeleteSession(token string) error
+	ReplaceHash(username string, hash []byte) error
+	UpdateHash(username string, oldHash, newHash []byte) error
+	RenameUser(username, newUsername, newCanonical string) error
+	DeleteUser(username string) ([]string, error)
+	FetchLoginFailures(scope, subject string, since time.Time) (storage.LoginFailures, error)
+	RecordLoginFailure(scope, subject string, at, since time.Time) (storage.LoginFailures, error)
+	ForgetLoginFailure(scope, subject string) error
+	ClearLoginFailures(scope, subject string) error
+	SetTOTP(username, secret string, recoveryHashes []string) error
+	FetchTOTP(username string) (storage.TOTPEnrollment, error)
+	ConfirmTOTP(username string) error
+	UseTOTPStep(username string, step int64) (bool, error)
+	UseRecoveryCode(username, hash string) (bool, error)
+	DeleteTOTP(username string) error
 }
 
 type userController struct {
-	db UserStore
+	db     UserStore
+	hasher Hasher
+	policy CredentialPolicy
+	// blobs holds the content of attachments, if they are enabled.
+	blobs storage.BlobStore
+	// Failed logins for the same username or from the same address hold up further attempts according to these.
+	usernameThrottle, clientIPThrottle ThrottlePolicy
+	// admins may unlock accounts.
+	admins map[string]bool
+	// totpIssuer names this service in authenticator apps.
+	totpIssuer string
+}
+
+// UserOption configures optional behaviour of the user controller.
+type UserOption func(*userController)
+
+// WithAccountBlobs lets DeleteAccount delete the content of the attachments that go along with an account, which
+// should be kept in the same store as was passed to WithBlobStore.
+func WithAccountBlobs(blobs storage.BlobStore) UserOption {
+	return func(c *userController) {
+		c.blobs = blobs
+	}
 }
 
-func NewUserController(db UserStore) *userController {
-	return &userController{db: db}
+// WithHasher sets the policy by which passphrases are hashed. Existing hashes are upgraded as their users log in.
+func WithHasher(hasher Hasher) UserOption {
+	return func(c *userController) {
+		c.hasher = hasher
+	}
+}
+
+// WithLoginThrottles sets the policies by which failed logins for the same username & from the same IP address hold up
+// further attempts.
+func WithLoginThrottles(byUsername, byClientIP ThrottlePolicy) UserOption {
+	return func(c *userController) {
+		c.usernameThrottle, c.clientIPThrottle = byUsername, byClientIP
+	}
 }
 
+// WithAdmins grants the specified users the right to unlock accounts. Since the right goes with the username, their
+// accounts can't be renamed or deleted, lest someone else register the username & inherit it.
+func WithAdmins(usernames ...string) UserOption {
+	return func(c *userController) {
+		for _, username := range usernames {
+			c.admins[username] = true
+		}
+	}
+}
+
+func NewUserController(db UserStore, opts ...UserOption) *userController {
+	c := &userController{
+		db:               db,
+		hasher:           DefaultHasher,
+		policy:           DefaultCredentialPolicy,
+		usernameThrottle: DefaultUsernameThrottle,
+		clientIPThrottle: DefaultClientIPThrottle,
+		admins:           make(map[string]bool),
+		totpIssuer:       DefaultTOTPIssuer,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// CreateUser registers a user, provided the username & passphrase meet the credential policy. Otherwise a PolicyError
+// reports everything that is wrong with either.
 func (c *userController) CreateUser(username, passphrase string) error {
-	// Validate that password is long enough.
-	if len(passphrase) < 16 {
-		return fmt.Errorf("passphrase below 16 char minimum")
+	violations := &PolicyError{}
+	c.policy.Username.check(violations, "username", username)
+	c.checkPassphrase(violations, "passphrase", passphrase, username)
+	if err := violations.orNil(); err != nil {
+		return err
 	}
 	// Check for existing user with identical username.
-	if hash, _ := c.db.FetchHash(username); hash != nil {
-		//TODO: handle other errors.
-		return fmt.Errorf("desired username already taken")
+	if _, err := c.db.FetchHash(username); err == nil {
+		return storage.ErrUserExists
+	} else if !errors.Is(err, storage.ErrUserNotFound) {
+		return err
 	}
-	// Generate a bcrypt hash for the password.
-	hash, err := bcrypt.GenerateFromPassword([]byte(passphrase), bcrypt.DefaultCost)
+	hash, err := c.hasher.Hash(passphrase)
 	if err != nil {
-		return fmt.Errorf("unable to hash passphrase: %v.", err)
+		return err
 	}
-	// Persist the username/hash pair to the users table.
-	return c.db.AddUser(username, hash)
+	// Persist the username/hash pair to the users table, which fails with storage.ErrUserExists if someone else took the
+	// username in the meantime, or one that differs only in case or form.
+	return c.db.AddUser(username, storage.CanonicalUsername(username), hash)
 }
 
+// Authenticate returns ErrInvalidCredentials if the username is unknown or the passphrase is wrong, without revealing
+// which. Failures count towards the throttling of the username, as for Login.
 func (c *userController) Authenticate(username, passphrase string) error {
+	if _, err := c.verify(username, passphrase, ""); err != nil {
+		return err
+	}
+	return c.db.ClearLoginFailures(usernameScope, username)
+}
+
+// verify checks a user's passphrase, returning the hash against which it was checked. Attempts are refused with a
+// throttledError while too many have failed recently, whether for the username or from the client's address, if
+// known. Each attempt is counted as a failure until the caller, having finished authenticating the user, releases it.
+func (c *userController) verify(username, passphrase, clientIP string) ([]byte, error) {
+	if err := c.reserveAttempt(username, clientIP); err != nil {
+		return nil, err
+	}
+	// Unknown usernames are throttled too, so as not to reveal which ones exist.
 	hash, err := c.db.FetchHash(username)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, fmt.Errorf("authentication failed because hashed passphrase currently unavailable from storage: %v.", err)
+	}
+	if err := verifyPassphrase(hash, passphrase); err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+// sessionKey derives the value under which a session is persisted, so that tokens are never stored in the clear.
+func sessionKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *userController) newSession(username string) (string, time.Time, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to generate session token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	expiry := time.Now().Add(SessionTTL)
+	if err := c.db.AddSession(sessionKey(token), username, expiry); err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to persist session: %w", err)
+	}
+	return token, expiry, nil
+}
+
+// Login authenticates a user connecting from the specified address, which may be empty if unknown, & starts a session.
+// Users who have enrolled in TOTP must also give a code from their authenticator app or one of their recovery codes,
+// without which ErrTOTPRequired is returned once the passphrase has been verified. If their hash was generated under
+// an earlier policy, it is replaced with one that conforms to the current policy while the passphrase is at hand.
+func (c *userController) Login(username, passphrase, code, clientIP string) (string, time.Time, error) {
+	hash, err := c.verify(username, passphrase, clientIP)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := c.secondFactor(username, code); errors.Is(err, ErrTOTPRequired) {
+		// The passphrase was right, so the attempt isn't held against the user, though earlier failures still are.
+		if releaseErr := c.releaseAttempt(username, clientIP); releaseErr != nil {
+			return "", time.Time{}, releaseErr
+		}
+		return "", time.Time{}, err
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := c.releaseAttempt(username, clientIP); err != nil {
+		return "", time.Time{}, err
+	}
+	if err := c.db.ClearLoginFailures(usernameScope, username); err != nil {
+		return "", time.Time{}, err
+	}
+	if c.hasher.Outdated(hash) {
+		// The outdated hash still works, so a failure to replace it is left for a later login to retry.
+		if upgraded, err := c.hasher.Hash(passphrase); err != nil {
+			log.Printf("Unable to rehash passphrase of %v: %v.", username, err)
+		} else if err := c.db.UpdateHash(username, hash, upgraded); err != nil {
+			log.Printf("Unable to upgrade passphrase hash of %v: %v.", username, err)
+		}
+	}
+	return c.newSession(username)
+}
+
+func (c *userController) Logout(token string) error {
+	return c.db.DeleteSession(sessionKey(token))
+}
+
+// ValidateSession returns the username that owns the specified session token, provided it has not expired.
+func (c *userController) ValidateSession(token string) (string, error) {
+	username, expiry, err := c.db.FetchSession(sessionKey(token))
 	if err != nil {
-		return fmt.Errorf("authentication failed because hashed passphrase currently unavailable from storage: %v.", err)
+		return "", fmt.Errorf("invalid session token: %w", err)
+	}
+	if time.Now().After(expiry) {
+		c.db.DeleteSession(sessionKey(token))
+		return "", ErrSessionExpired
+	}
+	return username, nil
+}
+
+// RefreshSession replaces a valid session token with a new one that has a later expiry.
+func (c *userController) RefreshSession(token string) (string, time.Time, error) {
+	username, err := c.ValidateSession(token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := c.db.DeleteSession(sessionKey(token)); err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to revoke old session: %v", err)
+	}
+	return c.newSession(username)
+}
+
+// ChangePassphrase replaces a user's passphrase, provided the old one is correct. Every session of theirs is revoked, so
+// a new one is returned for the caller to carry on with.
+func (c *userController) ChangePassphrase(username, oldPassphrase, newPassphrase string) (string, time.Time, error) {
+	if err := c.Authenticate(username, oldPassphrase); err != nil {
+		return "", time.Time{}, err
+	}
+	violations := &PolicyError{}
+	c.checkPassphrase(violations, "new_passphrase", newPassphrase, username)
+	if err := violations.orNil(); err != nil {
+		return "", time.Time{}, err
+	}
+	hash, err := c.hasher.Hash(newPassphrase)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := c.db.ReplaceHash(username, hash); err != nil {
+		return "", time.Time{}, err
+	}
+	return c.newSession(username)
+}
+
+// RenameUser changes a user's username, provided the new one meets the credential policy, & their sessions, messages
+// & conversations follow. The old username becomes available to others.
+func (c *userController) RenameUser(username, newUsername string) error {
+	if c.admins[username] {
+		return fmt.Errorf("%w: %v", ErrAdminAccount, username)
+	}
+	violations := &PolicyError{}
+	c.policy.Username.check(violations, "new_username", newUsername)
+	if err := violations.orNil(); err != nil {
+		return err
+	}
+	if newUsername == username {
+		return nil
+	}
+	return c.db.RenameUser(username, newUsername, storage.CanonicalUsername(newUsername))
+}
+
+// DeleteAccount deletes a user, provided the passphrase is correct, along with their sessions, the messages they sent,
+// the attachments they uploaded & their 1:1 conversations. Other members of their group conversations keep the
+// messages they sent themselves.
+func (c *userController) DeleteAccount(username, passphrase string) error {
+	if err := c.Authenticate(username, passphrase); err != nil {
+		return err
+	}
+	if c.admins[username] {
+		return fmt.Errorf("%w: %v", ErrAdminAccount, username)
+	}
+	keys, err := c.db.DeleteUser(username)
+	if err != nil {
+		return err
+	}
+	if c.blobs == nil {
+		return nil
+	}
+	// The account is gone whether or not this succeeds, so all that a failure leaves behind is an orphaned blob.
+	for _, key := range keys {
+		c.blobs.Delete(key)
 	}
-	return bcrypt.CompareHashAndPassword(hash, []byte(passphrase))
+	return nil
 }
@@ -1,29 +1,227 @@
 package logic_test
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/adsouza/chat-backend/logic"
+	"github.com/adsouza/chat-backend/storage"
 )
 
+type mockSession struct {
+	username string
+	expiry   time.Time
+}
+
 type mockUserStore struct {
-	hashes map[string][]byte
+	hashes   map[string][]byte
+	sessions map[string]mockSession
+	// canonical maps the canonical form of each username to the username.
+	canonical map[string]string
+	// uploads lists the blob keys of each user's attachments.
+	uploads map[string][]string
+	// failures holds the failed logins for each scope & subject, keyed by both separated by a slash.
+	failures map[string]storage.LoginFailures
+	totp     map[string]storage.TOTPEnrollment
+	// recoveryCodes holds the hashes of each user's unused recovery codes.
+	recoveryCodes map[string]map[string]bool
 }
 
-func (m *mockUserStore) AddUser(username string, hash []byte) error {
+func (m *mockUserStore) AddUser(username, canonical string, hash []byte) error {
+	if m.canonical == nil {
+		m.canonical = make(map[string]string)
+	}
+	if _, ok := m.canonical[canonical]; ok {
+		return storage.ErrUserExists
+	}
 	m.hashes[username] = hash
+	m.canonical[canonical] = username
 	return nil
 }
 
 func (m *mockUserStore) FetchHash(username string) ([]byte, error) {
 	hash, ok := m.hashes[username]
 	if !ok {
-		return nil, fmt.Errorf("no row with key %v exists", username)
+		return nil, storage.ErrUserNotFound
 	}
 	return hash, nil
 }
 
+func (m *mockUserStore) AddSession(token, username string, expiry time.Time) error {
+	if m.sessions == nil {
+		m.sessions = make(map[string]mockSession)
+	}
+	m.sessions[token] = mockSession{username: username, expiry: expiry}
+	return nil
+}
+
+func (m *mockUserStore) FetchSession(token string) (string, time.Time, error) {
+	session, ok := m.sessions[token]
+	if !ok {
+		return "", time.Time{}, storage.ErrSessionNotFound
+	}
+	return session.username, session.expiry, nil
+}
+
+func (m *mockUserStore) DeleteSession(token string) error {
+	delete(m.sessions, token)
+	return nil
+}
+
+func (m *mockUserStore) ReplaceHash(username string, hash []byte) error {
+	if _, ok := m.hashes[username]; !ok {
+		return storage.ErrUserNotFound
+	}
+	m.hashes[username] = hash
+	for token, session := range m.sessions {
+		if session.username == username {
+			delete(m.sessions, token)
+		}
+	}
+	return nil
+}
+
+func (m *mockUserStore) UpdateHash(username string, oldHash, newHash []byte) error {
+	if hash, ok := m.hashes[username]; ok && bytes.Equal(hash, oldHash) {
+		m.hashes[username] = newHash
+	}
+	return nil
+}
+
+func (m *mockUserStore) RenameUser(username, newUsername, newCanonical string) error {
+	hash, ok := m.hashes[username]
+	if !ok {
+		return storage.ErrUserNotFound
+	}
+	if _, ok := m.hashes[newUsername]; ok {
+		return storage.ErrUserExists
+	}
+	if owner, ok := m.canonical[newCanonical]; ok && owner != username {
+		return storage.ErrUserExists
+	}
+	for canonical, owner := range m.canonical {
+		if owner == username {
+			delete(m.canonical, canonical)
+		}
+	}
+	if m.canonical == nil {
+		m.canonical = make(map[string]string)
+	}
+	m.canonical[newCanonical] = newUsername
+	delete(m.hashes, username)
+	m.hashes[newUsername] = hash
+	for token, session := range m.sessions {
+		if session.username == username {
+			m.sessions[token] = mockSession{username: newUsername, expiry: session.expiry}
+		}
+	}
+	return nil
+}
+
+func (m *mockUserStore) DeleteUser(username string) ([]string, error) {
+	if _, ok := m.hashes[username]; !ok {
+		return nil, storage.ErrUserNotFound
+	}
+	delete(m.hashes, username)
+	for token, session := range m.sessions {
+		if session.username == username {
+			delete(m.sessions, token)
+		}
+	}
+	return m.uploads[username], nil
+}
+
+func (m *mockUserStore) FetchLoginFailures(scope, subject string, since time.Time) (storage.LoginFailures, error) {
+	failures := m.failures[scope+"/"+subject]
+	if failures.Last.Before(since) {
+		return storage.LoginFailures{}, nil
+	}
+	return failures, nil
+}
+
+func (m *mockUserStore) RecordLoginFailure(scope, subject string, at, since time.Time) (storage.LoginFailures, error) {
+	if m.failures == nil {
+		m.failures = make(map[string]storage.LoginFailures)
+	}
+	failures, _ := m.FetchLoginFailures(scope, subject, since)
+	failures = storage.LoginFailures{Count: failures.Count + 1, Last: at}
+	m.failures[scope+"/"+subject] = failures
+	return failures, nil
+}
+
+func (m *mockUserStore) ForgetLoginFailure(scope, subject string) error {
+	if failures, ok := m.failures[scope+"/"+subject]; ok && failures.Count > 0 {
+		failures.Count--
+		m.failures[scope+"/"+subject] = failures
+	}
+	return nil
+}
+
+func (m *mockUserStore) ClearLoginFailures(scope, subject string) error {
+	delete(m.failures, scope+"/"+subject)
+	return nil
+}
+
+func (m *mockUserStore) SetTOTP(username, secret string, recoveryHashes []string) error {
+	if _, ok := m.hashes[username]; !ok {
+		return storage.ErrUserNotFound
+	}
+	if m.totp == nil {
+		m.totp, m.recoveryCodes = make(map[string]storage.TOTPEnrollment), make(map[string]map[string]bool)
+	}
+	m.totp[username] = storage.TOTPEnrollment{Secret: secret}
+	m.recoveryCodes[username] = make(map[string]bool)
+	for _, hash := range recoveryHashes {
+		m.recoveryCodes[username][hash] = true
+	}
+	return nil
+}
+
+func (m *mockUserStore) FetchTOTP(username string) (storage.TOTPEnrollment, error) {
+	enrollment, ok := m.totp[username]
+	if !ok {
+		return storage.TOTPEnrollment{}, storage.ErrTOTPNotFound
+	}
+	return enrollment, nil
+}
+
+func (m *mockUserStore) ConfirmTOTP(username string) error {
+	enrollment, ok := m.totp[username]
+	if !ok {
+		return storage.ErrTOTPNotFound
+	}
+	enrollment.Confirmed = true
+	m.totp[username] = enrollment
+	return nil
+}
+
+func (m *mockUserStore) UseTOTPStep(username string, step int64) (bool, error) {
+	enrollment, ok := m.totp[username]
+	if !ok || enrollment.LastStep >= step {
+		return false, nil
+	}
+	enrollment.LastStep = step
+	m.totp[username] = enrollment
+	return true, nil
+}
+
+func (m *mockUserStore) UseRecoveryCode(username, hash string) (bool, error) {
+	if !m.recoveryCodes[username][hash] {
+		return false, nil
+	}
+	delete(m.recoveryCodes[username], hash)
+	return true, nil
+}
+
+func (m *mockUserStore) DeleteTOTP(username string) error {
+	delete(m.totp, username)
+	delete(m.recoveryCodes, username)
+	return nil
+}
+
 func TestUsersHappyPath(t *testing.T) {
 	userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)})
 	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
@@ -39,8 +237,8 @@ func TestUsersHappyPath(t *testing.T) {
 
 func TestShortPassphrase(t *testing.T) {
 	userCtlr := logic.NewUserController(&mockUserStore{})
-	if err := userCtlr.CreateUser("testuser1", "123456789abcdef"); err == nil {
-		t.Errorf("Passphrase shorter than 16 chars was permitted but should not be.")
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdef"); !errors.Is(err, logic.ErrWeakPassphrase) {
+		t.Errorf("Passphrase shorter than 16 chars: got error %v, want %v.", err, logic.ErrWeakPassphrase)
 	}
 }
 
@@ -49,15 +247,15 @@ func TestDupeUsername(t *testing.T) {
 	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
 		t.Errorf("16 char passphrase was not permitted but should be.")
 	}
-	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err == nil {
-		t.Errorf("Duplicate username was permitted but should not be.")
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); !errors.Is(err, storage.ErrUserExists) {
+		t.Errorf("Duplicate username: got error %v, want %v.", err, storage.ErrUserExists)
 	}
 }
 
 func TestNonexistentUser(t *testing.T) {
 	userCtlr := logic.NewUserController(&mockUserStore{})
-	if err := userCtlr.Authenticate("testuser1", "123456789abcdefg"); err == nil {
-		t.Errorf("Managed to authenticate user that was never added!")
+	if err := userCtlr.Authenticate("testuser1", "123456789abcdefg"); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Errorf("Authenticating user that was never added: got error %v, want %v.", err, logic.ErrInvalidCredentials)
 	}
 }
 
@@ -66,7 +264,184 @@ func TestWrongPassphrase(t *testing.T) {
 	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
 		t.Errorf("16 char passphrase was not permitted but should be.")
 	}
-	if err := userCtlr.Authenticate("testuser1", "123456789abcdef!"); err == nil {
-		t.Errorf("Managed to authenticate user using wrong passphrase!")
+	if err := userCtlr.Authenticate("testuser1", "123456789abcdef!"); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Errorf("Authenticating with wrong passphrase: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)})
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("16 char passphrase was not permitted but should be.")
+	}
+	if _, _, err := userCtlr.Login("testuser1", "123456789abcdef!", "", ""); err == nil {
+		t.Errorf("Managed to log in using wrong passphrase!")
+	}
+	token, expiry, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "")
+	if err != nil {
+		t.Fatalf("Unable to log in as user that was just added: %v.", err)
+	}
+	if !expiry.After(time.Now()) {
+		t.Errorf("Session expiry %v is not in the future.", expiry)
+	}
+	username, err := userCtlr.ValidateSession(token)
+	if err != nil {
+		t.Fatalf("Unable to validate session token that was just issued: %v.", err)
+	}
+	if got, want := username, "testuser1"; got != want {
+		t.Errorf("Session username mismatch: got %v, want %v.", got, want)
+	}
+	if err := userCtlr.Logout(token); err != nil {
+		t.Fatalf("Unable to log out: %v.", err)
+	}
+	if _, err := userCtlr.ValidateSession(token); err == nil {
+		t.Errorf("Session token is still valid after logging out!")
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)})
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("16 char passphrase was not permitted but should be.")
+	}
+	token, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "")
+	if err != nil {
+		t.Fatalf("Unable to log in as user that was just added: %v.", err)
+	}
+	refreshed, _, err := userCtlr.RefreshSession(token)
+	if err != nil {
+		t.Fatalf("Unable to refresh session: %v.", err)
+	}
+	if _, err := userCtlr.ValidateSession(token); err == nil {
+		t.Errorf("Old session token is still valid after refreshing!")
+	}
+	if _, err := userCtlr.ValidateSession(refreshed); err != nil {
+		t.Errorf("Unable to validate refreshed session token: %v.", err)
+	}
+}
+
+func TestExpiredSession(t *testing.T) {
+	store := &mockUserStore{hashes: make(map[string][]byte)}
+	userCtlr := logic.NewUserController(store)
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("16 char passphrase was not permitted but should be.")
+	}
+	token, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "")
+	if err != nil {
+		t.Fatalf("Unable to log in as user that was just added: %v.", err)
+	}
+	for key, session := range store.sessions {
+		store.sessions[key] = mockSession{username: session.username, expiry: time.Now().Add(-time.Minute)}
+	}
+	if _, err := userCtlr.ValidateSession(token); !errors.Is(err, logic.ErrSessionExpired) {
+		t.Errorf("Validating expired session token: got error %v, want %v.", err, logic.ErrSessionExpired)
+	}
+	if _, _, err := userCtlr.RefreshSession(token); err == nil {
+		t.Errorf("Managed to refresh an expired session token!")
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)})
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("16 char passphrase was not permitted but should be.")
+	}
+	token, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "")
+	if err != nil {
+		t.Fatalf("Unable to log in as user that was just added: %v.", err)
+	}
+	if _, _, err := userCtlr.ChangePassphrase("testuser1", "123456789abcdef!", "abcdefg123456789"); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Errorf("Changing passphrase with wrong old passphrase: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+	}
+	if _, _, err := userCtlr.ChangePassphrase("testuser1", "123456789abcdefg", "abcdefg"); !errors.Is(err, logic.ErrWeakPassphrase) {
+		t.Errorf("Changing to a passphrase shorter than 16 chars: got error %v, want %v.", err, logic.ErrWeakPassphrase)
+	}
+	newToken, _, err := userCtlr.ChangePassphrase("testuser1", "123456789abcdefg", "abcdefg123456789")
+	if err != nil {
+		t.Fatalf("Unable to change passphrase: %v.", err)
+	}
+	if _, err := userCtlr.ValidateSession(token); err == nil {
+		t.Errorf("Session token is still valid after changing passphrase!")
+	}
+	if username, err := userCtlr.ValidateSession(newToken); err != nil || username != "testuser1" {
+		t.Errorf("Unable to validate session token issued when changing passphrase: got %v, %v.", username, err)
+	}
+	if err := userCtlr.Authenticate("testuser1", "123456789abcdefg"); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Errorf("Authenticating with old passphrase: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+	}
+	if err := userCtlr.Authenticate("testuser1", "abcdefg123456789"); err != nil {
+		t.Errorf("Unable to authenticate with new passphrase: %v.", err)
+	}
+}
+
+func TestRenameUser(t *testing.T) {
+	userCtlr := logic.NewUserController(&mockUserStore{hashes: make(map[string][]byte)})
+	for _, username := range []string{"testuser1", "testuser2"} {
+		if err := userCtlr.CreateUser(username, "123456789abcdefg"); err != nil {
+			t.Fatalf("16 char passphrase was not permitted but should be.")
+		}
+	}
+	token, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "")
+	if err != nil {
+		t.Fatalf("Unable to log in as user that was just added: %v.", err)
+	}
+	if err := userCtlr.RenameUser("testuser1", ""); !errors.Is(err, logic.ErrEmptyUsername) {
+		t.Errorf("Renaming to an empty username: got error %v, want %v.", err, logic.ErrEmptyUsername)
+	}
+	if err := userCtlr.RenameUser("testuser1", "testuser2"); !errors.Is(err, storage.ErrUserExists) {
+		t.Errorf("Renaming to a taken username: got error %v, want %v.", err, storage.ErrUserExists)
+	}
+	if err := userCtlr.RenameUser("testuser1", "testuser1"); err != nil {
+		t.Errorf("Unable to rename a user to their own username: %v.", err)
+	}
+	if err := userCtlr.RenameUser("testuser1", "renamed"); err != nil {
+		t.Fatalf("Unable to rename user: %v.", err)
+	}
+	if username, err := userCtlr.ValidateSession(token); err != nil || username != "renamed" {
+		t.Errorf("Session did not follow rename: got %v, %v.", username, err)
+	}
+	if err := userCtlr.Authenticate("renamed", "123456789abcdefg"); err != nil {
+		t.Errorf("Unable to authenticate with new username: %v.", err)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	blobs, err := storage.NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to create blob store: %v.", err)
+	}
+	for _, key := range []string{"blob1", "blob2"} {
+		if err := blobs.Put(key, strings.NewReader("Notes")); err != nil {
+			t.Fatalf("Unable to store blob: %v.", err)
+		}
+	}
+	store := &mockUserStore{hashes: make(map[string][]byte), uploads: map[string][]string{"testuser1": {"blob1"}}}
+	userCtlr := logic.NewUserController(store, logic.WithAccountBlobs(blobs))
+	if err := userCtlr.CreateUser("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("16 char passphrase was not permitted but should be.")
+	}
+	token, _, err := userCtlr.Login("testuser1", "123456789abcdefg", "", "")
+	if err != nil {
+		t.Fatalf("Unable to log in as user that was just added: %v.", err)
+	}
+	if err := userCtlr.DeleteAccount("testuser1", "123456789abcdef!"); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Errorf("Deleting account with wrong passphrase: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+	}
+	if err := userCtlr.DeleteAccount("testuser1", "123456789abcdefg"); err != nil {
+		t.Fatalf("Unable to delete account: %v.", err)
+	}
+	if _, err := userCtlr.ValidateSession(token); err == nil {
+		t.Errorf("Session token is still valid after deleting account!")
+	}
+	if err := userCtlr.Authenticate("testuser1", "123456789abcdefg"); !errors.Is(err, logic.ErrInvalidCredentials) {
+		t.Errorf("Authenticating as deleted user: got error %v, want %v.", err, logic.ErrInvalidCredentials)
+	}
+	if _, err := blobs.Get("blob1"); !errors.Is(err, storage.ErrBlobNotFound) {
+		t.Errorf("Reading blob of deleted user: got error %v, want %v.", err, storage.ErrBlobNotFound)
+	}
+	if r, err := blobs.Get("blob2"); err != nil {
+		t.Errorf("Unable to read blob of another user: %v.", err)
+	} else {
+		r.Close()
 	}
 }
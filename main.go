@@ -6,38 +6,241 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/adsouza/chat-backend/api"
 	"github.com/adsouza/chat-backend/logic"
 	"github.com/adsouza/chat-backend/storage"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
 func main() {
-	dsn := flag.String("dsn", "chat.db", "Data Source Name to use for storage layer.")
+	dsn := flag.String("dsn", "chat.db",
+		"Data Source Name to use for storage layer: a postgres:// URL, or else the path of a SQLite DB file.")
 	port := flag.Uint("port", 12345, "Port number on which to listen for incoming connections.")
+	httpPort := flag.Uint("http_port", 8080, "Port number on which to serve the HTTP/JSON gateway, or 0 to disable it.")
+	unfurl := flag.Bool("unfurl_links", true, "Whether to fetch links sent in messages so as to include previews of them.")
+	attachmentsDir := flag.String("attachments_dir", "attachments",
+		"Directory in which to keep the content of attachments, or empty to disable them. Ignored if -s3_bucket is set.")
+	s3Endpoint := flag.String("s3_endpoint", "https://s3.amazonaws.com",
+		"Base URL of the S3-compatible service in which to keep the content of attachments.")
+	s3Region := flag.String("s3_region", "us-east-1", "Region of the S3 bucket.")
+	s3Bucket := flag.String("s3_bucket", "",
+		"S3 bucket in which to keep the content of attachments, using the credentials in $AWS_ACCESS_KEY_ID & $AWS_SECRET_ACCESS_KEY.")
+	hashAlgorithm := flag.String("hash_algorithm", "bcrypt",
+		"Algorithm with which to hash passphrases, either bcrypt or argon2id. Existing hashes are upgraded as users log in.")
+	bcryptCost := flag.Int("bcrypt_cost", bcrypt.DefaultCost, "Cost of bcrypt hashes.")
+	argon2Time := flag.Uint("argon2_time", uint(logic.DefaultArgon2idHasher.Time), "Number of passes that argon2id makes over its memory.")
+	argon2Memory := flag.Uint("argon2_memory_kib", uint(logic.DefaultArgon2idHasher.Memory), "Memory used by argon2id, in KiB.")
+	argon2Threads := flag.Uint("argon2_threads", uint(logic.DefaultArgon2idHasher.Threads), "Degree of parallelism of argon2id.")
+	admins := flag.String("admins", "", "Comma-separated usernames of the administrators, who may unlock accounts.")
+	lockoutThreshold := flag.Uint("lockout_threshold", uint(logic.DefaultUsernameThrottle.LockoutThreshold),
+		"Number of failed logins in a row after which a username is locked out.")
+	ipLockoutThreshold := flag.Uint("ip_lockout_threshold", uint(logic.DefaultClientIPThrottle.LockoutThreshold),
+		"Number of failed logins in a row after which a client's IP address is locked out.")
+	lockoutDuration := flag.Duration("lockout_duration", logic.DefaultUsernameThrottle.LockoutDuration,
+		"How long a username or IP address stays locked out, which is also how long failed logins are remembered.")
+	totpIssuer := flag.String("totp_issuer", logic.DefaultTOTPIssuer, "Name under which authenticator apps list this service.")
+	minUsernameLength := flag.Int("min_username_length", logic.DefaultCredentialPolicy.Username.MinLength,
+		"Minimum number of characters in a username.")
+	maxUsernameLength := flag.Int("max_username_length", logic.DefaultCredentialPolicy.Username.MaxLength,
+		"Maximum number of characters in a username, or 0 for no limit.")
+	unicodeUsernames := flag.Bool("unicode_usernames", false,
+		"Whether usernames may contain letters & digits from any script, rather than only ASCII ones.")
+	reservedUsernames := flag.String("reserved_usernames", strings.Join(logic.DefaultReservedUsernames, ","),
+		"Comma-separated usernames that can't be registered.")
+	minPassphraseLength := flag.Int("min_passphrase_length", logic.DefaultCredentialPolicy.Passphrase.MinLength,
+		"Minimum number of characters in a passphrase.")
+	maxPassphraseLength := flag.Int("max_passphrase_length", logic.DefaultCredentialPolicy.Passphrase.MaxLength,
+		"Maximum number of characters in a passphrase, or 0 for no limit.")
+	passphraseBlocklist := flag.String("passphrase_blocklist", "",
+		"File listing common or breached passphrases that can't be chosen, one per line, either as is or as SHA-1 hashes.")
+	trustedProxies := flag.String("trusted_proxies", "127.0.0.0/8,::1",
+		"Comma-separated IP addresses & CIDR ranges of proxies whose X-Forwarded-For header identifies the client they relay "+
+			"requests for. Must include loopback addresses, from which the HTTP gateway relays requests to the gRPC server.")
+	webSocketOrigins := flag.String("websocket_origins", "",
+		"Comma-separated origins, e.g. https://chat.example.com, of pages on other hosts that may open WebSockets.")
 	flag.Parse()
 
-	db, err := sql.Open("sqlite3", *dsn)
+	db, store, migrator, err := openDB(*dsn)
 	if err != nil {
 		log.Fatalf("Could not open connection to DB: %v.", err)
 	}
 	defer db.Close()
-	if _, err := db.Exec(storage.PragmaCmd); err != nil {
-		log.Printf("Unable to enable foreign key constraints in DB: %v.", err)
+	if flag.Arg(0) == "migrate" {
+		if err := migrate(migrator, flag.Args()[1:]); err != nil {
+			log.Fatalf("Migration failed: %v.", err)
+		}
+		return
+	}
+	if err := migrator.Up(); err != nil {
+		log.Fatalf("Unable to initialize DB: %v.", err)
 	}
-	db.Exec(storage.UserTableInitCmd)
-	db.Exec(storage.ConversationTableInitCmd)
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		log.Fatalf("Could not bind to port: %v.", err)
 	}
-	grpcServer := grpc.NewServer()
-	userCtlr := logic.NewUserController(storage.NewSQLDB(db))
-	msgCtlr := logic.NewMessageController(storage.NewSQLDB(db))
-	api.RegisterChatServer(grpcServer, api.NewChatServer(userCtlr, msgCtlr))
+	var opts []logic.MessageOption
+	if *unfurl {
+		opts = append(opts, logic.WithUnfurler(logic.NewUnfurler(nil)))
+	}
+	var blobs storage.BlobStore
+	switch {
+	case *s3Bucket != "":
+		blobs, err = storage.NewS3BlobStore(storage.S3Config{
+			Endpoint:        *s3Endpoint,
+			Region:          *s3Region,
+			Bucket:          *s3Bucket,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	case *attachmentsDir != "":
+		blobs, err = storage.NewFileBlobStore(*attachmentsDir)
+	}
+	if err != nil {
+		log.Fatalf("Unable to set up storage for attachments: %v.", err)
+	}
+	var hasher logic.Hasher
+	switch *hashAlgorithm {
+	case "bcrypt":
+		if *bcryptCost < bcrypt.MinCost || *bcryptCost > bcrypt.MaxCost {
+			log.Fatalf("bcrypt cost must be between %d & %d.", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		hasher = logic.BcryptHasher{Cost: *bcryptCost}
+	case "argon2id":
+		if *argon2Time == 0 || *argon2Threads == 0 || *argon2Threads > 255 {
+			log.Fatalf("argon2id needs at least 1 pass & between 1 & 255 threads.")
+		}
+		hasher = logic.Argon2idHasher{Time: uint32(*argon2Time), Memory: uint32(*argon2Memory), Threads: uint8(*argon2Threads)}
+	default:
+		log.Fatalf("Unknown hash algorithm %q; want bcrypt or argon2id.", *hashAlgorithm)
+	}
+	if *lockoutDuration <= 0 {
+		log.Fatalf("Lockout duration must be positive.")
+	}
+	byUsername, byClientIP := logic.DefaultUsernameThrottle, logic.DefaultClientIPThrottle
+	byUsername.LockoutThreshold, byUsername.LockoutDuration = uint32(*lockoutThreshold), *lockoutDuration
+	byClientIP.LockoutThreshold, byClientIP.LockoutDuration = uint32(*ipLockoutThreshold), *lockoutDuration
+	userOpts := []logic.UserOption{
+		logic.WithHasher(hasher), logic.WithLoginThrottles(byUsername, byClientIP), logic.WithTOTPIssuer(*totpIssuer),
+	}
+	if *minUsernameLength < 1 || *maxUsernameLength != 0 && *maxUsernameLength < *minUsernameLength {
+		log.Fatalf("Minimum username length must be at least 1 & the maximum 0 or no less than the minimum.")
+	}
+	if *maxPassphraseLength != 0 && *maxPassphraseLength < *minPassphraseLength {
+		log.Fatalf("Maximum passphrase length must be 0 or no less than the minimum.")
+	}
+	policy := logic.CredentialPolicy{
+		Username:   logic.UsernamePolicy{MinLength: *minUsernameLength, MaxLength: *maxUsernameLength, Allowed: logic.ASCIIUsernameChars},
+		Passphrase: logic.PassphrasePolicy{MinLength: *minPassphraseLength, MaxLength: *maxPassphraseLength},
+	}
+	if *unicodeUsernames {
+		policy.Username.Allowed = logic.UnicodeUsernameChars
+	}
+	if *reservedUsernames != "" {
+		policy.Username.Reserved = strings.Split(*reservedUsernames, ",")
+	}
+	if *passphraseBlocklist != "" {
+		if policy.Passphrase.Blocklist, err = logic.LoadPassphraseList(*passphraseBlocklist); err != nil {
+			log.Fatalf("Could not load passphrase blocklist: %v.", err)
+		}
+		log.Printf("Loaded %d passphrases that can't be chosen.", policy.Passphrase.Blocklist.Len())
+	}
+	userOpts = append(userOpts, logic.WithCredentialPolicy(policy))
+	if *admins != "" {
+		userOpts = append(userOpts, logic.WithAdmins(strings.Split(*admins, ",")...))
+	}
+	if blobs != nil {
+		opts = append(opts, logic.WithBlobStore(blobs))
+		userOpts = append(userOpts, logic.WithAccountBlobs(blobs))
+	}
+	proxies, err := api.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Could not parse trusted proxies: %v.", err)
+	}
+	userCtlr := logic.NewUserController(store, userOpts...)
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(api.AuthInterceptor(userCtlr)),
+		grpc.StreamInterceptor(api.AuthStreamInterceptor(userCtlr)))
+	msgCtlr := logic.NewMessageController(store, opts...)
+	chat := api.NewChatServer(userCtlr, msgCtlr, proxies)
+	api.RegisterChatServer(grpcServer, chat)
+	if *httpPort != 0 {
+		var origins []string
+		if *webSocketOrigins != "" {
+			origins = strings.Split(*webSocketOrigins, ",")
+		}
+		go serveGateway(*httpPort, *port, proxies, api.NewWebSocketHandler(chat, userCtlr, origins...))
+	}
 	log.Println("Chat service is now ready!")
 	grpcServer.Serve(lis)
 }
+
+// serveGateway serves the HTTP/JSON gateway, which relays requests to the gRPC server on the specified port, along with
+// the WebSocket endpoint.
+func serveGateway(httpPort, grpcPort uint, proxies api.TrustedProxies, webSocket http.Handler) {
+	conn, err := grpc.Dial(fmt.Sprintf("localhost:%d", grpcPort), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Could not connect gateway to gRPC server: %v.", err)
+	}
+	gateway, err := api.NewGateway(conn, proxies)
+	if err != nil {
+		log.Fatalf("Could not create gateway: %v.", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(api.GatewayPrefix, gateway)
+	mux.Handle(api.WebSocketPath, webSocket)
+	log.Fatalf("Gateway stopped: %v.", http.ListenAndServe(fmt.Sprintf(":%d", httpPort), mux))
+}
+
+// openDB connects to the DB specified by dsn, choosing the driver based on its form.
+func openDB(dsn string) (*sql.DB, *storage.SQLDB, *storage.Migrator, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return db, storage.NewPostgresDB(db), storage.NewPostgresMigrator(db), nil
+	}
+	db, err := sql.Open("sqlite3", storage.SQLiteDSN(dsn))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return db, storage.NewSQLDB(db), storage.NewMigrator(db), nil
+}
+
+// migrate implements the migrate subcommand, which applies, reverts or lists schema migrations.
+func migrate(migrator *storage.Migrator, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s [flags] migrate up|down|status", os.Args[0])
+	}
+	switch args[0] {
+	case "up":
+		return migrator.Up()
+	case "down":
+		return migrator.Down()
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if !status.AppliedAt.IsZero() {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-32s  %v\n", status.Version, state, status.Description)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q; want up, down or status", args[0])
+	}
+}
@@ -1,6 +1,7 @@
 protoc -I ./ api/api.proto --go_out=plugins=grpc:. && \
-go test storage/sqlite_test.go && \
+go test -tags sqlite_fts5 storage/*_test.go && \
+go test entities/*_test.go && \
 go test logic/*_test.go && \
-go run integration_demo.go && \
+go run -tags sqlite_fts5 integration_demo.go && \
 echo "All tests pass :-)"
-go run main.go
+go run -tags sqlite_fts5 main.go
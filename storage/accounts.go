@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"fmt"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// CanonicalUsername returns the form of a username that is unique among users: its compatibility decomposition, case
+// folded, so that e.g. "Bob", "BOB" & "ｂｏｂ" are all the same user.
+func CanonicalUsername(username string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(username)))
+}
+
+// ReplaceHash stores a new hash of a user's passphrase & revokes all of their sessions.
+func (s *SQLDB) ReplaceHash(username string, hash []byte) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE users SET hash = ? WHERE username = ?", string(hash), username)
+	if err != nil {
+		return fmt.Errorf("unable to update hash: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("unable to update hash: %v", err)
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE username = ?", username); err != nil {
+		return fmt.Errorf("unable to revoke sessions: %v", err)
+	}
+	return tx.Commit()
+}
+
+// UpdateHash replaces a user's hash with an equivalent one, such as a hash of the same passphrase in a stronger format.
+// Nothing happens unless the current hash is still oldHash, so that a concurrent change of passphrase isn't undone.
+func (s *SQLDB) UpdateHash(username string, oldHash, newHash []byte) error {
+	if _, err := s.Exec("UPDATE users SET hash = ? WHERE username = ? AND hash = ?", string(newHash), username, string(oldHash)); err != nil {
+		return fmt.Errorf("unable to update hash: %v", err)
+	}
+	return nil
+}
+
+// RenameUser changes a username, along with its canonical form, which may be the same as before so long as the username
+// itself differs. Every reference to the user, from their sessions to the messages they sent, follows along by way of
+// the ON UPDATE CASCADE clauses of the foreign keys.
+func (s *SQLDB) RenameUser(username, newUsername, newCanonical string) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	var taken bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE (username = ? OR canonical_username = ?) AND username <> ?)",
+		newUsername, newCanonical, username).Scan(&taken); err != nil {
+		return fmt.Errorf("unable to look up user: %v", err)
+	}
+	if taken {
+		return fmt.Errorf("%w: %v", ErrUserExists, newUsername)
+	}
+	res, err := tx.Exec("UPDATE users SET username = ?, canonical_username = ? WHERE username = ?", newUsername, newCanonical, username)
+	if err != nil {
+		return fmt.Errorf("unable to rename user: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("unable to rename user: %v", err)
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	// Their 1:1 conversations are identified by the usernames of their members.
+	if err := keyDirectConversations(tx, `c.direct_key IS NOT NULL
+	AND c.id IN (SELECT conversation FROM conversation_members WHERE username = ?)`, newUsername); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// doomedConversations selects the conversations that go along with the account of the user bound to its parameter:
+// their 1:1 conversations, which would otherwise be mistaken for the peer's conversation with themselves, & any group
+// that has no other members.
+const doomedConversations = `SELECT c.id FROM conversations c JOIN conversation_members cm ON cm.conversation = c.id
+	WHERE cm.username = ? AND (NOT c.is_group OR (SELECT COUNT(*) FROM conversation_members o WHERE o.conversation = c.id) = 1)`
+
+// DeleteUser deletes an account along with the messages the user sent, which the foreign key from messages to users
+// would otherwise prevent, their 1:1 conversations & anything else of theirs. The other members of their group
+// conversations keep the messages they sent themselves. Returns the blob keys of the attachments that were deleted,
+// whose content the caller is responsible for deleting.
+func (s *SQLDB) DeleteUser(username string) ([]string, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if exists, err := userExists(tx, username); err != nil || !exists {
+		if err == nil {
+			err = fmt.Errorf("%w: %v", ErrUserNotFound, username)
+		}
+		return nil, err
+	}
+	rows, err := tx.Query(`SELECT blob_key FROM attachments WHERE owner = ?
+	OR message IN (SELECT id FROM messages WHERE conversation IN (`+doomedConversations+`))
+	ORDER BY id`, username, username)
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute query for attachments of user: %v", err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("unable to parse blob key from DB: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read attachments of user: %v", err)
+	}
+	for _, cmd := range []string{
+		"DELETE FROM conversations WHERE id IN (" + doomedConversations + ")",
+		"DELETE FROM messages WHERE sender = ?",
+		"DELETE FROM users WHERE username = ?",
+	} {
+		if _, err := tx.Exec(cmd, username); err != nil {
+			return nil, fmt.Errorf("unable to delete user: %v", err)
+		}
+	}
+	return keys, tx.Commit()
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Attachment describes a file that a user uploaded, whose content is kept in a BlobStore under BlobKey.
+type Attachment struct {
+	ID    int64
+	Owner string
+	// Message is the ID of the message in which the attachment was sent, or 0 if it hasn't been yet.
+	Message     int64
+	BlobKey     string
+	Filename    string
+	ContentType string
+	Size        int64
+	// SHA256 is the hex-encoded digest of the content.
+	SHA256 string
+	// Width & Height are zero unless the content is an image.
+	Width, Height uint32
+	CreatedAt     time.Time
+}
+
+const attachmentColumns = "id, owner, message, blob_key, filename, content_type, size, sha256, width, height, created_at"
+
+// AddAttachment records an uploaded file whose content has already been stored, returning it with its ID filled in.
+func (s *SQLDB) AddAttachment(a Attachment) (Attachment, error) {
+	if exists, err := userExists(s, a.Owner); err != nil || !exists {
+		if err == nil {
+			err = fmt.Errorf("%w: %v", ErrUserNotFound, a.Owner)
+		}
+		return Attachment{}, err
+	}
+	var ts string
+	if err := s.QueryRow(`INSERT INTO attachments (owner, blob_key, filename, content_type, size, sha256, width, height)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id, created_at`,
+		a.Owner, a.BlobKey, a.Filename, a.ContentType, a.Size, a.SHA256, a.Width, a.Height).Scan(&a.ID, &ts); err != nil {
+		return Attachment{}, fmt.Errorf("unable to add attachment: %v", err)
+	}
+	var err error
+	if a.CreatedAt, err = parseTimestamp(ts); err != nil {
+		return Attachment{}, fmt.Errorf("unable to parse timestamp from DB: %v", err)
+	}
+	return a, nil
+}
+
+func (s *SQLDB) FetchAttachment(id int64) (Attachment, error) {
+	var a Attachment
+	var message sql.NullInt64
+	var ts string
+	err := s.QueryRow("SELECT "+attachmentColumns+" FROM attachments WHERE id = ?", id).Scan(
+		&a.ID, &a.Owner, &message, &a.BlobKey, &a.Filename, &a.ContentType, &a.Size, &a.SHA256, &a.Width, &a.Height, &ts)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return Attachment{}, fmt.Errorf("%w: %d", ErrAttachmentNotFound, id)
+	case err != nil:
+		return Attachment{}, fmt.Errorf("unable to parse attachment from DB: %v", err)
+	}
+	a.Message = message.Int64
+	if a.CreatedAt, err = parseTimestamp(ts); err != nil {
+		return Attachment{}, fmt.Errorf("unable to parse timestamp from DB: %v", err)
+	}
+	return a, nil
+}
+
+// attachToMessage records that the specified attachments were sent in a message. Each must belong to owner & not have
+// been sent already.
+func attachToMessage(e execer, message int64, owner string, ids []int64) error {
+	for _, id := range ids {
+		res, err := e.Exec("UPDATE attachments SET message = ? WHERE id = ? AND owner = ? AND message IS NULL", message, id, owner)
+		if err != nil {
+			return fmt.Errorf("unable to attach attachment to message: %v", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return fmt.Errorf("unable to attach attachment to message: %v", err)
+		} else if n == 0 {
+			return fmt.Errorf("%w: %d", ErrAttachmentUnavailable, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// BlobStore keeps the content of attachments, each under a key chosen by the caller. Keys consist of letters, digits,
+// '.', '-' & '_', & don't start with a '.'.
+type BlobStore interface {
+	// Put stores everything read from content under key, replacing any blob that was already stored there.
+	Put(key string, content io.Reader) error
+	// Get returns the content stored under key, or ErrBlobNotFound.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes the blob stored under key. Deleting a blob that doesn't exist is harmless.
+	Delete(key string) error
+}
+
+var blobKeyPattern = regexp.MustCompile(`^[\w-][\w.-]*$`)
+
+func checkBlobKey(key string) error {
+	if !blobKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	return nil
+}
+
+// FileBlobStore keeps each blob in a file named after its key, in a single directory.
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore returns a store of blobs in dir, creating it if necessary.
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create blob directory: %v", err)
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+// Put writes the content to a temporary file that is only renamed into place once complete, so that readers never see
+// part of a blob.
+func (s *FileBlobStore) Put(key string, content io.Reader) error {
+	if err := checkBlobKey(key); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return fmt.Errorf("unable to create blob file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write blob: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write blob: %v", err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(s.dir, key)); err != nil {
+		return fmt.Errorf("unable to store blob: %v", err)
+	}
+	return nil
+}
+
+func (s *FileBlobStore) Get(key string) (io.ReadCloser, error) {
+	if err := checkBlobKey(key); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(s.dir, key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %v", ErrBlobNotFound, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open blob: %v", err)
+	}
+	return f, nil
+}
+
+func (s *FileBlobStore) Delete(key string) error {
+	if err := checkBlobKey(key); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(s.dir, key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to delete blob: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package storage_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/adsouza/chat-backend/storage"
+)
+
+func testBlobStore(t *testing.T, store storage.BlobStore) {
+	read := func(key string) (string, error) {
+		t.Helper()
+		r, err := store.Get(key)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Unable to read blob: %v.", err)
+		}
+		return string(data), nil
+	}
+	if _, err := read("missing"); !errors.Is(err, storage.ErrBlobNotFound) {
+		t.Errorf("Reading a missing blob: got error %v, want %v.", err, storage.ErrBlobNotFound)
+	}
+	for _, content := range []string{"Hello, world!", strings.Repeat("0123456789", 100000), ""} {
+		if err := store.Put("blob-1.txt", strings.NewReader(content)); err != nil {
+			t.Fatalf("Unable to store blob: %v.", err)
+		}
+		got, err := read("blob-1.txt")
+		if err != nil {
+			t.Fatalf("Unable to retrieve blob: %v.", err)
+		}
+		if got != content {
+			t.Errorf("Blob content mismatch: got %d bytes, want %d.", len(got), len(content))
+		}
+	}
+	if err := store.Delete("blob-1.txt"); err != nil {
+		t.Fatalf("Unable to delete blob: %v.", err)
+	}
+	if _, err := read("blob-1.txt"); !errors.Is(err, storage.ErrBlobNotFound) {
+		t.Errorf("Reading a deleted blob: got error %v, want %v.", err, storage.ErrBlobNotFound)
+	}
+	if err := store.Delete("blob-1.txt"); err != nil {
+		t.Errorf("Unable to delete a blob twice: %v.", err)
+	}
+	for _, key := range []string{"", "../escape", "a/b", ".hidden"} {
+		if err := store.Put(key, strings.NewReader("x")); err == nil {
+			t.Errorf("Able to store a blob with key %q.", key)
+		}
+	}
+}
+
+func TestFileBlobStore(t *testing.T) {
+	store, err := storage.NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to create blob store: %v.", err)
+	}
+	testBlobStore(t, store)
+}
+
+// fakeS3 stands in for an S3 bucket, rejecting any request whose signature doesn't match the one secret it knows.
+type fakeS3 struct {
+	secret  string
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.verify(r); err != nil {
+		http.Error(w, "SignatureDoesNotMatch: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != r.Header.Get("X-Amz-Content-Sha256") {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+	case http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "MethodNotAllowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// verify recomputes the AWS Signature Version 4 of a request from the headers it claims to have signed.
+func (f *fakeS3) verify(r *http.Request) error {
+	var credential, signedHeaders, signature string
+	for _, field := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "), ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			signature = value
+		}
+	}
+	scope := strings.SplitN(credential, "/", 2)
+	if len(scope) != 2 || scope[0] != "test-key" {
+		return fmt.Errorf("unexpected credential %q", credential)
+	}
+	canonical := []string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery}
+	for _, name := range strings.Split(signedHeaders, ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonical = append(canonical, name+":"+value)
+	}
+	canonical = append(canonical, "", signedHeaders, r.Header.Get("X-Amz-Content-Sha256"))
+	requestHash := sha256.Sum256([]byte(strings.Join(canonical, "\n")))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", r.Header.Get("X-Amz-Date"), scope[1], hex.EncodeToString(requestHash[:])}, "\n")
+	key := []byte("AWS4" + f.secret)
+	for _, part := range strings.Split(scope[1], "/") {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	if want := hex.EncodeToString(mac.Sum(nil)); signature != want {
+		return fmt.Errorf("got signature %q, want %q", signature, want)
+	}
+	return nil
+}
+
+func TestS3BlobStore(t *testing.T) {
+	bucket := &fakeS3{secret: "test-secret", objects: make(map[string][]byte)}
+	server := httptest.NewServer(bucket)
+	defer server.Close()
+	store, err := storage.NewS3BlobStore(storage.S3Config{
+		Endpoint:        server.URL,
+		Region:          "test-region",
+		Bucket:          "attachments",
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "test-secret",
+	})
+	if err != nil {
+		t.Fatalf("Unable to create blob store: %v.", err)
+	}
+	testBlobStore(t, store)
+	if err := store.Put("blob-2", strings.NewReader("Hello!")); err != nil {
+		t.Fatalf("Unable to store blob: %v.", err)
+	}
+	if _, ok := bucket.objects["/attachments/blob-2"]; !ok {
+		t.Errorf("Blob was not stored in the bucket: got objects %v.", bucket.objects)
+	}
+	wrongSecret, err := storage.NewS3BlobStore(storage.S3Config{
+		Endpoint:        server.URL,
+		Region:          "test-region",
+		Bucket:          "attachments",
+		AccessKeyID:     "test-key",
+		SecretAccessKey: "wrong-secret",
+	})
+	if err != nil {
+		t.Fatalf("Unable to create blob store: %v.", err)
+	}
+	if _, err := wrongSecret.Get("blob-2"); err == nil || errors.Is(err, storage.ErrBlobNotFound) {
+		t.Errorf("Reading a blob with the wrong credentials: got error %v, want a signature mismatch.", err)
+	}
+}
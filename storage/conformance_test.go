@@ -0,0 +1,1332 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adsouza/chat-backend/storage"
+)
+
+// storeFactory returns an empty store backed by a fresh DB, along with a func to release it.
+type storeFactory func(t *testing.T) (*storage.SQLDB, func())
+
+// conformanceSuite is run against every supported DB, each of which must behave identically.
+var conformanceSuite = []struct {
+	name string
+	test func(t *testing.T, newStore storeFactory)
+}{
+	{"HappyPath", testHappyPath},
+	{"NonexistentUser", testNonexistentUser},
+	{"MessageOrder", testMessageOrder},
+	{"MsgFromNonexistentUser", testMsgFromNonexistentUser},
+	{"MsgToNonexistentUser", testMsgToNonexistentUser},
+	{"MessagePagination", testMessagePagination},
+	{"Sessions", testSessions},
+	{"SessionForNonexistentUser", testSessionForNonexistentUser},
+	{"ReadMessagesReceivedAfter", testReadMessagesReceivedAfter},
+	{"GroupConversation", testGroupConversation},
+	{"DirectConversation", testDirectConversation},
+	{"ConcurrentDirectConversation", testConcurrentDirectConversation},
+	{"ConversationSummaries", testConversationSummaries},
+	{"ReadCursors", testReadCursors},
+	{"UnreadCount", testUnreadCount},
+	{"MessageSync", testMessageSync},
+	{"EditMessage", testEditMessage},
+	{"DeleteMessage", testDeleteMessage},
+	{"IdempotentMessages", testIdempotentMessages},
+	{"Contacts", testContacts},
+	{"Attachments", testAttachments},
+	{"ReplaceHash", testReplaceHash},
+	{"UpdateHash", testUpdateHash},
+	{"RenameUser", testRenameUser},
+	{"DeleteUser", testDeleteUser},
+	{"LoginFailures", testLoginFailures},
+	{"TOTP", testTOTP},
+	{"CanonicalUsernames", testCanonicalUsernames},
+}
+
+func runConformanceSuite(t *testing.T, newStore storeFactory) {
+	for _, tc := range conformanceSuite {
+		t.Run(tc.name, func(t *testing.T) { tc.test(t, newStore) })
+	}
+}
+
+func testHappyPath(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	hash, err := store.FetchHash("testuser1")
+	if err != nil {
+		t.Fatalf("Unable to retrieve hash for recently added user: %v.", err)
+	}
+	if got, want := string(hash), "012345678901234567890123456789012345678901234567890123456789"; got != want {
+		t.Errorf("Hash mismatch:\ngot  %v\nwant %v", got, want)
+	}
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); !errors.Is(err, storage.ErrUserExists) {
+		t.Errorf("Adding a user twice: got error %v, want %v.", err, storage.ErrUserExists)
+	}
+	if err := store.AddUser("testuser2", "testuser2", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a 2nd row to the users table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, ""); err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	messages, _, err := store.ReadMessagesBefore("testuser1", "testuser2", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve messages for specified conversation: %v.", err)
+	}
+	if messages == nil {
+		t.Fatalf("No messages found for recently initiated conversation.")
+	}
+	if got, want := messages[0].Content, "Hello!"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Author, "testuser1"; got != want {
+		t.Errorf("Message author mismatch: got %v, want %v.", got, want)
+	}
+	// Now make sure it works with the usernames in reverse order too.
+	messages, _, err = store.ReadMessagesBefore("testuser2", "testuser1", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve messages for specified conversation: %v.", err)
+	}
+	if messages == nil {
+		t.Fatalf("No messages found for recently initiated conversation.")
+	}
+	if got, want := messages[0].Content, "Hello!"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Author, "testuser1"; got != want {
+		t.Errorf("Message author mismatch: got %v, want %v.", got, want)
+	}
+}
+
+func testNonexistentUser(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if _, err := store.FetchHash("testuser1"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("Retrieving hash for nonexistent user: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+}
+
+func testMessageOrder(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if err := store.AddUser("testuser2", "testuser2", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, ""); err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser2", "testuser1", "Nice to meet you.", nil, ""); err != nil {
+		t.Fatalf("Unable to add a 2nd row to the messages table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser1", "testuser2", "Goodbye.", nil, ""); err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	messages, _, err := store.ReadMessagesBefore("testuser1", "testuser2", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve messages for specified conversation: %v.", err)
+	}
+	if messages == nil {
+		t.Fatalf("No messages found for recently initiated conversation.")
+	}
+	if got, want := len(messages), 3; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Goodbye."; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := messages[1].Content, "Nice to meet you."; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := messages[2].Content, "Hello!"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+}
+
+func testMsgFromNonexistentUser(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser2", "testuser1", "Hello!", nil, ""); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("Adding a message with a nonexistent sender: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+}
+
+func testMsgToNonexistentUser(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, ""); !errors.Is(err, storage.ErrRecipientUnknown) {
+		t.Errorf("Adding a message with a nonexistent recipient: got error %v, want %v.", err, storage.ErrRecipientUnknown)
+	}
+}
+
+func testMessagePagination(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if err := store.AddUser("testuser2", "testuser2", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, ""); err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser2", "testuser1", "Nice to meet you.", nil, ""); err != nil {
+		t.Fatalf("Unable to add a 2nd row to the messages table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser1", "testuser2", "Goodbye.", nil, ""); err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	messages, cToken, err := store.ReadMessagesBefore("testuser1", "testuser2", 2, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve messages for specified conversation: %v.", err)
+	}
+	if messages == nil {
+		t.Fatalf("No messages found for recently initiated conversation.")
+	}
+	if got, want := len(messages), 2; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Goodbye."; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := messages[1].Content, "Nice to meet you."; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	messages, _, err = store.ReadMessagesBefore("testuser1", "testuser2", math.MaxUint32, cToken)
+	if err != nil {
+		t.Fatalf("Unable to retrieve messages for specified conversation: %v.", err)
+	}
+	if messages == nil {
+		t.Fatalf("No messages found for earlier conversation.")
+	}
+	if got, want := len(messages), 1; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Hello!"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+}
+
+func testSessions(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	expiry := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	if err := store.AddSession("token1", "testuser1", expiry); err != nil {
+		t.Fatalf("Unable to add a new row to the sessions table: %v.", err)
+	}
+	username, gotExpiry, err := store.FetchSession("token1")
+	if err != nil {
+		t.Fatalf("Unable to retrieve recently added session: %v.", err)
+	}
+	if got, want := username, "testuser1"; got != want {
+		t.Errorf("Session username mismatch: got %v, want %v.", got, want)
+	}
+	if !gotExpiry.Equal(expiry) {
+		t.Errorf("Session expiry mismatch: got %v, want %v.", gotExpiry, expiry)
+	}
+	if err := store.DeleteSession("token1"); err != nil {
+		t.Fatalf("Unable to delete session: %v.", err)
+	}
+	if _, _, err := store.FetchSession("token1"); !errors.Is(err, storage.ErrSessionNotFound) {
+		t.Errorf("Retrieving deleted session: got error %v, want %v.", err, storage.ErrSessionNotFound)
+	}
+}
+
+func testSessionForNonexistentUser(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddSession("token1", "testuser1", time.Now().Add(time.Hour)); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("Adding a session for a nonexistent user: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+}
+
+func testReadMessagesReceivedAfter(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if err := store.AddUser("testuser2", "testuser2", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	first, _, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, "")
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser2", "testuser1", "Nice to meet you.", nil, ""); err != nil {
+		t.Fatalf("Unable to add a 2nd row to the messages table: %v.", err)
+	}
+	last, _, err := store.AddMessage("testuser1", "testuser2", "Goodbye.", nil, "")
+	if err != nil {
+		t.Fatalf("Unable to add a 3rd row to the messages table: %v.", err)
+	}
+	if first.ID >= last.ID {
+		t.Errorf("Message IDs are not increasing: %v then %v.", first.ID, last.ID)
+	}
+	if last.Timestamp.IsZero() {
+		t.Errorf("New message has no timestamp.")
+	}
+	messages, cToken, err := store.ReadMessagesReceivedAfter("testuser2", math.MaxUint32, first.ID)
+	if err != nil {
+		t.Fatalf("Unable to retrieve messages for specified recipient: %v.", err)
+	}
+	if got, want := len(messages), 1; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Goodbye."; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := cToken, last.ID; got != want {
+		t.Errorf("Continuation token mismatch: got %v, want %v.", got, want)
+	}
+	messages, cToken, err = store.ReadMessagesReceivedAfter("testuser2", math.MaxUint32, cToken)
+	if err != nil {
+		t.Fatalf("Unable to retrieve messages for specified recipient: %v.", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Retrieved %v messages that were already seen.", len(messages))
+	}
+	if got, want := cToken, last.ID; got != want {
+		t.Errorf("Continuation token mismatch: got %v, want %v.", got, want)
+	}
+}
+
+func testGroupConversation(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2", "testuser3"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	id, err := store.CreateConversation("Test group", []string{"testuser1", "testuser2"})
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the conversations table: %v.", err)
+	}
+	if err := store.AddMember(id, "testuser3"); err != nil {
+		t.Fatalf("Unable to add a member to conversation: %v.", err)
+	}
+	if err := store.AddMember(id, "testuser3"); !errors.Is(err, storage.ErrAlreadyMember) {
+		t.Errorf("Adding the same member to a conversation twice: got error %v, want %v.", err, storage.ErrAlreadyMember)
+	}
+	if err := store.AddMember(id, "testuser4"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("Adding a nonexistent user to a conversation: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+	conversation, err := store.FetchConversation(id)
+	if err != nil {
+		t.Fatalf("Unable to retrieve conversation: %v.", err)
+	}
+	if got, want := conversation.Title, "Test group"; got != want {
+		t.Errorf("Conversation title mismatch: got %v, want %v.", got, want)
+	}
+	if !conversation.Group {
+		t.Errorf("Conversation is not marked as a group.")
+	}
+	if got, want := len(conversation.Members), 3; got != want {
+		t.Errorf("Conversation has wrong number of members: got %v, want %v.", got, want)
+	}
+	if got, want := conversation.Owner, "testuser1"; got != want {
+		t.Errorf("Conversation owner mismatch: got %v, want %v.", got, want)
+	}
+	if _, _, err := store.AddConversationMessage(id, "testuser1", "Hello everyone!", nil, ""); err != nil {
+		t.Fatalf("Unable to add a message to conversation: %v.", err)
+	}
+	if _, _, err := store.AddConversationMessage(id, "testuser3", "Hi!", nil, ""); err != nil {
+		t.Fatalf("Unable to add a 2nd message to conversation: %v.", err)
+	}
+	messages, _, err := store.ReadConversationBefore("testuser2", id, math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve messages for conversation: %v.", err)
+	}
+	if got, want := len(messages), 2; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Hi!"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	// Group messages must not leak into the 1:1 conversation between members.
+	messages, _, err = store.ReadMessagesBefore("testuser1", "testuser3", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve messages for 1:1 conversation: %v.", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Retrieved %v group messages from a 1:1 conversation.", len(messages))
+	}
+	messages, _, err = store.ReadMessagesReceivedAfter("testuser2", math.MaxUint32, 0)
+	if err != nil {
+		t.Fatalf("Unable to retrieve messages for specified recipient: %v.", err)
+	}
+	if got, want := len(messages), 2; got != want {
+		t.Errorf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if err := store.RemoveMember(id, "testuser2"); err != nil {
+		t.Fatalf("Unable to remove a member from conversation: %v.", err)
+	}
+	if err := store.RemoveMember(id, "testuser2"); !errors.Is(err, storage.ErrMemberNotFound) {
+		t.Errorf("Removing a member from a conversation twice: got error %v, want %v.", err, storage.ErrMemberNotFound)
+	}
+	if err := store.RemoveMember(id, "testuser1"); err != nil {
+		t.Fatalf("Unable to remove the owner from conversation: %v.", err)
+	}
+	if conversation, err := store.FetchConversation(id); err != nil || conversation.Owner != "" {
+		t.Errorf("Conversation still has an owner after they left: %+v, %v.", conversation, err)
+	}
+}
+
+func testDirectConversation(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	if id, err := store.FindDirectConversation("testuser1", "testuser2"); err != nil || id != 0 {
+		t.Errorf("Found a 1:1 conversation before starting one: got %v (%v), want 0.", id, err)
+	}
+	id, err := store.DirectConversation("testuser1", "testuser2")
+	if err != nil {
+		t.Fatalf("Unable to start a 1:1 conversation: %v.", err)
+	}
+	if found, err := store.FindDirectConversation("testuser2", "testuser1"); err != nil || found != id {
+		t.Errorf("Did not find the 1:1 conversation: got %v (%v), want %v.", found, err, id)
+	}
+	if again, err := store.DirectConversation("testuser2", "testuser1"); err != nil || again != id {
+		t.Errorf("Did not get the same 1:1 conversation back: got %v (%v), want %v.", again, err, id)
+	}
+	self, err := store.DirectConversation("testuser1", "testuser1")
+	if err != nil {
+		t.Fatalf("Unable to start a conversation with oneself: %v.", err)
+	}
+	if self == id {
+		t.Errorf("Conversation with oneself is the same as a 1:1 conversation with someone else.")
+	}
+	msg, _, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, "")
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	if got, want := msg.Conversation, id; got != want {
+		t.Errorf("Message conversation mismatch: got %v, want %v.", got, want)
+	}
+	if err := store.RenameUser("testuser1", "renamed", "renamed"); err != nil {
+		t.Fatalf("Unable to rename user: %v.", err)
+	}
+	if again, err := store.DirectConversation("testuser2", "renamed"); err != nil || again != id {
+		t.Errorf("Did not get the same 1:1 conversation back after a rename: got %v (%v), want %v.", again, err, id)
+	}
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if other, err := store.DirectConversation("testuser1", "testuser2"); err != nil || other == id {
+		t.Errorf("New user with the old username got the 1:1 conversation of the renamed user: got %v (%v).", other, err)
+	}
+}
+
+func testConcurrentDirectConversation(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	ids := make([]int64, 8)
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = store.DirectConversation("testuser1", "testuser2")
+		}(i)
+	}
+	wg.Wait()
+	for i := range ids {
+		if errs[i] != nil {
+			t.Fatalf("Unable to start a 1:1 conversation: %v.", errs[i])
+		}
+		if ids[i] != ids[0] {
+			t.Errorf("Concurrent callers started different 1:1 conversations: got %v, want %v.", ids[i], ids[0])
+		}
+	}
+}
+
+func testConversationSummaries(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2", "testuser3"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	group, err := store.CreateConversation("Test group", []string{"testuser1", "testuser2", "testuser3"})
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the conversations table: %v.", err)
+	}
+	if _, err := store.CreateConversation("Empty group", []string{"testuser1", "testuser2"}); err != nil {
+		t.Fatalf("Unable to add a 2nd row to the conversations table: %v.", err)
+	}
+	if _, _, err := store.AddMessage("testuser2", "testuser1", "Hello!", nil, ""); err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	if _, _, err := store.AddConversationMessage(group, "testuser1", "Hello everyone!", nil, ""); err != nil {
+		t.Fatalf("Unable to add a message to group conversation: %v.", err)
+	}
+	if _, _, err := store.AddConversationMessage(group, "testuser2", "Hi!", nil, ""); err != nil {
+		t.Fatalf("Unable to add a 2nd message to group conversation: %v.", err)
+	}
+	if _, _, err := store.AddConversationMessage(group, "testuser3", "Hey.", nil, ""); err != nil {
+		t.Fatalf("Unable to add a 3rd message to group conversation: %v.", err)
+	}
+	summaries, cToken, err := store.ReadConversationSummaries("testuser1", 1, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve conversation summaries: %v.", err)
+	}
+	if got, want := len(summaries), 1; got != want {
+		t.Fatalf("Wrong number of conversations retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := summaries[0].ID, group; got != want {
+		t.Errorf("Most recently active conversation mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := summaries[0].LastMessage.Content, "Hey."; got != want {
+		t.Errorf("Last message content mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := summaries[0].Unread, uint32(2); got != want {
+		t.Errorf("Unread count mismatch: got %v, want %v.", got, want)
+	}
+	summaries, _, err = store.ReadConversationSummaries("testuser1", math.MaxUint32, cToken)
+	if err != nil {
+		t.Fatalf("Unable to retrieve conversation summaries: %v.", err)
+	}
+	if got, want := len(summaries), 1; got != want {
+		t.Fatalf("Wrong number of conversations retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := summaries[0].Peer, "testuser2"; got != want {
+		t.Errorf("Conversation peer mismatch: got %v, want %v.", got, want)
+	}
+	if summaries[0].Group {
+		t.Errorf("1:1 conversation is marked as a group.")
+	}
+	if got, want := summaries[0].Unread, uint32(1); got != want {
+		t.Errorf("Unread count mismatch: got %v, want %v.", got, want)
+	}
+	summaries, _, err = store.ReadConversationSummaries("testuser3", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve conversation summaries: %v.", err)
+	}
+	if got, want := len(summaries), 1; got != want {
+		t.Fatalf("Wrong number of conversations retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := summaries[0].Unread, uint32(0); got != want {
+		t.Errorf("Unread count mismatch: got %v, want %v.", got, want)
+	}
+}
+
+func testReadCursors(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2", "testuser3"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	first, _, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, "")
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	second, _, err := store.AddMessage("testuser1", "testuser2", "Are you there?", nil, "")
+	if err != nil {
+		t.Fatalf("Unable to add a 2nd row to the messages table: %v.", err)
+	}
+	cursors, err := store.ReadCursors(first.Conversation)
+	if err != nil {
+		t.Fatalf("Unable to retrieve read cursors: %v.", err)
+	}
+	if got, want := len(cursors), 2; got != want {
+		t.Fatalf("Wrong number of read cursors retrieved: got %v, want %v.", got, want)
+	}
+	// Sending a message implies having read the conversation up to that point.
+	if got, want := cursors[0], (storage.ReadCursor{Username: "testuser1", Message: second.ID}); got != want {
+		t.Errorf("Read cursor mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := cursors[1], (storage.ReadCursor{Username: "testuser2", Message: 0}); got != want {
+		t.Errorf("Read cursor mismatch: got %v, want %v.", got, want)
+	}
+	summaries, _, err := store.ReadConversationSummaries("testuser2", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve conversation summaries: %v.", err)
+	}
+	if got, want := summaries[0].Unread, uint32(2); got != want {
+		t.Errorf("Unread count mismatch: got %v, want %v.", got, want)
+	}
+	if err := store.UpdateReadCursor(first.Conversation, "testuser2", second.ID); err != nil {
+		t.Fatalf("Unable to update read cursor: %v.", err)
+	}
+	// Read cursors must never move backwards.
+	if err := store.UpdateReadCursor(first.Conversation, "testuser2", first.ID); err != nil {
+		t.Fatalf("Unable to update read cursor: %v.", err)
+	}
+	cursors, err = store.ReadCursors(first.Conversation)
+	if err != nil {
+		t.Fatalf("Unable to retrieve read cursors: %v.", err)
+	}
+	if got, want := cursors[1], (storage.ReadCursor{Username: "testuser2", Message: second.ID}); got != want {
+		t.Errorf("Read cursor mismatch: got %v, want %v.", got, want)
+	}
+	summaries, _, err = store.ReadConversationSummaries("testuser2", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve conversation summaries: %v.", err)
+	}
+	if got, want := summaries[0].Unread, uint32(0); got != want {
+		t.Errorf("Unread count mismatch: got %v, want %v.", got, want)
+	}
+	if err := store.UpdateReadCursor(first.Conversation+1, "testuser2", second.ID); err == nil {
+		t.Errorf("Able to set read cursor to a message from another conversation!")
+	}
+	if err := store.UpdateReadCursor(first.Conversation, "testuser3", second.ID); err == nil {
+		t.Errorf("Able to set read cursor for a non-member!")
+	}
+}
+
+func testUnreadCount(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	var sent []storage.Message
+	for _, content := range []string{"Hello!", "Oops.", "Are you there?"} {
+		msg, _, err := store.AddMessage("testuser1", "testuser2", content, nil, "")
+		if err != nil {
+			t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+		}
+		sent = append(sent, msg)
+	}
+	if err := store.HideMessage(sent[0].ID, "testuser2"); err != nil {
+		t.Fatalf("Unable to hide message: %v.", err)
+	}
+	if err := store.DeleteMessage(sent[1].ID); err != nil {
+		t.Fatalf("Unable to delete message: %v.", err)
+	}
+	summaries, _, err := store.ReadConversationSummaries("testuser2", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to retrieve conversation summaries: %v.", err)
+	}
+	if got, want := len(summaries), 1; got != want {
+		t.Fatalf("Wrong number of conversations retrieved: got %v, want %v.", got, want)
+	}
+	// Neither the hidden message nor the deleted one is there to be read.
+	if got, want := summaries[0].Unread, uint32(1); got != want {
+		t.Errorf("Unread count mismatch: got %v, want %v.", got, want)
+	}
+}
+
+func testMessageSync(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if err := store.AddUser("testuser2", "testuser2", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	messages, syncToken, err := store.ReadMessagesAfter("testuser1", "testuser2", math.MaxUint32, 0)
+	if err != nil {
+		t.Fatalf("Unable to sync conversation that has not started: %v.", err)
+	}
+	if len(messages) != 0 || syncToken != 0 {
+		t.Errorf("Synced %v messages & got sync token %v from a conversation that has not started.", len(messages), syncToken)
+	}
+	for _, content := range []string{"Hello!", "Nice to meet you.", "Goodbye."} {
+		if _, _, err := store.AddMessage("testuser1", "testuser2", content, nil, ""); err != nil {
+			t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+		}
+	}
+	messages, syncToken, err = store.ReadMessagesAfter("testuser2", "testuser1", 2, 0)
+	if err != nil {
+		t.Fatalf("Unable to sync conversation: %v.", err)
+	}
+	if got, want := len(messages), 2; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Hello!"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := syncToken, messages[1].ID; got != want {
+		t.Errorf("Sync token mismatch: got %v, want %v.", got, want)
+	}
+	messages, syncToken, err = store.ReadMessagesAfter("testuser2", "testuser1", 2, syncToken)
+	if err != nil {
+		t.Fatalf("Unable to sync conversation: %v.", err)
+	}
+	if got, want := len(messages), 1; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Goodbye."; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if _, _, err := store.AddMessage("testuser2", "testuser1", "Wait!", nil, ""); err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	messages, _, err = store.ReadConversationAfter("testuser2", messages[0].Conversation, 2, syncToken)
+	if err != nil {
+		t.Fatalf("Unable to sync conversation: %v.", err)
+	}
+	if got, want := len(messages), 1; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Wait!"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+}
+
+func testEditMessage(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if err := store.AddUser("testuser2", "testuser2", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	msg, _, err := store.AddMessage("testuser1", "testuser2", "Helo!", nil, "")
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	for _, content := range []string{"Hello!", "Hello there!"} {
+		if _, err := store.EditMessage(msg.ID, content, nil); err != nil {
+			t.Fatalf("Unable to edit message: %v.", err)
+		}
+	}
+	messages, _, err := store.ReadMessagesBefore("testuser2", "testuser1", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to read messages: %v.", err)
+	}
+	if got, want := len(messages), 1; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Hello there!"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Revisions, uint32(2); got != want {
+		t.Errorf("Revision count mismatch: got %v, want %v.", got, want)
+	}
+	if messages[0].EditedAt.IsZero() {
+		t.Errorf("Edited message has no edit timestamp.")
+	}
+	revisions, err := store.ReadRevisions(msg.ID)
+	if err != nil {
+		t.Fatalf("Unable to read message revisions: %v.", err)
+	}
+	if got, want := len(revisions), 3; got != want {
+		t.Fatalf("Wrong number of revisions retrieved: got %v, want %v.", got, want)
+	}
+	for i, want := range []string{"Helo!", "Hello!", "Hello there!"} {
+		if got := revisions[i].Content; got != want {
+			t.Errorf("Revision %d content mismatch: got %v, want %v.", i+1, got, want)
+		}
+		if got, want := revisions[i].Number, uint32(i+1); got != want {
+			t.Errorf("Revision number mismatch: got %v, want %v.", got, want)
+		}
+	}
+	if _, err := store.EditMessage(msg.ID+1, "Nothing to see here.", nil); !errors.Is(err, storage.ErrMessageNotFound) {
+		t.Errorf("Editing a nonexistent message: got error %v, want %v.", err, storage.ErrMessageNotFound)
+	}
+	unedited, _, err := store.AddMessage("testuser2", "testuser1", "Hi!", nil, "")
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	if fetched, err := store.FetchMessage(unedited.ID); err != nil {
+		t.Errorf("Unable to fetch message: %v.", err)
+	} else if !fetched.EditedAt.IsZero() || fetched.Revisions != 0 {
+		t.Errorf("Unedited message reports an edit at %v with %v revisions.", fetched.EditedAt, fetched.Revisions)
+	}
+}
+
+func testDeleteMessage(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if err := store.AddUser("testuser2", "testuser2", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	var sent []storage.Message
+	for _, content := range []string{"One", "Two", "Three", "Four"} {
+		msg, _, err := store.AddMessage("testuser1", "testuser2", content, nil, "")
+		if err != nil {
+			t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+		}
+		sent = append(sent, msg)
+	}
+	if _, err := store.EditMessage(sent[1].ID, "Deux", nil); err != nil {
+		t.Fatalf("Unable to edit message: %v.", err)
+	}
+	if err := store.DeleteMessage(sent[1].ID); err != nil {
+		t.Fatalf("Unable to delete message for everyone: %v.", err)
+	}
+	if err := store.DeleteMessage(sent[3].ID + 1); !errors.Is(err, storage.ErrMessageNotFound) {
+		t.Errorf("Deleting a nonexistent message: got error %v, want %v.", err, storage.ErrMessageNotFound)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.HideMessage(sent[2].ID, "testuser2"); err != nil {
+			t.Fatalf("Unable to delete message for one user: %v.", err)
+		}
+	}
+	// The recipient pages through the conversation 2 messages at a time.
+	messages, cToken, err := store.ReadMessagesBefore("testuser2", "testuser1", 2, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to read messages: %v.", err)
+	}
+	if got, want := len(messages), 2; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "Four"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	if !messages[1].Deleted || messages[1].Content != "" || messages[1].Revisions != 0 {
+		t.Errorf("Message deleted for everyone was not replaced by a tombstone: %+v.", messages[1])
+	}
+	messages, _, err = store.ReadMessagesBefore("testuser2", "testuser1", 2, cToken)
+	if err != nil {
+		t.Fatalf("Unable to read messages: %v.", err)
+	}
+	if got, want := len(messages), 1; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	if got, want := messages[0].Content, "One"; got != want {
+		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	}
+	// The sender still sees the message that only the recipient deleted.
+	messages, _, err = store.ReadMessagesAfter("testuser1", "testuser2", math.MaxUint32, 0)
+	if err != nil {
+		t.Fatalf("Unable to sync messages: %v.", err)
+	}
+	if got, want := len(messages), 4; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+	revisions, err := store.ReadRevisions(sent[1].ID)
+	if err != nil {
+		t.Fatalf("Unable to read message revisions: %v.", err)
+	}
+	if got, want := len(revisions), 1; got != want {
+		t.Errorf("Wrong number of revisions retained for deleted message: got %v, want %v.", got, want)
+	}
+}
+
+func testIdempotentMessages(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2", "testuser3"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	first, created, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, "key1")
+	if err != nil || !created {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	retried, created, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, "key1")
+	if err != nil {
+		t.Fatalf("Unable to retry adding a message: %v.", err)
+	}
+	if created {
+		t.Errorf("Retrying a message with the same idempotency key stored a duplicate.")
+	}
+	if got, want := retried.ID, first.ID; got != want {
+		t.Errorf("Message ID mismatch: got %v, want %v.", got, want)
+	}
+	if !retried.Timestamp.Equal(first.Timestamp) {
+		t.Errorf("Message timestamp mismatch: got %v, want %v.", retried.Timestamp, first.Timestamp)
+	}
+	if _, _, err := store.AddMessage("testuser1", "testuser3", "Hello!", nil, "key1"); !errors.Is(err, storage.ErrIdempotencyKeyReused) {
+		t.Errorf("Reusing an idempotency key in another conversation: got error %v, want %v.", err, storage.ErrIdempotencyKeyReused)
+	}
+	if _, created, err := store.AddMessage("testuser2", "testuser1", "Hi!", nil, "key1"); err != nil || !created {
+		t.Errorf("Another sender was unable to use the same idempotency key: %v.", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, created, err := store.AddMessage("testuser1", "testuser2", "Still there?", nil, ""); err != nil || !created {
+			t.Errorf("Unable to add a message without an idempotency key: %v.", err)
+		}
+	}
+	messages, _, err := store.ReadMessagesBefore("testuser1", "testuser2", math.MaxUint32, math.MaxInt64)
+	if err != nil {
+		t.Fatalf("Unable to read messages: %v.", err)
+	}
+	if got, want := len(messages), 4; got != want {
+		t.Errorf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	}
+}
+
+func testContacts(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2", "testuser3", "testuser4"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	if _, _, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, ""); err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	if _, err := store.CreateConversation("Test group", []string{"testuser1", "testuser2", "testuser3"}); err != nil {
+		t.Fatalf("Unable to add a new row to the conversations table: %v.", err)
+	}
+	for user, want := range map[string][]string{
+		"testuser1": {"testuser2", "testuser3"},
+		"testuser3": {"testuser1", "testuser2"},
+		"testuser4": nil,
+	} {
+		got, err := store.ReadContacts(user)
+		if err != nil {
+			t.Fatalf("Unable to read contacts: %v.", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Contacts of %v mismatch: got %v, want %v.", user, got, want)
+		}
+	}
+}
+
+func testAttachments(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	if _, err := store.AddAttachment(storage.Attachment{Owner: "nobody", BlobKey: "blob"}); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("Adding an attachment for a nonexistent user: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+	want := storage.Attachment{
+		Owner:       "testuser1",
+		BlobKey:     "blob1",
+		Filename:    "beach.png",
+		ContentType: "image/png",
+		Size:        1234,
+		SHA256:      "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		Width:       640,
+		Height:      480,
+	}
+	added, err := store.AddAttachment(want)
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the attachments table: %v.", err)
+	}
+	if added.ID == 0 || added.CreatedAt.IsZero() {
+		t.Errorf("Added attachment is missing its ID or creation time: %+v.", added)
+	}
+	other, err := store.AddAttachment(storage.Attachment{Owner: "testuser2", BlobKey: "blob2", Filename: "notes.txt", ContentType: "text/plain"})
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the attachments table: %v.", err)
+	}
+	want.ID, want.CreatedAt = added.ID, added.CreatedAt
+	got, err := store.FetchAttachment(added.ID)
+	if err != nil {
+		t.Fatalf("Unable to fetch attachment: %v.", err)
+	}
+	if got != want {
+		t.Errorf("Attachment mismatch:\ngot  %+v\nwant %+v", got, want)
+	}
+	if _, err := store.FetchAttachment(other.ID + 1); !errors.Is(err, storage.ErrAttachmentNotFound) {
+		t.Errorf("Fetching a nonexistent attachment: got error %v, want %v.", err, storage.ErrAttachmentNotFound)
+	}
+	if _, _, err := store.AddMessage("testuser1", "testuser2", "Look!", nil, "key1", added.ID, other.ID); !errors.Is(err, storage.ErrAttachmentUnavailable) {
+		t.Errorf("Attaching another user's attachment: got error %v, want %v.", err, storage.ErrAttachmentUnavailable)
+	}
+	if got, err := store.FetchAttachment(added.ID); err != nil || got.Message != 0 {
+		t.Errorf("Failing to attach another user's attachment still attached one of the sender's: %+v, %v.", got, err)
+	}
+	if _, err := store.FetchMessageByIdempotencyKey("testuser1", "key1"); !errors.Is(err, storage.ErrMessageNotFound) {
+		t.Errorf("Failing to attach an attachment still stored the message: got error %v, want %v.", err, storage.ErrMessageNotFound)
+	}
+	msg, created, err := store.AddMessage("testuser1", "testuser2", "Look!", nil, "key1", added.ID)
+	if err != nil || !created {
+		t.Fatalf("Unable to add a message with an attachment: %v.", err)
+	}
+	if got, err := store.FetchAttachment(added.ID); err != nil || got.Message != msg.ID {
+		t.Errorf("Attachment was not attached to message %d: %+v, %v.", msg.ID, got, err)
+	}
+	if got, err := store.FetchMessageByIdempotencyKey("testuser1", "key1"); err != nil || got.ID != msg.ID {
+		t.Errorf("Message sent with idempotency key mismatch: got %+v (%v), want ID %d.", got, err, msg.ID)
+	}
+	if retried, created, err := store.AddMessage("testuser1", "testuser2", "Look!", nil, "key1", added.ID); err != nil || created || retried.ID != msg.ID {
+		t.Errorf("Retrying a message with an attachment: got %+v, %v (%v), want the original.", retried, created, err)
+	}
+	if _, _, err := store.AddMessage("testuser1", "testuser2", "Again!", nil, "key2", added.ID); !errors.Is(err, storage.ErrAttachmentUnavailable) {
+		t.Errorf("Attaching an attachment twice: got error %v, want %v.", err, storage.ErrAttachmentUnavailable)
+	}
+}
+
+func testReplaceHash(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if err := store.AddSession("token1", "testuser1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Unable to add a new row to the sessions table: %v.", err)
+	}
+	if err := store.ReplaceHash("testuser1", []byte("abcdefghijklmnopqrstuvwxyz")); err != nil {
+		t.Fatalf("Unable to replace hash: %v.", err)
+	}
+	if hash, err := store.FetchHash("testuser1"); err != nil || string(hash) != "abcdefghijklmnopqrstuvwxyz" {
+		t.Errorf("Hash was not replaced: got %q, %v.", hash, err)
+	}
+	if _, _, err := store.FetchSession("token1"); !errors.Is(err, storage.ErrSessionNotFound) {
+		t.Errorf("Retrieving session from before the hash was replaced: got error %v, want %v.", err, storage.ErrSessionNotFound)
+	}
+	if err := store.ReplaceHash("testuser2", []byte("abcdefghijklmnopqrstuvwxyz")); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("Replacing the hash of a nonexistent user: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+}
+
+func testUpdateHash(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	}
+	if err := store.AddSession("token1", "testuser1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Unable to add a new row to the sessions table: %v.", err)
+	}
+	if err := store.UpdateHash("testuser1", []byte("012345678901234567890123456789012345678901234567890123456789"), []byte("upgraded")); err != nil {
+		t.Fatalf("Unable to update hash: %v.", err)
+	}
+	if hash, err := store.FetchHash("testuser1"); err != nil || string(hash) != "upgraded" {
+		t.Errorf("Hash was not updated: got %q, %v.", hash, err)
+	}
+	if _, _, err := store.FetchSession("token1"); err != nil {
+		t.Errorf("Unable to retrieve session after updating hash: %v.", err)
+	}
+	if err := store.UpdateHash("testuser1", []byte("stale"), []byte("overwritten")); err != nil {
+		t.Fatalf("Unable to update hash: %v.", err)
+	}
+	if hash, err := store.FetchHash("testuser1"); err != nil || string(hash) != "upgraded" {
+		t.Errorf("Hash was updated even though it had changed: got %q, %v.", hash, err)
+	}
+}
+
+func testRenameUser(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2", "testuser3"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	if err := store.AddSession("token1", "testuser1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Unable to add a new row to the sessions table: %v.", err)
+	}
+	msg, _, err := store.AddMessage("testuser1", "testuser2", "Hello!", nil, "key1")
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	group, err := store.CreateConversation("Test group", []string{"testuser1", "testuser3"})
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the conversations table: %v.", err)
+	}
+	if err := store.RenameUser("testuser1", "testuser2", "testuser2"); !errors.Is(err, storage.ErrUserExists) {
+		t.Errorf("Renaming a user to a taken username: got error %v, want %v.", err, storage.ErrUserExists)
+	}
+	if err := store.RenameUser("testuser4", "testuser5", "testuser5"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("Renaming a nonexistent user: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+	if err := store.RenameUser("testuser1", "renamed", "renamed"); err != nil {
+		t.Fatalf("Unable to rename user: %v.", err)
+	}
+	if _, err := store.FetchHash("testuser1"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("Retrieving hash of old username: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+	if _, err := store.FetchHash("renamed"); err != nil {
+		t.Errorf("Unable to retrieve hash of new username: %v.", err)
+	}
+	if username, _, err := store.FetchSession("token1"); err != nil || username != "renamed" {
+		t.Errorf("Session did not follow rename: got %v, %v.", username, err)
+	}
+	if got, err := store.FetchMessage(msg.ID); err != nil || got.Author != "renamed" {
+		t.Errorf("Message author did not follow rename: got %+v, %v.", got, err)
+	}
+	messages, _, err := store.ReadMessagesBefore("renamed", "testuser2", math.MaxUint32, math.MaxInt64)
+	if err != nil || len(messages) != 1 {
+		t.Errorf("1:1 conversation did not follow rename: got %v, %v.", messages, err)
+	}
+	conversation, err := store.FetchConversation(group)
+	if err != nil {
+		t.Fatalf("Unable to retrieve conversation: %v.", err)
+	}
+	if fmt.Sprint(conversation.Members) != "[renamed testuser3]" {
+		t.Errorf("Conversation members did not follow rename: got %v.", conversation.Members)
+	}
+	cursors, err := store.ReadCursors(msg.Conversation)
+	if err != nil {
+		t.Fatalf("Unable to read cursors: %v.", err)
+	}
+	if fmt.Sprint(cursors) != fmt.Sprintf("[{renamed %d} {testuser2 0}]", msg.ID) {
+		t.Errorf("Read cursor did not follow rename: got %v.", cursors)
+	}
+	if _, created, err := store.AddMessage("renamed", "testuser2", "Hello!", nil, "key1"); err != nil || created {
+		t.Errorf("Idempotency key did not follow rename: got created %v, %v.", created, err)
+	}
+}
+
+func testDeleteUser(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"testuser1", "testuser2", "testuser3"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	if err := store.AddSession("token1", "testuser1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Unable to add a new row to the sessions table: %v.", err)
+	}
+	var attachments []storage.Attachment
+	for _, a := range []storage.Attachment{
+		{Owner: "testuser1", BlobKey: "unsent"},
+		{Owner: "testuser2", BlobKey: "direct"},
+		{Owner: "testuser3", BlobKey: "group"},
+	} {
+		added, err := store.AddAttachment(a)
+		if err != nil {
+			t.Fatalf("Unable to add a new row to the attachments table: %v.", err)
+		}
+		attachments = append(attachments, added)
+	}
+	direct, _, err := store.AddMessage("testuser2", "testuser1", "Hello!", nil, "", attachments[1].ID)
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	}
+	group, err := store.CreateConversation("Test group", []string{"testuser1", "testuser2", "testuser3"})
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the conversations table: %v.", err)
+	}
+	mine, _, err := store.AddConversationMessage(group, "testuser1", "Hi all!", nil, "")
+	if err != nil {
+		t.Fatalf("Unable to add a message to conversation: %v.", err)
+	}
+	theirs, _, err := store.AddConversationMessage(group, "testuser3", "Hi!", nil, "", attachments[2].ID)
+	if err != nil {
+		t.Fatalf("Unable to add a message to conversation: %v.", err)
+	}
+	solo, err := store.CreateConversation("Notes to self", []string{"testuser1"})
+	if err != nil {
+		t.Fatalf("Unable to add a new row to the conversations table: %v.", err)
+	}
+	keys, err := store.DeleteUser("testuser1")
+	if err != nil {
+		t.Fatalf("Unable to delete user: %v.", err)
+	}
+	if fmt.Sprint(keys) != "[unsent direct]" {
+		t.Errorf("Blob keys of deleted attachments mismatch: got %v, want [unsent direct].", keys)
+	}
+	if _, err := store.FetchHash("testuser1"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("Retrieving hash of deleted user: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+	if _, _, err := store.FetchSession("token1"); !errors.Is(err, storage.ErrSessionNotFound) {
+		t.Errorf("Retrieving session of deleted user: got error %v, want %v.", err, storage.ErrSessionNotFound)
+	}
+	for _, id := range []int64{direct.Conversation, solo} {
+		if _, err := store.FetchConversation(id); !errors.Is(err, storage.ErrConversationNotFound) {
+			t.Errorf("Retrieving conversation %d of deleted user: got error %v, want %v.", id, err, storage.ErrConversationNotFound)
+		}
+	}
+	for _, id := range []int64{direct.ID, mine.ID} {
+		if _, err := store.FetchMessage(id); !errors.Is(err, storage.ErrMessageNotFound) {
+			t.Errorf("Retrieving message %d of deleted user: got error %v, want %v.", id, err, storage.ErrMessageNotFound)
+		}
+	}
+	conversation, err := store.FetchConversation(group)
+	if err != nil {
+		t.Fatalf("Unable to retrieve conversation: %v.", err)
+	}
+	if fmt.Sprint(conversation.Members) != "[testuser2 testuser3]" {
+		t.Errorf("Deleted user is still a member of conversation: got %v.", conversation.Members)
+	}
+	if _, err := store.FetchMessage(theirs.ID); err != nil {
+		t.Errorf("Unable to retrieve message another member sent: %v.", err)
+	}
+	if _, err := store.FetchAttachment(attachments[2].ID); err != nil {
+		t.Errorf("Unable to retrieve attachment another member sent: %v.", err)
+	}
+	if _, err := store.DeleteUser("testuser1"); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("Deleting a nonexistent user: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Errorf("Unable to reuse the username of a deleted user: %v.", err)
+	}
+}
+
+func testLoginFailures(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	start := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	for i := 1; i <= 3; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		failures, err := store.RecordLoginFailure("username", "testuser1", at, start)
+		if err != nil {
+			t.Fatalf("Unable to record failed login: %v.", err)
+		}
+		if failures.Count != uint32(i) || !failures.Last.Equal(at) {
+			t.Errorf("Failed logins mismatch: got %+v, want %d ending at %v.", failures, i, at)
+		}
+	}
+	if _, err := store.RecordLoginFailure("ip", "192.0.2.1", start, start); err != nil {
+		t.Fatalf("Unable to record failed login: %v.", err)
+	}
+	failures, err := store.FetchLoginFailures("username", "testuser1", start)
+	if err != nil {
+		t.Fatalf("Unable to fetch failed logins: %v.", err)
+	}
+	if got, want := failures.Count, uint32(3); got != want {
+		t.Errorf("Failed login count mismatch: got %v, want %v.", got, want)
+	}
+	if failures, err := store.FetchLoginFailures("username", "testuser2", start); err != nil || failures.Count != 0 {
+		t.Errorf("Failed logins of a subject without any: got %+v, %v.", failures, err)
+	}
+	if failures, err := store.FetchLoginFailures("username", "testuser1", start.Add(time.Hour)); err != nil || failures.Count != 0 {
+		t.Errorf("Failed logins before the specified time were not disregarded: got %+v, %v.", failures, err)
+	}
+	// Once the earlier failures are too old, the count starts afresh & they are purged.
+	later := start.Add(30 * time.Minute)
+	if failures, err := store.RecordLoginFailure("username", "testuser1", later, start.Add(10*time.Minute)); err != nil || failures.Count != 1 {
+		t.Errorf("Count of failed logins was not restarted: got %+v, %v.", failures, err)
+	}
+	if failures, err := store.FetchLoginFailures("ip", "192.0.2.1", start); err != nil || failures.Count != 0 {
+		t.Errorf("Old failed logins were not purged: got %+v, %v.", failures, err)
+	}
+	if _, err := store.RecordLoginFailure("username", "testuser1", later, start.Add(10*time.Minute)); err != nil {
+		t.Fatalf("Unable to record failed login: %v.", err)
+	}
+	if err := store.ForgetLoginFailure("username", "testuser1"); err != nil {
+		t.Fatalf("Unable to forget failed login: %v.", err)
+	}
+	if failures, err := store.FetchLoginFailures("username", "testuser1", start); err != nil || failures.Count != 1 || !failures.Last.Equal(later) {
+		t.Errorf("Failed logins after forgetting one: got %+v, %v, want 1 ending at %v.", failures, err, later)
+	}
+	if err := store.ClearLoginFailures("username", "testuser1"); err != nil {
+		t.Fatalf("Unable to clear failed logins: %v.", err)
+	}
+	if failures, err := store.FetchLoginFailures("username", "testuser1", start); err != nil || failures.Count != 0 {
+		t.Errorf("Failed logins were not cleared: got %+v, %v.", failures, err)
+	}
+}
+
+func testTOTP(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	if err := store.AddUser("testuser1", "testuser1", []byte("hash")); err != nil {
+		t.Fatalf("Unable to add user: %v.", err)
+	}
+	if _, err := store.FetchTOTP("testuser1"); !errors.Is(err, storage.ErrTOTPNotFound) {
+		t.Errorf("TOTP secret of user who never enrolled: got error %v, want %v.", err, storage.ErrTOTPNotFound)
+	}
+	if err := store.SetTOTP("testuser2", "SECRET", nil); !errors.Is(err, storage.ErrUserNotFound) {
+		t.Errorf("TOTP secret for unknown user: got error %v, want %v.", err, storage.ErrUserNotFound)
+	}
+	if err := store.SetTOTP("testuser1", "FIRST", []string{"a", "b"}); err != nil {
+		t.Fatalf("Unable to set TOTP secret: %v.", err)
+	}
+	if err := store.SetTOTP("testuser1", "SECOND", []string{"c", "d"}); err != nil {
+		t.Fatalf("Unable to replace TOTP secret: %v.", err)
+	}
+	if err := store.ConfirmTOTP("testuser1"); err != nil {
+		t.Fatalf("Unable to confirm TOTP secret: %v.", err)
+	}
+	enrollment, err := store.FetchTOTP("testuser1")
+	if err != nil {
+		t.Fatalf("Unable to fetch TOTP secret: %v.", err)
+	}
+	if want := (storage.TOTPEnrollment{Secret: "SECOND", Confirmed: true}); enrollment != want {
+		t.Errorf("TOTP secret mismatch: got %+v, want %+v.", enrollment, want)
+	}
+	for _, tc := range []struct {
+		step int64
+		want bool
+	}{{100, true}, {100, false}, {99, false}, {101, true}} {
+		if used, err := store.UseTOTPStep("testuser1", tc.step); err != nil || used != tc.want {
+			t.Errorf("Use of TOTP step %d: got %v, %v, want %v.", tc.step, used, err, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		hash string
+		want bool
+	}{{"a", false}, {"c", true}, {"c", false}, {"d", true}} {
+		if used, err := store.UseRecoveryCode("testuser1", tc.hash); err != nil || used != tc.want {
+			t.Errorf("Use of recovery code %q: got %v, %v, want %v.", tc.hash, used, err, tc.want)
+		}
+	}
+	if err := store.RenameUser("testuser1", "renamed", "renamed"); err != nil {
+		t.Fatalf("Unable to rename user: %v.", err)
+	}
+	if enrollment, err := store.FetchTOTP("renamed"); err != nil || enrollment.LastStep != 101 {
+		t.Errorf("TOTP secret did not follow renamed user: got %+v, %v.", enrollment, err)
+	}
+	if err := store.DeleteTOTP("renamed"); err != nil {
+		t.Fatalf("Unable to delete TOTP secret: %v.", err)
+	}
+	if _, err := store.FetchTOTP("renamed"); !errors.Is(err, storage.ErrTOTPNotFound) {
+		t.Errorf("TOTP secret after deletion: got error %v, want %v.", err, storage.ErrTOTPNotFound)
+	}
+	if err := store.ConfirmTOTP("renamed"); !errors.Is(err, storage.ErrTOTPNotFound) {
+		t.Errorf("Confirmation of deleted TOTP secret: got error %v, want %v.", err, storage.ErrTOTPNotFound)
+	}
+	if err := store.SetTOTP("renamed", "THIRD", []string{"e"}); err != nil {
+		t.Fatalf("Unable to set TOTP secret: %v.", err)
+	}
+	if _, err := store.DeleteUser("renamed"); err != nil {
+		t.Fatalf("Unable to delete user: %v.", err)
+	}
+	if _, err := store.FetchTOTP("renamed"); !errors.Is(err, storage.ErrTOTPNotFound) {
+		t.Errorf("TOTP secret of deleted user: got error %v, want %v.", err, storage.ErrTOTPNotFound)
+	}
+}
+
+func testCanonicalUsernames(t *testing.T, newStore storeFactory) {
+	store, closer := newStore(t)
+	defer closer()
+	for _, username := range []string{"TestUser1", "testuser2"} {
+		if err := store.AddUser(username, strings.ToLower(username), []byte("hash")); err != nil {
+			t.Fatalf("Unable to add user %v: %v.", username, err)
+		}
+	}
+	if err := store.AddUser("TESTUSER1", "testuser1", []byte("hash")); !errors.Is(err, storage.ErrUserExists) {
+		t.Errorf("Username with the same canonical form: got error %v, want %v.", err, storage.ErrUserExists)
+	}
+	if err := store.RenameUser("testuser2", "TestUser2", "testuser2"); err != nil {
+		t.Errorf("Unable to change the case of a username: %v.", err)
+	}
+	if err := store.RenameUser("TestUser2", "testUSER1", "testuser1"); !errors.Is(err, storage.ErrUserExists) {
+		t.Errorf("Rename to a username with the same canonical form as another: got error %v, want %v.", err, storage.ErrUserExists)
+	}
+	if _, err := store.FetchHash("TestUser2"); err != nil {
+		t.Errorf("Unable to look up renamed user: %v.", err)
+	}
+	if err := store.AddUser("testuser2", "testuser2", []byte("hash")); !errors.Is(err, storage.ErrUserExists) {
+		t.Errorf("Canonical form was not renamed along with the username: got error %v, want %v.", err, storage.ErrUserExists)
+	}
+}
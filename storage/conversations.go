@@ -0,0 +1,322 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// queryer is satisfied by SQLDB & its transactions, as well as by *sql.Tx.
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// execer is satisfied by SQLDB & its transactions, as well as by *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// createConversation must be called within a transaction.
+func createConversation(tx interface {
+	queryer
+	execer
+}, title string, group bool, members []string) (int64, error) {
+	var id int64
+	if err := tx.QueryRow("INSERT INTO conversations (title, is_group) VALUES (?, ?) RETURNING id", title, group).Scan(&id); err != nil {
+		return 0, fmt.Errorf("unable to add conversation: %v", err)
+	}
+	return id, addMembers(tx, id, members)
+}
+
+// addMembers adds each of the specified users to a conversation that was just created.
+func addMembers(tx interface {
+	queryer
+	execer
+}, id int64, members []string) error {
+	for _, member := range members {
+		if exists, err := userExists(tx, member); err != nil || !exists {
+			if err == nil {
+				err = fmt.Errorf("%w: %v", ErrUserNotFound, member)
+			}
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO conversation_members (conversation, username) VALUES (?, ?) ON CONFLICT DO NOTHING",
+			id, member); err != nil {
+			return fmt.Errorf("unable to add %v to conversation: %v", member, err)
+		}
+	}
+	return nil
+}
+
+// directKey identifies the 1:1 conversation between the specified users, whichever way round they are.
+func directKey(user1, user2 string) string {
+	if user2 < user1 {
+		user1, user2 = user2, user1
+	}
+	return strconv.Quote(user1) + strconv.Quote(user2)
+}
+
+// keyDirectConversations sets the key of each 1:1 conversation selected by filter, which is applied to conversations c,
+// from its current members. Where conversations would share a key, only the oldest gets it.
+func keyDirectConversations(tx migrationTx, filter string, args ...interface{}) error {
+	rows, err := tx.Query(`SELECT c.id, MIN(m.username), MAX(m.username) FROM conversations c
+	JOIN conversation_members m ON m.conversation = c.id
+	WHERE NOT c.is_group AND `+filter+` GROUP BY c.id ORDER BY c.id`, args...)
+	if err != nil {
+		return fmt.Errorf("unable to list 1:1 conversations: %v", err)
+	}
+	keys := make(map[string]int64)
+	for rows.Next() {
+		var id int64
+		var user1, user2 string
+		if err := rows.Scan(&id, &user1, &user2); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to parse members of 1:1 conversation: %v", err)
+		}
+		if key := directKey(user1, user2); keys[key] == 0 {
+			keys[key] = id
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unable to list 1:1 conversations: %v", err)
+	}
+	for key, id := range keys {
+		if _, err := tx.Exec("UPDATE conversations SET direct_key = ? WHERE id = ?", key, id); err != nil {
+			return fmt.Errorf("unable to set key of 1:1 conversation: %v", err)
+		}
+	}
+	return nil
+}
+
+// findDirectConversation returns the ID of the 1:1 conversation between the specified users, or 0 if there is none.
+func findDirectConversation(q queryer, user1, user2 string) (int64, error) {
+	var id int64
+	err := q.QueryRow("SELECT id FROM conversations WHERE direct_key = ?", directKey(user1, user2)).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("unable to look up conversation between specified users: %v", err)
+	default:
+		return id, nil
+	}
+}
+
+// FindDirectConversation returns the ID of the 1:1 conversation between the specified users, or 0 if they have yet to
+// start one.
+func (s *SQLDB) FindDirectConversation(user1, user2 string) (int64, error) {
+	return findDirectConversation(s, user1, user2)
+}
+
+// DirectConversation returns the ID of the 1:1 conversation between the specified users, starting one if necessary.
+func (s *SQLDB) DirectConversation(user1, user2 string) (int64, error) {
+	if id, err := findDirectConversation(s, user1, user2); err != nil || id != 0 {
+		return id, err
+	}
+	tx, err := s.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	var id int64
+	err = tx.QueryRow("INSERT INTO conversations (is_group, direct_key) VALUES (?, ?) ON CONFLICT (direct_key) DO NOTHING RETURNING id",
+		false, directKey(user1, user2)).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Another caller started the conversation in the meantime.
+		tx.Rollback()
+		return findDirectConversation(s, user1, user2)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("unable to add conversation: %v", err)
+	}
+	if err := addMembers(tx, id, []string{user1, user2}); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// CreateConversation starts a new group conversation, which is owned by the first of its members, & returns its ID.
+func (s *SQLDB) CreateConversation(title string, members []string) (int64, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	id, err := createConversation(tx, title, true, members)
+	if err != nil {
+		return 0, err
+	}
+	if len(members) > 0 {
+		if _, err := tx.Exec("UPDATE conversation_members SET is_owner = ? WHERE conversation = ? AND username = ?",
+			true, id, members[0]); err != nil {
+			return 0, fmt.Errorf("unable to record owner of conversation: %v", err)
+		}
+	}
+	return id, tx.Commit()
+}
+
+func (s *SQLDB) FetchConversation(id int64) (Conversation, error) {
+	conversation := Conversation{ID: id}
+	err := s.QueryRow("SELECT title, is_group FROM conversations WHERE id = ?", id).Scan(&conversation.Title, &conversation.Group)
+	switch {
+	case err == sql.ErrNoRows:
+		return Conversation{}, ErrConversationNotFound
+	case err != nil:
+		return Conversation{}, fmt.Errorf("unexpected DB access failure: %v", err)
+	}
+	rows, err := s.Query("SELECT username, is_owner FROM conversation_members WHERE conversation = ? ORDER BY username", id)
+	if err != nil {
+		return Conversation{}, fmt.Errorf("unable to execute query for conversation members: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member string
+		var owner bool
+		if err := rows.Scan(&member, &owner); err != nil {
+			return Conversation{}, fmt.Errorf("unable to parse conversation member from DB: %v", err)
+		}
+		conversation.Members = append(conversation.Members, member)
+		if owner {
+			conversation.Owner = member
+		}
+	}
+	return conversation, rows.Err()
+}
+
+func (s *SQLDB) AddMember(conversation int64, username string) error {
+	if exists, err := userExists(s, username); err != nil || !exists {
+		if err == nil {
+			err = fmt.Errorf("%w: %v", ErrUserNotFound, username)
+		}
+		return err
+	}
+	res, err := s.Exec("INSERT INTO conversation_members (conversation, username) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		conversation, username)
+	if err != nil {
+		return fmt.Errorf("unable to add member to conversation: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("unable to add member to conversation: %v", err)
+	} else if n == 0 {
+		return ErrAlreadyMember
+	}
+	return nil
+}
+
+func (s *SQLDB) RemoveMember(conversation int64, username string) error {
+	res, err := s.Exec("DELETE FROM conversation_members WHERE conversation = ? AND username = ?", conversation, username)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("unable to remove member from conversation: %v", err)
+	} else if n == 0 {
+		return ErrMemberNotFound
+	}
+	return nil
+}
+
+// ReadConversationSummaries returns up to limit of the conversations that user is a member of, most recently active
+// first, starting with those whose last message precedes the one with the specified ID. It also returns the ID of the
+// last message in the last conversation returned, for use as a continuation token. Conversations without any messages
+// (other than those user has deleted for themselves) are omitted.
+func (s *SQLDB) ReadConversationSummaries(user string, limit uint32, before int64) ([]ConversationSummary, int64, error) {
+	rows, err := s.Query(`SELECT c.id, c.title, c.is_group,
+		COALESCE((SELECT p.username FROM conversation_members p WHERE p.conversation = c.id AND p.username != ? LIMIT 1), ?),
+		(SELECT COUNT(*) FROM messages u WHERE u.conversation = c.id AND u.sender != ?
+			AND u.id > COALESCE((SELECT r.message FROM read_cursors r WHERE r.conversation = c.id AND r.username = ?), 0)
+			AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message = u.id AND h.username = ?)
+			AND NOT EXISTS (SELECT 1 FROM message_tombstones t WHERE t.message = u.id)),
+		`+messageColumns+` FROM conversation_members cm
+	JOIN conversations c ON c.id = cm.conversation
+	JOIN messages m ON m.id = (SELECT MAX(l.id) FROM messages l WHERE l.conversation = c.id
+		AND NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message = l.id AND h.username = ?))
+	WHERE cm.username = ? AND m.id < ?
+	ORDER BY m.id DESC LIMIT ?`,
+		user, user, user, user, user, user, user, before, limit)
+	if err != nil {
+		return nil, math.MaxInt64, fmt.Errorf("unable to execute query for conversations of specified user: %v", err)
+	}
+	defer rows.Close()
+	var summaries []ConversationSummary
+	var last int64
+	for rows.Next() {
+		summary := ConversationSummary{}
+		if err := scanMessage(rows, &summary.LastMessage,
+			&summary.ID, &summary.Title, &summary.Group, &summary.Peer, &summary.Unread); err != nil {
+			return nil, math.MaxInt64, err
+		}
+		if summary.Group {
+			summary.Peer = ""
+		}
+		summaries = append(summaries, summary)
+		last = summary.LastMessage.ID
+	}
+	return summaries, last, rows.Err()
+}
+
+// updateReadCursor advances a member's read cursor to the specified message, which must belong to the conversation.
+// Cursors never move backwards.
+func updateReadCursor(e execer, conversation int64, username string, message int64) error {
+	res, err := e.Exec(`INSERT INTO read_cursors (conversation, username, message)
+	SELECT conversation, CAST(? AS TEXT), id FROM messages WHERE id = ? AND conversation = ?
+	ON CONFLICT (conversation, username) DO UPDATE SET message = CASE
+		WHEN excluded.message > read_cursors.message THEN excluded.message ELSE read_cursors.message END`,
+		username, message, conversation)
+	if err != nil {
+		return fmt.Errorf("unable to update read cursor: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("unable to update read cursor: %v", err)
+	} else if n == 0 {
+		return fmt.Errorf("%w in conversation", ErrMessageNotFound)
+	}
+	return nil
+}
+
+func (s *SQLDB) UpdateReadCursor(conversation int64, username string, message int64) error {
+	return updateReadCursor(s, conversation, username, message)
+}
+
+// ReadCursors returns the read cursor of every member of a conversation, using 0 for those who have read nothing.
+func (s *SQLDB) ReadCursors(conversation int64) ([]ReadCursor, error) {
+	rows, err := s.Query(`SELECT cm.username, COALESCE(rc.message, 0) FROM conversation_members cm
+	LEFT JOIN read_cursors rc ON rc.conversation = cm.conversation AND rc.username = cm.username
+	WHERE cm.conversation = ? ORDER BY cm.username`, conversation)
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute query for read cursors: %v", err)
+	}
+	defer rows.Close()
+	var cursors []ReadCursor
+	for rows.Next() {
+		cursor := ReadCursor{}
+		if err := rows.Scan(&cursor.Username, &cursor.Message); err != nil {
+			return nil, fmt.Errorf("unable to parse read cursor from DB: %v", err)
+		}
+		cursors = append(cursors, cursor)
+	}
+	return cursors, rows.Err()
+}
+
+// ReadContacts returns everyone other than user who is a member of any of user's conversations, in order of username.
+func (s *SQLDB) ReadContacts(user string) ([]string, error) {
+	rows, err := s.Query(`SELECT DISTINCT other.username FROM conversation_members me
+	JOIN conversation_members other ON other.conversation = me.conversation
+	WHERE me.username = ? AND other.username != ? ORDER BY other.username`, user, user)
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute query for contacts: %v", err)
+	}
+	defer rows.Close()
+	var contacts []string
+	for rows.Next() {
+		var contact string
+		if err := rows.Scan(&contact); err != nil {
+			return nil, fmt.Errorf("unable to parse contact from DB: %v", err)
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
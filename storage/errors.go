@@ -0,0 +1,62 @@
+package storage
+
+// Kind classifies a domain error by the sort of failure it represents, so that callers can handle whole classes of
+// errors alike without knowing about each one.
+type Kind int
+
+const (
+	// KindInvalid means the request was malformed or violated a policy, so retrying it unchanged won't help.
+	KindInvalid Kind = iota + 1
+	KindNotFound
+	KindExists
+	KindUnauthenticated
+	KindPermissionDenied
+	// KindFailedPrecondition means the request is incompatible with the current state of whatever it refers to.
+	KindFailedPrecondition
+	// KindUnsupported means this deployment lacks the feature that was requested.
+	KindUnsupported
+	// KindExhausted means a limit on how often something may be done was reached, so it may succeed if retried later.
+	KindExhausted
+)
+
+// Error is a domain error that clients can branch on. Reason is a stable identifier in UPPER_SNAKE_CASE, whereas the
+// message is meant for humans & may change. The errors below & those in the logic package are sentinels to be compared
+// with errors.Is, & may be wrapped to add detail.
+type Error struct {
+	Kind   Kind
+	Reason string
+	msg    string
+}
+
+func NewError(kind Kind, reason, msg string) *Error {
+	return &Error{Kind: kind, Reason: reason, msg: msg}
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+// FieldViolation describes how one field of a request breaks a rule, for errors that report each field at fault.
+type FieldViolation struct {
+	Field, Description string
+}
+
+var (
+	ErrUserExists           = NewError(KindExists, "USER_EXISTS", "desired username already taken")
+	ErrUserNotFound         = NewError(KindNotFound, "USER_NOT_FOUND", "no such username found")
+	ErrRecipientUnknown     = NewError(KindNotFound, "RECIPIENT_UNKNOWN", "recipient is not a registered user")
+	ErrSessionNotFound      = NewError(KindUnauthenticated, "SESSION_NOT_FOUND", "no such session found")
+	ErrConversationNotFound = NewError(KindNotFound, "CONVERSATION_NOT_FOUND", "no such conversation found")
+	ErrMemberNotFound       = NewError(KindNotFound, "MEMBER_NOT_FOUND", "no such conversation member found")
+	ErrAlreadyMember        = NewError(KindExists, "ALREADY_MEMBER", "user is already a member of the conversation")
+	ErrMessageNotFound      = NewError(KindNotFound, "MESSAGE_NOT_FOUND", "no such message found")
+	ErrIdempotencyKeyReused = NewError(KindFailedPrecondition, "IDEMPOTENCY_KEY_REUSED",
+		"idempotency key was already used for a message in another conversation")
+	ErrAttachmentNotFound    = NewError(KindNotFound, "ATTACHMENT_NOT_FOUND", "no such attachment found")
+	ErrAttachmentUnavailable = NewError(KindFailedPrecondition, "ATTACHMENT_UNAVAILABLE",
+		"attachment belongs to another user or was already sent in a message")
+	ErrBlobNotFound = NewError(KindNotFound, "BLOB_NOT_FOUND", "no such blob found")
+	ErrTOTPNotFound = NewError(KindNotFound, "TOTP_NOT_FOUND", "user has not enrolled a TOTP secret")
+	// ErrSearchUnavailable is returned by SearchMessages when the DB has no full-text index of messages.
+	ErrSearchUnavailable = NewError(KindUnsupported, "SEARCH_UNAVAILABLE", "full-text search of messages is unavailable")
+)
@@ -0,0 +1,20 @@
+package storage
+
+type EventKind int
+
+const (
+	// EventTyping means that the user is composing a message in the conversation.
+	EventTyping EventKind = iota
+	// EventOnline & EventOffline mean that the user has opened their first event subscription or closed their last one.
+	EventOnline
+	EventOffline
+)
+
+// Event is an ephemeral notification of what another user is doing. Unlike a Message, it is delivered to subscribers
+// but never stored.
+type Event struct {
+	Kind     EventKind
+	Username string
+	// Conversation is only set for EventTyping.
+	Conversation int64
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// LoginFailures counts the failed logins in a row for one subject, such as a username or a client's IP address.
+type LoginFailures struct {
+	Count uint32
+	Last  time.Time
+}
+
+// FetchLoginFailures returns the failed logins recorded for a subject within the specified scope, disregarding any
+// whose last failure came before since.
+func (s *SQLDB) FetchLoginFailures(scope, subject string, since time.Time) (LoginFailures, error) {
+	var failures LoginFailures
+	var last int64
+	err := s.QueryRow("SELECT failures, last_failure FROM login_failures WHERE scope = ? AND subject = ? AND last_failure >= ?",
+		scope, subject, since.UnixMilli()).Scan(&failures.Count, &last)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return LoginFailures{}, nil
+	case err != nil:
+		return LoginFailures{}, fmt.Errorf("unable to look up failed logins: %v", err)
+	}
+	failures.Last = time.UnixMilli(last)
+	return failures, nil
+}
+
+// RecordLoginFailure counts another failed login at the specified time, starting the count afresh if the previous
+// failure came before since, & returns the updated count. Records of failures before since are purged.
+func (s *SQLDB) RecordLoginFailure(scope, subject string, at, since time.Time) (LoginFailures, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return LoginFailures{}, fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	failures := LoginFailures{Last: time.UnixMilli(at.UnixMilli())}
+	if err := tx.QueryRow(`INSERT INTO login_failures (scope, subject, failures, last_failure) VALUES (?, ?, 1, ?)
+	ON CONFLICT (scope, subject) DO UPDATE SET
+		failures = CASE WHEN login_failures.last_failure < ? THEN 1 ELSE login_failures.failures + 1 END,
+		last_failure = excluded.last_failure
+	RETURNING failures`, scope, subject, at.UnixMilli(), since.UnixMilli()).Scan(&failures.Count); err != nil {
+		return LoginFailures{}, fmt.Errorf("unable to record failed login: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM login_failures WHERE last_failure < ?", since.UnixMilli()); err != nil {
+		return LoginFailures{}, fmt.Errorf("unable to purge old failed logins: %v", err)
+	}
+	return failures, tx.Commit()
+}
+
+// ForgetLoginFailure takes back one failed login recorded for a subject within the specified scope, leaving the time
+// of the last failure as it was.
+func (s *SQLDB) ForgetLoginFailure(scope, subject string) error {
+	if _, err := s.Exec("UPDATE login_failures SET failures = failures - 1 WHERE scope = ? AND subject = ? AND failures > 0",
+		scope, subject); err != nil {
+		return fmt.Errorf("unable to forget failed login: %v", err)
+	}
+	return nil
+}
+
+// ClearLoginFailures forgets the failed logins recorded for a subject within the specified scope.
+func (s *SQLDB) ClearLoginFailures(scope, subject string) error {
+	if _, err := s.Exec("DELETE FROM login_failures WHERE scope = ? AND subject = ?", scope, subject); err != nil {
+		return fmt.Errorf("unable to clear failed logins: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,433 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const schemaMigrationsInitCmd = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY NOT NULL,
+	description TEXT NOT NULL,
+	applied_at BIGINT NOT NULL)`
+
+// migrationLockKey identifies the Postgres advisory lock that serializes migration runs.
+const migrationLockKey = 0x63686174
+
+// migrationTx is the connection on which migrations run, which holds the migration lock & has a transaction open.
+type migrationTx interface {
+	queryer
+	execer
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// migration is one versioned change to the schema. Applying down must undo the effect of applying up.
+type migration struct {
+	version     int
+	description string
+	up, down    func(tx migrationTx) error
+}
+
+// statements returns a migration step that executes each of cmds in order.
+func statements(cmds ...string) func(tx migrationTx) error {
+	return func(tx migrationTx) error {
+		for _, cmd := range cmds {
+			if _, err := tx.Exec(cmd); err != nil {
+				return fmt.Errorf("unable to execute migration statement: %v", err)
+			}
+		}
+		return nil
+	}
+}
+
+// dropBaseline removes every table created by the baseline migration, dependents first.
+var dropBaseline = statements(
+	"DROP TABLE IF EXISTS messages_fts",
+	"DROP TABLE IF EXISTS message_tombstones",
+	"DROP TABLE IF EXISTS hidden_messages",
+	"DROP TABLE IF EXISTS message_revisions",
+	"DROP TABLE IF EXISTS read_cursors",
+	"DROP TABLE IF EXISTS sessions",
+	"DROP TABLE IF EXISTS messages",
+	"DROP TABLE IF EXISTS conversation_members",
+	"DROP TABLE IF EXISTS conversations",
+	"DROP TABLE IF EXISTS users",
+)
+
+const attachmentIndexInitCmd = "CREATE INDEX IF NOT EXISTS attachments_by_message ON attachments (message)"
+
+var dropAttachments = statements("DROP TABLE IF EXISTS attachments")
+
+const loginFailureIndexInitCmd = "CREATE INDEX IF NOT EXISTS login_failures_by_time ON login_failures (last_failure)"
+
+var dropLoginFailures = statements("DROP TABLE IF EXISTS login_failures")
+
+var dropTOTP = statements("DROP TABLE IF EXISTS recovery_codes", "DROP TABLE IF EXISTS totp_secrets")
+
+// addCanonicalUsernames backfills the canonical form of existing usernames, which is computed here rather than in SQL
+// so that it matches that of new usernames exactly. Where existing usernames share a canonical form, the first in
+// order keeps it & the others are left without one, so that no account is lost.
+func addCanonicalUsernames(tx migrationTx) error {
+	if _, err := tx.Exec("ALTER TABLE users ADD COLUMN canonical_username TEXT"); err != nil {
+		return fmt.Errorf("unable to add canonical usernames: %v", err)
+	}
+	rows, err := tx.Query("SELECT username FROM users ORDER BY username")
+	if err != nil {
+		return fmt.Errorf("unable to list usernames: %v", err)
+	}
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to list usernames: %v", err)
+		}
+		usernames = append(usernames, username)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unable to list usernames: %v", err)
+	}
+	taken := make(map[string]bool)
+	for _, username := range usernames {
+		canonical := CanonicalUsername(username)
+		if taken[canonical] {
+			continue
+		}
+		taken[canonical] = true
+		if _, err := tx.Exec("UPDATE users SET canonical_username = ? WHERE username = ?", canonical, username); err != nil {
+			return fmt.Errorf("unable to backfill canonical username: %v", err)
+		}
+	}
+	if _, err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS users_by_canonical_username ON users (canonical_username)"); err != nil {
+		return fmt.Errorf("unable to index canonical usernames: %v", err)
+	}
+	return nil
+}
+
+var dropCanonicalUsernames = statements(
+	"DROP INDEX IF EXISTS users_by_canonical_username",
+	"ALTER TABLE users DROP COLUMN canonical_username",
+)
+
+// addDirectKeys identifies each existing 1:1 conversation by its members, so that a unique index can stop concurrent
+// callers from starting the same one twice. Where there are already duplicates, the oldest is the one that is kept in
+// use, as before.
+func addDirectKeys(tx migrationTx) error {
+	if _, err := tx.Exec("ALTER TABLE conversations ADD COLUMN direct_key TEXT"); err != nil {
+		return fmt.Errorf("unable to add keys of 1:1 conversations: %v", err)
+	}
+	if err := keyDirectConversations(tx, "1 = 1"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS conversations_by_direct_key ON conversations (direct_key)"); err != nil {
+		return fmt.Errorf("unable to index keys of 1:1 conversations: %v", err)
+	}
+	return nil
+}
+
+var dropDirectKeys = statements(
+	"DROP INDEX IF EXISTS conversations_by_direct_key",
+	"ALTER TABLE conversations DROP COLUMN direct_key",
+)
+
+var dropConversationOwners = statements("ALTER TABLE conversation_members DROP COLUMN is_owner")
+
+// The migrations for each DB must be listed in order of version & leave both with equivalent schemas, apart from the
+// full-text index of messages, which only SQLite has.
+var (
+	sqliteMigrations = []migration{
+		{1, "create the baseline schema, upgrading any DB that predates migrations", sqliteBaseline, dropBaseline},
+		{2, "add attachments", statements(AttachmentTableInitCmd, attachmentIndexInitCmd), dropAttachments},
+		{3, "track failed logins", statements(LoginFailureTableInitCmd, loginFailureIndexInitCmd), dropLoginFailures},
+		{4, "add two-factor authentication", statements(TOTPTableInitCmd, RecoveryCodeTableInitCmd), dropTOTP},
+		{5, "make usernames unique regardless of case", addCanonicalUsernames, dropCanonicalUsernames},
+		{searchIndexVersion, "index message content for full-text search", addSearchIndex, dropSearchIndex},
+		{7, "allow only one 1:1 conversation per pair of users", addDirectKeys, dropDirectKeys},
+		{8, "record the owners of group conversations",
+			statements("ALTER TABLE conversation_members ADD COLUMN is_owner BOOLEAN NOT NULL DEFAULT 0"), dropConversationOwners},
+	}
+	postgresMigrations = []migration{
+		{1, "create the baseline schema", statements(PostgresTableInitCmds...), dropBaseline},
+		{2, "add attachments", statements(PostgresAttachmentTableInitCmd, attachmentIndexInitCmd), dropAttachments},
+		{3, "track failed logins", statements(PostgresLoginFailureTableInitCmd, loginFailureIndexInitCmd), dropLoginFailures},
+		{4, "add two-factor authentication", statements(PostgresTOTPTableInitCmd, PostgresRecoveryCodeTableInitCmd), dropTOTP},
+		{5, "make usernames unique regardless of case", addCanonicalUsernames, dropCanonicalUsernames},
+		{7, "allow only one 1:1 conversation per pair of users", addDirectKeys, dropDirectKeys},
+		{8, "record the owners of group conversations",
+			statements("ALTER TABLE conversation_members ADD COLUMN is_owner BOOLEAN NOT NULL DEFAULT FALSE"), dropConversationOwners},
+	}
+)
+
+// expectedColumns lists the columns that each table must have once every migration has been applied.
+var expectedColumns = []struct {
+	table   string
+	columns []string
+}{
+	{"users", []string{"username", "hash", "canonical_username"}},
+	{"conversations", []string{"id", "title", "is_group", "direct_key"}},
+	{"conversation_members", []string{"conversation", "username", "is_owner"}},
+	{"messages", []string{"id", "conversation", "timestamp", "sender", "content", "metadata", "idempotency_key"}},
+	{"sessions", []string{"token", "username", "expiry"}},
+	{"read_cursors", []string{"conversation", "username", "message"}},
+	{"message_revisions", []string{"message", "revision", "replaced_at", "content", "metadata"}},
+	{"hidden_messages", []string{"message", "username"}},
+	{"message_tombstones", []string{"message", "deleted_at"}},
+	{"attachments", []string{"id", "owner", "message", "blob_key", "filename", "content_type", "size", "sha256", "width", "height", "created_at"}},
+	{"login_failures", []string{"scope", "subject", "failures", "last_failure"}},
+	{"totp_secrets", []string{"username", "secret", "confirmed", "last_step"}},
+	{"recovery_codes", []string{"username", "hash"}},
+}
+
+// MigrationStatus describes a migration that is either known to this binary or recorded as applied in the DB.
+type MigrationStatus struct {
+	Version     int
+	Description string
+	// AppliedAt is zero for migrations that are yet to be applied.
+	AppliedAt time.Time
+}
+
+// Migrator applies the versioned migrations that define the schema, recording each in the schema_migrations table.
+// Concurrent runs against the same DB are serialized by a lock that is held for the duration of each run.
+type Migrator struct {
+	db         *sql.DB
+	migrations []migration
+	// begin starts the transaction in which a run happens, which also takes the lock unless a lock query is needed.
+	begin, lock string
+	// columnsQuery lists the names of the columns of the table bound to its parameter.
+	columnsQuery string
+	placeholderStyle
+}
+
+func NewMigrator(db *sql.DB) *Migrator {
+	migrations := sqliteMigrations
+	if !fts5Available {
+		migrations = nil
+		for _, mig := range sqliteMigrations {
+			if mig.version != searchIndexVersion {
+				migrations = append(migrations, mig)
+			}
+		}
+	}
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+		// Taking the write lock up front stops concurrent runs from both deciding to apply the same migration.
+		begin:            "BEGIN IMMEDIATE",
+		columnsQuery:     "SELECT name FROM pragma_table_info(?)",
+		placeholderStyle: questionMarks,
+	}
+}
+
+func NewPostgresMigrator(db *sql.DB) *Migrator {
+	return &Migrator{
+		db:         db,
+		migrations: postgresMigrations,
+		begin:      "BEGIN",
+		lock:       "SELECT pg_advisory_xact_lock(?)",
+		columnsQuery: `SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ?`,
+		placeholderStyle: dollarNumbers,
+	}
+}
+
+// lockedConn runs statements on the single connection that holds the migration lock.
+type lockedConn struct {
+	ctx  context.Context
+	conn *sql.Conn
+	placeholderStyle
+}
+
+func (c *lockedConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.conn.ExecContext(c.ctx, c.rebind(query), args...)
+}
+
+func (c *lockedConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.conn.QueryContext(c.ctx, c.rebind(query), args...)
+}
+
+func (c *lockedConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.conn.QueryRowContext(c.ctx, c.rebind(query), args...)
+}
+
+// withLock runs fn in a transaction that holds the migration lock, which is committed only if fn succeeds.
+func (m *Migrator) withLock(fn func(tx migrationTx) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to obtain DB connection: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, m.begin); err != nil {
+		return fmt.Errorf("unable to start transaction: %v", err)
+	}
+	tx := &lockedConn{ctx, conn, m.placeholderStyle}
+	err = func() error {
+		if m.lock != "" {
+			if _, err := tx.Exec(m.lock, migrationLockKey); err != nil {
+				return fmt.Errorf("unable to acquire migration lock: %v", err)
+			}
+		}
+		if _, err := tx.Exec(schemaMigrationsInitCmd); err != nil {
+			return fmt.Errorf("unable to create schema_migrations table: %v", err)
+		}
+		return fn(tx)
+	}()
+	if err != nil {
+		conn.ExecContext(ctx, "ROLLBACK")
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return fmt.Errorf("unable to commit migrations: %v", err)
+	}
+	return nil
+}
+
+// appliedMigrations maps the version of every applied migration to the time it was applied.
+func appliedMigrations(tx migrationTx) (map[int]time.Time, error) {
+	rows, err := tx.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read schema_migrations table: %v", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("unable to parse row of schema_migrations table: %v", err)
+		}
+		applied[version] = time.Unix(appliedAt, 0)
+	}
+	return applied, rows.Err()
+}
+
+// Up applies every pending migration in order & then verifies the resulting schema.
+func (m *Migrator) Up() error {
+	err := m.withLock(func(tx migrationTx) error {
+		applied, err := appliedMigrations(tx)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.version]; ok {
+				continue
+			}
+			if err := mig.up(tx); err != nil {
+				return fmt.Errorf("migration %d (%v) failed: %v", mig.version, mig.description, err)
+			}
+			if _, err := tx.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)",
+				mig.version, mig.description, time.Now().Unix()); err != nil {
+				return fmt.Errorf("unable to record migration %d: %v", mig.version, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return m.Verify()
+}
+
+// Down reverts the most recently applied migration.
+func (m *Migrator) Down() error {
+	return m.withLock(func(tx migrationTx) error {
+		applied, err := appliedMigrations(tx)
+		if err != nil {
+			return err
+		}
+		latest := 0
+		for version := range applied {
+			if version > latest {
+				latest = version
+			}
+		}
+		if latest == 0 {
+			return fmt.Errorf("no migrations have been applied")
+		}
+		for _, mig := range m.migrations {
+			if mig.version != latest {
+				continue
+			}
+			if err := mig.down(tx); err != nil {
+				return fmt.Errorf("reverting migration %d (%v) failed: %v", mig.version, mig.description, err)
+			}
+			if _, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", mig.version); err != nil {
+				return fmt.Errorf("unable to record reversion of migration %d: %v", mig.version, err)
+			}
+			return nil
+		}
+		return fmt.Errorf("DB schema version %d is newer than this binary supports", latest)
+	})
+}
+
+// Status describes every migration known to this binary, along with any others that have been applied to the DB, in
+// order of version.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := m.withLock(func(tx migrationTx) error {
+		applied, err := appliedMigrations(tx)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			statuses = append(statuses, MigrationStatus{Version: mig.version, Description: mig.description, AppliedAt: applied[mig.version]})
+			delete(applied, mig.version)
+		}
+		for version, appliedAt := range applied {
+			statuses = append(statuses, MigrationStatus{Version: version, Description: "unknown to this binary", AppliedAt: appliedAt})
+		}
+		return nil
+	})
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, err
+}
+
+// Verify checks that exactly the migrations known to this binary have been applied & that every table has the
+// expected columns.
+func (m *Migrator) Verify() error {
+	statuses, err := m.Status()
+	if err != nil {
+		return err
+	}
+	latest := m.migrations[len(m.migrations)-1].version
+	for _, status := range statuses {
+		if status.Version == searchIndexVersion && !fts5Available && m.placeholderStyle == questionMarks &&
+			!status.AppliedAt.IsZero() {
+			return fmt.Errorf("this DB has a full-text index of messages, which requires building with -tags sqlite_fts5")
+		}
+		if status.Version > latest {
+			return fmt.Errorf("DB schema version %d is newer than this binary supports", status.Version)
+		}
+		if status.AppliedAt.IsZero() {
+			return fmt.Errorf("migration %d (%v) has not been applied", status.Version, status.Description)
+		}
+	}
+	for _, expected := range expectedColumns {
+		rows, err := m.db.Query(m.rebind(m.columnsQuery), expected.table)
+		if err != nil {
+			return fmt.Errorf("unable to inspect %v table: %v", expected.table, err)
+		}
+		present := make(map[string]bool)
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				rows.Close()
+				return fmt.Errorf("unable to inspect %v table: %v", expected.table, err)
+			}
+			present[column] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("unable to inspect %v table: %v", expected.table, err)
+		}
+		for _, column := range expected.columns {
+			if !present[column] {
+				return fmt.Errorf("%v table is missing the %v column", expected.table, column)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build !(sqlite_fts5 || fts5)
+
+package storage
+
+// fts5Available reports whether go-sqlite3 includes the FTS5 module, which it only does when built with the
+// sqlite_fts5 tag.
+const fts5Available = false
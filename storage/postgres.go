@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"database/sql"
+)
+
+// PostgresTableInitCmds create the same tables & indexes as CreateTables does for SQLite, using Postgres types.
+var PostgresTableInitCmds = []string{
+	"CREATE TABLE IF NOT EXISTS users (username TEXT PRIMARY KEY NOT NULL, hash TEXT NOT NULL)",
+	`CREATE TABLE IF NOT EXISTS conversations (
+		id BIGSERIAL PRIMARY KEY,
+		title TEXT NOT NULL DEFAULT '',
+		is_group BOOLEAN NOT NULL DEFAULT FALSE)`,
+	`CREATE TABLE IF NOT EXISTS conversation_members (
+		conversation BIGINT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+		username TEXT NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+		PRIMARY KEY (conversation, username))`,
+	`CREATE TABLE IF NOT EXISTS messages (
+		id BIGSERIAL PRIMARY KEY,
+		conversation BIGINT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+		timestamp TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		sender TEXT NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE RESTRICT,
+		content TEXT NOT NULL,
+		metadata BYTEA,
+		idempotency_key TEXT)`,
+	`CREATE TABLE IF NOT EXISTS sessions (
+		token TEXT PRIMARY KEY NOT NULL,
+		username TEXT NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+		expiry BIGINT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS read_cursors (
+		conversation BIGINT NOT NULL,
+		username TEXT NOT NULL,
+		message BIGINT NOT NULL,
+		PRIMARY KEY (conversation, username),
+		FOREIGN KEY (conversation, username) REFERENCES conversation_members(conversation, username)
+			ON UPDATE CASCADE ON DELETE CASCADE)`,
+	`CREATE TABLE IF NOT EXISTS message_revisions (
+		message BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+		revision INTEGER NOT NULL,
+		replaced_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		content TEXT NOT NULL,
+		metadata BYTEA,
+		PRIMARY KEY (message, revision))`,
+	`CREATE TABLE IF NOT EXISTS hidden_messages (
+		message BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+		username TEXT NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+		PRIMARY KEY (message, username))`,
+	`CREATE TABLE IF NOT EXISTS message_tombstones (
+		message BIGINT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+		deleted_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL)`,
+	"CREATE INDEX IF NOT EXISTS messages_by_conversation ON messages (conversation, id)",
+	"CREATE INDEX IF NOT EXISTS messages_by_sender ON messages (conversation, sender, id)",
+	"CREATE INDEX IF NOT EXISTS conversation_members_by_username ON conversation_members (username)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS messages_by_idempotency_key ON messages (sender, idempotency_key)",
+}
+
+// PostgresAttachmentTableInitCmd is the Postgres equivalent of AttachmentTableInitCmd.
+const PostgresAttachmentTableInitCmd = `CREATE TABLE IF NOT EXISTS attachments (
+	id BIGSERIAL PRIMARY KEY,
+	owner TEXT NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+	message BIGINT REFERENCES messages(id) ON DELETE CASCADE,
+	blob_key TEXT NOT NULL,
+	filename TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	sha256 TEXT NOT NULL,
+	width INTEGER NOT NULL DEFAULT 0,
+	height INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL)`
+
+// PostgresLoginFailureTableInitCmd is the Postgres equivalent of LoginFailureTableInitCmd.
+const PostgresLoginFailureTableInitCmd = `CREATE TABLE IF NOT EXISTS login_failures (
+	scope TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	failures INTEGER NOT NULL,
+	last_failure BIGINT NOT NULL,
+	PRIMARY KEY (scope, subject))`
+
+// PostgresTOTPTableInitCmd is the Postgres equivalent of TOTPTableInitCmd.
+const PostgresTOTPTableInitCmd = `CREATE TABLE IF NOT EXISTS totp_secrets (
+	username TEXT PRIMARY KEY NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+	secret TEXT NOT NULL,
+	confirmed BOOLEAN NOT NULL DEFAULT FALSE,
+	last_step BIGINT NOT NULL DEFAULT 0)`
+
+// PostgresRecoveryCodeTableInitCmd is the Postgres equivalent of RecoveryCodeTableInitCmd.
+const PostgresRecoveryCodeTableInitCmd = `CREATE TABLE IF NOT EXISTS recovery_codes (
+	username TEXT NOT NULL REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+	hash TEXT NOT NULL,
+	PRIMARY KEY (username, hash))`
+
+// CreatePostgresTables brings a Postgres DB up to date by applying any pending migrations, for use with NewPostgresDB.
+// See Migrator.
+func CreatePostgresTables(db *sql.DB) error {
+	return NewPostgresMigrator(db).Up()
+}
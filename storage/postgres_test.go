@@ -0,0 +1,68 @@
+package storage_test
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/adsouza/chat-backend/storage"
+	_ "github.com/lib/pq"
+)
+
+// postgresDSNVar names the environment variable holding the URL of a Postgres DB in which the tests may create &
+// drop schemas, e.g. postgres://localhost/chat_test?sslmode=disable.
+const postgresDSNVar = "CHAT_TEST_POSTGRES_DSN"
+
+// newPostgresStore isolates each test in a schema of its own, which is dropped afterwards.
+func newPostgresStore(t *testing.T) (*storage.SQLDB, func()) {
+	dsn, err := url.Parse(os.Getenv(postgresDSNVar))
+	if err != nil {
+		t.Fatalf("Unable to parse %v: %v.", postgresDSNVar, err)
+	}
+	admin, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		t.Fatalf("Unable to open connection to DB: %v.", err)
+	}
+	var schema string
+	if err := admin.QueryRow("SELECT 'chat_test_' || md5(random()::text)").Scan(&schema); err != nil {
+		admin.Close()
+		t.Fatalf("Unable to choose a schema name: %v.", err)
+	}
+	if _, err := admin.Exec(fmt.Sprintf("CREATE SCHEMA %s", schema)); err != nil {
+		admin.Close()
+		t.Fatalf("Unable to create schema in test DB: %v.", err)
+	}
+	dropSchema := func() {
+		if _, err := admin.Exec(fmt.Sprintf("DROP SCHEMA %s CASCADE", schema)); err != nil {
+			t.Errorf("Unable to drop schema from test DB: %v.", err)
+		}
+		admin.Close()
+	}
+	// Any parameter that lib/pq doesn't recognize is passed on to the server as a run-time setting.
+	query := dsn.Query()
+	query.Set("search_path", schema)
+	dsn.RawQuery = query.Encode()
+	db, err := sql.Open("postgres", dsn.String())
+	if err != nil {
+		dropSchema()
+		t.Fatalf("Unable to open connection to DB: %v.", err)
+	}
+	if err := storage.CreatePostgresTables(db); err != nil {
+		db.Close()
+		dropSchema()
+		t.Fatalf("Unable to create tables in test DB: %v.", err)
+	}
+	return storage.NewPostgresDB(db), func() {
+		db.Close()
+		dropSchema()
+	}
+}
+
+func TestPostgres(t *testing.T) {
+	if os.Getenv(postgresDSNVar) == "" {
+		t.Skipf("Set %v to run the storage tests against Postgres.", postgresDSNVar)
+	}
+	runConformanceSuite(t, newPostgresStore)
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// S3Config describes how to reach a bucket of Amazon S3 or a compatible service, such as MinIO.
+type S3Config struct {
+	// Endpoint is the base URL of the service, such as https://s3.eu-west-1.amazonaws.com.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// The credentials with which requests are signed.
+	AccessKeyID     string
+	SecretAccessKey string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// S3BlobStore keeps each blob as an object in an S3 bucket, named after its key. Requests address the bucket by path
+// rather than by host name, which every S3-compatible service supports, & are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	config   S3Config
+	endpoint *url.URL
+}
+
+func NewS3BlobStore(config S3Config) (*S3BlobStore, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Region == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("both an S3 region & bucket are required")
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &S3BlobStore{config: config, endpoint: endpoint}, nil
+}
+
+// emptyPayloadHash is the hex-encoded SHA-256 digest of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Put spools the content to a temporary file first, since S3 needs to know its length & digest up front.
+func (s *S3BlobStore) Put(key string, content io.Reader) error {
+	if err := checkBlobKey(key); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "blob-*")
+	if err != nil {
+		return fmt.Errorf("unable to spool blob: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, digest), content)
+	if err != nil {
+		return fmt.Errorf("unable to spool blob: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("unable to spool blob: %v", err)
+	}
+	resp, err := s.do(http.MethodPut, key, io.NopCloser(f), size, hex.EncodeToString(digest.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("upload", key, resp)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	if err := checkBlobKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodGet, key, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %v", ErrBlobNotFound, key)
+	default:
+		defer resp.Body.Close()
+		return nil, s3Error("download", key, resp)
+	}
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	if err := checkBlobKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(http.MethodDelete, key, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// S3 reports success whether or not the object existed, but other services may not.
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error("delete", key, resp)
+	}
+	return nil
+}
+
+// do sends a signed request for the object stored under key.
+func (s *S3BlobStore) do(method, key string, body io.ReadCloser, size int64, payloadHash string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.config.Bucket + "/" + key
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create S3 request: %v", err)
+	}
+	if size > 0 {
+		req.Body, req.ContentLength = body, size
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	resp, err := s.config.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3 request failed: %v", err)
+	}
+	return resp, nil
+}
+
+// sign adds the headers that authenticate a request according to AWS Signature Version 4, signing only those headers
+// that S3 requires to be signed.
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	timestamp := now.Format("20060102T150405Z")
+	date := timestamp[:8]
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + timestamp,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + s.config.SecretAccessKey)
+	for _, part := range []string{date, s.config.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error describes a failed request, including the start of the error document that S3 responds with.
+func s3Error(action, key string, resp *http.Response) error {
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unable to %v blob %v: S3 responded with %v: %s", action, key, resp.Status, strings.TrimSpace(string(detail)))
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	PragmaCmd                = "PRAGMA foreign_keys = ON"
+	UserTableInitCmd         = "CREATE TABLE IF NOT EXISTS users (username TEXT PRIMARY KEY NOT NULL, hash TEXT NOT NULL)"
+	ConversationTableInitCmd = `CREATE TABLE IF NOT EXISTS conversations (
+		id INTEGER PRIMARY KEY,
+		title TEXT NOT NULL DEFAULT '',
+		is_group BOOLEAN NOT NULL DEFAULT 0)`
+	MemberTableInitCmd = `CREATE TABLE IF NOT EXISTS conversation_members (
+		conversation INTEGER NOT NULL,
+		username TEXT NOT NULL,
+		PRIMARY KEY (conversation, username),
+		FOREIGN KEY (conversation) REFERENCES conversations(id) ON DELETE CASCADE,
+		FOREIGN KEY (username) REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE)`
+	MessageTableInitCmd = `CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY,
+		conversation INTEGER NOT NULL,
+		timestamp NUMERIC DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		sender TEXT NOT NULL,
+		content TEXT NOT NULL,
+		metadata BLOB,
+		idempotency_key TEXT,
+		FOREIGN KEY (conversation) REFERENCES conversations(id) ON DELETE CASCADE,
+		FOREIGN KEY (sender) REFERENCES users(username) ON UPDATE CASCADE ON DELETE RESTRICT)`
+	SessionTableInitCmd = `CREATE TABLE IF NOT EXISTS sessions (
+		token TEXT PRIMARY KEY NOT NULL,
+		username TEXT NOT NULL,
+		expiry INTEGER NOT NULL,
+		FOREIGN KEY (username) REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE)`
+	ReadCursorTableInitCmd = `CREATE TABLE IF NOT EXISTS read_cursors (
+		conversation INTEGER NOT NULL,
+		username TEXT NOT NULL,
+		message INTEGER NOT NULL,
+		PRIMARY KEY (conversation, username),
+		FOREIGN KEY (conversation, username) REFERENCES conversation_members(conversation, username)
+			ON UPDATE CASCADE ON DELETE CASCADE)`
+	RevisionTableInitCmd = `CREATE TABLE IF NOT EXISTS message_revisions (
+		message INTEGER NOT NULL,
+		revision INTEGER NOT NULL,
+		replaced_at NUMERIC DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		content TEXT NOT NULL,
+		metadata BLOB,
+		PRIMARY KEY (message, revision),
+		FOREIGN KEY (message) REFERENCES messages(id) ON DELETE CASCADE)`
+	HiddenMessageTableInitCmd = `CREATE TABLE IF NOT EXISTS hidden_messages (
+		message INTEGER NOT NULL,
+		username TEXT NOT NULL,
+		PRIMARY KEY (message, username),
+		FOREIGN KEY (message) REFERENCES messages(id) ON DELETE CASCADE,
+		FOREIGN KEY (username) REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE)`
+	TombstoneTableInitCmd = `CREATE TABLE IF NOT EXISTS message_tombstones (
+		message INTEGER PRIMARY KEY,
+		deleted_at NUMERIC DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		FOREIGN KEY (message) REFERENCES messages(id) ON DELETE CASCADE)`
+	IndexInitCmd = `CREATE INDEX IF NOT EXISTS messages_by_conversation ON messages (conversation, id);
+		CREATE INDEX IF NOT EXISTS messages_by_sender ON messages (conversation, sender, id);
+		CREATE INDEX IF NOT EXISTS conversation_members_by_username ON conversation_members (username);
+		CREATE UNIQUE INDEX IF NOT EXISTS messages_by_idempotency_key ON messages (sender, idempotency_key)`
+	// AttachmentTableInitCmd is applied by migration 2, so it isn't part of the baseline.
+	AttachmentTableInitCmd = `CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY,
+		owner TEXT NOT NULL,
+		message INTEGER,
+		blob_key TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		sha256 TEXT NOT NULL,
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		created_at NUMERIC DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		FOREIGN KEY (owner) REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE,
+		FOREIGN KEY (message) REFERENCES messages(id) ON DELETE CASCADE)`
+	// LoginFailureTableInitCmd is applied by migration 3. Failures are tracked for usernames whether or not they exist,
+	// so there is no foreign key to the users table.
+	LoginFailureTableInitCmd = `CREATE TABLE IF NOT EXISTS login_failures (
+		scope TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		failures INTEGER NOT NULL,
+		last_failure INTEGER NOT NULL,
+		PRIMARY KEY (scope, subject))`
+	// TOTPTableInitCmd & RecoveryCodeTableInitCmd are applied by migration 4.
+	TOTPTableInitCmd = `CREATE TABLE IF NOT EXISTS totp_secrets (
+		username TEXT PRIMARY KEY NOT NULL,
+		secret TEXT NOT NULL,
+		confirmed BOOLEAN NOT NULL DEFAULT 0,
+		last_step INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (username) REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE)`
+	RecoveryCodeTableInitCmd = `CREATE TABLE IF NOT EXISTS recovery_codes (
+		username TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		PRIMARY KEY (username, hash),
+		FOREIGN KEY (username) REFERENCES users(username) ON UPDATE CASCADE ON DELETE CASCADE)`
+)
+
+// SQLiteDSN adds the parameter that makes go-sqlite3 enable foreign key constraints on every connection it opens to the
+// DB, whereas PragmaCmd only enables them on whichever connection in the pool happens to run it. Renaming & deleting
+// users rely on the constraints to cascade.
+func SQLiteDSN(dsn string) string {
+	if dsn == "" {
+		dsn = ":memory:"
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&_foreign_keys=on"
+	}
+	return dsn + "?_foreign_keys=on"
+}
+
+// CreateTables brings a SQLite DB up to date by applying any pending migrations. See Migrator.
+func CreateTables(db *sql.DB) error {
+	return NewMigrator(db).Up()
+}
+
+// sqliteBaseline creates any tables that are missing from the DB & upgrades those created before migrations existed,
+// so that every such DB ends up with the same schema.
+func sqliteBaseline(tx migrationTx) error {
+	for _, cmd := range []string{
+		UserTableInitCmd, ConversationTableInitCmd, MemberTableInitCmd, MessageTableInitCmd, SessionTableInitCmd,
+		ReadCursorTableInitCmd, RevisionTableInitCmd, HiddenMessageTableInitCmd, TombstoneTableInitCmd,
+	} {
+		if _, err := tx.Exec(cmd); err != nil {
+			return fmt.Errorf("unable to create table: %v", err)
+		}
+	}
+	if err := upgradeLegacyMessages(tx); err != nil {
+		return err
+	}
+	if err := addIdempotencyKeys(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(IndexInitCmd); err != nil {
+		return fmt.Errorf("unable to create indexes: %v", err)
+	}
+	return nil
+}
+
+// upgradeLegacyMessages moves each 1:1 thread from a messages table that predates conversations (& so has a recipient
+// column) into a 2 member conversation, preserving message IDs.
+func upgradeLegacyMessages(tx migrationTx) error {
+	var legacy bool
+	if err := tx.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('messages') WHERE name = 'recipient'").Scan(&legacy); err != nil {
+		return fmt.Errorf("unable to inspect messages table: %v", err)
+	}
+	if !legacy {
+		return nil
+	}
+	if _, err := tx.Exec("ALTER TABLE messages RENAME TO legacy_messages"); err != nil {
+		return fmt.Errorf("unable to rename legacy messages table: %v", err)
+	}
+	if _, err := tx.Exec(MessageTableInitCmd); err != nil {
+		return fmt.Errorf("unable to create messages table: %v", err)
+	}
+	rows, err := tx.Query("SELECT DISTINCT MIN(sender, recipient), MAX(sender, recipient) FROM legacy_messages")
+	if err != nil {
+		return fmt.Errorf("unable to query legacy messages table: %v", err)
+	}
+	var pairs [][2]string
+	for rows.Next() {
+		var pair [2]string
+		if err := rows.Scan(&pair[0], &pair[1]); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to parse participants of legacy conversation: %v", err)
+		}
+		pairs = append(pairs, pair)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unable to read participants of legacy conversations: %v", err)
+	}
+	for _, pair := range pairs {
+		id, err := createConversation(tx, "", false, pair[:])
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO messages (id, conversation, timestamp, sender, content, metadata)
+		SELECT rowid, ?, timestamp, sender, content, metadata FROM legacy_messages
+		WHERE MIN(sender, recipient) = ? AND MAX(sender, recipient) = ?`, id, pair[0], pair[1]); err != nil {
+			return fmt.Errorf("unable to copy legacy messages into conversation: %v", err)
+		}
+		// Having sent a message implies having read everything before it.
+		if _, err := tx.Exec(`INSERT INTO read_cursors (conversation, username, message)
+		SELECT conversation, sender, MAX(id) FROM messages WHERE conversation = ? GROUP BY sender`, id); err != nil {
+			return fmt.Errorf("unable to initialize read cursors for legacy conversation: %v", err)
+		}
+	}
+	if _, err := tx.Exec("DROP TABLE legacy_messages"); err != nil {
+		return fmt.Errorf("unable to drop legacy messages table: %v", err)
+	}
+	return nil
+}
+
+// addIdempotencyKeys adds the idempotency_key column to a messages table created before it existed.
+func addIdempotencyKeys(tx migrationTx) error {
+	var present bool
+	if err := tx.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('messages') WHERE name = 'idempotency_key'").Scan(&present); err != nil {
+		return fmt.Errorf("unable to inspect messages table: %v", err)
+	}
+	if present {
+		return nil
+	}
+	if _, err := tx.Exec("ALTER TABLE messages ADD COLUMN idempotency_key TEXT"); err != nil {
+		return fmt.Errorf("unable to add idempotency_key column to messages table: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// Snippets are HTML, in which the content of a message is escaped & each matching term is wrapped in these.
+const (
+	HighlightStart = "<b>"
+	HighlightEnd   = "</b>"
+)
+
+// searchIndexVersion is the migration that sets up an FTS5 index of message content on SQLite, which triggers keep in
+// sync with the messages table. The FTS5 module is only compiled into go-sqlite3 when it is built with the
+// sqlite_fts5 tag, so binaries built without it leave the migration out, & the index is created (& populated from any
+// existing messages) the first time the DB is migrated by a binary that has it. A DB with the index can't be opened
+// by a binary without the module, since its triggers would fail.
+const searchIndexVersion = 6
+
+var addSearchIndex = statements(
+	"CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(content, content='messages', content_rowid='id')",
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF content ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		INSERT INTO messages_fts (rowid, content) VALUES (new.id, new.content);
+	END`,
+	"INSERT INTO messages_fts (messages_fts) VALUES ('rebuild')",
+)
+
+var dropSearchIndex = statements(
+	"DROP TRIGGER IF EXISTS messages_fts_update",
+	"DROP TRIGGER IF EXISTS messages_fts_delete",
+	"DROP TRIGGER IF EXISTS messages_fts_insert",
+	"DROP TABLE IF EXISTS messages_fts",
+)
+
+// SearchQuery selects the messages returned by SearchMessages. Filters left as their zero values are not applied.
+type SearchQuery struct {
+	Text string
+	// Peer restricts the search to the 1:1 conversation with the specified user.
+	Peer   string
+	Author string
+	// Only messages sent at or after After & before Before match.
+	After, Before time.Time
+	Limit         uint32
+	// Offset skips that many of the best matches, for pagination.
+	Offset int64
+}
+
+// SearchResult is a message that matched a search, along with an HTML excerpt of its content in which the matching
+// terms are highlighted.
+type SearchResult struct {
+	Message
+	Snippet string
+}
+
+// ftsQuery turns arbitrary user input into an FTS5 query that matches messages containing every word, so that
+// characters with special meaning to FTS5 can't cause syntax errors.
+func ftsQuery(text string) string {
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// SearchMessages returns the messages in viewer's conversations that best match the query, best first, omitting any
+// that viewer has deleted for themselves.
+func (s *SQLDB) SearchMessages(viewer string, query SearchQuery) ([]SearchResult, error) {
+	var available bool
+	if s.placeholderStyle == questionMarks {
+		if err := s.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE name = 'messages_fts'").Scan(&available); err != nil {
+			return nil, fmt.Errorf("unable to inspect DB for full-text index: %v", err)
+		}
+	}
+	if !available {
+		return nil, ErrSearchUnavailable
+	}
+	match := ftsQuery(query.Text)
+	if match == "" {
+		return nil, fmt.Errorf("a search query must contain at least one word")
+	}
+	sqlQuery := "SELECT snippet(messages_fts, 0, ?, ?, '…', 16), " + messageColumns + ` FROM messages_fts
+	JOIN messages m ON m.id = messages_fts.rowid
+	JOIN conversation_members cm ON cm.conversation = m.conversation AND cm.username = ?
+	WHERE messages_fts MATCH ? AND ` + notHiddenFrom
+	// FTS5 can't escape the content, so matches are marked with delimiters that are random, & thus can't be forged by
+	// whoever wrote the message, until it has been escaped.
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate highlight delimiters: %v", err)
+	}
+	start, end := "\x02"+hex.EncodeToString(nonce), "\x03"+hex.EncodeToString(nonce)
+	highlighter := strings.NewReplacer(start, HighlightStart, end, HighlightEnd)
+	args := []interface{}{start, end, viewer, match, viewer}
+	if query.Peer != "" {
+		conversation, err := findDirectConversation(s, viewer, query.Peer)
+		if err != nil {
+			return nil, err
+		}
+		sqlQuery += " AND m.conversation = ?"
+		args = append(args, conversation)
+	}
+	if query.Author != "" {
+		sqlQuery += " AND m.sender = ?"
+		args = append(args, query.Author)
+	}
+	if !query.After.IsZero() {
+		sqlQuery += " AND m.timestamp >= ?"
+		args = append(args, query.After.UTC().Format("2006-01-02 15:04:05"))
+	}
+	if !query.Before.IsZero() {
+		sqlQuery += " AND m.timestamp < ?"
+		args = append(args, query.Before.UTC().Format("2006-01-02 15:04:05"))
+	}
+	sqlQuery += " ORDER BY bm25(messages_fts), m.id DESC LIMIT ? OFFSET ?"
+	args = append(args, query.Limit, query.Offset)
+	rows, err := s.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute full-text search: %v", err)
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		result := SearchResult{}
+		if err := scanMessage(rows, &result.Message, &result.Snippet); err != nil {
+			return nil, err
+		}
+		result.Snippet = highlighter.Replace(html.EscapeString(result.Snippet))
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
@@ -2,41 +2,173 @@ package storage
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"math"
+	"strings"
 	"time"
 )
 
+type Message struct {
+	ID, Conversation int64
+	Timestamp        time.Time
+	Author, Content  string
+	Metadata         []byte
+	// EditedAt is zero unless the message has been edited, in which case Revisions counts its earlier versions.
+	EditedAt  time.Time
+	Revisions uint32
+	// Deleted marks a tombstone left in place of a message its author deleted for everyone.
+	Deleted bool
+}
+
+// Revision is one version of the content of a message.
+type Revision struct {
+	Number    uint32
+	Timestamp time.Time
+	Content   string
+	Metadata  []byte
+}
+
+type Conversation struct {
+	ID    int64
+	Title string
+	Group bool
+	// Owner is the member of a group who created it, or empty if they have left it or it predates owners.
+	Owner   string
+	Members []string
+}
+
+// ConversationSummary describes a conversation from the perspective of one of its members.
+type ConversationSummary struct {
+	ID    int64
+	Title string
+	Group bool
+	// Peer is the other participant in a 1:1 conversation.
+	Peer        string
+	LastMessage Message
+	// Unread counts the messages from others after the member's read cursor, other than deleted ones & those the member
+	// has hidden.
+	Unread uint32
+}
+
+// ReadCursor records the newest message in a conversation that a member has read.
+type ReadCursor struct {
+	Username string
+	Message  int64
+}
+
+// messageColumns lists the columns from which scanMessage populates each Message, for a messages table aliased as m.
+const messageColumns = `m.id, m.conversation, m.timestamp, m.sender, m.content, m.metadata,
+	(SELECT MAX(r.replaced_at) FROM message_revisions r WHERE r.message = m.id),
+	(SELECT COUNT(*) FROM message_revisions r WHERE r.message = m.id),
+	EXISTS (SELECT 1 FROM message_tombstones t WHERE t.message = m.id)`
+
+// notHiddenFrom excludes messages that the user bound to its parameter has deleted for themselves.
+const notHiddenFrom = "NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message = m.id AND h.username = ?)"
+
+// placeholderStyle determines how the ? placeholders used by every query in this package are passed to the driver.
+type placeholderStyle int
+
 const (
-	PragmaCmd                = "PRAGMA foreign_keys = ON"
-	UserTableInitCmd         = "CREATE TABLE IF NOT EXISTS users (username TEXT PRIMARY KEY NOT NULL, hash TEXT NOT NULL)"
-	ConversationTableInitCmd = `CREATE TABLE IF NOT EXISTS messages (
-		timestamp NUMERIC DEFAULT CURRENT_TIMESTAMP NOT NULL, 
-		sender TEXT NOT NULL,
-		recipient TEXT NOT NULL,
-		content TEXT NOT NULL,
-		metadata BLOB,
-		FOREIGN KEY (sender) REFERENCES users(username) ON UPDATE CASCADE ON DELETE RESTRICT,
-		FOREIGN KEY (recipient) REFERENCES users(username) ON UPDATE CASCADE ON DELETE RESTRICT)`
+	questionMarks placeholderStyle = iota
+	dollarNumbers
 )
 
-type Message struct {
-	Timestamp       time.Time
-	Author, Content string
-	Metadata        []byte
+// rebind rewrites the placeholders in a query into the style expected by the driver.
+func (p placeholderStyle) rebind(query string) string {
+	if p == questionMarks {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
 }
 
+// SQLDB implements storage on top of either SQLite or PostgreSQL, whose tables are created by CreateTables &
+// CreatePostgresTables respectively.
 type SQLDB struct {
 	*sql.DB
+	placeholderStyle
 }
 
 func NewSQLDB(db *sql.DB) *SQLDB {
-	return &SQLDB{db}
+	return &SQLDB{db, questionMarks}
 }
 
-func (s *SQLDB) AddUser(username string, hash []byte) error {
-	_, err := s.Exec("INSERT INTO users (username, hash) VALUES (?, ?)", username, hash)
-	return err
+func NewPostgresDB(db *sql.DB) *SQLDB {
+	return &SQLDB{db, dollarNumbers}
+}
+
+func (s *SQLDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.DB.Exec(s.rebind(query), args...)
+}
+
+func (s *SQLDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.DB.Query(s.rebind(query), args...)
+}
+
+func (s *SQLDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return s.DB.QueryRow(s.rebind(query), args...)
+}
+
+// sqlTx is a transaction that rewrites placeholders in the same way as the SQLDB that began it.
+type sqlTx struct {
+	*sql.Tx
+	placeholderStyle
+}
+
+func (s *SQLDB) Begin() (*sqlTx, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{tx, s.placeholderStyle}, nil
+}
+
+func (tx *sqlTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.rebind(query), args...)
+}
+
+func (tx *sqlTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.rebind(query), args...)
+}
+
+func (tx *sqlTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.rebind(query), args...)
+}
+
+// AddUser registers a username, which must differ from every other in its canonical form as well as in itself. The
+// canonical form is whatever the caller decides makes usernames equivalent, e.g. case-folding.
+func (s *SQLDB) AddUser(username, canonical string, hash []byte) error {
+	// Hashes are stored as text, which Postgres won't implicitly convert from a byte slice.
+	res, err := s.Exec("INSERT INTO users (username, canonical_username, hash) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+		username, canonical, string(hash))
+	if err != nil {
+		return fmt.Errorf("unable to add user: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("unable to add user: %v", err)
+	} else if n == 0 {
+		return ErrUserExists
+	}
+	return nil
+}
+
+// userExists reports whether the specified user has registered.
+func userExists(q queryer, username string) (bool, error) {
+	var exists bool
+	if err := q.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists); err != nil {
+		return false, fmt.Errorf("unable to look up user: %v", err)
+	}
+	return exists, nil
 }
 
 func (s *SQLDB) FetchHash(username string) ([]byte, error) {
@@ -44,7 +176,7 @@ func (s *SQLDB) FetchHash(username string) ([]byte, error) {
 	err := s.QueryRow("SELECT hash FROM users WHERE username=?", username).Scan(&hash)
 	switch {
 	case err == sql.ErrNoRows:
-		return nil, fmt.Errorf("no such username found")
+		return nil, ErrUserNotFound
 	case err != nil:
 		return nil, fmt.Errorf("unexpected DB access failure: %v", err)
 	default:
@@ -52,36 +184,343 @@ func (s *SQLDB) FetchHash(username string) ([]byte, error) {
 	}
 }
 
-func (s *SQLDB) AddMessage(sender, recipient, content string, metadata []byte) error {
-	_, err := s.Exec("INSERT INTO messages (sender, recipient, content, metadata) VALUES (?, ?, ?, ?)", sender, recipient, content, metadata)
+// AddSession persists a session for a user, returning ErrUserNotFound if they don't exist, e.g. because their account
+// was deleted while they were logging in.
+func (s *SQLDB) AddSession(token, username string, expiry time.Time) error {
+	_, err := s.Exec("INSERT INTO sessions (token, username, expiry) VALUES (?, ?, ?)", token, username, expiry.Unix())
+	if err == nil {
+		return nil
+	}
+	// The likeliest cause is the foreign key constraint on the username, which each driver reports in its own way.
+	if exists, existsErr := userExists(s, username); existsErr == nil && !exists {
+		return fmt.Errorf("%w: %v", ErrUserNotFound, username)
+	}
+	return fmt.Errorf("unable to add session: %v", err)
+}
+
+func (s *SQLDB) FetchSession(token string) (string, time.Time, error) {
+	var username string
+	var expiry int64
+	err := s.QueryRow("SELECT username, expiry FROM sessions WHERE token=?", token).Scan(&username, &expiry)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", time.Time{}, ErrSessionNotFound
+	case err != nil:
+		return "", time.Time{}, fmt.Errorf("unexpected DB access failure: %v", err)
+	default:
+		return username, time.Unix(expiry, 0), nil
+	}
+}
+
+func (s *SQLDB) DeleteSession(token string) error {
+	_, err := s.Exec("DELETE FROM sessions WHERE token=?", token)
 	return err
 }
 
-func (s *SQLDB) ReadMessagesBefore(user1, user2 string, limit uint32, before int64) ([]Message, int64, error) {
-	//TODO: use a prepared query.
-	rows, err := s.Query(
-		`SELECT rowid, timestamp, sender, content, metadata FROM messages WHERE rowid < ? AND sender = ? AND recipient = ?
-	UNION ALL SELECT rowid, timestamp, sender, content, metadata FROM messages WHERE rowid < ? AND sender = ? AND recipient = ?
-	ORDER BY rowid DESC LIMIT ?`,
-		before, user1, user2, before, user2, user1, limit)
+// parseTimestamp converts the textual form of CURRENT_TIMESTAMP into a time.Time. SQLite stores it as text, whereas
+// Postgres returns a time.Time that database/sql formats according to RFC 3339 when scanning it into a string.
+func parseTimestamp(ts string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02 15:04:05", ts); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339Nano, ts)
+}
+
+// AddMessage stores a message in the 1:1 conversation between sender & recipient, starting one if necessary. See
+// AddConversationMessage.
+func (s *SQLDB) AddMessage(sender, recipient, content string, metadata []byte, idempotencyKey string, attachments ...int64) (Message, bool, error) {
+	if exists, err := userExists(s, recipient); err != nil || !exists {
+		if err == nil {
+			err = fmt.Errorf("%w: %v", ErrRecipientUnknown, recipient)
+		}
+		return Message{}, false, err
+	}
+	conversation, err := s.DirectConversation(sender, recipient)
+	if err != nil {
+		return Message{}, false, err
+	}
+	return s.AddConversationMessage(conversation, sender, content, metadata, idempotencyKey, attachments...)
+}
+
+// AddConversationMessage stores a message in the specified conversation, attaches the specified attachments to it &
+// advances the sender's read cursor to it, all or none of which happens. Each attachment must belong to the sender &
+// not have been sent already. If the sender already stored a message in the conversation with the same non-empty
+// idempotency key, that message is returned instead & the bool result is false.
+func (s *SQLDB) AddConversationMessage(conversation int64, sender, content string, metadata []byte, idempotencyKey string, attachments ...int64) (Message, bool, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return Message{}, false, fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	key := sql.NullString{String: idempotencyKey, Valid: idempotencyKey != ""}
+	msg := Message{Conversation: conversation, Author: sender, Content: content, Metadata: metadata}
+	var ts string
+	err = tx.QueryRow(`INSERT INTO messages (conversation, sender, content, metadata, idempotency_key) VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (sender, idempotency_key) DO NOTHING RETURNING id, timestamp`,
+		conversation, sender, content, metadata, key).Scan(&msg.ID, &ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Nothing was inserted because the key was already used.
+		if msg, err = fetchMessageByIdempotencyKey(tx, sender, idempotencyKey); err != nil {
+			return Message{}, false, err
+		}
+		if msg.Conversation != conversation {
+			return Message{}, false, fmt.Errorf("%w: %q", ErrIdempotencyKeyReused, idempotencyKey)
+		}
+		return msg, false, nil
+	}
 	if err != nil {
-		return nil, math.MaxInt64, fmt.Errorf("unable to execute query for messages between specified users: %v", err)
+		return Message{}, false, err
+	}
+	if msg.Timestamp, err = parseTimestamp(ts); err != nil {
+		return Message{}, false, fmt.Errorf("unable to parse timestamp from DB: %v", err)
+	}
+	if err := attachToMessage(tx, msg.ID, sender, attachments); err != nil {
+		return Message{}, false, err
+	}
+	if err := updateReadCursor(tx, conversation, sender, msg.ID); err != nil {
+		return Message{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Message{}, false, fmt.Errorf("unable to commit message: %v", err)
+	}
+	return msg, true, nil
+}
+
+// fetchMessageByIdempotencyKey returns the message that sender stored with the specified idempotency key.
+func fetchMessageByIdempotencyKey(q queryer, sender, idempotencyKey string) (Message, error) {
+	var msg Message
+	err := scanMessage(q.QueryRow("SELECT "+messageColumns+" FROM messages m WHERE m.sender = ? AND m.idempotency_key = ?",
+		sender, idempotencyKey), &msg)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, fmt.Errorf("%w: none sent by %v with key %q", ErrMessageNotFound, sender, idempotencyKey)
+	}
+	return msg, err
+}
+
+// FetchMessageByIdempotencyKey returns the message that sender stored with the specified non-empty idempotency key, or
+// ErrMessageNotFound if there is none.
+func (s *SQLDB) FetchMessageByIdempotencyKey(sender, idempotencyKey string) (Message, error) {
+	return fetchMessageByIdempotencyKey(s, sender, idempotencyKey)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage populates msg from a row that consists of any leading columns followed by messageColumns.
+func scanMessage(row scanner, msg *Message, leading ...interface{}) error {
+	var ts string
+	var editedAt sql.NullString
+	dest := append(leading, &msg.ID, &msg.Conversation, &ts, &msg.Author, &msg.Content, &msg.Metadata, &editedAt, &msg.Revisions, &msg.Deleted)
+	if err := row.Scan(dest...); err != nil {
+		return fmt.Errorf("unable to parse data from DB into message struct: %w", err)
 	}
+	var err error
+	if msg.Timestamp, err = parseTimestamp(ts); err != nil {
+		return fmt.Errorf("unable to parse timestamp from DB: %v", err)
+	}
+	if editedAt.Valid {
+		if msg.EditedAt, err = parseTimestamp(editedAt.String); err != nil {
+			return fmt.Errorf("unable to parse edit timestamp from DB: %v", err)
+		}
+	}
+	return nil
+}
+
+// scanMessages reads every row into a Message, returning them along with the ID of the last one (or 0 if empty).
+func scanMessages(rows *sql.Rows) ([]Message, int64, error) {
 	defer rows.Close()
-	var rowId int64
 	var messages []Message
+	var last int64
+	for rows.Next() {
+		msg := Message{}
+		if err := scanMessage(rows, &msg); err != nil {
+			return nil, 0, err
+		}
+		messages = append(messages, msg)
+		last = msg.ID
+	}
+	return messages, last, rows.Err()
+}
+
+// ReadMessagesBefore reads from the 1:1 conversation between viewer & peer. See ReadConversationBefore.
+func (s *SQLDB) ReadMessagesBefore(viewer, peer string, limit uint32, before int64) ([]Message, int64, error) {
+	conversation, err := findDirectConversation(s, viewer, peer)
+	if err != nil {
+		return nil, math.MaxInt64, err
+	}
+	if conversation == 0 {
+		return nil, 0, nil
+	}
+	return s.ReadConversationBefore(viewer, conversation, limit, before)
+}
+
+// ReadConversationBefore returns up to limit of the messages in a conversation that precede the one with the specified
+// ID, newest first, along with the ID of the last one returned for use as a continuation token. Messages that viewer
+// has deleted for themselves are skipped, whereas those deleted for everyone are returned as tombstones.
+func (s *SQLDB) ReadConversationBefore(viewer string, conversation int64, limit uint32, before int64) ([]Message, int64, error) {
+	//TODO: use a prepared query.
+	rows, err := s.Query("SELECT "+messageColumns+" FROM messages m WHERE m.conversation = ? AND m.id < ? AND "+notHiddenFrom+
+		" ORDER BY m.id DESC LIMIT ?", conversation, before, viewer, limit)
+	if err != nil {
+		return nil, math.MaxInt64, fmt.Errorf("unable to execute query for messages in specified conversation: %v", err)
+	}
+	messages, last, err := scanMessages(rows)
+	if err != nil {
+		return nil, math.MaxInt64, err
+	}
+	return messages, last, nil
+}
+
+// ReadMessagesAfter reads from the 1:1 conversation between viewer & peer. See ReadConversationAfter.
+func (s *SQLDB) ReadMessagesAfter(viewer, peer string, limit uint32, after int64) ([]Message, int64, error) {
+	conversation, err := findDirectConversation(s, viewer, peer)
+	if err != nil {
+		return nil, after, err
+	}
+	if conversation == 0 {
+		return nil, after, nil
+	}
+	return s.ReadConversationAfter(viewer, conversation, limit, after)
+}
+
+// ReadConversationAfter returns up to limit of the messages in a conversation that follow the one with the specified
+// ID, oldest first, along with the ID of the last one returned (or after, if none were) for use as a sync token.
+// Messages are filtered & marked as for ReadConversationBefore.
+func (s *SQLDB) ReadConversationAfter(viewer string, conversation int64, limit uint32, after int64) ([]Message, int64, error) {
+	rows, err := s.Query("SELECT "+messageColumns+" FROM messages m WHERE m.conversation = ? AND m.id > ? AND "+notHiddenFrom+
+		" ORDER BY m.id ASC LIMIT ?", conversation, after, viewer, limit)
+	if err != nil {
+		return nil, after, fmt.Errorf("unable to execute query for messages in specified conversation: %v", err)
+	}
+	messages, last, err := scanMessages(rows)
+	if err != nil {
+		return nil, after, err
+	}
+	if last == 0 {
+		last = after
+	}
+	return messages, last, nil
+}
+
+// ReadMessagesReceivedAfter returns up to limit of the messages sent to recipient (by anyone else in any of their
+// conversations) after the one with the specified ID, in the order they were sent, along with the ID of the last one
+// returned.
+func (s *SQLDB) ReadMessagesReceivedAfter(recipient string, limit uint32, after int64) ([]Message, int64, error) {
+	rows, err := s.Query("SELECT "+messageColumns+` FROM messages m
+	JOIN conversation_members cm ON cm.conversation = m.conversation
+	WHERE cm.username = ? AND m.sender != ? AND m.id > ? AND `+notHiddenFrom+` ORDER BY m.id ASC LIMIT ?`,
+		recipient, recipient, after, recipient, limit)
+	if err != nil {
+		return nil, after, fmt.Errorf("unable to execute query for messages sent to specified user: %v", err)
+	}
+	messages, last, err := scanMessages(rows)
+	if err != nil {
+		return nil, after, err
+	}
+	if last == 0 {
+		last = after
+	}
+	return messages, last, nil
+}
+
+func (s *SQLDB) FetchMessage(id int64) (Message, error) {
 	msg := Message{}
-	var ts string
+	err := scanMessage(s.QueryRow("SELECT "+messageColumns+" FROM messages m WHERE m.id = ?", id), &msg)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, ErrMessageNotFound
+	}
+	return msg, err
+}
+
+// EditMessage replaces the content & metadata of a message, keeping the previous version as a revision.
+func (s *SQLDB) EditMessage(id int64, content string, metadata []byte) (Message, error) {
+	tx, err := s.Begin()
+	if err != nil {
+		return Message{}, fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO message_revisions (message, revision, content, metadata)
+	SELECT m.id, (SELECT COUNT(*) FROM message_revisions r WHERE r.message = m.id) + 1, m.content, m.metadata
+	FROM messages m WHERE m.id = ?`, id)
+	if err != nil {
+		return Message{}, fmt.Errorf("unable to record revision: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Message{}, fmt.Errorf("unable to record revision: %v", err)
+	} else if n == 0 {
+		return Message{}, ErrMessageNotFound
+	}
+	if _, err := tx.Exec("UPDATE messages SET content = ?, metadata = ? WHERE id = ?", content, metadata, id); err != nil {
+		return Message{}, fmt.Errorf("unable to update message: %v", err)
+	}
+	msg := Message{}
+	if err := scanMessage(tx.QueryRow("SELECT "+messageColumns+" FROM messages m WHERE m.id = ?", id), &msg); err != nil {
+		return Message{}, err
+	}
+	return msg, tx.Commit()
+}
+
+// ReadRevisions returns every version of a message's content, oldest first, each with the time it was written.
+func (s *SQLDB) ReadRevisions(id int64) ([]Revision, error) {
+	msg, err := s.FetchMessage(id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.Query("SELECT revision, replaced_at, content, metadata FROM message_revisions WHERE message = ? ORDER BY revision", id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to execute query for message revisions: %v", err)
+	}
+	defer rows.Close()
+	var revisions []Revision
+	written := msg.Timestamp
 	for rows.Next() {
-		err := rows.Scan(&rowId, &ts, &msg.Author, &msg.Content, &msg.Metadata)
-		if err != nil {
-			return nil, math.MaxInt64, fmt.Errorf("unable to parse data from DB into message struct: %v", err)
+		revision := Revision{Timestamp: written}
+		var replacedAt string
+		if err := rows.Scan(&revision.Number, &replacedAt, &revision.Content, &revision.Metadata); err != nil {
+			return nil, fmt.Errorf("unable to parse message revision from DB: %v", err)
 		}
-		msg.Timestamp, err = time.Parse("2006-01-02 15:04:05", ts)
-		if err != nil {
-			return nil, math.MaxInt64, fmt.Errorf("unable to parse timestamp from DB: %v", err)
+		if written, err = parseTimestamp(replacedAt); err != nil {
+			return nil, fmt.Errorf("unable to parse timestamp from DB: %v", err)
 		}
-		messages = append(messages, msg)
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	current := Revision{Number: uint32(len(revisions) + 1), Timestamp: written, Content: msg.Content, Metadata: msg.Metadata}
+	return append(revisions, current), nil
+}
+
+// HideMessage deletes a message for the specified user only. Hiding a message more than once is harmless.
+func (s *SQLDB) HideMessage(id int64, username string) error {
+	if _, err := s.Exec("INSERT INTO hidden_messages (message, username) VALUES (?, ?) ON CONFLICT DO NOTHING", id, username); err != nil {
+		return fmt.Errorf("unable to hide message: %v", err)
+	}
+	return nil
+}
+
+// DeleteMessage deletes a message for everyone, replacing it & all of its revisions with a tombstone.
+func (s *SQLDB) DeleteMessage(id int64) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("UPDATE messages SET content = '', metadata = NULL WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("unable to erase message: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("unable to erase message: %v", err)
+	} else if n == 0 {
+		return ErrMessageNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM message_revisions WHERE message = ?", id); err != nil {
+		return fmt.Errorf("unable to erase message revisions: %v", err)
+	}
+	if _, err := tx.Exec("INSERT INTO message_tombstones (message) VALUES (?) ON CONFLICT DO NOTHING", id); err != nil {
+		return fmt.Errorf("unable to record tombstone: %v", err)
 	}
-	return messages, rowId, rows.Err()
+	return tx.Commit()
 }
@@ -2,194 +2,320 @@ package storage_test
 
 import (
 	"database/sql"
+	"errors"
 	"math"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/adsouza/chat-backend/storage"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func newStore(t *testing.T) (*storage.SQLDB, func()) {
+func newSQLiteStore(t *testing.T) (*storage.SQLDB, func()) {
 	db, err := sql.Open("sqlite3", "")
 	if err != nil {
 		t.Fatalf("Unable to open connection to DB: %v.", err)
 	}
+	// Each connection to an unnamed DB gets its own private copy, so only use one.
+	db.SetMaxOpenConns(1)
 	if _, err := db.Exec(storage.PragmaCmd); err != nil {
 		t.Errorf("Unable to enable foreign key constraints in test DB: %v.", err)
 	}
-	if _, err := db.Exec(storage.UserTableInitCmd); err != nil {
+	if err := storage.CreateTables(db); err != nil {
 		db.Close()
-		t.Fatalf("Unable to create new users table in test DB: %v.", err)
-	}
-	if _, err := db.Exec(storage.ConversationTableInitCmd); err != nil {
-		db.Close()
-		t.Fatalf("Unable to create new conversations table in test DB: %v.", err)
+		t.Fatalf("Unable to create tables in test DB: %v.", err)
 	}
 	return storage.NewSQLDB(db), func() { db.Close() }
 }
 
-func TestHappyPath(t *testing.T) {
-	store, closer := newStore(t)
-	defer closer()
-	if err := store.AddUser("testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
-		t.Fatalf("Unable to add a new row to the users table: %v.", err)
-	}
-	hash, err := store.FetchHash("testuser1")
+func TestSQLite(t *testing.T) {
+	runConformanceSuite(t, newSQLiteStore)
+}
+
+// newPooledSQLiteStore returns a store backed by a DB file that it reopens for nearly every statement, as a busy server
+// would, so that any setting that is only applied to one connection goes missing.
+func newPooledSQLiteStore(t *testing.T) (*storage.SQLDB, func()) {
+	db, err := sql.Open("sqlite3", storage.SQLiteDSN(filepath.Join(t.TempDir(), "chat.db")))
 	if err != nil {
-		t.Fatalf("Unable to retrieve hash for recently added user: %v.", err)
-	}
-	if got, want := string(hash), "012345678901234567890123456789012345678901234567890123456789"; got != want {
-		t.Errorf("Hash mismatch:\ngot  %v\nwant %v", got, want)
+		t.Fatalf("Unable to open connection to DB: %v.", err)
 	}
-	if err := store.AddUser("testuser2", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
-		t.Fatalf("Unable to add a 2nd row to the users table: %v.", err)
+	db.SetMaxIdleConns(0)
+	if err := storage.CreateTables(db); err != nil {
+		db.Close()
+		t.Fatalf("Unable to create tables in test DB: %v.", err)
 	}
-	if err := store.AddMessage("testuser1", "testuser2", "Hello!", nil); err != nil {
-		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	return storage.NewSQLDB(db), func() { db.Close() }
+}
+
+func TestSQLiteConnectionPool(t *testing.T) {
+	runConformanceSuite(t, newPooledSQLiteStore)
+}
+
+func TestLegacyMessagesUpgrade(t *testing.T) {
+	db, err := sql.Open("sqlite3", "")
+	if err != nil {
+		t.Fatalf("Unable to open connection to DB: %v.", err)
 	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, cmd := range []string{
+		storage.PragmaCmd,
+		storage.UserTableInitCmd,
+		`CREATE TABLE messages (
+		timestamp NUMERIC DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		sender TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		content TEXT NOT NULL,
+		metadata BLOB,
+		FOREIGN KEY (sender) REFERENCES users(username) ON UPDATE CASCADE ON DELETE RESTRICT,
+		FOREIGN KEY (recipient) REFERENCES users(username) ON UPDATE CASCADE ON DELETE RESTRICT)`,
+		"INSERT INTO users (username, hash) VALUES ('testuser1', 'x'), ('testuser2', 'x'), ('testuser3', 'x')",
+		`INSERT INTO messages (sender, recipient, content) VALUES
+		('testuser1', 'testuser2', 'Hello!'), ('testuser3', 'testuser1', 'Hey.'), ('testuser2', 'testuser1', 'Hi!')`,
+	} {
+		if _, err := db.Exec(cmd); err != nil {
+			t.Fatalf("Unable to set up legacy DB: %v.", err)
+		}
+	}
+	if err := storage.CreateTables(db); err != nil {
+		t.Fatalf("Unable to upgrade legacy DB: %v.", err)
+	}
+	store := storage.NewSQLDB(db)
 	messages, _, err := store.ReadMessagesBefore("testuser1", "testuser2", math.MaxUint32, math.MaxInt64)
 	if err != nil {
 		t.Fatalf("Unable to retrieve messages for specified conversation: %v.", err)
 	}
-	if messages == nil {
-		t.Fatalf("No messages found for recently initiated conversation.")
-	}
-	if got, want := messages[0].Content, "Hello!"; got != want {
-		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
-	}
-	if got, want := messages[0].Author, "testuser1"; got != want {
-		t.Errorf("Message author mismatch: got %v, want %v.", got, want)
-	}
-	// Now make sure it works with the usernames in reverse order too.
-	messages, _, err = store.ReadMessagesBefore("testuser2", "testuser1", math.MaxUint32, math.MaxInt64)
-	if err != nil {
-		t.Fatalf("Unable to retrieve messages for specified conversation: %v.", err)
+	if got, want := len(messages), 2; got != want {
+		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
 	}
-	if messages == nil {
-		t.Fatalf("No messages found for recently initiated conversation.")
+	if got, want := messages[0].ID, int64(3); got != want {
+		t.Errorf("Message ID mismatch: got %v, want %v.", got, want)
 	}
-	if got, want := messages[0].Content, "Hello!"; got != want {
+	if got, want := messages[1].Content, "Hello!"; got != want {
 		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
 	}
-	if got, want := messages[0].Author, "testuser1"; got != want {
-		t.Errorf("Message author mismatch: got %v, want %v.", got, want)
+	// Running it again must be harmless.
+	if err := storage.CreateTables(db); err != nil {
+		t.Fatalf("Unable to re-run table creation on upgraded DB: %v.", err)
 	}
 }
 
-func TestNonexistentUser(t *testing.T) {
-	store, closer := newStore(t)
+func TestMigrations(t *testing.T) {
+	store, closer := newSQLiteStore(t)
 	defer closer()
-	if _, err := store.FetchHash("testuser1"); err == nil {
-		t.Errorf("Able to retrieve hash for nonexistent user!")
+	migrator := storage.NewMigrator(store.DB)
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatalf("Unable to read migration status: %v.", err)
 	}
-}
-
-func TestMessageOrder(t *testing.T) {
-	store, closer := newStore(t)
-	defer closer()
-	if err := store.AddUser("testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
-		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	for _, status := range statuses {
+		if status.AppliedAt.IsZero() {
+			t.Errorf("Migration %d was not applied.", status.Version)
+		}
 	}
-	if err := store.AddUser("testuser2", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
-		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+	// Running them again must be harmless.
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("Unable to re-run migrations: %v.", err)
 	}
-	if err := store.AddMessage("testuser1", "testuser2", "Hello!", nil); err != nil {
-		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	for range statuses {
+		if err := migrator.Down(); err != nil {
+			t.Fatalf("Unable to revert migration: %v.", err)
+		}
 	}
-	if err := store.AddMessage("testuser2", "testuser1", "Nice to meet you.", nil); err != nil {
-		t.Fatalf("Unable to add a 2nd row to the messages table: %v.", err)
+	if err := migrator.Down(); err == nil {
+		t.Errorf("Able to revert more migrations than were applied!")
 	}
-	if err := store.AddMessage("testuser1", "testuser2", "Goodbye.", nil); err != nil {
-		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+	if err := migrator.Verify(); err == nil {
+		t.Errorf("Schema passed verification with no migrations applied!")
 	}
-	messages, _, err := store.ReadMessagesBefore("testuser1", "testuser2", math.MaxUint32, math.MaxInt64)
-	if err != nil {
-		t.Fatalf("Unable to retrieve messages for specified conversation: %v.", err)
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err == nil {
+		t.Errorf("Able to add a user after reverting every migration!")
 	}
-	if messages == nil {
-		t.Fatalf("No messages found for recently initiated conversation.")
+	if err := migrator.Up(); err != nil {
+		t.Fatalf("Unable to re-apply migrations: %v.", err)
 	}
-	if got, want := len(messages), 3; got != want {
-		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
+	if err := store.AddUser("testuser1", "testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+		t.Errorf("Unable to add a user after re-applying migrations: %v.", err)
 	}
-	if got, want := messages[0].Content, "Goodbye."; got != want {
-		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
-	}
-	if got, want := messages[1].Content, "Nice to meet you."; got != want {
-		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	if _, err := store.Exec("INSERT INTO schema_migrations (version, description, applied_at) VALUES (1000, 'from the future', 0)"); err != nil {
+		t.Fatalf("Unable to record a migration: %v.", err)
 	}
-	if got, want := messages[2].Content, "Hello!"; got != want {
-		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	if err := migrator.Verify(); err == nil {
+		t.Errorf("Schema from a newer version passed verification!")
 	}
 }
 
-func TestMsgFromNonexistentUser(t *testing.T) {
-	store, closer := newStore(t)
+func TestDirectKeyBackfill(t *testing.T) {
+	store, closer := newSQLiteStore(t)
 	defer closer()
-	if err := store.AddUser("testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
-		t.Fatalf("Unable to add a new row to the users table: %v.", err)
-	}
-	if err := store.AddMessage("testuser2", "testuser1", "Hello!", nil); err == nil {
-		t.Errorf("Able to add a new row to the messages table with a nonexistent sender!")
+	for _, username := range []string{"testuser1", "testuser2"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	// Revert to before 1:1 conversations were unique, so as to start a duplicate.
+	migrator := storage.NewMigrator(store.DB)
+	for reverted := false; !reverted; {
+		statuses, err := migrator.Status()
+		if err != nil {
+			t.Fatalf("Unable to read migration status: %v.", err)
+		}
+		for _, status := range statuses {
+			reverted = reverted || (status.Version == 7 && status.AppliedAt.IsZero())
+		}
+		if !reverted {
+			if err := migrator.Down(); err != nil {
+				t.Fatalf("Unable to revert migration: %v.", err)
+			}
+		}
+	}
+	var ids []int64
+	for i := 0; i < 2; i++ {
+		var id int64
+		if err := store.QueryRow("INSERT INTO conversations (is_group) VALUES (0) RETURNING id").Scan(&id); err != nil {
+			t.Fatalf("Unable to add a new row to the conversations table: %v.", err)
+		}
+		if _, err := store.Exec("INSERT INTO conversation_members (conversation, username) VALUES (?, 'testuser1'), (?, 'testuser2')", id, id); err != nil {
+			t.Fatalf("Unable to add a new row to the conversation_members table: %v.", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := storage.CreateTables(store.DB); err != nil {
+		t.Fatalf("Unable to re-apply migrations: %v.", err)
+	}
+	if id, err := store.DirectConversation("testuser2", "testuser1"); err != nil || id != ids[0] {
+		t.Errorf("1:1 conversation with a duplicate mismatch: got %v (%v), want the oldest, %v.", id, err, ids[0])
 	}
 }
 
-func TestMsgToNonexistentUser(t *testing.T) {
-	store, closer := newStore(t)
-	defer closer()
-	if err := store.AddUser("testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
-		t.Fatalf("Unable to add a new row to the users table: %v.", err)
+func TestCanonicalUsernameBackfill(t *testing.T) {
+	db, err := sql.Open("sqlite3", "")
+	if err != nil {
+		t.Fatalf("Unable to open connection to DB: %v.", err)
 	}
-	if err := store.AddMessage("testuser1", "testuser2", "Hello!", nil); err == nil {
-		t.Errorf("Able to add a new row to the messages table with a nonexistent recipient!")
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, cmd := range []string{
+		storage.PragmaCmd,
+		storage.UserTableInitCmd,
+		"INSERT INTO users (username, hash) VALUES ('Bob', 'x'), ('bob', 'y'), ('Carol', 'z'), ('Straße', 'w'), ('ＤＡＶＥ', 'v')",
+	} {
+		if _, err := db.Exec(cmd); err != nil {
+			t.Fatalf("Unable to set up legacy DB: %v.", err)
+		}
+	}
+	if err := storage.CreateTables(db); err != nil {
+		t.Fatalf("Unable to upgrade legacy DB: %v.", err)
+	}
+	store := storage.NewSQLDB(db)
+	for _, username := range []string{"Bob", "bob", "Carol", "Straße", "ＤＡＶＥ"} {
+		if _, err := store.FetchHash(username); err != nil {
+			t.Errorf("Unable to look up user %v that predates canonical usernames: %v.", username, err)
+		}
+	}
+	// Non-ASCII usernames must collide with their equivalents just as new ones would.
+	for _, username := range []string{"BOB", "carol", "STRASSE", "dave"} {
+		if err := store.AddUser(username, storage.CanonicalUsername(username), []byte("hash")); !errors.Is(err, storage.ErrUserExists) {
+			t.Errorf("Username %v that differs from an existing one only in case or form: got error %v, want %v.", username, err, storage.ErrUserExists)
+		}
 	}
 }
 
-func TestMessagePagination(t *testing.T) {
-	store, closer := newStore(t)
+func TestSearchMessages(t *testing.T) {
+	store, closer := newSQLiteStore(t)
 	defer closer()
-	if err := store.AddUser("testuser1", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
-		t.Fatalf("Unable to add a new row to the users table: %v.", err)
-	}
-	if err := store.AddUser("testuser2", []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
-		t.Fatalf("Unable to add a new row to the users table: %v.", err)
-	}
-	if err := store.AddMessage("testuser1", "testuser2", "Hello!", nil); err != nil {
-		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
-	}
-	if err := store.AddMessage("testuser2", "testuser1", "Nice to meet you.", nil); err != nil {
-		t.Fatalf("Unable to add a 2nd row to the messages table: %v.", err)
-	}
-	if err := store.AddMessage("testuser1", "testuser2", "Goodbye.", nil); err != nil {
-		t.Fatalf("Unable to add a new row to the messages table: %v.", err)
-	}
-	messages, cToken, err := store.ReadMessagesBefore("testuser1", "testuser2", 2, math.MaxInt64)
-	if err != nil {
-		t.Fatalf("Unable to retrieve messages for specified conversation: %v.", err)
-	}
-	if messages == nil {
-		t.Fatalf("No messages found for recently initiated conversation.")
-	}
-	if got, want := len(messages), 2; got != want {
-		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
-	}
-	if got, want := messages[0].Content, "Goodbye."; got != want {
-		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
-	}
-	if got, want := messages[1].Content, "Nice to meet you."; got != want {
-		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
-	}
-	messages, _, err = store.ReadMessagesBefore("testuser1", "testuser2", math.MaxUint32, cToken)
-	if err != nil {
-		t.Fatalf("Unable to retrieve messages for specified conversation: %v.", err)
-	}
-	if messages == nil {
-		t.Fatalf("No messages found for earlier conversation.")
-	}
-	if got, want := len(messages), 1; got != want {
-		t.Fatalf("Wrong number of messages retrieved: got %v, want %v.", got, want)
-	}
-	if got, want := messages[0].Content, "Hello!"; got != want {
-		t.Errorf("Message content mismatch: got %v, want %v.", got, want)
+	if _, err := store.SearchMessages("testuser1", storage.SearchQuery{Text: "harbour", Limit: 10}); err == storage.ErrSearchUnavailable {
+		t.Skip("Full-text search requires building with -tags sqlite_fts5.")
+	}
+	for _, username := range []string{"testuser1", "testuser2", "testuser3"} {
+		if err := store.AddUser(username, username, []byte("012345678901234567890123456789012345678901234567890123456789")); err != nil {
+			t.Fatalf("Unable to add a new row to the users table: %v.", err)
+		}
+	}
+	var ids []int64
+	for _, m := range []struct{ sender, recipient, content string }{
+		{"testuser1", "testuser2", "Meet me at the harbour at noon."},
+		{"testuser2", "testuser1", "Which harbour?"},
+		{"testuser3", "testuser2", "Harbour party tonight!"},
+		{"testuser1", "testuser3", "Are you going to the harbour party?"},
+		{"testuser2", "testuser1", "The old harbour, by the lighthouse."},
+		{"testuser2", "testuser1", "<b>Fake</b> & <script>alert(1)</script>"},
+	} {
+		msg, _, err := store.AddMessage(m.sender, m.recipient, m.content, nil, "")
+		if err != nil {
+			t.Fatalf("Unable to add a new row to the messages table: %v.", err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	search := func(query storage.SearchQuery) []storage.SearchResult {
+		t.Helper()
+		query.Limit = 10
+		results, err := store.SearchMessages("testuser1", query)
+		if err != nil {
+			t.Fatalf("Unable to search messages: %v.", err)
+		}
+		return results
+	}
+	results := search(storage.SearchQuery{Text: "harbour"})
+	if got, want := len(results), 4; got != want {
+		t.Fatalf("Wrong number of search results: got %v, want %v.", got, want)
+	}
+	for _, result := range results {
+		if result.ID == ids[2] {
+			t.Errorf("Search returned a message from a conversation the searcher is not part of: %+v.", result)
+		}
+	}
+	if got, want := results[0].ID, ids[1]; got != want {
+		t.Errorf("Best search result mismatch: got message %v, want %v.", got, want)
+	}
+	if got, want := results[0].Snippet, "Which "+storage.HighlightStart+"harbour"+storage.HighlightEnd+"?"; got != want {
+		t.Errorf("Snippet mismatch: got %q, want %q.", got, want)
+	}
+	// Markup in the content must not be mistaken for highlighting.
+	want := "&lt;b&gt;" + storage.HighlightStart + "Fake" + storage.HighlightEnd + "&lt;/b&gt; &amp; &lt;script&gt;alert(1)&lt;/script&gt;"
+	if got := search(storage.SearchQuery{Text: "fake"})[0].Snippet; got != want {
+		t.Errorf("Snippet of content with markup mismatch: got %q, want %q.", got, want)
+	}
+	if got, want := len(search(storage.SearchQuery{Text: "HARBOUR party"})), 1; got != want {
+		t.Errorf("Wrong number of results for multi-word search: got %v, want %v.", got, want)
+	}
+	if got, want := len(search(storage.SearchQuery{Text: `harbour" OR "party`})), 0; got != want {
+		t.Errorf("Wrong number of results for search with FTS syntax: got %v, want %v.", got, want)
+	}
+	if got, want := len(search(storage.SearchQuery{Text: "harbour", Author: "testuser2"})), 2; got != want {
+		t.Errorf("Wrong number of results for search by author: got %v, want %v.", got, want)
+	}
+	if got, want := len(search(storage.SearchQuery{Text: "harbour", Peer: "testuser3"})), 1; got != want {
+		t.Errorf("Wrong number of results for search with peer: got %v, want %v.", got, want)
+	}
+	if got, want := len(search(storage.SearchQuery{Text: "harbour", After: time.Now().Add(time.Hour)})), 0; got != want {
+		t.Errorf("Wrong number of results for search of the future: got %v, want %v.", got, want)
+	}
+	if got, want := len(search(storage.SearchQuery{Text: "harbour", Before: time.Now().Add(time.Hour)})), 4; got != want {
+		t.Errorf("Wrong number of results for search of the past: got %v, want %v.", got, want)
+	}
+	if _, err := store.EditMessage(ids[0], "Meet me at the lighthouse at noon.", nil); err != nil {
+		t.Fatalf("Unable to edit message: %v.", err)
+	}
+	if err := store.DeleteMessage(ids[1]); err != nil {
+		t.Fatalf("Unable to delete message: %v.", err)
+	}
+	if err := store.HideMessage(ids[3], "testuser1"); err != nil {
+		t.Fatalf("Unable to hide message: %v.", err)
+	}
+	results = search(storage.SearchQuery{Text: "harbour"})
+	if got, want := len(results), 1; got != want {
+		t.Fatalf("Wrong number of search results after edit & deletions: got %v, want %v.", got, want)
+	}
+	if got, want := results[0].ID, ids[4]; got != want {
+		t.Errorf("Search result mismatch: got message %v, want %v.", got, want)
+	}
+	if got, want := len(search(storage.SearchQuery{Text: "lighthouse"})), 2; got != want {
+		t.Errorf("Wrong number of results for edited content: got %v, want %v.", got, want)
+	}
+	if !strings.Contains(search(storage.SearchQuery{Text: "noon"})[0].Snippet, "lighthouse") {
+		t.Errorf("Snippet does not reflect edited content.")
 	}
 }
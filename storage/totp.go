@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// TOTPEnrollment is a user's TOTP secret, which only takes effect once they confirm that their authenticator generates
+// codes for it.
+type TOTPEnrollment struct {
+	// Secret is base32 encoded, as it appears in otpauth:// URIs.
+	Secret    string
+	Confirmed bool
+	// LastStep is the time step of the last code that was accepted, so that neither it nor any earlier code can be
+	// used again.
+	LastStep int64
+}
+
+// SetTOTP replaces any TOTP secret a user has with an unconfirmed one, along with their recovery codes, of which only
+// hashes are stored.
+func (s *SQLDB) SetTOTP(username, secret string, recoveryHashes []string) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if exists, err := userExists(tx, username); err != nil || !exists {
+		if err == nil {
+			err = fmt.Errorf("%w: %v", ErrUserNotFound, username)
+		}
+		return err
+	}
+	for _, cmd := range []string{"DELETE FROM totp_secrets WHERE username = ?", "DELETE FROM recovery_codes WHERE username = ?"} {
+		if _, err := tx.Exec(cmd, username); err != nil {
+			return fmt.Errorf("unable to delete previous TOTP secret: %v", err)
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO totp_secrets (username, secret, confirmed, last_step) VALUES (?, ?, ?, 0)",
+		username, secret, false); err != nil {
+		return fmt.Errorf("unable to store TOTP secret: %v", err)
+	}
+	for _, hash := range recoveryHashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (username, hash) VALUES (?, ?)", username, hash); err != nil {
+			return fmt.Errorf("unable to store recovery code: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// FetchTOTP returns a user's TOTP secret, or ErrTOTPNotFound if they have none, whether confirmed or not.
+func (s *SQLDB) FetchTOTP(username string) (TOTPEnrollment, error) {
+	var enrollment TOTPEnrollment
+	err := s.QueryRow("SELECT secret, confirmed, last_step FROM totp_secrets WHERE username = ?", username).Scan(
+		&enrollment.Secret, &enrollment.Confirmed, &enrollment.LastStep)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return TOTPEnrollment{}, ErrTOTPNotFound
+	case err != nil:
+		return TOTPEnrollment{}, fmt.Errorf("unable to look up TOTP secret: %v", err)
+	}
+	return enrollment, nil
+}
+
+// ConfirmTOTP makes a user's TOTP secret take effect.
+func (s *SQLDB) ConfirmTOTP(username string) error {
+	res, err := s.Exec("UPDATE totp_secrets SET confirmed = ? WHERE username = ?", true, username)
+	if err != nil {
+		return fmt.Errorf("unable to confirm TOTP secret: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("unable to confirm TOTP secret: %v", err)
+	} else if n == 0 {
+		return ErrTOTPNotFound
+	}
+	return nil
+}
+
+// UseTOTPStep records that a code for the specified time step was accepted, reporting false if a code for the same or
+// a later step already was, in which case the code must be rejected as a replay.
+func (s *SQLDB) UseTOTPStep(username string, step int64) (bool, error) {
+	res, err := s.Exec("UPDATE totp_secrets SET last_step = ? WHERE username = ? AND last_step < ?", step, username, step)
+	if err != nil {
+		return false, fmt.Errorf("unable to record use of TOTP code: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("unable to record use of TOTP code: %v", err)
+	}
+	return n > 0, nil
+}
+
+// UseRecoveryCode deletes one of a user's recovery codes by its hash, reporting false if they have no such code.
+func (s *SQLDB) UseRecoveryCode(username, hash string) (bool, error) {
+	res, err := s.Exec("DELETE FROM recovery_codes WHERE username = ? AND hash = ?", username, hash)
+	if err != nil {
+		return false, fmt.Errorf("unable to use recovery code: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("unable to use recovery code: %v", err)
+	}
+	return n > 0, nil
+}
+
+// DeleteTOTP removes a user's TOTP secret & recovery codes.
+func (s *SQLDB) DeleteTOTP(username string) error {
+	tx, err := s.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	for _, cmd := range []string{"DELETE FROM recovery_codes WHERE username = ?", "DELETE FROM totp_secrets WHERE username = ?"} {
+		if _, err := tx.Exec(cmd, username); err != nil {
+			return fmt.Errorf("unable to delete TOTP secret: %v", err)
+		}
+	}
+	return tx.Commit()
+}